@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/buchanae/tanker/storage"
+)
+
+// Archives are directories holding a full copy of a repo for long-term storage:
+//
+//	<dir>/repo.bundle          a git bundle of all refs
+//	<dir>/manifest.json        the LFS objects referenced by the history
+//	<dir>/objects/ab/cd/<oid>  the LFS objects, content-addressed
+//
+// The objects layout matches git-lfs' own local object store.
+const archiveBundleName = "repo.bundle"
+
+// archiveObjectPath returns the path to an object in the archive at "dir".
+func archiveObjectPath(dir, oid string) string {
+	return filepath.Join(dir, "objects", oid[:2], oid[2:4], oid)
+}
+
+// archive writes a git bundle and all LFS objects referenced in history to "out".
+//
+// Objects are copied from the local LFS store when present and downloaded from
+// remote storage otherwise. Objects already in the archive are skipped, so an
+// interrupted archive can be resumed by running it again.
+func archive(ctx context.Context, t *Tanker, out string) error {
+
+	err := storage.EnsureDir(out)
+	if err != nil {
+		return fmt.Errorf("creating archive directory: %s", err)
+	}
+
+	cmd := exec.Command("git", "bundle", "create", filepath.Join(out, archiveBundleName), "--all")
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if err != nil {
+		return fmt.Errorf("creating git bundle: %s", err)
+	}
+
+	files, err := lsFiles("--all")
+	if err != nil {
+		return err
+	}
+
+	var store storage.Storage
+
+	manifest := bundleManifest{
+		Version: 1,
+		Created: time.Now(),
+	}
+	seen := map[string]bool{}
+
+	for _, f := range files {
+		if seen[f.Oid] {
+			continue
+		}
+		seen[f.Oid] = true
+
+		dest := archiveObjectPath(out, f.Oid)
+		local := lfsObjectPath(t.Paths.Git, f.Oid)
+
+		if st, err := os.Stat(dest); err == nil {
+			// Already archived.
+			manifest.Objects = append(manifest.Objects, bundleEntry{f.Oid, st.Size(), f.Path})
+			continue
+		}
+
+		var src io.ReadCloser
+		if fh, err := os.Open(local); err == nil {
+			src = fh
+		} else {
+			// Not available locally, so download it from the remote.
+			if store == nil {
+				store, err = newStorage(t.Config)
+				if err != nil {
+					return err
+				}
+			}
+			src, err = downloadToTemp(ctx, store, t.Config.BaseURL, t.Paths.Data, f.Oid)
+			if err != nil {
+				return fmt.Errorf("downloading object for %q: %s", f.Path, err)
+			}
+		}
+
+		size, err := archiveObject(src, dest, f.Oid)
+		src.Close()
+		if err != nil {
+			return fmt.Errorf("archiving object for %q: %s", f.Path, err)
+		}
+		manifest.Objects = append(manifest.Objects, bundleEntry{f.Oid, size, f.Path})
+		log.Println("Archived", f.Oid, f.Path)
+	}
+
+	b, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshaling manifest: %s", err)
+	}
+	err = ioutil.WriteFile(filepath.Join(out, bundleManifestName), b, 0644)
+	if err != nil {
+		return fmt.Errorf("writing manifest: %s", err)
+	}
+
+	fmt.Printf("archived %d objects to %s\n", len(manifest.Objects), out)
+	return nil
+}
+
+// archiveObject copies "src" to "dest", verifying its checksum on the way.
+// The object is written to a temporary file first, so "dest" only ever
+// exists with complete, verified content.
+func archiveObject(src io.Reader, dest, oid string) (int64, error) {
+	err := storage.EnsurePath(dest)
+	if err != nil {
+		return 0, err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(dest), "tmp-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	verifier, err := storage.NewOIDVerifier(oid)
+	if err != nil {
+		return 0, err
+	}
+	size, err := io.Copy(io.MultiWriter(tmp, verifier), src)
+	if err != nil {
+		return 0, err
+	}
+	if err := verifier.Verify(); err != nil {
+		return 0, err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+	return size, os.Rename(tmp.Name(), dest)
+}
+
+// downloadToTemp downloads an object into a temporary file in "dataDir".
+// The returned file is removed when it is closed.
+func downloadToTemp(ctx context.Context, store storage.Storage, baseURL, dataDir, oid string) (io.ReadCloser, error) {
+	url, err := store.Join(baseURL, oid)
+	if err != nil {
+		return nil, err
+	}
+
+	tmp, err := ioutil.TempFile(dataDir, "download-")
+	if err != nil {
+		return nil, err
+	}
+	rm := &removeOnClose{tmp}
+
+	_, err = store.Get(ctx, url, tmp)
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		rm.Close()
+		return nil, err
+	}
+	return rm, nil
+}
+
+// removeOnClose removes a temporary file when it's closed.
+type removeOnClose struct {
+	*os.File
+}
+
+func (r *removeOnClose) Close() error {
+	err := r.File.Close()
+	os.Remove(r.Name())
+	return err
+}
+
+// restore uploads all the LFS objects in an archive to the configured remote,
+// recreating a working remote for a repo cloned from the archive's bundle.
+func restore(ctx context.Context, conf Config, dir string) error {
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, bundleManifestName))
+	if err != nil {
+		return fmt.Errorf("reading archive manifest: %s", err)
+	}
+	var manifest bundleManifest
+	err = json.Unmarshal(b, &manifest)
+	if err != nil {
+		return fmt.Errorf("parsing archive manifest: %s", err)
+	}
+
+	store, err := newStorage(conf)
+	if err != nil {
+		return err
+	}
+
+	var uploaded int
+	for _, e := range manifest.Objects {
+		ok, err := restoreObject(ctx, store, conf, archiveObjectPath(dir, e.Oid), e)
+		if err != nil {
+			return fmt.Errorf("restoring object for %q: %s", e.Path, err)
+		}
+		if ok {
+			uploaded++
+		}
+	}
+
+	fmt.Printf("restored %d objects, %d already present in the remote\n",
+		uploaded, len(manifest.Objects)-uploaded)
+	return nil
+}
+
+// restoreObject verifies and uploads a single archived object.
+// Returns false if the object already existed in the remote.
+func restoreObject(ctx context.Context, store storage.Storage, conf Config, path string, e bundleEntry) (bool, error) {
+	url, err := store.Join(conf.BaseURL, e.Oid)
+	if err != nil {
+		return false, err
+	}
+
+	if obj, err := store.Stat(ctx, url); err == nil && obj.Size == e.Size {
+		return false, nil
+	}
+
+	fh, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer fh.Close()
+
+	verifier, err := storage.NewOIDVerifier(e.Oid)
+	if err != nil {
+		return false, err
+	}
+	if _, err := io.Copy(verifier, fh); err != nil {
+		return false, err
+	}
+	if err := verifier.Verify(); err != nil {
+		return false, err
+	}
+	if _, err := fh.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+
+	log.Println("Uploading", e.Oid, url)
+	opts, body := putOptions(conf, e.Path, fh)
+	opts.Size = e.Size
+	_, err = store.Put(ctx, url, body, opts)
+	return err == nil, err
+}
@@ -0,0 +1,121 @@
+// Package buildinfo describes the build of tanker linked into a binary:
+// its version, the Go toolchain and platform, the storage backends left in
+// by build tags, and the versions of the storage SDKs.
+package buildinfo
+
+import (
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+
+	"github.com/buchanae/tanker/storage"
+)
+
+// Release details, set with -ldflags when tanker is released, e.g.
+// "-X github.com/buchanae/tanker/buildinfo.Version=1.2.3". See .goreleaser.yml.
+var (
+	GitCommit   = "unknown"
+	GitBranch   = "unknown"
+	GitUpstream = "unknown"
+	BuildDate   = "unknown"
+	Version     = "unknown"
+)
+
+// modulePath is the path of the tanker module.
+const modulePath = "github.com/buchanae/tanker"
+
+// sdkModules are the modules of the storage SDKs, which are reported
+// if they're linked, i.e. their backend wasn't left out by a build tag.
+var sdkModules = map[string]bool{
+	"github.com/aws/aws-sdk-go": true,
+	"github.com/jlaffaye/ftp":   true,
+	"github.com/ncw/swift":      true,
+	"github.com/pkg/sftp":       true,
+	"golang.org/x/crypto":       true,
+	"golang.org/x/oauth2":       true,
+	"google.golang.org/api":     true,
+}
+
+// Info describes a build of tanker.
+type Info struct {
+	Version     string `json:"version"`
+	GitCommit   string `json:"gitCommit"`
+	GitBranch   string `json:"gitBranch"`
+	GitUpstream string `json:"gitUpstream"`
+	BuildDate   string `json:"buildDate"`
+	GoVersion   string `json:"goVersion"`
+	OS          string `json:"os"`
+	Arch        string `json:"arch"`
+	// URL schemes of the storage backends in the build, e.g. "gs".
+	Backends []string `json:"backends"`
+	// Storage SDKs linked into the build.
+	SDKs []Module `json:"sdks"`
+}
+
+// Module is a Go module linked into the build.
+type Module struct {
+	Path    string `json:"path"`
+	Version string `json:"version"`
+}
+
+// Read returns the details of the build. Release details which weren't set
+// with -ldflags, e.g. in binaries of library users, are taken from the Go
+// build info where possible: the version of the tanker module, and the
+// commit it was built from.
+func Read() Info {
+	info := Info{
+		Version:     Version,
+		GitCommit:   GitCommit,
+		GitBranch:   GitBranch,
+		GitUpstream: GitUpstream,
+		BuildDate:   BuildDate,
+		GoVersion:   runtime.Version(),
+		OS:          runtime.GOOS,
+		Arch:        runtime.GOARCH,
+		SDKs:        []Module{},
+	}
+	for _, p := range storage.Protocols() {
+		info.Backends = append(info.Backends, strings.TrimSuffix(p, "://"))
+	}
+
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+
+	if bi.Main.Path == modulePath {
+		setUnknown(&info.Version, bi.Main.Version)
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				setUnknown(&info.GitCommit, s.Value)
+			case "vcs.time":
+				setUnknown(&info.BuildDate, s.Value)
+			}
+		}
+	}
+	for _, dep := range bi.Deps {
+		version := dep.Version
+		if dep.Replace != nil {
+			version = dep.Replace.Version
+		}
+		if dep.Path == modulePath {
+			setUnknown(&info.Version, version)
+		} else if sdkModules[dep.Path] {
+			info.SDKs = append(info.SDKs, Module{dep.Path, version})
+		}
+	}
+	sort.Slice(info.SDKs, func(i, j int) bool {
+		return info.SDKs[i].Path < info.SDKs[j].Path
+	})
+	return info
+}
+
+// setUnknown sets "field" to "value" if it's "unknown" and "value" isn't
+// empty, or "(devel)", Go's version for builds outside a module cache.
+func setUnknown(field *string, value string) {
+	if *field == "unknown" && value != "" && value != "(devel)" {
+		*field = value
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"time"
+
+	"github.com/buchanae/tanker/storage"
+)
+
+// Bundles are tar files used to move LFS objects between machines which
+// can't reach the same storage, e.g. to an air-gapped cluster.
+//
+// The first entry is always "manifest.json", followed by one
+// "objects/<oid>" entry per object.
+const bundleManifestName = "manifest.json"
+
+type bundleManifest struct {
+	Version int
+	Created time.Time
+	Objects []bundleEntry
+}
+
+type bundleEntry struct {
+	Oid  string
+	Size int64
+	// Path of the file in the repo at export time. Informational only.
+	Path string
+}
+
+// exportBundle writes the LFS objects of the given files to a tar bundle at "out".
+// All objects must be present in the local LFS store.
+func exportBundle(gitDir, out string, files []lfsFile) error {
+
+	manifest := bundleManifest{
+		Version: 1,
+		Created: time.Now(),
+	}
+
+	seen := map[string]bool{}
+	for _, f := range files {
+		if seen[f.Oid] {
+			continue
+		}
+		seen[f.Oid] = true
+
+		st, err := os.Stat(lfsObjectPath(gitDir, f.Oid))
+		if os.IsNotExist(err) {
+			return fmt.Errorf("object for %q is not present locally, try \"git lfs pull\" first", f.Path)
+		}
+		if err != nil {
+			return fmt.Errorf("checking object for %q: %s", f.Path, err)
+		}
+		manifest.Objects = append(manifest.Objects, bundleEntry{
+			Oid:  f.Oid,
+			Size: st.Size(),
+			Path: f.Path,
+		})
+	}
+
+	fh, err := os.Create(out)
+	if err != nil {
+		return fmt.Errorf("creating bundle: %s", err)
+	}
+	defer fh.Close()
+
+	tw := tar.NewWriter(fh)
+
+	b, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshaling manifest: %s", err)
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Name:    bundleManifestName,
+		Mode:    0644,
+		Size:    int64(len(b)),
+		ModTime: manifest.Created,
+	})
+	if err != nil {
+		return fmt.Errorf("writing manifest: %s", err)
+	}
+	if _, err := tw.Write(b); err != nil {
+		return fmt.Errorf("writing manifest: %s", err)
+	}
+
+	for _, e := range manifest.Objects {
+		err := addBundleObject(tw, lfsObjectPath(gitDir, e.Oid), e)
+		if err != nil {
+			return fmt.Errorf("adding object for %q: %s", e.Path, err)
+		}
+		log.Println("Exported", e.Oid, e.Path)
+	}
+
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("finishing bundle: %s", err)
+	}
+	return fh.Close()
+}
+
+func addBundleObject(tw *tar.Writer, src string, e bundleEntry) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = tw.WriteHeader(&tar.Header{
+		Name:    path.Join("objects", e.Oid),
+		Mode:    0644,
+		Size:    e.Size,
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// importBundle uploads the objects in a tar bundle to the configured remote.
+//
+// Each object is staged in "dataDir" and its checksum is verified against
+// its OID before it is uploaded. Objects which already exist in the remote
+// are skipped, so an interrupted import can be safely repeated.
+func importBundle(ctx context.Context, conf Config, dataDir, bundle string) error {
+
+	store, err := newStorage(conf)
+	if err != nil {
+		return err
+	}
+
+	fh, err := os.Open(bundle)
+	if err != nil {
+		return fmt.Errorf("opening bundle: %s", err)
+	}
+	defer fh.Close()
+
+	tr := tar.NewReader(fh)
+
+	hdr, err := tr.Next()
+	if err != nil {
+		return fmt.Errorf("reading bundle: %s", err)
+	}
+	if hdr.Name != bundleManifestName {
+		return fmt.Errorf("invalid bundle: expected %s as the first entry, found %q", bundleManifestName, hdr.Name)
+	}
+
+	var manifest bundleManifest
+	err = json.NewDecoder(tr).Decode(&manifest)
+	if err != nil {
+		return fmt.Errorf("reading manifest: %s", err)
+	}
+
+	expected := map[string]bundleEntry{}
+	for _, e := range manifest.Objects {
+		expected[e.Oid] = e
+	}
+
+	var count int
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("reading bundle: %s", err)
+		}
+
+		oid := path.Base(hdr.Name)
+		e, ok := expected[oid]
+		if !ok || path.Dir(hdr.Name) != "objects" {
+			return fmt.Errorf("invalid bundle: unexpected entry %q", hdr.Name)
+		}
+
+		err = importObject(ctx, store, conf, dataDir, tr, e)
+		if err != nil {
+			return fmt.Errorf("importing object for %q: %s", e.Path, err)
+		}
+		delete(expected, oid)
+		count++
+	}
+
+	if len(expected) != 0 {
+		return fmt.Errorf("invalid bundle: %d objects listed in the manifest are missing", len(expected))
+	}
+
+	fmt.Printf("imported %d objects\n", count)
+	return nil
+}
+
+func importObject(ctx context.Context, store storage.Storage, conf Config, dataDir string, r io.Reader, e bundleEntry) error {
+	url, err := store.Join(conf.BaseURL, e.Oid)
+	if err != nil {
+		return err
+	}
+
+	// Skip objects which already exist in the remote.
+	if obj, err := store.Stat(ctx, url); err == nil && obj.Size == e.Size {
+		log.Println("Skipping existing object", url)
+		return nil
+	}
+
+	tmp, err := ioutil.TempFile(dataDir, "import-")
+	if err != nil {
+		return fmt.Errorf("creating staging file: %s", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	verifier, err := storage.NewOIDVerifier(e.Oid)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(io.MultiWriter(tmp, verifier), r)
+	if err != nil {
+		return fmt.Errorf("staging object: %s", err)
+	}
+	if err := verifier.Verify(); err != nil {
+		return err
+	}
+
+	_, err = tmp.Seek(0, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("rewinding staging file: %s", err)
+	}
+
+	log.Println("Uploading", e.Oid, url)
+	opts, body := putOptions(conf, e.Path, tmp)
+	opts.Size = e.Size
+	_, err = store.Put(ctx, url, body, opts)
+	return err
+}
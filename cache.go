@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/buchanae/tanker/storage"
+)
+
+// CacheConfig configures a machine-wide cache of objects, shared by every
+// clone on the machine, e.g. on shared CI runners. The transfer agent
+// copies objects from the cache instead of downloading them. The cache is
+// filled by "tanker warm".
+type CacheConfig struct {
+	// Directory of the cache, laid out like git-lfs' object store.
+	// Empty disables the cache.
+	Dir string
+}
+
+// cachePath returns the path of the object in the cache.
+func cachePath(dir, oid string) string {
+	return filepath.Join(dir, oid[:2], oid[2:4], oid)
+}
+
+// cached returns true if the object is in the cache. Objects are moved into
+// place once complete, so an object in the cache is always complete.
+func cached(dir, oid string) bool {
+	if dir == "" {
+		return false
+	}
+	_, err := os.Stat(cachePath(dir, oid))
+	return err == nil
+}
+
+// copyFromCache copies the object from the cache to "dest", hard linking
+// it if possible. The cache may be shared with other users, so "dest"
+// must not be modified afterwards, which holds for git-lfs' object store.
+func copyFromCache(dir, oid, dest string) error {
+	src := cachePath(dir, oid)
+	// Mark the object as recently used, so that it's evicted last, see
+	// cacheQuota. This fails for other users' objects in a shared cache,
+	// which only makes them evicted sooner.
+	now := time.Now()
+	os.Chtimes(src, now, now)
+
+	os.Remove(dest)
+	if os.Link(src, dest) == nil {
+		return nil
+	}
+
+	fh, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("opening cached object: %s", err)
+	}
+	defer fh.Close()
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return fmt.Errorf("creating %s: %s", dest, err)
+	}
+	_, copyErr := io.Copy(out, fh)
+	closeErr := out.Close()
+	if copyErr != nil {
+		return fmt.Errorf("copying cached object: %s", copyErr)
+	}
+	return closeErr
+}
+
+// addToCache writes an object to the cache from "src", checking its
+// content against its OID. The object is written to a temporary file
+// first, so that an interrupted write leaves nothing in the cache.
+func addToCache(dir, oid string, src io.Reader) error {
+	verifier, err := storage.NewOIDVerifier(oid)
+	if err != nil {
+		return err
+	}
+	path := cachePath(dir, oid)
+	if err := storage.EnsurePath(path); err != nil {
+		return fmt.Errorf("creating cache dir: %s", err)
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "tmp-")
+	if err != nil {
+		return fmt.Errorf("creating cache file: %s", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, copyErr := io.Copy(io.MultiWriter(tmp, verifier), src)
+	closeErr := tmp.Close()
+	if copyErr != nil {
+		return copyErr
+	}
+	if closeErr != nil {
+		return fmt.Errorf("writing cache file: %s", closeErr)
+	}
+	if err := verifier.Verify(); err != nil {
+		return err
+	}
+
+	// Other users of the cache must be able to read it.
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return fmt.Errorf("writing cache file: %s", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("writing cache file: %s", err)
+	}
+	return nil
+}
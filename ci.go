@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/buchanae/tanker/buildinfo"
+	"github.com/buchanae/tanker/storage"
+)
+
+// ciSummary is the machine-readable summary written by "tanker ci setup",
+// e.g. to be saved as a CI artifact.
+type ciSummary struct {
+	Version string
+	BaseURL string
+	Scheme  string
+	// The CI system detected from the environment: "github", "gitlab",
+	// or empty.
+	CI string
+	// Directories, relative to the repo root, which should be cached
+	// between CI runs.
+	CachePaths []string
+}
+
+// ciSetup configures tanker in the repo non-interactively, from these
+// environment variables:
+//
+//	TANKER_BASE_URL  the base URL, if not already in the config file
+//	TANKER_CONFIG    YAML merged over the config file, e.g. storage settings
+//
+// It prints hints for caching tanker's directories in the detected CI
+// system, and if "summaryPath" is set, writes a ciSummary there as JSON.
+func ciSetup(t *Tanker, summaryPath string, out io.Writer) error {
+	if raw := os.Getenv("TANKER_CONFIG"); raw != "" {
+		if err := ParseConfig([]byte(raw), &t.Config); err != nil {
+			return withExitCode(exitConfig, fmt.Errorf("parsing TANKER_CONFIG: %s", err))
+		}
+	}
+	if url := os.Getenv("TANKER_BASE_URL"); url != "" {
+		t.Config.BaseURL = url
+	}
+	if t.Config.BaseURL == "" {
+		return withExitCode(exitConfig, userErrorf("no base URL: set TANKER_BASE_URL"))
+	}
+
+	err := storage.ValidateURL(t.Config.BaseURL, t.Config.Storage)
+	if err != nil {
+		return err
+	}
+	rollback, err := configureLFS(context.Background(), t.Config.BaseURL)
+	if err != nil {
+		return err
+	}
+	if err := WriteConfigFile(t.Config, t.Paths.Config); err != nil {
+		rollback()
+		return userErrorf("writing config file: %s", err)
+	}
+
+	summary := ciSummary{
+		Version:    buildinfo.Version,
+		BaseURL:    t.Config.BaseURL,
+		Scheme:     storage.Scheme(t.Config.BaseURL),
+		CI:         detectCI(),
+		CachePaths: ciCachePaths(t),
+	}
+	fmt.Fprintln(out, "configured tanker for", summary.BaseURL)
+	printCacheHints(summary, out)
+
+	if os.Getenv("GITHUB_OUTPUT") != "" {
+		if err := writeGitHubOutput(os.Getenv("GITHUB_OUTPUT"), summary); err != nil {
+			return err
+		}
+	}
+
+	if summaryPath != "" {
+		b, err := json.MarshalIndent(summary, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(summaryPath, append(b, '\n'), 0644); err != nil {
+			return fmt.Errorf("writing summary: %s", err)
+		}
+	}
+	return nil
+}
+
+// detectCI returns the CI system tanker is running in, if any.
+func detectCI() string {
+	switch {
+	case os.Getenv("GITHUB_ACTIONS") == "true":
+		return "github"
+	case os.Getenv("GITLAB_CI") == "true":
+		return "gitlab"
+	}
+	return ""
+}
+
+// ciCachePaths returns the directories worth caching between CI runs,
+// relative to the repo root: the LFS object store, and tanker's pack
+// cache and index, if in use.
+func ciCachePaths(t *Tanker) []string {
+	lfsDir := filepath.Join(t.Paths.Git, "lfs", "objects")
+	if env, err := lfsEnv(); err == nil && env["LocalMediaDir"] != "" {
+		lfsDir = env["LocalMediaDir"]
+	}
+	paths := []string{lfsDir}
+	if t.Config.Pack.Enabled {
+		paths = append(paths, t.Paths.Packs)
+	}
+	paths = append(paths, t.Paths.Index)
+
+	for i, p := range paths {
+		if rel, err := filepath.Rel(t.Paths.Repo, p); err == nil {
+			paths[i] = rel
+		}
+	}
+	return paths
+}
+
+// printCacheHints prints how to cache the summary's paths in its CI system.
+func printCacheHints(s ciSummary, out io.Writer) {
+	fmt.Fprintln(out, "\nCache these paths between runs, so objects aren't downloaded again:")
+	for _, p := range s.CachePaths {
+		fmt.Fprintln(out, "  "+p)
+	}
+
+	switch s.CI {
+	case "github":
+		fmt.Fprintln(out, "\ne.g. give this step \"id: tanker\", then before pulling:")
+		fmt.Fprintln(out, "  - uses: actions/cache@v4")
+		fmt.Fprintln(out, "    with:")
+		fmt.Fprintln(out, "      path: ${{ steps.tanker.outputs.tanker-cache-paths }}")
+		fmt.Fprintln(out, "      key: tanker-${{ runner.os }}-${{ github.sha }}")
+		fmt.Fprintln(out, "      restore-keys: tanker-${{ runner.os }}-")
+	case "gitlab":
+		fmt.Fprintln(out, "\ne.g. in .gitlab-ci.yml:")
+		fmt.Fprintln(out, "  cache:")
+		fmt.Fprintln(out, "    key: tanker")
+		fmt.Fprintln(out, "    paths:")
+		for _, p := range s.CachePaths {
+			fmt.Fprintln(out, "      - "+p)
+		}
+	}
+}
+
+// writeGitHubOutput sets GitHub Actions step outputs from the summary,
+// e.g. "tanker-cache-paths" for actions/cache.
+func writeGitHubOutput(path string, s ciSummary) error {
+	fh, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("writing GitHub Actions outputs: %s", err)
+	}
+	defer fh.Close()
+
+	fmt.Fprintf(fh, "tanker-base-url=%s\n", s.BaseURL)
+	fmt.Fprintln(fh, "tanker-cache-paths<<TANKER_EOF")
+	for _, p := range s.CachePaths {
+		fmt.Fprintln(fh, p)
+	}
+	fmt.Fprintln(fh, "TANKER_EOF")
+	return fh.Close()
+}
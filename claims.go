@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Several transfer agents may download into the same data dir at once,
+// e.g. when "git lfs pull" runs in a terminal while an IDE fetches, and
+// they may be asked for the same objects. Downloads are kept apart by claims:
+//
+//   - An agent claims an object before downloading it, by locking the file
+//     "<oid>.claim" in the data dir, which records the agent's PID. Other
+//     agents wait for the claim to be released.
+//   - Downloads are written to a partial file unique to the process,
+//     "<oid>.<pid>.<random>.part", and renamed to "<oid>" once complete,
+//     so an agent never sees another's partial download.
+//   - An agent which claims an object that another agent has completed, but
+//     which git-lfs hasn't moved yet, links it to "<oid>.<pid>" and reports
+//     that, instead of downloading it again, so that each git-lfs process
+//     moves its own file.
+
+// claimObject claims an object in the data dir, waiting until "ctx" is done
+// for other agents to release it. The returned func releases the claim.
+func claimObject(ctx context.Context, dir, oid string) (func(), error) {
+	path := filepath.Join(dir, oid+".claim")
+	waiting := false
+	for {
+		fh, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("opening claim file: %s", err)
+		}
+		ok, err := tryLock(fh, true)
+		if err != nil {
+			fh.Close()
+			return nil, fmt.Errorf("claiming %s: %s", oid, err)
+		}
+
+		if ok && sameFile(fh, path) {
+			fh.Truncate(0)
+			fmt.Fprintln(fh, os.Getpid())
+			removePartials(dir, oid)
+			return func() {
+				// Removed while locked, so that agents waiting on this
+				// file see it was released and open a new one.
+				os.Remove(path)
+				unlock(fh)
+				fh.Close()
+			}, nil
+		}
+		if ok {
+			// The agent which held the claim released it, removing the
+			// file, after it was opened here. Try again with a new one.
+			unlock(fh)
+			fh.Close()
+			continue
+		}
+		fh.Close()
+
+		if !waiting {
+			waiting = true
+			pid, _ := ioutil.ReadFile(path)
+			log.Println("Waiting for tanker process", strings.TrimSpace(string(pid)), "which is downloading", oid)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(lockRetryInterval):
+		}
+	}
+}
+
+// sameFile returns true if "fh" is still the file at "path".
+func sameFile(fh *os.File, path string) bool {
+	a, err := fh.Stat()
+	if err != nil {
+		return false
+	}
+	b, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(a, b)
+}
+
+// removePartials removes partial downloads of an object left behind by
+// agents which were killed. It must be called with the object claimed.
+func removePartials(dir, oid string) {
+	paths, _ := filepath.Glob(filepath.Join(dir, oid+".*.part"))
+	for _, p := range paths {
+		debugln("Removing partial download", p)
+		os.Remove(p)
+	}
+}
+
+// createPartial creates an empty partial download of an object in the
+// data dir, and returns its path.
+func createPartial(dir, oid string) (string, error) {
+	fh, err := ioutil.TempFile(dir, fmt.Sprintf("%s.%d.*.part", oid, os.Getpid()))
+	if err != nil {
+		return "", fmt.Errorf("creating partial download: %s", err)
+	}
+	return fh.Name(), fh.Close()
+}
+
+// reuseDownload links the completed download at "path", if there is one of
+// the given size, to a path unique to this process, and returns that path.
+// It must be called with the object claimed.
+func reuseDownload(path string, size int64) (string, bool) {
+	info, err := os.Stat(path)
+	if err != nil || info.Size() != size {
+		return "", false
+	}
+	own := fmt.Sprintf("%s.%d", path, os.Getpid())
+	os.Remove(own)
+	if err := os.Link(path, own); err != nil {
+		debugln("Error linking completed download", path, err)
+		return "", false
+	}
+	return own, true
+}
@@ -4,9 +4,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"reflect"
 	"strings"
+	"time"
 
+	"github.com/alecthomas/units"
 	"github.com/ghodss/yaml"
   "github.com/buchanae/tanker/storage"
 )
@@ -14,12 +17,138 @@ import (
 func DefaultConfig() Config {
 	return Config{
     Storage: storage.DefaultConfig(),
+		HeartbeatInterval: storage.Duration(10 * time.Second),
+		Pack: PackConfig{
+			MaxObjectSize: int64(units.MiB),
+		},
+		Inline: InlineConfig{
+			MaxSize: int64(units.MiB),
+		},
+		Mirrors: MirrorConfig{
+			MinSize:    int64(64 * units.MiB),
+			StripeSize: int64(16 * units.MiB),
+		},
+		Hooks: HooksConfig{
+			MaxSize:          int64(units.GiB),
+			MaxUntrackedSize: int64(10 * units.MiB),
+		},
+		Index: IndexConfig{
+			Shared: SharedIndexConfig{
+				CompactAfter: 50,
+			},
+		},
+		Replication: ReplicationConfig{
+			Concurrency: 4,
+		},
+		Restore: RestoreConfig{
+			PollInterval: storage.Duration(time.Minute),
+		},
+		Plan: PlanConfig{
+			ConfirmSize: int64(10 * units.GiB),
+		},
+		Sync: SyncConfig{
+			Interval: storage.Duration(15 * time.Minute),
+			Retries:  2,
+		},
+		Watch: WatchConfig{
+			Quiet:      storage.Duration(30 * time.Second),
+			LFSMinSize: int64(units.MiB),
+		},
+		Priority: PriorityConfig{
+			BackgroundRate: int64(units.MiB),
+		},
 	}
 }
 
 type Config struct {
 	BaseURL string
   Storage storage.Config
+	// Download objects at the version recorded in the journal when they were
+	// uploaded. Only applies to versioned buckets, and protects against an
+	// object being overwritten with different content.
+	PinVersions bool
+	// Never overwrite existing objects. Uploads are made conditional on
+	// the object not existing yet, and conflicts are reported as errors,
+	// unless the storage backend's checksum shows the content is the same.
+	Immutable bool
+	// Don't set a Content-Type on uploaded objects. By default, the type
+	// is detected from the file's extension or content.
+	DisableContentTypeDetection bool
+	// Download objects into git-lfs' own temp directory, as reported by
+	// "git lfs env", instead of ".git/tanker/data". The temp directory is on
+	// the same filesystem as the LFS object store, so git-lfs can move
+	// downloads into place instead of copying them.
+	DownloadToLFSDir bool
+	// Access control applied to uploaded objects: "private" or "public-read".
+	// Public datasets should use "public-read". Empty means the storage
+	// backend's default.
+	ACL string
+	// While a transfer makes no progress, e.g. during a slow stat or while
+	// a large object's manifest is written, send git-lfs a progress message
+	// this often, so it knows tanker is still alive. Zero disables this.
+	HeartbeatInterval storage.Duration
+	// Maximum time to spend transferring a single object. When exceeded,
+	// the transfer is canceled and reported as failed to git-lfs, and the
+	// rest of the session continues. Zero means no limit.
+	ObjectTimeout storage.Duration
+	// Cancel a transfer when no data has been transferred for this long,
+	// e.g. on a hung connection which is never closed, and report it as
+	// stalled to git-lfs. Zero disables this.
+	StallTimeout storage.Duration
+	// Number of objects the transfer agent uploads or downloads at once.
+	// Zero means lfs.concurrenttransfers when git-lfs runs a single agent,
+	// i.e. lfs.customtransfer.tanker.concurrent is false, and otherwise 1,
+	// since git-lfs runs an agent per concurrent transfer.
+	ConcurrentTransfers int
+	// Bundling of small objects into packs. See "tanker pack".
+	Pack PackConfig
+	// Signing uploaded objects, and verifying their signatures on download.
+	Signing SigningConfig
+	// Generating files derived from uploaded objects, e.g. indexes, and
+	// storing them next to the objects. See "tanker sidecar get".
+	Sidecars SidecarConfig
+	// Storing objects under a prefix per branch or environment.
+	Namespace NamespaceConfig
+	// Storing small objects in git instead of remote storage.
+	Inline InlineConfig
+	// Downloading large objects from several mirrors at once.
+	Mirrors MirrorConfig
+	// Copying uploaded objects to secondary remotes in the background.
+	// See "tanker replicate".
+	Replication ReplicationConfig
+	// Prices used to estimate storage and egress costs.
+	// If unset, rough list prices for the storage backend are used.
+	Pricing PricingConfig
+	// Downloading objects in archive tiers, which must be restored first.
+	Restore RestoreConfig
+	// The local index of objects in remote storage. See "tanker index".
+	Index IndexConfig
+	// The pre-commit hook. See "tanker hooks install".
+	Hooks HooksConfig
+	// The machine-wide object cache. See "tanker warm".
+	Cache CacheConfig
+	// Limits on the disk space used by downloads.
+	Quota QuotaConfig
+	// The plan printed before large downloads. See PlanConfig.
+	Plan PlanConfig
+	// Syncing the repo periodically. See "tanker sync".
+	Sync SyncConfig
+	// Committing and pushing new files. See "tanker watch".
+	Watch WatchConfig
+	// How background transfers, e.g. those of "tanker sync" and "tanker
+	// watch", yield to interactive ones.
+	Priority PriorityConfig
+	// Language of messages shown to the user, e.g. "es". Empty means the
+	// language of the user's locale. TANKER_LANG overrides this.
+	Language string
+}
+
+// warnDeprecated logs a warning for each deprecated setting the config
+// sets, e.g. in a config file written by an older version of tanker.
+func warnDeprecated(conf Config) {
+	if conf.Storage.Swift.MaxRetries != 0 {
+		log.Println(`Config Storage.Swift.MaxRetries is deprecated and ignored. Set Storage.Retry.Backends with Scheme "swift" to tune retries on Swift.`)
+	}
 }
 
 // ParseConfig parses a YAML doc into the given Config instance.
@@ -43,6 +172,12 @@ func ParseConfig(raw []byte, conf *Config) error {
 // and returns a Config struct.
 func ParseConfigFile(path string, conf *Config) error {
 
+	unlock, err := lockFile(path, false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	// Read file
 	source, err := ioutil.ReadFile(path)
 	if err != nil {
@@ -137,11 +272,19 @@ func checkForUnknownKeys(jsonStr []byte, obj interface{}) error {
 	return nil
 }
 
-// WriteConfigFile writes the configuration to a YAML file.
+// WriteConfigFile writes the configuration to a YAML file. The file is
+// replaced atomically, so readers never see a partial write.
 func WriteConfigFile(c Config, path string) error {
 	b, err := yaml.Marshal(c)
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(path, b, 0600)
+
+	unlock, err := lockFile(path, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return writeFileAtomic(path, b, 0600)
 }
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/buchanae/tanker/storage"
+)
+
+// PricingConfig is a simple pricing model for remote storage,
+// used to estimate costs in "tanker du" and "tanker cost".
+// Prices are per GiB, in whatever currency you like.
+type PricingConfig struct {
+	// Price of storing one GiB for a month.
+	StoragePerGBMonth float64
+	// Price of downloading one GiB out of the storage provider.
+	EgressPerGB float64
+}
+
+// defaultPricing holds rough list prices per backend, used when the config
+// doesn't set any. Self-hosted backends are assumed to be free.
+var defaultPricing = map[string]PricingConfig{
+	// Google Cloud Storage, standard class, worldwide egress.
+	storage.GSProtocol: {StoragePerGBMonth: 0.020, EgressPerGB: 0.12},
+	// Amazon S3, standard class, egress to the internet from us-east-1.
+	storage.S3Protocol:           {StoragePerGBMonth: 0.023, EgressPerGB: 0.09},
+	storage.SwiftProtocol:        {},
+	storage.FTPProtocol:          {},
+	storage.SFTPProtocol:         {},
+	storage.WebDAVProtocol:       {},
+	storage.WebDAVSecureProtocol: {},
+}
+
+// pricingFor returns the configured pricing, or the default pricing
+// for the backend of the base URL if none is configured.
+func pricingFor(conf Config) PricingConfig {
+	if conf.Pricing != (PricingConfig{}) {
+		return conf.Pricing
+	}
+	for proto, p := range defaultPricing {
+		if strings.HasPrefix(conf.BaseURL, proto) {
+			return p
+		}
+	}
+	return PricingConfig{}
+}
+
+const gib = float64(1 << 30)
+
+// StorageCost returns the monthly cost of storing the given number of bytes.
+func (p PricingConfig) StorageCost(bytes int64) float64 {
+	return float64(bytes) / gib * p.StoragePerGBMonth
+}
+
+// EgressCost returns the cost of downloading the given number of bytes.
+func (p PricingConfig) EgressCost(bytes int64) float64 {
+	return float64(bytes) / gib * p.EgressPerGB
+}
+
+// cost prints the estimated monthly cost of the remote storage, and the
+// cost of pulling the LFS files matching the given paths which aren't
+// present locally yet. With no paths, the pull estimate covers every LFS
+// file in the current checkout.
+func cost(ctx context.Context, conf Config, paths []string) error {
+	store, err := newStorage(conf)
+	if err != nil {
+		return err
+	}
+	p := pricingFor(conf)
+
+	listing, err := store.List(ctx, conf.BaseURL, storage.ListOptions{Recursive: true})
+	if err != nil {
+		return fmt.Errorf("listing objects: %s", err)
+	}
+
+	sizes := map[string]int64{}
+	var total int64
+	for _, obj := range listing {
+		total += obj.Size
+		if !isTrashed(obj.Name) {
+			sizes[path.Base(obj.Name)] = obj.Size
+		}
+	}
+
+	fmt.Printf("storage: %s, %.2f per month\n", formatBytes(total), p.StorageCost(total))
+
+	var args []string
+	if len(paths) > 0 {
+		args = []string{"--include", strings.Join(paths, ",")}
+	}
+	files, err := lsFiles(args...)
+	if err != nil {
+		return err
+	}
+
+	var pull int64
+	var count, missing int
+	seen := map[string]bool{}
+	for _, f := range files {
+		if f.Present || seen[f.Oid] {
+			continue
+		}
+		seen[f.Oid] = true
+
+		size, ok := sizes[f.Oid]
+		if !ok {
+			missing++
+			continue
+		}
+		pull += size
+		count++
+	}
+
+	fmt.Printf("pull:    %s in %d objects, %.2f egress\n", formatBytes(pull), count, p.EgressCost(pull))
+	if missing > 0 {
+		fmt.Printf("warning: %d objects to pull weren't found in remote storage\n", missing)
+	}
+	return nil
+}
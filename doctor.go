@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/buchanae/tanker/storage"
+)
+
+// doctor checks the tanker setup of the current repo and prints a report,
+// including which storage operations are supported for the configured remote.
+// It returns an error if tanker won't be able to transfer objects.
+func doctor(ctx context.Context, t *Tanker) error {
+	var failed bool
+	check := func(name string, err error) {
+		if err != nil {
+			failed = true
+			fmt.Printf("  %-24s FAIL  %s\n", name, err)
+		} else {
+			fmt.Printf("  %-24s ok\n", name)
+		}
+	}
+
+	fmt.Println("git-lfs:")
+	_, err := exec.Command("git", "lfs", "version").Output()
+	check("installed", err)
+
+	out, _ := exec.Command("git", "config", "lfs.standalonetransferagent").Output()
+	agent := strings.TrimSpace(string(out))
+	if agent != "tanker" {
+		check("transfer agent", fmt.Errorf("lfs.standalonetransferagent is %q, run \"tanker init\"", agent))
+	} else {
+		check("transfer agent", nil)
+	}
+	check("lfs.url", upstreamDrift(t.Config))
+
+	fmt.Println("storage:")
+	store, err := newStorage(t.Config)
+	check("configured", err)
+	if err != nil {
+		return fmt.Errorf("tanker is not set up correctly")
+	}
+
+	fmt.Printf("  %-24s %s\n", "base url", t.Config.BaseURL)
+	for _, op := range store.UnsupportedOperations(t.Config.BaseURL).Ops() {
+		if op.Err != nil {
+			fmt.Printf("  %-24s no    %s\n", op.Name, op.Err)
+		} else {
+			fmt.Printf("  %-24s yes\n", op.Name)
+		}
+	}
+
+	_, err = store.List(ctx, t.Config.BaseURL, storage.ListOptions{Recursive: true})
+	check("reachable", err)
+	check("upload", checkSupported(store, t.Config, "upload"))
+	check("download", checkSupported(store, t.Config, "download"))
+
+	if failed {
+		return fmt.Errorf("tanker is not set up correctly")
+	}
+	return nil
+}
+
+// checkSupported returns an error if the storage can't perform the
+// operations needed for a git-lfs "upload" or "download" operation,
+// including applying the configured ACL to uploads.
+func checkSupported(store storage.Storage, conf Config, operation string) error {
+	ops := store.UnsupportedOperations(conf.BaseURL)
+
+	var err error
+	switch operation {
+	case "upload":
+		err = ops.Put
+		if err == nil && conf.ACL != "" {
+			err = storage.ValidateACL(conf.ACL)
+			if err == nil {
+				err = ops.ACL
+			}
+		}
+	case "download":
+		err = ops.Get
+	}
+	if err != nil {
+		return fmt.Errorf("can't %s objects using %s: %s", operation, conf.BaseURL, err)
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/alecthomas/units"
+	"github.com/buchanae/tanker/storage"
+)
+
+// duReport summarizes the usage of remote storage under the base URL.
+type duReport struct {
+	BaseURL string
+	Objects int
+	Bytes   int64
+	// Usage by the first path component under the base URL,
+	// e.g. the trash is reported as ".trash".
+	Prefixes []duUsage
+	// Usage by file extension, according to the paths of the objects
+	// in the repo's history. Objects which aren't referenced by any
+	// path are reported as "(unreferenced)".
+	Extensions []duUsage
+	// The largest objects, biggest first.
+	Largest []duObject
+	// Estimated monthly cost of storing all the objects. See PricingConfig.
+	MonthlyCost float64
+}
+
+// duUsage is the number and total size of a group of objects.
+type duUsage struct {
+	Name    string
+	Objects int
+	Bytes   int64
+}
+
+type duObject struct {
+	Oid  string
+	Path string `json:",omitempty"`
+	Size int64
+}
+
+// du lists the objects under the base URL and aggregates their usage.
+// "top" is the number of largest objects to report.
+func du(ctx context.Context, conf Config, top int) (*duReport, error) {
+	store, err := newStorage(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	listing, err := store.List(ctx, conf.BaseURL, storage.ListOptions{Recursive: true})
+	if err != nil {
+		return nil, fmt.Errorf("listing objects: %s", err)
+	}
+
+	// Map OIDs to paths in the repo, to break usage down by file type.
+	paths := map[string]string{}
+	files, err := lsFiles("--all")
+	if err != nil {
+		errorln("Error listing LFS files, skipping file types", err)
+	}
+	for _, f := range files {
+		paths[f.Oid] = f.Path
+	}
+
+	report := &duReport{BaseURL: conf.BaseURL}
+	prefixes := map[string]*duUsage{}
+	exts := map[string]*duUsage{}
+	var objs []duObject
+
+	base := strings.TrimSuffix(conf.BaseURL, "/") + "/"
+	for _, obj := range listing {
+		report.Objects++
+		report.Bytes += obj.Size
+
+		rel := strings.TrimPrefix(obj.URL, base)
+		prefix := strings.SplitN(rel, "/", 2)[0]
+		if isOID(prefix) {
+			prefix = "(objects)"
+		}
+		addUsage(prefixes, prefix, obj.Size)
+
+		oid := path.Base(obj.Name)
+		if !isOID(oid) || isTrashed(rel) {
+			continue
+		}
+
+		p, ok := paths[oid]
+		ext := "(unreferenced)"
+		if ok {
+			ext = strings.ToLower(path.Ext(p))
+			if ext == "" {
+				ext = "(none)"
+			}
+		}
+		addUsage(exts, ext, obj.Size)
+		objs = append(objs, duObject{Oid: oid, Path: p, Size: obj.Size})
+	}
+
+	report.Prefixes = sortUsage(prefixes)
+	report.Extensions = sortUsage(exts)
+
+	sort.Slice(objs, func(i, j int) bool {
+		return objs[i].Size > objs[j].Size
+	})
+	if len(objs) > top {
+		objs = objs[:top]
+	}
+	report.Largest = objs
+	report.MonthlyCost = pricingFor(conf).StorageCost(report.Bytes)
+	return report, nil
+}
+
+func addUsage(m map[string]*duUsage, name string, size int64) {
+	u, ok := m[name]
+	if !ok {
+		u = &duUsage{Name: name}
+		m[name] = u
+	}
+	u.Objects++
+	u.Bytes += size
+}
+
+// sortUsage returns the usage groups, largest first.
+func sortUsage(m map[string]*duUsage) []duUsage {
+	var out []duUsage
+	for _, u := range m {
+		out = append(out, *u)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Bytes != out[j].Bytes {
+			return out[i].Bytes > out[j].Bytes
+		}
+		return out[i].Name < out[j].Name
+	})
+	return out
+}
+
+// print writes the report to stdout, as JSON or as human-readable tables.
+func (r *duReport) print(asJSON bool) error {
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	}
+
+	fmt.Printf("%s: %d objects, %s, %.2f per month\n",
+		r.BaseURL, r.Objects, formatBytes(r.Bytes), r.MonthlyCost)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "\nPREFIX\tOBJECTS\tSIZE")
+	for _, u := range r.Prefixes {
+		fmt.Fprintf(tw, "%s\t%d\t%s\n", u.Name, u.Objects, formatBytes(u.Bytes))
+	}
+	fmt.Fprintln(tw, "\nTYPE\tOBJECTS\tSIZE")
+	for _, u := range r.Extensions {
+		fmt.Fprintf(tw, "%s\t%d\t%s\n", u.Name, u.Objects, formatBytes(u.Bytes))
+	}
+	fmt.Fprintln(tw, "\nLARGEST\tSIZE\tPATH")
+	for _, o := range r.Largest {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", o.Oid, formatBytes(o.Size), o.Path)
+	}
+	return tw.Flush()
+}
+
+// formatBytes formats a byte count for humans, e.g. "1.5GiB".
+func formatBytes(n int64) string {
+	if n < int64(units.KiB) {
+		return fmt.Sprintf("%dB", n)
+	}
+	f := float64(n)
+	for _, unit := range []string{"KiB", "MiB", "GiB", "TiB"} {
+		f /= 1024
+		if f < 1024 || unit == "TiB" {
+			return fmt.Sprintf("%.1f%s", f, unit)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/buchanae/tanker/storage"
+)
+
+// Exit codes, so that scripts can branch on the kind of failure.
+// See exitCode.
+const (
+	// Any failure not covered below.
+	exitError = 1
+	// The config is invalid, or the storage backend isn't configured.
+	exitConfig = 2
+	// Storage credentials are missing, expired, or lack permission.
+	exitAuth = 3
+	// Storage couldn't be reached, or failed after retries.
+	exitNetwork = 4
+	// Some objects of a batch, e.g. in "tanker warm", failed.
+	exitPartial = 5
+	// Objects failed "tanker verify".
+	exitVerify = 6
+)
+
+// exitCodesHelp describes the exit codes, for the root command's help.
+const exitCodesHelp = `Exit codes:
+  0  success
+  1  other failure
+  2  invalid config, or storage backend not configured
+  3  storage credentials missing, expired, or lacking permission
+  4  storage unreachable, or still failing after retries
+  5  some objects failed, e.g. in "tanker warm" or "tanker pull"
+  6  objects failed "tanker verify"`
+
+// exitCodeError gives an error an exit code explicitly, for failures
+// which can't be told apart by their error, e.g. partial failures.
+type exitCodeError struct {
+	code int
+	err  error
+}
+
+// withExitCode wraps "err" so that tanker exits with "code".
+func withExitCode(code int, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &exitCodeError{code, err}
+}
+
+func (e *exitCodeError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitCodeError) Unwrap() error {
+	return e.err
+}
+
+// exitCode returns the exit code of a command which failed with "err".
+func exitCode(err error) int {
+	var explicit *exitCodeError
+	if errors.As(err, &explicit) {
+		return explicit.code
+	}
+
+	var notConfigured *storage.ErrNotConfigured
+	var invalidURL *storage.ErrInvalidURL
+	var unsupported *storage.ErrUnsupportedProtocol
+	if errors.As(err, &notConfigured) || errors.As(err, &invalidURL) || errors.As(err, &unsupported) {
+		return exitConfig
+	}
+
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		switch storage.KindOf(e) {
+		case storage.AuthError, storage.PermissionError:
+			return exitAuth
+		case storage.TransientError:
+			return exitNetwork
+		}
+	}
+
+	// Some SDKs flatten network errors into strings.
+	var netErr net.Error
+	if errors.As(err, &netErr) || strings.Contains(err.Error(), "no such host") {
+		return exitNetwork
+	}
+	return exitError
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// auditRecord is a journal entry as exported by "tanker history export",
+// for ingesting transfer audit records into a data warehouse.
+type auditRecord struct {
+	Time time.Time `parquet:"time,timestamp(millisecond)" json:"time"`
+	// "upload", "download", "replicate", or "repair"
+	Op      string `parquet:"op" json:"op"`
+	Oid     string `parquet:"oid" json:"oid"`
+	URL     string `parquet:"url" json:"url"`
+	Size    int64  `parquet:"size" json:"size"`
+	Version string `parquet:"version,optional" json:"version,omitempty"`
+	// Time spent transferring the object, in milliseconds.
+	DurationMs int64  `parquet:"duration_ms" json:"duration_ms"`
+	Replica    string `parquet:"replica,optional" json:"replica,omitempty"`
+	// Base URL of the remote storage the repo is configured with.
+	BaseURL string `parquet:"base_url" json:"base_url"`
+}
+
+var historyFormats = map[string]func(io.Writer, []auditRecord) error{
+	"csv":     writeHistoryCSV,
+	"json":    writeHistoryJSON,
+	"parquet": writeHistoryParquet,
+}
+
+// exportHistory writes the journal entries recorded since "since" to "out",
+// in the given format. A zero "since" exports the whole journal.
+func exportHistory(t *Tanker, format string, since time.Time, out io.Writer) error {
+	write, ok := historyFormats[format]
+	if !ok {
+		return userErrorf("unknown format %q, expected csv, json, or parquet", format)
+	}
+
+	entries, err := readJournal(t.Paths.Journal)
+	if err != nil {
+		return err
+	}
+	var records []auditRecord
+	for _, e := range entries {
+		if e.Time.Before(since) {
+			continue
+		}
+		records = append(records, auditRecord{
+			Time:       e.Time,
+			Op:         e.Op,
+			Oid:        e.Oid,
+			URL:        e.URL,
+			Size:       e.Size,
+			Version:    e.Version,
+			DurationMs: e.Duration.Milliseconds(),
+			Replica:    e.Replica,
+			BaseURL:    t.Config.BaseURL,
+		})
+	}
+	return write(out, records)
+}
+
+// parseSince parses the start of an export: a date, e.g. "2024-01-31",
+// a time in RFC 3339 format, or an age, e.g. "30d" for the last 30 days.
+func parseSince(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	age, err := parseAge(s)
+	if err != nil {
+		return time.Time{}, userErrorf("invalid --since %q, expected a date, a time, or an age, e.g. 30d", s)
+	}
+	return time.Now().Add(-age), nil
+}
+
+func writeHistoryCSV(w io.Writer, records []auditRecord) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"time", "op", "oid", "url", "size", "version", "duration_ms", "replica", "base_url"})
+	for _, r := range records {
+		cw.Write([]string{
+			r.Time.UTC().Format(time.RFC3339Nano),
+			r.Op,
+			r.Oid,
+			r.URL,
+			strconv.FormatInt(r.Size, 10),
+			r.Version,
+			strconv.FormatInt(r.DurationMs, 10),
+			r.Replica,
+			r.BaseURL,
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeHistoryJSON writes one JSON object per line, which warehouses
+// load more easily than a single array.
+func writeHistoryJSON(w io.Writer, records []auditRecord) error {
+	enc := json.NewEncoder(w)
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeHistoryParquet(w io.Writer, records []auditRecord) error {
+	pw := parquet.NewGenericWriter[auditRecord](w)
+	if _, err := pw.Write(records); err != nil {
+		return fmt.Errorf("writing parquet: %s", err)
+	}
+	if err := pw.Close(); err != nil {
+		return fmt.Errorf("writing parquet: %s", err)
+	}
+	return nil
+}
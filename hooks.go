@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// HooksConfig configures the pre-commit hook installed by
+// "tanker hooks install", which checks staged files for accidentally
+// huge commits.
+type HooksConfig struct {
+	// Staged LFS files larger than this, in bytes, are reported.
+	// Zero disables the check.
+	MaxSize int64
+	// Staged files which aren't tracked by LFS, i.e. don't match any
+	// "git lfs track" pattern, and are larger than this, are reported.
+	// Zero disables the check.
+	MaxUntrackedSize int64
+	// Fail the commit when files are reported, instead of only warning.
+	// "git commit --no-verify" skips the hook.
+	Block bool
+}
+
+// hookMarker identifies hooks installed by tanker, so they can be replaced.
+const hookMarker = "# Installed by tanker."
+
+const preCommitHook = `#!/bin/sh
+` + hookMarker + ` See "tanker hooks install".
+command -v tanker >/dev/null 2>&1 || exit 0
+exec tanker hooks pre-commit
+`
+
+// installHooks installs tanker's pre-commit hook into the repo's hooks
+// directory. An existing hook which tanker didn't install is only
+// replaced if "force" is set.
+func installHooks(force bool) error {
+	out, err := exec.Command("git", "rev-parse", "--git-path", "hooks").Output()
+	if err != nil {
+		return fmt.Errorf("finding hooks directory: %s", err)
+	}
+	path := filepath.Join(strings.TrimSpace(string(out)), "pre-commit")
+
+	existing, err := ioutil.ReadFile(path)
+	if err == nil && !bytes.Contains(existing, []byte(hookMarker)) && !force {
+		return fmt.Errorf("a pre-commit hook already exists at %s: "+
+			"add \"tanker hooks pre-commit\" to it, or use --force to replace it", path)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("creating hooks directory: %s", err)
+	}
+	if err := ioutil.WriteFile(path, []byte(preCommitHook), 0755); err != nil {
+		return fmt.Errorf("writing hook: %s", err)
+	}
+	// WriteFile doesn't change the mode of an existing file.
+	if err := os.Chmod(path, 0755); err != nil {
+		return fmt.Errorf("writing hook: %s", err)
+	}
+	fmt.Println("installed pre-commit hook at", path)
+	return nil
+}
+
+// preCommit checks the staged files according to the config, and writes
+// a warning about each huge file to "out". If the config blocks such
+// commits, an error is returned when any are found.
+func preCommit(conf HooksConfig, out io.Writer) error {
+	if conf.MaxSize <= 0 && conf.MaxUntrackedSize <= 0 {
+		return nil
+	}
+
+	blobs, err := stagedBlobs()
+	if err != nil {
+		return err
+	}
+
+	var found int
+	for _, b := range blobs {
+		switch {
+		case b.LFS && conf.MaxSize > 0 && b.Size > conf.MaxSize:
+			fmt.Fprintf(out, "tanker: %s is a %s LFS object, larger than Hooks.MaxSize (%s)\n",
+				b.Path, formatBytes(b.Size), formatBytes(conf.MaxSize))
+			found++
+		case !b.LFS && conf.MaxUntrackedSize > 0 && b.Size > conf.MaxUntrackedSize:
+			fmt.Fprintf(out, "tanker: %s is %s and isn't tracked by LFS, larger than Hooks.MaxUntrackedSize (%s); "+
+				"see \"git lfs track\"\n", b.Path, formatBytes(b.Size), formatBytes(conf.MaxUntrackedSize))
+			found++
+		}
+	}
+
+	if found > 0 && conf.Block {
+		return fmt.Errorf("commit blocked: %d staged files are too large "+
+			"(set Hooks.Block to false to only warn, or commit with --no-verify)", found)
+	}
+	return nil
+}
+
+// stagedBlobs returns the files which are added or modified in the index,
+// with the sizes of LFS objects read from their pointers.
+func stagedBlobs() ([]*gitBlob, error) {
+	out, err := exec.Command("git", "diff", "--cached", "--raw", "-z", "--no-abbrev",
+		"--no-renames", "--diff-filter=AM").Output()
+	if err != nil {
+		return nil, fmt.Errorf("listing staged files: %s", err)
+	}
+
+	// Records are ":<mode> <mode> <sha> <sha> <status>\0<path>\0".
+	var blobs []*gitBlob
+	fields := strings.Split(string(out), "\x00")
+	for i := 0; i+1 < len(fields); i += 2 {
+		meta := strings.Fields(fields[i])
+		if len(meta) != 5 || meta[1] == "160000" {
+			// Skip malformed records and submodules.
+			continue
+		}
+		blobs = append(blobs, &gitBlob{Path: fields[i+1], Sha: meta[3]})
+	}
+
+	if err := readPointers(blobs); err != nil {
+		return nil, fmt.Errorf("reading staged files: %s", err)
+	}
+	return blobs, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/buchanae/tanker/storage"
+)
+
+// Messages shown to the user, e.g. command errors, are translated into the
+// user's language when there's a catalog for it. Logs stay in English, so
+// that they can be shared in bug reports: errors made with userErrorf read
+// in English, and are only translated when printed by printError.
+//
+// The language is taken from TANKER_LANG, then the Language config setting,
+// then LC_ALL, LC_MESSAGES, or LANG.
+
+// catalogs maps a language, e.g. "es", to translations of English messages,
+// keyed by their English format string.
+var catalogs = map[string]map[string]string{}
+
+var language struct {
+	mtx sync.Mutex
+	// From the Language config setting.
+	config string
+}
+
+// setLanguage sets the language from the Language config setting.
+func setLanguage(lang string) {
+	language.mtx.Lock()
+	defer language.mtx.Unlock()
+	language.config = lang
+}
+
+// currentLanguage returns the user's language, e.g. "es", or empty for
+// English.
+func currentLanguage() string {
+	language.mtx.Lock()
+	config := language.config
+	language.mtx.Unlock()
+
+	for _, lang := range []string{
+		os.Getenv("TANKER_LANG"),
+		config,
+		os.Getenv("LC_ALL"),
+		os.Getenv("LC_MESSAGES"),
+		os.Getenv("LANG"),
+	} {
+		if lang != "" {
+			return normalizeLanguage(lang)
+		}
+	}
+	return ""
+}
+
+// normalizeLanguage returns the language of a locale, e.g. "es" for
+// "es_MX.UTF-8". The "C" and "POSIX" locales are English.
+func normalizeLanguage(locale string) string {
+	if i := strings.IndexAny(locale, "_.@-"); i >= 0 {
+		locale = locale[:i]
+	}
+	locale = strings.ToLower(locale)
+	if locale == "c" || locale == "posix" {
+		return "en"
+	}
+	return locale
+}
+
+// translate returns the translation of an English message in the user's
+// language, or the message itself if there's none.
+func translate(msg string) string {
+	if t, ok := catalogs[currentLanguage()][msg]; ok {
+		return t
+	}
+	return msg
+}
+
+// tr formats a message in the user's language. Arguments which are
+// userErrors are translated too.
+func tr(format string, args ...interface{}) string {
+	localized := make([]interface{}, len(args))
+	for i, arg := range args {
+		if e, ok := arg.(*userError); ok {
+			arg = e.Localized()
+		}
+		localized[i] = arg
+	}
+	return fmt.Sprintf(translate(format), localized...)
+}
+
+// userError is an error shown to the user, which can be translated.
+// Error returns the English message.
+type userError struct {
+	format string
+	args   []interface{}
+}
+
+// userErrorf returns a userError, formatted like fmt.Errorf. The format
+// string is the key of its translations in the catalogs.
+func userErrorf(format string, args ...interface{}) error {
+	return &userError{format, args}
+}
+
+func (e *userError) Error() string {
+	return fmt.Sprintf(e.format, e.args...)
+}
+
+// Localized returns the message in the user's language.
+func (e *userError) Localized() string {
+	return tr(e.format, e.args...)
+}
+
+// Unwrap returns the error the message was made from, if any, so that
+// remediation hints can still be found for it.
+func (e *userError) Unwrap() error {
+	for i := len(e.args) - 1; i >= 0; i-- {
+		if err, ok := e.args[i].(error); ok {
+			return err
+		}
+	}
+	return nil
+}
+
+// printError prints a command's error to the user, in their language,
+// followed by a remediation hint if there is one. See storage.WithHint.
+func printError(out io.Writer, err error) {
+	if e, ok := err.(*exitCodeError); ok {
+		err = e.err
+	}
+	hint := ""
+	if h, ok := storage.WithHint(err).(*storage.ErrHinted); ok {
+		err, hint = h.Err, h.Hint
+	}
+
+	msg := err.Error()
+	if u, ok := err.(*userError); ok {
+		msg = u.Localized()
+	}
+	fmt.Fprintln(out, translate("Error:"), msg)
+	if hint != "" {
+		fmt.Fprintln(out, translate("hint:"), translate(hint))
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// include adds patterns to lfs.fetchinclude and pulls the matching files.
+//
+// git-lfs only fetches files which match an include pattern and don't
+// match any lfs.fetchexclude pattern, so an exclude pattern can silently
+// keep included files from being fetched. Such conflicts are reported,
+// and if "removeExcludes" is set, the conflicting exclude patterns are
+// removed. The effective fetch set is printed afterwards.
+func include(patterns []string, removeExcludes bool, out io.Writer) error {
+	includes, err := fetchPatterns("lfs.fetchinclude")
+	if err != nil {
+		return err
+	}
+	excludes, err := fetchPatterns("lfs.fetchexclude")
+	if err != nil {
+		return err
+	}
+
+	conflicts, err := excludeConflicts(patterns, excludes)
+	if err != nil {
+		return err
+	}
+	if len(conflicts) > 0 {
+		if removeExcludes {
+			fmt.Fprintln(out, "removing lfs.fetchexclude patterns which conflict with the included files:")
+		} else {
+			fmt.Fprintln(out, "warning: lfs.fetchexclude patterns keep some included files from being fetched:")
+		}
+		var kept []string
+		for _, e := range excludes {
+			if n, ok := conflicts[e]; ok {
+				fmt.Fprintf(out, "  %s (excludes %d included files)\n", e, n)
+			} else {
+				kept = append(kept, e)
+			}
+		}
+		if removeExcludes {
+			excludes = kept
+			if err := setFetchPatterns("lfs.fetchexclude", excludes); err != nil {
+				return err
+			}
+		} else {
+			fmt.Fprintln(out, "use --remove-excludes to remove them")
+		}
+	}
+
+	uniq := map[string]bool{}
+	for _, key := range append(includes, patterns...) {
+		uniq[key] = true
+	}
+	includes = nil
+	for key := range uniq {
+		includes = append(includes, key)
+	}
+	sort.Strings(includes)
+	if err := setFetchPatterns("lfs.fetchinclude", includes); err != nil {
+		return err
+	}
+
+	cmd := exec.Command("git", "lfs", "pull", "--include", strings.Join(patterns, ","))
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+
+	return printFetchSet(includes, excludes, out)
+}
+
+// excludeConflicts returns the exclude patterns which match files that
+// match the include patterns, with the number of files each one excludes.
+// A pattern identical to an include pattern always conflicts.
+func excludeConflicts(includes, excludes []string) (map[string]int, error) {
+	conflicts := map[string]int{}
+	if len(excludes) == 0 {
+		return conflicts, nil
+	}
+
+	included, err := lsFiles("--include", strings.Join(includes, ","))
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range excludes {
+		if containsString(includes, e) {
+			conflicts[e] = len(included)
+			continue
+		}
+		remaining, err := lsFiles("--include", strings.Join(includes, ","), "--exclude", e)
+		if err != nil {
+			return nil, err
+		}
+		if n := len(included) - len(remaining); n > 0 {
+			conflicts[e] = n
+		}
+	}
+	return conflicts, nil
+}
+
+// printFetchSet prints the patterns git-lfs fetches by, and how many files
+// in the checkout they select.
+func printFetchSet(includes, excludes []string, out io.Writer) error {
+	args := []string{"--include", strings.Join(includes, ",")}
+	if len(excludes) > 0 {
+		args = append(args, "--exclude", strings.Join(excludes, ","))
+	}
+	files, err := lsFiles(args...)
+	if err != nil {
+		return err
+	}
+	all, err := lsFiles()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(out, "fetch include:", strings.Join(includes, ","))
+	if len(excludes) > 0 {
+		fmt.Fprintln(out, "fetch exclude:", strings.Join(excludes, ","))
+	}
+	fmt.Fprintf(out, "%d of %d LFS files are fetched\n", len(files), len(all))
+	return nil
+}
+
+// fetchPatterns returns the comma-separated patterns of a git config key,
+// e.g. "lfs.fetchinclude".
+func fetchPatterns(key string) ([]string, error) {
+	out, err := exec.Command("git", "config", "--get", key).Output()
+	// exit code 1 means the config doesn't exist, which is ok in this case.
+	if getExitCode(err) == 1 {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("getting %s config: %s", key, err)
+	}
+
+	var patterns []string
+	for _, p := range strings.Split(strings.TrimSpace(string(out)), ",") {
+		if p != "" {
+			patterns = append(patterns, p)
+		}
+	}
+	return patterns, nil
+}
+
+// setFetchPatterns sets a git config key to comma-separated patterns,
+// or unsets it if there are none.
+func setFetchPatterns(key string, patterns []string) error {
+	if len(patterns) == 0 {
+		err := exec.Command("git", "config", "--unset", key).Run()
+		// exit code 5 means the key wasn't set.
+		if err != nil && getExitCode(err) != 5 {
+			return fmt.Errorf("unsetting %s config: %s", key, err)
+		}
+		return nil
+	}
+	if err := exec.Command("git", "config", key, strings.Join(patterns, ",")).Run(); err != nil {
+		return fmt.Errorf("setting %s config: %s", key, err)
+	}
+	return nil
+}
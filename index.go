@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/buchanae/tanker/storage"
+	_ "modernc.org/sqlite"
+)
+
+// IndexConfig configures the local index of remote objects.
+type IndexConfig struct {
+	// Skip uploading objects which the index shows are already in remote
+	// storage with the same size, without asking the storage backend.
+	// This makes pushes of mostly unchanged data instant, but trusts that
+	// nothing deleted the objects since they were indexed.
+	SkipKnownUploads bool
+	// Index entries last seen longer ago than this aren't trusted for
+	// skipping uploads. Zero means entries never expire.
+	MaxAge storage.Duration
+	// The index of remote objects shared by all clones, kept in remote
+	// storage. See SharedIndexConfig.
+	Shared SharedIndexConfig
+}
+
+// objectIndex is a local SQLite database of the objects known to be in
+// remote storage, by OID, stored at ".git/tanker/index.db". It's updated
+// whenever tanker sees an object, e.g. after a transfer or during
+// "tanker verify", and rebuilt from a full listing by "tanker index refresh".
+//
+// Objects are indexed under the namespace they were seen in, see
+// namespacePrefix, since an object in one namespace isn't in the others.
+//
+// The index is only a cache, so errors writing it are logged and ignored.
+// A nil *objectIndex is valid, and knows no objects.
+type objectIndex struct {
+	db *sql.DB
+	// Prefix of the current namespace, or empty for the base URL itself.
+	namespace string
+}
+
+// indexEntry is an object in the index.
+type indexEntry struct {
+	Oid  string
+	Size int64
+	ETag string
+	// When the object was last seen in remote storage.
+	Seen time.Time
+	// When the object's content was last downloaded and checked against
+	// its OID, or zero if it never was.
+	Verified time.Time
+	// Prefix of the namespace the object was seen in. Null for objects
+	// indexed before namespaces were recorded, which could be in any.
+	Namespace sql.NullString
+}
+
+const indexSchema = `
+CREATE TABLE IF NOT EXISTS objects (
+	oid       TEXT PRIMARY KEY,
+	size      INTEGER NOT NULL,
+	etag      TEXT NOT NULL,
+	seen      INTEGER NOT NULL,
+	verified  INTEGER NOT NULL DEFAULT 0,
+	namespace TEXT
+)`
+
+// openIndex opens the index at "path", creating it if needed. Objects are
+// indexed under the namespace with the given prefix.
+func openIndex(path, namespace string) (*objectIndex, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("opening index: %s", err)
+	}
+	// Several transfer agents may run at once, so wait for each other's
+	// writes instead of failing. A single connection keeps the pragmas
+	// in effect for every query.
+	db.SetMaxOpenConns(1)
+	for _, stmt := range []string{
+		"PRAGMA busy_timeout = 10000",
+		"PRAGMA journal_mode = WAL",
+		indexSchema,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("initializing index %s: %s", path, err)
+		}
+	}
+	if err := addNamespaceColumn(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("initializing index %s: %s", path, err)
+	}
+	return &objectIndex{db, namespace}, nil
+}
+
+// addNamespaceColumn adds the namespace column to indexes created before
+// it existed. Their entries are left null.
+func addNamespaceColumn(db *sql.DB) error {
+	var n int
+	err := db.QueryRow("SELECT count(*) FROM pragma_table_info('objects') WHERE name = 'namespace'").Scan(&n)
+	if err != nil || n > 0 {
+		return err
+	}
+	_, err = db.Exec("ALTER TABLE objects ADD COLUMN namespace TEXT")
+	return err
+}
+
+// loadIndex opens the index at "path", for the current namespace. The index
+// is only a cache, so if it can't be opened, the error is logged and a nil
+// index is returned.
+func loadIndex(path string, conf NamespaceConfig) *objectIndex {
+	prefix, err := namespacePrefix(conf)
+	if err != nil {
+		errorln("Error opening index", err)
+		return nil
+	}
+	index, err := openIndex(path, prefix)
+	if err != nil {
+		errorln("Error opening index", err)
+		return nil
+	}
+	return index
+}
+
+// Close closes the index database.
+func (x *objectIndex) Close() error {
+	if x == nil {
+		return nil
+	}
+	return x.db.Close()
+}
+
+// seen records that the object was seen in remote storage.
+func (x *objectIndex) seen(oid string, obj *storage.Object) {
+	x.upsert(oid, obj, false)
+}
+
+// verified records that the object's content was checked against its OID.
+func (x *objectIndex) verified(oid string, obj *storage.Object) {
+	x.upsert(oid, obj, true)
+}
+
+func (x *objectIndex) upsert(oid string, obj *storage.Object, verified bool) {
+	if x == nil || obj == nil {
+		return
+	}
+	now := time.Now().Unix()
+	var v int64
+	if verified {
+		v = now
+	}
+	_, err := x.db.Exec(`
+		INSERT INTO objects (oid, size, etag, seen, verified, namespace) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (oid) DO UPDATE SET
+			size = excluded.size,
+			etag = excluded.etag,
+			seen = excluded.seen,
+			verified = max(verified, excluded.verified),
+			namespace = excluded.namespace`,
+		oid, obj.Size, obj.ETag, now, v, x.namespace)
+	if err != nil {
+		errorln("Error updating index", oid, err)
+	}
+}
+
+// forget removes an object which is no longer in remote storage.
+func (x *objectIndex) forget(oid string) {
+	if x == nil {
+		return
+	}
+	if _, err := x.db.Exec("DELETE FROM objects WHERE oid = ?", oid); err != nil {
+		errorln("Error updating index", oid, err)
+	}
+}
+
+// lookup returns the index entry of the given OID, or nil if the object
+// isn't known.
+func (x *objectIndex) lookup(oid string) *indexEntry {
+	if x == nil {
+		return nil
+	}
+	e := &indexEntry{Oid: oid}
+	var seen, verified int64
+	err := x.db.QueryRow("SELECT size, etag, seen, verified, namespace FROM objects WHERE oid = ?", oid).
+		Scan(&e.Size, &e.ETag, &seen, &verified, &e.Namespace)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		errorln("Error reading index", oid, err)
+		return nil
+	}
+	e.Seen = time.Unix(seen, 0)
+	if verified != 0 {
+		e.Verified = time.Unix(verified, 0)
+	}
+	return e
+}
+
+// knownUpload returns true if the index shows that the object with the
+// given OID and size is already in remote storage, in the current namespace,
+// and the config allows skipping its upload.
+func (x *objectIndex) knownUpload(conf IndexConfig, oid string, size int64) bool {
+	if !conf.SkipKnownUploads {
+		return false
+	}
+	e := x.lookup(oid)
+	if e == nil || e.Size != size {
+		return false
+	}
+	// e.g. an object pushed from a branch's namespace isn't at the base URL.
+	if !e.Namespace.Valid || e.Namespace.String != x.namespace {
+		return false
+	}
+	return conf.MaxAge <= 0 || time.Since(e.Seen) < time.Duration(conf.MaxAge)
+}
+
+// refreshIndex rebuilds the index at "path" from a full listing of the
+// objects under the base URL, and returns the number of objects indexed.
+// Verification times of objects which are still present are kept.
+func refreshIndex(ctx context.Context, conf Config, path string) (int, error) {
+	store, err := newStorage(conf)
+	if err != nil {
+		return 0, err
+	}
+	prefix, err := namespacePrefix(conf.Namespace)
+	if err != nil {
+		return 0, err
+	}
+	index, err := openIndex(path, prefix)
+	if err != nil {
+		return 0, err
+	}
+	defer index.Close()
+
+	listing, err := store.List(ctx, conf.BaseURL, storage.ListOptions{Recursive: true})
+	if err != nil {
+		return 0, fmt.Errorf("listing objects: %s", err)
+	}
+
+	tx, err := index.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("updating index: %s", err)
+	}
+	defer tx.Rollback()
+
+	start := time.Now().Unix()
+	var count int
+	for _, obj := range listing {
+		oid := objectOid(obj)
+		if oid == "" {
+			continue
+		}
+		_, err := tx.Exec(`
+			INSERT INTO objects (oid, size, etag, seen, namespace) VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT (oid) DO UPDATE SET
+				size = excluded.size,
+				etag = excluded.etag,
+				seen = excluded.seen,
+				namespace = excluded.namespace`,
+			oid, obj.Size, obj.ETag, start, prefix)
+		if err != nil {
+			return 0, fmt.Errorf("updating index: %s", err)
+		}
+		count++
+	}
+
+	// Anything not in the listing is gone from remote storage.
+	if _, err := tx.Exec("DELETE FROM objects WHERE seen < ?", start); err != nil {
+		return 0, fmt.Errorf("updating index: %s", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("updating index: %s", err)
+	}
+	return count, nil
+}
+
+// objectOid returns the OID of a listed object which is named by its OID,
+// or an empty string for other objects, e.g. packs and trashed objects.
+func objectOid(obj *storage.Object) string {
+	oid := path.Base(obj.Name)
+	if obj.Dir || !isOID(oid) || isTrashed(obj.Name) {
+		return ""
+	}
+	return oid
+}
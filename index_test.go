@@ -0,0 +1,80 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/buchanae/tanker/storage"
+)
+
+const testOid = "bf3e3e2af9366a3b704ae0c31de5afa64193ebabffde2091936ad2e7510bc03a"
+
+// Objects seen in a namespace aren't known uploads at the base URL,
+// or in other namespaces.
+func TestKnownUploadNamespace(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index.db")
+	conf := IndexConfig{SkipKnownUploads: true}
+
+	dev, err := openIndex(path, "branches/dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+	dev.seen(testOid, &storage.Object{Size: 10})
+
+	if !dev.knownUpload(conf, testOid, 10) {
+		t.Error("expected a known upload in the namespace it was seen in")
+	}
+
+	for _, ns := range []string{"", "branches/other"} {
+		x, err := openIndex(path, ns)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if x.knownUpload(conf, testOid, 10) {
+			t.Errorf("expected no known upload in namespace %q", ns)
+		}
+		x.Close()
+	}
+}
+
+// Entries of indexes created before namespaces were recorded could be in
+// any namespace, so they aren't trusted for skipping uploads.
+func TestKnownUploadLegacyIndex(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index.db")
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`
+		CREATE TABLE objects (
+			oid      TEXT PRIMARY KEY,
+			size     INTEGER NOT NULL,
+			etag     TEXT NOT NULL,
+			seen     INTEGER NOT NULL,
+			verified INTEGER NOT NULL DEFAULT 0
+		);
+		INSERT INTO objects (oid, size, etag, seen) VALUES (?, 10, '', strftime('%s', 'now'))`,
+		testOid)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	x, err := openIndex(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer x.Close()
+	conf := IndexConfig{SkipKnownUploads: true}
+	if x.knownUpload(conf, testOid, 10) {
+		t.Error("expected no known upload for an entry without a namespace")
+	}
+
+	// Seeing the object again records its namespace.
+	x.seen(testOid, &storage.Object{Size: 10})
+	if !x.knownUpload(conf, testOid, 10) {
+		t.Error("expected a known upload once the object was seen again")
+	}
+}
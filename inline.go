@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Small objects can be stored in git itself instead of remote storage,
+// which avoids the latency of remote storage for thousands of tiny files:
+//
+//	refs/tanker/inline  commit whose tree has a "<oid[:2]>/<oid>" blob per object
+//
+// The ref is pushed to the git remote at the end of each push which stored
+// objects inline, and fetched from it by downloads. Concurrent pushes from
+// different clones are merged, since objects never conflict.
+const (
+	inlineRef = "refs/tanker/inline"
+	// The inline ref as last fetched from, or pushed to, the git remote.
+	inlineRemoteRef = "refs/tanker/inline-remote"
+	// Attempts to push the ref, when other clones push in between.
+	inlinePushTries = 3
+)
+
+// InlineConfig configures storing small objects in git.
+type InlineConfig struct {
+	// Store objects up to MaxSize in git instead of remote storage. Every
+	// clone which downloads the objects must enable this too.
+	Enabled bool
+	// Largest object stored in git, in bytes.
+	MaxSize int64
+}
+
+// inlineStore stores objects in the inline ref, for one transfer session.
+// A nil *inlineStore is valid, and stores nothing.
+type inlineStore struct {
+	// Directory for the lock and the temporary git index.
+	dir string
+	// Git remote given by git-lfs, e.g. "origin".
+	remote string
+
+	mtx     sync.Mutex
+	fetched bool
+	// Objects stored in this session, as "update-index --index-info" lines.
+	added []string
+}
+
+func newInlineStore(conf Config, dir string) *inlineStore {
+	if !conf.Inline.Enabled {
+		return nil
+	}
+	return &inlineStore{dir: dir}
+}
+
+func inlinePath(oid string) string {
+	return oid[:2] + "/" + oid
+}
+
+// add writes the file at "path" to the git object store as the content of
+// "oid". It's committed to the inline ref and pushed by flush.
+func (s *inlineStore) add(oid, path string) error {
+	blob, err := inlineGit(nil, nil, "hash-object", "-w", "--no-filters", "--", path)
+	if err != nil {
+		return err
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.added = append(s.added, fmt.Sprintf("100644 blob %s\t%s\n", blob, inlinePath(oid)))
+	return nil
+}
+
+// get writes the content of "oid" to "dest", if it's stored inline.
+// The inline ref is fetched from the git remote once per session.
+func (s *inlineStore) get(oid, dest string) (bool, error) {
+	s.mtx.Lock()
+	if !s.fetched {
+		s.fetched = true
+		if _, err := s.fetch(); err != nil {
+			errorln("Error fetching inline objects", err)
+		}
+	}
+	s.mtx.Unlock()
+
+	for _, ref := range []string{inlineRef, inlineRemoteRef} {
+		spec := ref + ":" + inlinePath(oid)
+		if exec.Command("git", "cat-file", "-e", spec).Run() != nil {
+			continue
+		}
+		fh, err := os.Create(dest)
+		if err != nil {
+			return false, fmt.Errorf("opening dest path %q: %s", dest, err)
+		}
+		cmd := exec.Command("git", "cat-file", "blob", spec)
+		cmd.Stdout = fh
+		err = cmd.Run()
+		if closeErr := fh.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(dest)
+			return false, fmt.Errorf("reading inline object %s: %s", oid, err)
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// fetch updates inlineRemoteRef from the git remote, and returns its
+// commit, or an empty string if the remote has no inline objects yet.
+func (s *inlineStore) fetch() (string, error) {
+	if s.remote == "" {
+		return "", fmt.Errorf("no git remote")
+	}
+	out, err := inlineGit(nil, nil, "ls-remote", s.remote, inlineRef)
+	if err != nil {
+		return "", err
+	}
+	if out == "" {
+		return "", nil
+	}
+	_, err = inlineGit(nil, nil, "fetch", "--no-tags", "--quiet", s.remote, "+"+inlineRef+":"+inlineRemoteRef)
+	if err != nil {
+		return "", err
+	}
+	return revParse(inlineRemoteRef), nil
+}
+
+// flush commits the objects stored in this session to the inline ref,
+// merged with the ref on the git remote, and pushes it. Objects stored by
+// earlier sessions whose push failed are pushed too.
+func (s *inlineStore) flush() error {
+	if s == nil {
+		return nil
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	local := revParse(inlineRef)
+	if len(s.added) == 0 && (local == "" || local == revParse(inlineRemoteRef)) {
+		return nil
+	}
+
+	unlock, err := lockFile(filepath.Join(s.dir, "inline"), true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	for attempt := 1; ; attempt++ {
+		err := s.push()
+		if err == nil || attempt >= inlinePushTries {
+			return err
+		}
+		log.Println("Retrying push of inline objects", err)
+	}
+}
+
+func (s *inlineStore) push() error {
+	remote, err := s.fetch()
+	if err != nil {
+		return fmt.Errorf("fetching inline objects: %s", err)
+	}
+	local := revParse(inlineRef)
+
+	// Build the merged tree in a separate index, leaving the user's alone.
+	indexPath := filepath.Join(s.dir, "inline-index")
+	os.Remove(indexPath)
+	defer os.Remove(indexPath)
+	env := []string{"GIT_INDEX_FILE=" + indexPath}
+
+	if remote != "" {
+		_, err = inlineGit(env, nil, "read-tree", remote)
+	} else {
+		_, err = inlineGit(env, nil, "read-tree", "--empty")
+	}
+	if err != nil {
+		return err
+	}
+	var entries bytes.Buffer
+	if local != "" {
+		tree, err := inlineGit(nil, nil, "ls-tree", "-r", local)
+		if err != nil {
+			return err
+		}
+		if tree != "" {
+			entries.WriteString(tree + "\n")
+		}
+	}
+	for _, e := range s.added {
+		entries.WriteString(e)
+	}
+	if _, err := inlineGit(env, &entries, "update-index", "--index-info"); err != nil {
+		return err
+	}
+	tree, err := inlineGit(env, nil, "write-tree")
+	if err != nil {
+		return err
+	}
+
+	args := []string{"commit-tree", tree, "-m", "Add inline objects"}
+	if remote != "" {
+		args = append(args, "-p", remote)
+	}
+	if local != "" && local != remote {
+		args = append(args, "-p", local)
+	}
+	// The commit's author doesn't matter, and may not be configured.
+	env = append(env,
+		"GIT_AUTHOR_NAME=tanker", "GIT_AUTHOR_EMAIL=tanker@localhost",
+		"GIT_COMMITTER_NAME=tanker", "GIT_COMMITTER_EMAIL=tanker@localhost")
+	commit, err := inlineGit(env, nil, args...)
+	if err != nil {
+		return err
+	}
+	if _, err := inlineGit(nil, nil, "update-ref", inlineRef, commit); err != nil {
+		return err
+	}
+	// The objects are in the local ref now, and are pushed by later
+	// sessions if this push fails.
+	s.added = nil
+
+	// Skip the pre-push hook, which would run git-lfs on the inline ref.
+	_, err = inlineGit(nil, nil, "push", "--no-verify", "--quiet", s.remote, commit+":"+inlineRef)
+	if err != nil {
+		return fmt.Errorf("pushing inline objects: %s", err)
+	}
+	if _, err := inlineGit(nil, nil, "update-ref", inlineRemoteRef, commit); err != nil {
+		return err
+	}
+	log.Println("Pushed inline objects", commit)
+	return nil
+}
+
+// revParse returns the commit of a ref, or an empty string if it doesn't exist.
+func revParse(ref string) string {
+	out, err := exec.Command("git", "rev-parse", "--verify", "--quiet", ref).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// inlineGit runs a git command with extra environment variables and stdin,
+// and returns its trimmed output.
+func inlineGit(env []string, stdin io.Reader, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdin = stdin
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %s: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
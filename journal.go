@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// journalEntry records a single completed transfer in the journal.
+//
+// The journal is an append-only file of JSON lines, one entry per line,
+// stored at ".git/tanker/journal".
+type journalEntry struct {
+	Time time.Time
+	// "upload", "download", "replicate", or "repair"
+	Op   string
+	Oid  string
+	URL  string
+	Size int64
+	// Version of the object in storage, if the storage system is versioned,
+	// e.g. a Google Cloud Storage generation number.
+	Version string `json:",omitempty"`
+	// Time spent transferring the object, used to estimate the duration
+	// of future transfers. See transferPlan.
+	Duration time.Duration `json:",omitempty"`
+	// Base URL of the secondary remote a "replicate" entry copied the
+	// object to, or a "repair" entry failed to. See ReplicationConfig.
+	Replica string `json:",omitempty"`
+	// Why the copy of a "repair" entry failed.
+	Error string `json:",omitempty"`
+}
+
+// appendJournal appends an entry to the journal file at "path".
+func appendJournal(path string, e journalEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("marshaling journal entry: %s", err)
+	}
+
+	unlock, err := lockFile(path, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	fh, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("opening journal: %s", err)
+	}
+	defer fh.Close()
+
+	_, err = fh.Write(append(b, '\n'))
+	if err != nil {
+		return fmt.Errorf("writing journal: %s", err)
+	}
+	return fh.Close()
+}
+
+// readJournal reads all entries from the journal file at "path".
+// A missing journal is not an error; it has no entries.
+func readJournal(path string) ([]journalEntry, error) {
+	unlock, err := lockFile(path, false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	fh, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("opening journal: %s", err)
+	}
+	defer fh.Close()
+
+	var entries []journalEntry
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		var e journalEntry
+		err := json.Unmarshal(scanner.Bytes(), &e)
+		if err != nil {
+			// Skip corrupt lines, e.g. from a partial write.
+			continue
+		}
+		entries = append(entries, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading journal: %s", err)
+	}
+	return entries, nil
+}
+
+// pinnedVersion returns the version recorded by the most recent upload
+// of the given OID, or an empty string if there is none.
+func pinnedVersion(path, oid string) (string, error) {
+	entries, err := readJournal(path)
+	if err != nil {
+		return "", err
+	}
+
+	var version string
+	for _, e := range entries {
+		if e.Op == "upload" && e.Oid == oid && e.Version != "" {
+			version = e.Version
+		}
+	}
+	return version, nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// sessionEnv is the environment variable which names the transfer session
+// of the agents started by git-lfs, e.g. for "tanker pull".
+const sessionEnv = "TANKER_SESSION"
+
+// ledger records the objects completed in a transfer session, which may
+// span several runs of the transfer agent, e.g. when git-lfs restarts it
+// between batches or a wrapper retries a failed pull. Objects in the ledger
+// are skipped when requested again, without checking remote storage.
+//
+// The ledger is a file of "<op> <oid>" lines in ".git/tanker/sessions".
+// A nil *ledger is valid, and has no objects.
+type ledger struct {
+	path string
+	mtx  sync.Mutex
+	done map[string]bool
+}
+
+// openLedger reads the ledger at "path", which may not exist yet.
+func openLedger(path string) (*ledger, error) {
+	l := &ledger{path: path, done: map[string]bool{}}
+	fh, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("opening session ledger: %s", err)
+	}
+	defer fh.Close()
+
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		l.done[scanner.Text()] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading session ledger: %s", err)
+	}
+	return l, nil
+}
+
+// completed returns true if the ledger has the object.
+func (l *ledger) completed(op, oid string) bool {
+	if l == nil {
+		return false
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.done[op+" "+oid]
+}
+
+// record adds the object to the ledger. The ledger only saves work,
+// so errors are logged and ignored.
+func (l *ledger) record(op, oid string) {
+	if l == nil {
+		return
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	line := op + " " + oid
+	l.done[line] = true
+
+	// Agents run concurrently by git-lfs share the ledger.
+	unlock, err := lockFile(l.path, true)
+	if err != nil {
+		errorln("Error writing session ledger", err)
+		return
+	}
+	defer unlock()
+
+	fh, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		errorln("Error writing session ledger", err)
+		return
+	}
+	defer fh.Close()
+	if _, err := fh.WriteString(line + "\n"); err != nil {
+		errorln("Error writing session ledger", err)
+	}
+}
+
+// sessionLedger opens the ledger of the session named by TANKER_SESSION
+// in "dir", or returns nil if there's no session.
+func sessionLedger(dir string) *ledger {
+	session := os.Getenv(sessionEnv)
+	if session == "" || dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		errorln("Error creating sessions dir", err)
+		return nil
+	}
+	l, err := openLedger(filepath.Join(dir, filepath.Base(session)))
+	if err != nil {
+		errorln(err)
+		return nil
+	}
+	return l
+}
+
+// pull runs "git lfs pull" for the given paths in a transfer session,
+// retrying up to "retries" times. The session is resumed by each retry,
+// and by the next pull if all of them fail, so objects which completed
+// aren't transferred again. Progress is shown by "ui", if not nil.
+func pull(t *Tanker, paths []string, retries int, ui *progressUI) error {
+	dir := t.Paths.Sessions
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("creating sessions dir: %s", err)
+	}
+
+	// Resume the session of an unfinished pull, if any.
+	current := filepath.Join(dir, "pull")
+	session := ""
+	if b, err := ioutil.ReadFile(current); err == nil {
+		session = strings.TrimSpace(string(b))
+		log.Println("Resuming pull session", session)
+	} else {
+		session, err = newSessionID()
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(current, []byte(session+"\n"), 0644); err != nil {
+			return fmt.Errorf("writing session: %s", err)
+		}
+	}
+
+	args := []string{"lfs", "pull"}
+	if len(paths) > 0 {
+		args = append(args, "--include", strings.Join(paths, ","))
+	}
+
+	var err error
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			fmt.Fprintf(os.Stderr, "tanker: pull failed, resuming (retry %d of %d)\n", attempt, retries)
+		}
+		cmd := exec.Command("git", args...)
+		cmd.Env = append(os.Environ(), sessionEnv+"="+session)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if ui != nil {
+			err = runWithProgress(cmd, ui, filepath.Join(dir, session+".progress"))
+		} else {
+			err = cmd.Run()
+		}
+		if err == nil {
+			os.Remove(filepath.Join(dir, session))
+			os.Remove(filepath.Join(dir, session) + ".lock")
+			os.Remove(current)
+			return nil
+		}
+	}
+	return withExitCode(exitPartial, userErrorf("git lfs pull failed: %s: run \"tanker pull\" again to resume", err))
+}
+
+// runWithProgress runs a git-lfs command, showing the progress git-lfs
+// writes to the file at "path" in the UI instead of git-lfs' own progress
+// meter. Its stderr is only printed if it fails.
+func runWithProgress(cmd *exec.Cmd, ui *progressUI, path string) error {
+	os.Remove(path)
+	defer os.Remove(path)
+
+	var stderr bytes.Buffer
+	cmd.Env = append(cmd.Env, "GIT_LFS_PROGRESS="+path)
+	cmd.Stdout = ui
+	cmd.Stderr = &stderr
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		followLFSProgress(ui, path, stop)
+		close(done)
+	}()
+	err := cmd.Run()
+	close(stop)
+	<-done
+	ui.close()
+
+	if err != nil {
+		os.Stderr.Write(stderr.Bytes())
+	}
+	return err
+}
+
+// newSessionID returns a random session ID.
+func newSessionID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generating session ID: %s", err)
+	}
+	return fmt.Sprintf("%x", b), nil
+}
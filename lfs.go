@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buchanae/tanker/storage"
+)
+
+// lfsFile describes a file tracked by git-lfs, as reported by "git lfs ls-files".
+type lfsFile struct {
+	Oid  string
+	Path string
+	// Present is true if the object content is available in the local LFS store.
+	Present bool
+}
+
+// lfsObjectPath returns the path to the object in git-lfs' local object store.
+func lfsObjectPath(gitDir, oid string) string {
+	return filepath.Join(gitDir, "lfs", "objects", oid[:2], oid[2:4], oid)
+}
+
+// lsFiles lists the files tracked by git-lfs in the current checkout.
+// Optional arguments are passed through to "git lfs ls-files",
+// e.g. "--include" patterns or a ref.
+func lsFiles(args ...string) ([]lfsFile, error) {
+	args = append([]string{"lfs", "ls-files", "--long"}, args...)
+	cmd := exec.Command("git", args...)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("listing git-lfs files: %s", err)
+	}
+
+	var files []lfsFile
+	for _, line := range strings.Split(string(out), "\n") {
+		// Each line looks like "<oid> <*|-> <path>", where "*" means the
+		// object is present locally and "-" means only the pointer is.
+		parts := strings.SplitN(line, " ", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		files = append(files, lfsFile{
+			Oid:     parts[0],
+			Present: parts[1] == "*",
+			Path:    parts[2],
+		})
+	}
+	return files, nil
+}
+
+// lsFileSizes returns the sizes of the objects of the files tracked by
+// git-lfs, by OID, from their pointers. Arguments are passed through to
+// "git lfs ls-files", as for lsFiles.
+func lsFileSizes(args ...string) (map[string]int64, error) {
+	args = append([]string{"lfs", "ls-files", "--json"}, args...)
+	out, err := exec.Command("git", args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("listing git-lfs files: %s", err)
+	}
+
+	var listing struct {
+		Files []struct {
+			Oid  string
+			Size int64
+		}
+	}
+	if err := json.Unmarshal(out, &listing); err != nil {
+		return nil, fmt.Errorf("parsing git-lfs files: %s", err)
+	}
+	sizes := map[string]int64{}
+	for _, f := range listing.Files {
+		sizes[f.Oid] = f.Size
+	}
+	return sizes, nil
+}
+
+// gitCommandTimeout limits each git command run to configure a repo, so
+// that one waiting on something, e.g. a locked config file, can't hang.
+const gitCommandTimeout = 30 * time.Second
+
+// configureLFS installs git-lfs in the repo, and configures it to use
+// tanker as its transfer agent, for the given base URL. If a setting fails,
+// the settings already changed are restored. The returned func restores
+// them too, e.g. if the caller fails to write the tanker config afterwards.
+func configureLFS(ctx context.Context, url string) (rollback func(), err error) {
+	if _, err := runGit(ctx, "lfs", "install", "--local"); err != nil {
+		return nil, fmt.Errorf("configuring git-lfs: %s", err)
+	}
+
+	out, err := runGit(ctx, "config", "--local", "--list")
+	if err != nil {
+		return nil, fmt.Errorf("configuring git-lfs: %s", err)
+	}
+	prev := map[string]string{}
+	for _, line := range strings.Split(out, "\n") {
+		if parts := strings.SplitN(line, "=", 2); len(parts) == 2 {
+			prev[parts[0]] = parts[1]
+		}
+	}
+
+	var applied []string
+	rollback = func() {
+		// Ctrl-C may have canceled "ctx", but the settings
+		// should still be restored.
+		ctx := context.Background()
+		for i := len(applied) - 1; i >= 0; i-- {
+			key := applied[i]
+			var err error
+			if v, ok := prev[key]; ok {
+				_, err = runGit(ctx, "config", "--local", key, v)
+			} else {
+				_, err = runGit(ctx, "config", "--local", "--unset", key)
+			}
+			if err != nil {
+				errorln("Error restoring git config", key, err)
+			}
+		}
+	}
+
+	for _, kv := range [][2]string{
+		{"lfs.standalonetransferagent", "tanker"},
+		{"lfs.customtransfer.tanker.path", "tanker"},
+		{"lfs.customtransfer.tanker.args", "transfer"},
+		{"lfs.url", url},
+	} {
+		key := kv[0]
+		if _, err := runGit(ctx, "config", "--local", key, kv[1]); err != nil {
+			rollback()
+			return nil, fmt.Errorf("configuring git-lfs: %s", err)
+		}
+		applied = append(applied, key)
+	}
+	return rollback, nil
+}
+
+// runGit runs a git command, limited to gitCommandTimeout, and returns its
+// stdout. Errors include git's stderr.
+func runGit(ctx context.Context, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, gitCommandTimeout)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+
+	name := "git " + strings.Join(args, " ")
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		return "", fmt.Errorf("%s timed out after %s", name, gitCommandTimeout)
+	case ctx.Err() != nil:
+		return "", fmt.Errorf("%s: %s", name, ctx.Err())
+	case err != nil:
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%s: %s: %s", name, err, msg)
+		}
+		return "", fmt.Errorf("%s: %s", name, err)
+	}
+	return string(out), nil
+}
+
+// lfsEnv returns the settings reported by "git lfs env", e.g. "LocalMediaDir".
+func lfsEnv() (map[string]string, error) {
+	out, err := exec.Command("git", "lfs", "env").Output()
+	if err != nil {
+		return nil, fmt.Errorf("running git lfs env: %s", err)
+	}
+
+	env := map[string]string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		env[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return env, nil
+}
+
+// lfsTempDir returns git-lfs' temp directory, which is on the same
+// filesystem as its local object store.
+func lfsTempDir() (string, error) {
+	env, err := lfsEnv()
+	if err != nil {
+		return "", err
+	}
+	dir := env["TempDir"]
+	if dir == "" {
+		if media := env["LocalMediaDir"]; media != "" {
+			dir = filepath.Join(filepath.Dir(media), "tmp")
+		}
+	}
+	if dir == "" {
+		return "", fmt.Errorf("git lfs env didn't report a temp directory")
+	}
+	return dir, nil
+}
+
+// lfsPointerMaxSize is the size above which a blob can't be an LFS pointer.
+const lfsPointerMaxSize = 1024
+
+// gitBlob is a file's content in git, e.g. a staged file.
+type gitBlob struct {
+	Path, Sha string
+	Size      int64
+	// LFS is set if the blob is an LFS pointer, in which case
+	// Oid and Size are those of the LFS object.
+	LFS bool
+	Oid string
+}
+
+// readPointers sets the size of each blob, and reads the ones which are
+// LFS pointers. All the sizes are read first, then only the small blobs,
+// which may be pointers, are read in full.
+func readPointers(blobs []*gitBlob) error {
+	var small []*gitBlob
+	err := catFile("--batch-check", blobs, func(b *gitBlob, size int64, r *bufio.Reader) error {
+		b.Size = size
+		if size <= lfsPointerMaxSize {
+			small = append(small, b)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return catFile("--batch", small, func(b *gitBlob, size int64, r *bufio.Reader) error {
+		content := make([]byte, size+1)
+		if _, err := io.ReadFull(r, content); err != nil {
+			return err
+		}
+		if oid, lfsSize, ok := parsePointer(content); ok {
+			b.Oid = oid
+			b.Size = lfsSize
+			b.LFS = true
+		}
+		return nil
+	})
+}
+
+// catFile runs "git cat-file" with the given batch flag for the blobs,
+// calling "fn" with the size of each. For "--batch", "fn" must read the
+// blob's content and the newline which follows it from "r".
+func catFile(flag string, blobs []*gitBlob, fn func(b *gitBlob, size int64, r *bufio.Reader) error) error {
+	if len(blobs) == 0 {
+		return nil
+	}
+	var input bytes.Buffer
+	for _, b := range blobs {
+		input.WriteString(b.Sha + "\n")
+	}
+	cmd := exec.Command("git", "cat-file", flag)
+	cmd.Stdin = &input
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("running git cat-file: %s", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("running git cat-file: %s", err)
+	}
+	defer cmd.Wait()
+
+	r := bufio.NewReader(stdout)
+	for _, b := range blobs {
+		// Each header is "<sha> <type> <size>".
+		header, err := r.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("reading git cat-file output: %s", err)
+		}
+		parts := strings.Fields(header)
+		if len(parts) != 3 {
+			return fmt.Errorf("reading git cat-file output: unexpected header %q", header)
+		}
+		size, _ := strconv.ParseInt(parts[2], 10, 64)
+		if err := fn(b, size, r); err != nil {
+			return fmt.Errorf("reading git cat-file output: %s", err)
+		}
+	}
+	return nil
+}
+
+// parsePointer returns the OID and size recorded in an LFS pointer file,
+// and false if the content isn't an LFS pointer.
+func parsePointer(content []byte) (oid string, size int64, ok bool) {
+	if !bytes.HasPrefix(content, []byte("version https://git-lfs.github.com/spec/")) {
+		return "", 0, false
+	}
+	var err error
+	for _, line := range strings.Split(string(content), "\n") {
+		switch {
+		case strings.HasPrefix(line, "oid "):
+			oid, _ = storage.OIDFromPointer(strings.TrimPrefix(line, "oid "))
+		case strings.HasPrefix(line, "size "):
+			size, err = strconv.ParseInt(strings.TrimPrefix(line, "size "), 10, 64)
+		}
+	}
+	return oid, size, isOID(oid) && err == nil
+}
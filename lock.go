@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// Tanker processes can run concurrently, e.g. a transfer agent started by
+// an IDE's git integration alongside one started from a terminal, so state
+// files are guarded by advisory locks on a "<file>.lock" file next to them.
+// Locks are released when the process exits, so a crashed process can't
+// leave a file locked.
+
+// lockTimeout is how long to wait for another process to release a lock.
+const lockTimeout = 30 * time.Second
+
+// lockRetryInterval is how often a held lock is retried.
+const lockRetryInterval = 50 * time.Millisecond
+
+// lockFile locks the file at "path", waiting up to lockTimeout for other
+// processes to release it. Shared locks may be held by several processes
+// at once, e.g. to read a file, while an exclusive lock excludes all others.
+// The returned function releases the lock.
+func lockFile(path string, exclusive bool) (func(), error) {
+	return lockFileWait(path, exclusive, lockTimeout)
+}
+
+// lockFileWait is lockFile, waiting up to "wait" for the lock.
+// Zero means the lock is only tried once.
+func lockFileWait(path string, exclusive bool, wait time.Duration) (func(), error) {
+	fh, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("opening lock file: %s", err)
+	}
+
+	deadline := time.Now().Add(wait)
+	for {
+		ok, err := tryLock(fh, exclusive)
+		if err != nil {
+			fh.Close()
+			return nil, fmt.Errorf("locking %s: %s", path, err)
+		}
+		if ok {
+			break
+		}
+		if !time.Now().Before(deadline) {
+			fh.Close()
+			return nil, fmt.Errorf("timed out after %s waiting for the lock on %s, "+
+				"which another tanker process is holding", wait, path)
+		}
+		time.Sleep(lockRetryInterval)
+	}
+
+	return func() {
+		unlock(fh)
+		fh.Close()
+	}, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/buchanae/tanker/storage"
+)
+
+// logOptions configures where tanker writes its logs, and how much.
+// See the global --log-* flags.
+type logOptions struct {
+	// Path of the log file. Empty means the repo's log file,
+	// or stderr when running outside a repo.
+	File string
+	// One of "debug", "info", "error", or "off".
+	Level string
+	// Log to stderr, even inside a repo.
+	Stderr bool
+}
+
+// logOpts holds the global --log-* flags.
+var logOpts logOptions
+
+// logLevels orders the log levels by verbosity.
+var logLevels = map[string]int{
+	"debug": 0,
+	"info":  1,
+	"error": 2,
+	"off":   3,
+}
+
+// Logs are written to stderr until setupLogging is called.
+// Nothing is ever logged to stdout, which the transfer agent uses
+// to talk to git-lfs.
+var (
+	debugLog = log.New(ioutil.Discard, "", log.LstdFlags)
+	errorLog = log.New(os.Stderr, "", log.LstdFlags)
+)
+
+// debugln logs at the "debug" level.
+// Messages logged with the standard "log" package are at the "info" level.
+func debugln(v ...interface{}) {
+	debugLog.Println(v...)
+}
+
+// errorln logs at the "error" level.
+func errorln(v ...interface{}) {
+	errorLog.Println(v...)
+}
+
+// setupLogging directs logs according to the given options. "repoFile" is
+// the repo's log file, or empty outside a repo. The opened log file, if any,
+// is returned and should be closed by the caller.
+func setupLogging(opts logOptions, repoFile string) (*os.File, error) {
+	level, ok := logLevels[opts.Level]
+	if !ok {
+		return nil, fmt.Errorf("invalid log level %q: must be debug, info, error, or off", opts.Level)
+	}
+
+	path := opts.File
+	if path == "" {
+		path = repoFile
+	}
+
+	var out io.Writer = os.Stderr
+	var fh *os.File
+	if !opts.Stderr && path != "" {
+		err := storage.EnsurePath(path)
+		if err != nil {
+			return nil, fmt.Errorf("initializing logging file: %s", err)
+		}
+		fh, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("opening logging file: %s", err)
+		}
+		out = fh
+	}
+
+	atLevel := func(l int) io.Writer {
+		if level <= l {
+			return out
+		}
+		return ioutil.Discard
+	}
+	debugLog.SetOutput(atLevel(logLevels["debug"]))
+	log.SetOutput(atLevel(logLevels["info"]))
+	errorLog.SetOutput(atLevel(logLevels["error"]))
+	return fh, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/buchanae/tanker/storage"
+)
+
+// listRemote prints the objects under "dir", a path relative to the
+// base URL. Unless "recursive" is set, only the immediate children are
+// printed, and deeper objects are grouped into directories.
+func listRemote(ctx context.Context, conf Config, dir string, recursive bool) error {
+	store, err := newStorage(conf)
+	if err != nil {
+		return err
+	}
+
+	url := conf.BaseURL
+	if dir = strings.Trim(dir, "/"); dir != "" {
+		url, err = store.Join(url, dir)
+		if err != nil {
+			return fmt.Errorf("joining url: %s", err)
+		}
+	}
+
+	objs, err := store.List(ctx, url, storage.ListOptions{Recursive: recursive})
+	if err != nil {
+		return fmt.Errorf("listing %s: %s", url, err)
+	}
+
+	// Directories first, then objects, each sorted by name.
+	sort.Slice(objs, func(i, j int) bool {
+		if objs[i].Dir != objs[j].Dir {
+			return objs[i].Dir
+		}
+		return objs[i].Name < objs[j].Name
+	})
+
+	base := strings.TrimSuffix(url, "/") + "/"
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, obj := range objs {
+		rel := strings.TrimPrefix(obj.URL, base)
+		if obj.Dir {
+			fmt.Fprintf(w, "\t\t%s\n", rel)
+			continue
+		}
+		if obj.Link != "" {
+			rel += " -> " + obj.Link
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", formatBytes(obj.Size),
+			obj.LastModified.Local().Format(time.RFC3339), rel)
+	}
+	return w.Flush()
+}
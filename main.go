@@ -1,17 +1,22 @@
 package main
 
 import (
+	"context"
   "crypto/sha256"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
   "strings"
 	"syscall"
+	"time"
 
+	"github.com/alecthomas/units"
   "github.com/spf13/cobra"
+  "github.com/buchanae/tanker/buildinfo"
   "github.com/buchanae/tanker/storage"
 	"github.com/hpcloud/tail"
 )
@@ -23,12 +28,17 @@ import (
 type Tanker struct {
   // Holds paths to commonly used files.
   Paths struct {
-    Repo, Git, Tanker, Logs, Data, Config string
+    Repo, Git, Tanker, Logs, Data, Config, Journal, Packs, Index, Sessions, Status string
   }
   Config Config
   LogFile *os.File
 }
 
+// InRepo returns true if tanker is running inside a git repository.
+func (t *Tanker) InRepo() bool {
+	return t.Paths.Repo != ""
+}
+
 func (t *Tanker) Close() error {
 	if t.LogFile != nil {
 		t.LogFile.Close()
@@ -36,13 +46,31 @@ func (t *Tanker) Close() error {
   return nil
 }
 
-func NewTanker() (*Tanker, error) {
+// repoMode declares whether a command must run inside a git repository.
+type repoMode int
+
+const (
+	requireRepo repoMode = iota
+	// Outside a repo, the tanker paths are empty, and the config
+	// is the default config.
+	optionalRepo
+)
+
+// errNotInRepo is returned by NewTanker when a command which requires
+// a repo is run outside one.
+var errNotInRepo = userErrorf("not in a git repository: run this command inside a git repository")
+
+// NewTanker finds the repo, loads the config, and initializes logging.
+func NewTanker(mode repoMode) (*Tanker, error) {
   repodir, err := findRepoRoot()
+	if err == errNotInRepo && mode == optionalRepo {
+		repodir, err = "", nil
+	}
   if err != nil {
 		return nil, err
   }
 
-  tanker := &Tanker{}
+  tanker := &Tanker{Config: DefaultConfig()}
 
 	if repodir != "" {
 		tanker.Paths.Repo = repodir
@@ -51,51 +79,110 @@ func NewTanker() (*Tanker, error) {
 		tanker.Paths.Logs = filepath.Join(tanker.Paths.Tanker, "logs")
 		tanker.Paths.Data = filepath.Join(tanker.Paths.Tanker, "data")
 		tanker.Paths.Config = filepath.Join(tanker.Paths.Tanker, "config.yml")
-
-		// Initialize logging to a file.
-		err = storage.EnsurePath(tanker.Paths.Logs)
-		if err != nil {
-			return nil, fmt.Errorf("initializing logging file: %s", err)
-		}
-		logfh, err := os.OpenFile(tanker.Paths.Logs, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-		if err != nil {
-			return nil, fmt.Errorf("opening logging file: %s", err)
-		}
-		tanker.LogFile = logfh
-		log.SetOutput(logfh)
+		tanker.Paths.Journal = filepath.Join(tanker.Paths.Tanker, "journal")
+		tanker.Paths.Packs = filepath.Join(tanker.Paths.Tanker, "packs")
+		tanker.Paths.Index = filepath.Join(tanker.Paths.Tanker, "index.db")
+		tanker.Paths.Sessions = filepath.Join(tanker.Paths.Tanker, "sessions")
+		tanker.Paths.Status = filepath.Join(tanker.Paths.Tanker, "status.json")
 
 		// Initialize a directory for writing tanker data during download.
 		err = storage.EnsureDir(tanker.Paths.Data)
 		if err != nil {
-			return nil, fmt.Errorf("initializing data directory: %s", err)
+			return nil, userErrorf("initializing data directory: %s", err)
 		}
 
-		tanker.Config = DefaultConfig()
-
 		// Ensure the config file exists.
 		if _, err := os.Open(tanker.Paths.Config); os.IsNotExist(err) {
 			err := WriteConfigFile(tanker.Config, tanker.Paths.Config)
 			if err != nil {
-				return nil, fmt.Errorf("writing default config file: %s", err)
+				return nil, withExitCode(exitConfig, userErrorf("writing default config file: %s", err))
 			}
 		}
 
 		// Load a tanker config file.
 		err = ParseConfigFile(tanker.Paths.Config, &tanker.Config)
 		if err != nil {
-			return nil, fmt.Errorf("parsing config: %s", err)
+			return nil, withExitCode(exitConfig, userErrorf("parsing config: %s", err))
 		}
 	}
 
+	// Initialize logging, to the repo's log file by default.
+	if logOpts.File != "" {
+		tanker.Paths.Logs = logOpts.File
+	}
+	logfh, err := setupLogging(logOpts, tanker.Paths.Logs)
+	if err != nil {
+		return nil, err
+	}
+	tanker.LogFile = logfh
+	warnDeprecated(tanker.Config)
+
+	setLanguage(tanker.Config.Language)
+
+	usage.mtx.Lock()
+	usage.scheme = storage.Scheme(tanker.Config.BaseURL)
+	usage.mtx.Unlock()
+
   return tanker, nil
 }
 
+// newStorage creates a storage client for the configured base URL.
+// Requests are rate limited, and failed operations are retried,
+// according to the storage config.
+func newStorage(conf Config) (storage.Storage, error) {
+	if conf.BaseURL == "" {
+		return nil, withExitCode(exitConfig, userErrorf("config BaseURL is required"))
+	}
+	store, err := storage.NewStorage(conf.BaseURL, conf.Storage)
+	if err != nil {
+		return nil, err
+	}
+	store, err = wrapStorage(conf, store)
+	if err != nil {
+		return nil, err
+	}
+	// Rate limit inside the retrier, so that retries are limited too.
+	limited := storage.NewRateLimiter(store, conf.Storage.RateLimit)
+	return storage.NewRetrier(limited, conf.Storage.RetryFor(conf.BaseURL)), nil
+}
+
+// wrapStorage wraps a backend with the external transfer commands and the
+// namespace of the config. The namespace wraps the commands, so that they
+// transfer objects at the URLs in the namespace.
+func wrapStorage(conf Config, store storage.Storage) (storage.Storage, error) {
+	for _, ext := range conf.Storage.External {
+		if ext.Scheme == storage.Scheme(conf.BaseURL) {
+			store = storage.NewExternalTransfer(store, ext)
+			break
+		}
+	}
+	prefix, err := namespacePrefix(conf.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	if prefix != "" {
+		store, err = storage.NewNamespace(store, conf.BaseURL, prefix)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return store, nil
+}
+
 func main() {
+	storage.UserAgent = "tanker/" + buildinfo.Version
 
   rootCmd := &cobra.Command{
     Use: "tanker",
     SilenceUsage: true,
   }
+	// Errors are printed by main, translated and with remediation hints.
+	rootCmd.SilenceErrors = true
+	rootCmd.Long = "tanker stores git-lfs objects in cloud storage.\n\n" + exitCodesHelp
+	rootCmd.PersistentFlags().StringVar(&logOpts.File, "log-file", "", "write logs to this file (default .git/tanker/logs, or stderr outside a repo)")
+	rootCmd.PersistentFlags().StringVar(&logOpts.Level, "log-level", "info", "log level: debug, info, error, or off")
+	rootCmd.PersistentFlags().BoolVar(&logOpts.Stderr, "log-stderr", false, "write logs to stderr instead of a file")
+	rootCmd.PersistentFlags().BoolVarP(&progressQuiet, "quiet", "q", false, "don't show progress bars")
 
   initCmd := &cobra.Command{
     Use: "init <base url>",
@@ -104,151 +191,117 @@ func main() {
 			url := args[0]
 
 			if len(url) == 0 {
-				return fmt.Errorf("empty URL")
-			}
-
-			if url == "swift://" {
-				return fmt.Errorf("invalid URL: a bucket name is required")
-			}
-
-			if !strings.HasPrefix(url, "swift://") {
-				return fmt.Errorf("invalid URL: tanker currently only supports swift://")
+				return userErrorf("empty URL")
 			}
 
-      tanker, err := NewTanker()
+      tanker, err := NewTanker(requireRepo)
       if err != nil {
         return err
       }
       defer tanker.Close()
 
-      cmd := exec.Command("git", "lfs", "install", "--local")
-      err = cmd.Run()
-      if err != nil {
-        return fmt.Errorf("configuring git-lfs: %s", err)
-      }
-
-
-      cmd = exec.Command("git", "config", "lfs.standalonetransferagent", "tanker")
-      err = cmd.Run()
-      if err != nil {
-        return fmt.Errorf("configuring git-lfs: %s", err)
-      }
-
-      cmd = exec.Command("git", "config", "lfs.customtransfer.tanker.path", "tanker")
-      err = cmd.Run()
-      if err != nil {
-        return fmt.Errorf("configuring git-lfs: %s", err)
-      }
-
-      cmd = exec.Command("git", "config", "lfs.customtransfer.tanker.args", "transfer")
-      err = cmd.Run()
-      if err != nil {
-        return fmt.Errorf("configuring git-lfs: %s", err)
-      }
+			err = storage.ValidateURL(url, tanker.Config.Storage)
+			if err != nil {
+				return err
+			}
 
-			cmd = exec.Command("git", "config", "lfs.url", url)
-			err = cmd.Run()
+			// Ctrl-C stops the git commands, and restores the settings
+			// already changed.
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			rollback, err := configureLFS(ctx, url)
 			if err != nil {
-				return fmt.Errorf("configuring git-lfs: %s", err)
+				return err
 			}
 
 			// TODO just derive from lfs.url
 			tanker.Config.BaseURL = url
 			err = WriteConfigFile(tanker.Config, tanker.Paths.Config)
 			if err != nil {
-				return fmt.Errorf("writing config file: %s", err)
+				rollback()
+				return userErrorf("writing config file: %s", err)
 			}
 
       return nil
     },
   }
 
+	var traceProtocol string
   transferCmd := &cobra.Command{
     Use: "transfer",
     RunE: func(cmd *cobra.Command, args []string) error {
 
-      tanker, err := NewTanker()
-      if err != nil {
-        return err
-      }
-      defer tanker.Close()
-
-      return transfer(tanker.Config, tanker.Paths.Data)
-    },
-  }
-
-  includeCmd := &cobra.Command{
-		Use: "include",
-		RunE: func(_ *cobra.Command, args []string) error {
-      tanker, err := NewTanker()
+      tanker, err := NewTanker(requireRepo)
       if err != nil {
         return err
       }
       defer tanker.Close()
 
-      if len(args) == 0 {
-        return fmt.Errorf("missing file list")
-      }
-
-      cmd := exec.Command("git", "config", "--get", "lfs.fetchinclude")
-      out, err := cmd.Output()
-			code := getExitCode(err)
-			// exit code 1 means the config doesn't exist, which is ok in this case.
-			// so we need special handling for that code here.
-      if code == 1 {
-        err = nil
-      }
-      if err != nil {
-				return fmt.Errorf("getting lfs.fetchinclude config: %s", err)
-			}
-      sout := string(out)
-      sout = strings.TrimSpace(sout)
-
-      uniq := map[string]bool{}
-
-      existingList := strings.Split(sout, ",")
-      for _, key := range existingList {
-        if key != "" {
-          uniq[key] = true
+      dataDir := tanker.Paths.Data
+      if tanker.Config.DownloadToLFSDir {
+        dataDir, err = lfsTempDir()
+        if err == nil {
+          err = storage.EnsureDir(dataDir)
         }
-      }
-
-      for _, key := range args {
-        if key != "" {
-          uniq[key] = true
+        if err != nil {
+          log.Println("Falling back to downloading into", tanker.Paths.Data, err)
+          dataDir = tanker.Paths.Data
         }
       }
 
-      var keys []string
-      for key, _ := range uniq {
-        keys = append(keys, key)
-      }
+      warnUpstreamDrift(tanker.Config)
+      return transfer(tanker.Config, dataDir, tanker.Paths.Journal, tanker.Paths.Packs, tanker.Paths.Index, tanker.Paths.Sessions, tanker.Paths.Status, traceProtocol)
+    },
+  }
+	transferCmd.Flags().StringVar(&traceProtocol, "trace-protocol", "", "mirror every message exchanged with git-lfs to this file, with secrets redacted, e.g. for bug reports")
 
-      list := strings.Join(keys, ",")
+	var includeRemoveExcludes, includeYes bool
+	includeCmd := &cobra.Command{
+		Use:   "include <pattern>...",
+		Short: "Fetch the LFS files matching the patterns, now and on future pulls",
+		Long: `Add the patterns to lfs.fetchinclude and pull the matching files. If
+lfs.fetchexclude patterns keep some of the files from being fetched, they're
+reported, and --remove-excludes removes them. The effective fetch set is
+printed afterwards. A plan of the download is printed first, and large
+downloads must be confirmed. See Plan.ConfirmSize.`,
+		RunE: func(_ *cobra.Command, args []string) error {
+			tanker, err := NewTanker(requireRepo)
+			if err != nil {
+				return err
+			}
+			defer tanker.Close()
 
-      cmd = exec.Command("git", "config", "lfs.fetchinclude", list)
-      err = cmd.Run()
-      if err != nil {
-        return fmt.Errorf("setting lfs.fetchinclude config: %s", err)
-      }
+			if len(args) == 0 {
+				return userErrorf("missing file list")
+			}
 
-      cmd = exec.Command("git", "lfs", "pull", "--include", strings.Join(args, ","))
-      cmd.Stdout = os.Stdout
-      cmd.Stderr = os.Stderr
-      err = cmd.Run()
-      if err != nil {
-        return err
-      }
+			var excludes []string
+			if !includeRemoveExcludes {
+				excludes, err = fetchPatterns("lfs.fetchexclude")
+				if err != nil {
+					return err
+				}
+			}
+			plan, err := pullPlan(args, excludes)
+			if err != nil {
+				return err
+			}
+			err = confirmPlan(tanker.Config, tanker.Paths.Journal, plan, includeYes, os.Stdin, os.Stdout)
+			if err != nil {
+				return err
+			}
 
-      return nil
+			return include(args, includeRemoveExcludes, os.Stdout)
 		},
 	}
+	includeCmd.Flags().BoolVar(&includeRemoveExcludes, "remove-excludes", false, "remove lfs.fetchexclude patterns which exclude the included files")
+	includeCmd.Flags().BoolVarP(&includeYes, "yes", "y", false, "don't ask to confirm large downloads")
 
   logsCmd := &cobra.Command{
     Use: "logs",
     RunE: func(cmd *cobra.Command, args []string) error {
 
-      tanker, err := NewTanker()
+      tanker, err := NewTanker(requireRepo)
       if err != nil {
         return err
       }
@@ -265,19 +318,22 @@ func main() {
     },
   }
 
+	var versionVerbose, versionJSON bool
   versionCmd := &cobra.Command{
     Use: "version",
-    Run: func(cmd *cobra.Command, args []string) {
-      fmt.Println(VersionString())
+    RunE: func(cmd *cobra.Command, args []string) error {
+      return printVersion(os.Stdout, versionVerbose, versionJSON)
     },
   }
+	versionCmd.Flags().BoolVarP(&versionVerbose, "verbose", "v", false, "also print the Go version, OS/arch, storage backends, and SDK versions")
+	versionCmd.Flags().BoolVar(&versionJSON, "json", false, "print all the details as JSON")
 
   clearCmd := &cobra.Command{
     Use: "clear",
     Args: cobra.ExactArgs(1),
     RunE: func(_ *cobra.Command, args []string) error {
 
-      tanker, err := NewTanker()
+      tanker, err := NewTanker(requireRepo)
       if err != nil {
         return err
       }
@@ -295,9 +351,7 @@ func main() {
 				return err
 			}
 			hex := fmt.Sprintf("%x", hash.Sum(nil))
-			first2 := hex[:2]
-			next2 := hex[2:4]
-			abspath := filepath.Join(tanker.Paths.Git, "lfs", "objects", first2, next2, hex)
+			abspath := lfsObjectPath(tanker.Paths.Git, hex)
 			e, err := exists(abspath)
 			if err != nil {
 				return err
@@ -315,24 +369,1068 @@ func main() {
     },
   }
 
-  rootCmd.AddCommand(initCmd)
-  rootCmd.AddCommand(transferCmd)
-  rootCmd.AddCommand(logsCmd)
-  rootCmd.AddCommand(includeCmd)
-  rootCmd.AddCommand(versionCmd)
-  rootCmd.AddCommand(clearCmd)
-  if err := rootCmd.Execute(); err != nil {
-    os.Exit(1)
-  }
+	exportCmd := &cobra.Command{
+		Use:   "export <output.tar> [paths...]",
+		Short: "Package LFS objects into a bundle for offline transfer",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(_ *cobra.Command, args []string) error {
+			tanker, err := NewTanker(requireRepo)
+			if err != nil {
+				return err
+			}
+			defer tanker.Close()
+
+			var lsArgs []string
+			if len(args) > 1 {
+				lsArgs = append(lsArgs, "--include", strings.Join(args[1:], ","))
+			}
+			files, err := lsFiles(lsArgs...)
+			if err != nil {
+				return err
+			}
+			if len(files) == 0 {
+				return userErrorf("no LFS files matched")
+			}
+
+			return exportBundle(tanker.Paths.Git, args[0], files)
+		},
+	}
+
+	importCmd := &cobra.Command{
+		Use:   "import <bundle>",
+		Short: "Upload the objects in a bundle to remote storage",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(_ *cobra.Command, args []string) error {
+			tanker, err := NewTanker(requireRepo)
+			if err != nil {
+				return err
+			}
+			defer tanker.Close()
+
+			return importBundle(context.Background(), tanker.Config, tanker.Paths.Data, args[0])
+		},
+	}
+
+	archiveCmd := &cobra.Command{
+		Use:   "archive <out dir>",
+		Short: "Archive the repo and all its LFS objects to a directory",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(_ *cobra.Command, args []string) error {
+			tanker, err := NewTanker(requireRepo)
+			if err != nil {
+				return err
+			}
+			defer tanker.Close()
+
+			return archive(context.Background(), tanker, args[0])
+		},
+	}
+
+	restoreCmd := &cobra.Command{
+		Use:   "restore <archive dir>",
+		Short: "Upload the LFS objects in an archive to remote storage",
+		Long: `Upload the LFS objects in an archive to remote storage.
+
+To recreate a repo from an archive, clone its bundle, configure the new remote
+with "tanker init", then run "tanker restore" from inside the clone:
+
+  git clone <archive dir>/repo.bundle repo
+  cd repo
+  tanker init <base url>
+  tanker restore <archive dir>`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(_ *cobra.Command, args []string) error {
+			tanker, err := NewTanker(requireRepo)
+			if err != nil {
+				return err
+			}
+			defer tanker.Close()
+
+			return restore(context.Background(), tanker.Config, args[0])
+		},
+	}
+
+	rmCmd := &cobra.Command{
+		Use:   "rm <oid or path>...",
+		Short: "Move objects in remote storage to the trash",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(_ *cobra.Command, args []string) error {
+			tanker, err := NewTanker(requireRepo)
+			if err != nil {
+				return err
+			}
+			defer tanker.Close()
+
+			oids, err := resolveOids(args)
+			if err != nil {
+				return err
+			}
+			store, err := newStorage(tanker.Config)
+			if err != nil {
+				return err
+			}
+			return trashObjects(context.Background(), store, tanker.Config.BaseURL, oids)
+		},
+	}
+
+	sidecarCmd := &cobra.Command{
+		Use:   "sidecar",
+		Short: "Manage files derived from objects, e.g. indexes, stored next to them",
+	}
+
+	sidecarGetCmd := &cobra.Command{
+		Use:   "get <suffix> <oid or path>...",
+		Short: "Download sidecar files",
+		Long: `Download the sidecar files with the given suffix, e.g. "bai", of objects.
+
+Sidecars are generated on upload by the generators in Sidecars.Generators in
+the config. A file's sidecar is written next to it, e.g. "reads.bam.bai" for
+"reads.bam", and an OID's to "<oid>.<suffix>" in the current directory.`,
+		Args: cobra.MinimumNArgs(2),
+		RunE: func(_ *cobra.Command, args []string) error {
+			tanker, err := NewTanker(requireRepo)
+			if err != nil {
+				return err
+			}
+			defer tanker.Close()
+
+			return getSidecars(context.Background(), tanker, args[0], args[1:])
+		},
+	}
+	sidecarCmd.AddCommand(sidecarGetCmd)
+
+	trashCmd := &cobra.Command{
+		Use:   "trash",
+		Short: "Manage objects in the remote trash",
+	}
+
+	trashListCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List objects in the remote trash",
+		Args:  cobra.NoArgs,
+		RunE: func(_ *cobra.Command, args []string) error {
+			tanker, err := NewTanker(requireRepo)
+			if err != nil {
+				return err
+			}
+			defer tanker.Close()
+
+			store, err := newStorage(tanker.Config)
+			if err != nil {
+				return err
+			}
+			entries, err := listTrash(context.Background(), store, tanker.Config.BaseURL)
+			if err != nil {
+				return err
+			}
+			for _, e := range entries {
+				fmt.Printf("%s  %s  %d\n", e.Date.Format(trashDateFormat), e.Oid, e.Size)
+			}
+			return nil
+		},
+	}
+
+	var trashOlderThan string
+	trashEmptyCmd := &cobra.Command{
+		Use:   "empty",
+		Short: "Permanently delete objects from the remote trash",
+		Args:  cobra.NoArgs,
+		RunE: func(_ *cobra.Command, args []string) error {
+			age, err := parseAge(trashOlderThan)
+			if err != nil {
+				return err
+			}
+
+			tanker, err := NewTanker(requireRepo)
+			if err != nil {
+				return err
+			}
+			defer tanker.Close()
+
+			store, err := newStorage(tanker.Config)
+			if err != nil {
+				return err
+			}
+			return emptyTrash(context.Background(), store, tanker.Config.BaseURL, age)
+		},
+	}
+	trashEmptyCmd.Flags().StringVar(&trashOlderThan, "older-than", "30d", "only delete objects trashed longer ago than this, e.g. 30d or 12h")
+
+	trashRestoreCmd := &cobra.Command{
+		Use:   "restore <oid or path>...",
+		Short: "Move objects from the remote trash back to their original location",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(_ *cobra.Command, args []string) error {
+			tanker, err := NewTanker(requireRepo)
+			if err != nil {
+				return err
+			}
+			defer tanker.Close()
+
+			oids, err := resolveOids(args)
+			if err != nil {
+				return err
+			}
+			store, err := newStorage(tanker.Config)
+			if err != nil {
+				return err
+			}
+			return restoreTrash(context.Background(), store, tanker.Config.BaseURL, oids)
+		},
+	}
+
+	trashCmd.AddCommand(trashListCmd)
+	trashCmd.AddCommand(trashEmptyCmd)
+	trashCmd.AddCommand(trashRestoreCmd)
+
+	var verifyWorkers int
+	var verifySample, verifyBudget string
+	verifyCmd := &cobra.Command{
+		Use:   "verify",
+		Short: "Check the integrity of objects in remote storage",
+		Args:  cobra.NoArgs,
+		RunE: func(_ *cobra.Command, args []string) error {
+			sample, err := parseSample(verifySample)
+			if err != nil {
+				return err
+			}
+
+			var budget int64
+			if verifyBudget != "" {
+				budget, err = units.ParseStrictBytes(verifyBudget)
+				if err != nil {
+					return userErrorf("invalid budget %q: %s", verifyBudget, err)
+				}
+			}
+
+			tanker, err := NewTanker(requireRepo)
+			if err != nil {
+				return err
+			}
+			defer tanker.Close()
+
+			index := loadIndex(tanker.Paths.Index, tanker.Config.Namespace)
+			defer index.Close()
+
+			return verify(context.Background(), tanker.Config, index, verifyOptions{
+				Sample:  sample,
+				Budget:  budget,
+				Workers: verifyWorkers,
+			})
+		},
+	}
+	verifyCmd.Flags().StringVar(&verifySample, "sample", "5%", "fraction of objects to download and hash, e.g. 5% or 0.05")
+	verifyCmd.Flags().StringVar(&verifyBudget, "budget", "", "maximum bytes to download for sampled objects, e.g. 10GB")
+	verifyCmd.Flags().IntVar(&verifyWorkers, "workers", 4, "number of objects to verify concurrently")
+
+	doctorCmd := &cobra.Command{
+		Use:   "doctor",
+		Short: "Check the tanker setup and which storage operations are supported",
+		Args:  cobra.NoArgs,
+		RunE: func(_ *cobra.Command, args []string) error {
+			tanker, err := NewTanker(requireRepo)
+			if err != nil {
+				return err
+			}
+			defer tanker.Close()
+
+			return doctor(context.Background(), tanker)
+		},
+	}
+
+	loginCmd := &cobra.Command{
+		Use:   "login <protocol>",
+		Short: "Sign in to a storage backend which acts as a user, e.g. gdrive or dropbox",
+		Long: `Sign in to a storage backend which acts as a user, e.g. gdrive or dropbox.
+The token is cached in the user's config dir, and shared by all repos,
+so this can run outside a repo.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(_ *cobra.Command, args []string) error {
+			tanker, err := NewTanker(optionalRepo)
+			if err != nil {
+				return err
+			}
+			defer tanker.Close()
+
+			scheme := strings.TrimSuffix(args[0], "://")
+			return storage.Login(context.Background(), scheme, tanker.Config.Storage, os.Stdin, os.Stdout)
+		},
+	}
+
+	restoreRequestCmd := &cobra.Command{
+		Use:   "restore-request [oid or path]...",
+		Short: "Start restoring archived objects, so they can be downloaded",
+		Long: `Start restoring the objects of the given OIDs or LFS files from an archive
+tier, e.g. Azure's Archive tier, so they can be downloaded once the restore
+finishes, which can take hours. With no arguments, the objects of every LFS
+file in the checkout which hasn't been downloaded are restored.
+
+Downloads of archived objects fail with an error explaining this, unless
+Restore.Wait is set in the config, in which case they request the restore
+themselves and wait for it.`,
+		RunE: func(_ *cobra.Command, args []string) error {
+			tanker, err := NewTanker(requireRepo)
+			if err != nil {
+				return err
+			}
+			defer tanker.Close()
+
+			var oids []string
+			if len(args) > 0 {
+				oids, err = resolveOids(args)
+			} else {
+				oids, err = unpresentOids()
+			}
+			if err != nil {
+				return err
+			}
+			return requestRestores(context.Background(), tanker.Config, oids, os.Stdout)
+		},
+	}
+
+	indexCmd := &cobra.Command{
+		Use:   "index",
+		Short: "Manage the local index of objects in remote storage",
+		Long: `Manage the local index of objects in remote storage, stored in
+".git/tanker/index.db". The index is updated whenever tanker transfers or
+verifies an object. With Index.SkipKnownUploads set in the config, uploads
+of objects which the index shows are already in remote storage are skipped.
+With Index.Shared.Enabled set, pushes also use and update a shared index
+kept in remote storage, which "tanker index compact" maintains.`,
+	}
+
+	indexRefreshCmd := &cobra.Command{
+		Use:   "refresh",
+		Short: "Rebuild the index from a full listing of remote storage",
+		Args:  cobra.NoArgs,
+		RunE: func(_ *cobra.Command, args []string) error {
+			tanker, err := NewTanker(requireRepo)
+			if err != nil {
+				return err
+			}
+			defer tanker.Close()
+
+			n, err := refreshIndex(context.Background(), tanker.Config, tanker.Paths.Index)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("indexed %d objects\n", n)
+			return nil
+		},
+	}
+	indexCmd.AddCommand(indexRefreshCmd)
+
+	var indexRelist bool
+	indexCompactCmd := &cobra.Command{
+		Use:   "compact",
+		Short: "Merge the updates of the shared index in remote storage",
+		Long: `Merge the updates pushes made to the shared index of remote objects, which
+is enabled by Index.Shared.Enabled, into one file, so that pushes download
+it in one request. With --relist, the shared index is rebuilt from a full
+listing of remote storage instead, e.g. after objects were deleted.`,
+		Args: cobra.NoArgs,
+		RunE: func(_ *cobra.Command, args []string) error {
+			tanker, err := NewTanker(requireRepo)
+			if err != nil {
+				return err
+			}
+			defer tanker.Close()
+
+			if indexRelist {
+				return writeSharedIndex(context.Background(), tanker.Config, os.Stdout)
+			}
+			store, err := newStorage(tanker.Config)
+			if err != nil {
+				return err
+			}
+			n, err := compactSharedIndex(context.Background(), store, tanker.Config.BaseURL)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("shared index lists %d objects\n", n)
+			return nil
+		},
+	}
+	indexCompactCmd.Flags().BoolVar(&indexRelist, "relist", false, "rebuild the shared index from a full listing")
+	indexCmd.AddCommand(indexCompactCmd)
+
+	hooksCmd := &cobra.Command{
+		Use:   "hooks",
+		Short: "Manage git hooks which guard against committing huge files",
+	}
+
+	var hooksForce bool
+	hooksInstallCmd := &cobra.Command{
+		Use:   "install",
+		Short: "Install a pre-commit hook which warns about huge staged files",
+		Long: `Install a pre-commit hook which warns when a staged LFS file is larger than
+Hooks.MaxSize, or a staged file which isn't tracked by LFS is larger than
+Hooks.MaxUntrackedSize. With Hooks.Block set in the config, such commits
+fail instead. "git commit --no-verify" skips the hook.`,
+		Args: cobra.NoArgs,
+		RunE: func(_ *cobra.Command, args []string) error {
+			tanker, err := NewTanker(requireRepo)
+			if err != nil {
+				return err
+			}
+			defer tanker.Close()
+
+			return installHooks(hooksForce)
+		},
+	}
+	hooksInstallCmd.Flags().BoolVar(&hooksForce, "force", false, "replace an existing pre-commit hook")
+
+	hooksPreCommitCmd := &cobra.Command{
+		Use:    "pre-commit",
+		Short:  "Check staged files, as the pre-commit hook",
+		Hidden: true,
+		Args:   cobra.NoArgs,
+		RunE: func(_ *cobra.Command, args []string) error {
+			tanker, err := NewTanker(requireRepo)
+			if err != nil {
+				return err
+			}
+			defer tanker.Close()
+
+			return preCommit(tanker.Config.Hooks, os.Stderr)
+		},
+	}
+	hooksCmd.AddCommand(hooksInstallCmd)
+	hooksCmd.AddCommand(hooksPreCommitCmd)
+
+	var lsRecursive bool
+	lsCmd := &cobra.Command{
+		Use:   "ls [path]",
+		Short: "List remote storage under the base URL, one directory at a time",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(_ *cobra.Command, args []string) error {
+			tanker, err := NewTanker(requireRepo)
+			if err != nil {
+				return err
+			}
+			defer tanker.Close()
+
+			var dir string
+			if len(args) > 0 {
+				dir = args[0]
+			}
+			return listRemote(context.Background(), tanker.Config, dir, lsRecursive)
+		},
+	}
+	lsCmd.Flags().BoolVarP(&lsRecursive, "recursive", "r", false, "list every object, not just the immediate children")
+
+	var duJSON bool
+	var duTop int
+	duCmd := &cobra.Command{
+		Use:   "du",
+		Short: "Report remote storage usage, by prefix, file type, and largest objects",
+		Args:  cobra.NoArgs,
+		RunE: func(_ *cobra.Command, args []string) error {
+			tanker, err := NewTanker(requireRepo)
+			if err != nil {
+				return err
+			}
+			defer tanker.Close()
+
+			report, err := du(context.Background(), tanker.Config, duTop)
+			if err != nil {
+				return err
+			}
+			return report.print(duJSON)
+		},
+	}
+	duCmd.Flags().BoolVar(&duJSON, "json", false, "print the report as JSON")
+	duCmd.Flags().IntVar(&duTop, "top", 10, "number of largest objects to report")
+
+	ciCmd := &cobra.Command{
+		Use:   "ci",
+		Short: "Helpers for running tanker in CI jobs",
+	}
+
+	var ciSummaryPath string
+	ciSetupCmd := &cobra.Command{
+		Use:   "setup",
+		Short: "Configure tanker non-interactively from environment variables",
+		Long: `Configure tanker and git-lfs in the repo non-interactively, for CI jobs.
+The base URL is read from TANKER_BASE_URL, if it isn't in the config file
+already, and TANKER_CONFIG may hold YAML which is merged over the config file,
+e.g. storage settings.
+
+Prints the directories worth caching between runs, with an example for
+GitHub Actions or GitLab CI when running in one. On GitHub Actions, they're
+also set as the "tanker-cache-paths" step output.`,
+		Args: cobra.NoArgs,
+		RunE: func(_ *cobra.Command, args []string) error {
+			tanker, err := NewTanker(requireRepo)
+			if err != nil {
+				return err
+			}
+			defer tanker.Close()
+
+			return ciSetup(tanker, ciSummaryPath, os.Stdout)
+		},
+	}
+	ciSetupCmd.Flags().StringVar(&ciSummaryPath, "summary", "", "write a JSON summary of the setup to this file, e.g. as a CI artifact")
+	ciCmd.AddCommand(ciSetupCmd)
+
+	telemetryCmd := &cobra.Command{
+		Use:   "telemetry on|off|status",
+		Short: "Turn anonymous usage statistics on or off",
+		Long: `Turn anonymous usage statistics on or off, for all repos. Telemetry is off
+unless turned on. When on, each command reports the tanker version, OS,
+command name, storage scheme, object count and size buckets, and error kind
+to the endpoint, with a random installation ID. URLs, paths, OIDs, and error
+messages are never reported. DO_NOT_TRACK=1 or TANKER_TELEMETRY=off turn it
+off regardless of this setting.`,
+	}
+
+	var telemetryEndpoint string
+	telemetryOnCmd := &cobra.Command{
+		Use:   "on",
+		Short: "Turn telemetry on",
+		Args:  cobra.NoArgs,
+		RunE: func(_ *cobra.Command, args []string) error {
+			return setTelemetry(true, telemetryEndpoint, os.Stdout)
+		},
+	}
+	telemetryOnCmd.Flags().StringVar(&telemetryEndpoint, "endpoint", "", "URL which events are POSTed to as JSON")
+
+	telemetryOffCmd := &cobra.Command{
+		Use:   "off",
+		Short: "Turn telemetry off",
+		Args:  cobra.NoArgs,
+		RunE: func(_ *cobra.Command, args []string) error {
+			return setTelemetry(false, "", os.Stdout)
+		},
+	}
+
+	telemetryStatusCmd := &cobra.Command{
+		Use:   "status",
+		Short: "Show whether telemetry is on, and what it reports",
+		Args:  cobra.NoArgs,
+		RunE: func(_ *cobra.Command, args []string) error {
+			return telemetryStatus(os.Stdout)
+		},
+	}
+	telemetryCmd.AddCommand(telemetryOnCmd)
+	telemetryCmd.AddCommand(telemetryOffCmd)
+	telemetryCmd.AddCommand(telemetryStatusCmd)
+
+	var watchQuiet, watchInterval time.Duration
+	watchCmd := &cobra.Command{
+		Use:   "watch <dir>",
+		Short: "Commit and push new and changed files in a directory as they appear",
+		Long: `Watch a directory for new and changed files, e.g. written by an instrument,
+and commit and push them once the directory has been quiet for Watch.Quiet,
+and every Watch.Interval if set. Files of Watch.LFSMinSize or larger are
+tracked with LFS first. Removed files are left in the repo. Runs until
+interrupted.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			tanker, err := NewTanker(requireRepo)
+			if err != nil {
+				return err
+			}
+			defer tanker.Close()
+
+			conf := tanker.Config.Watch
+			if cmd.Flags().Changed("quiet") {
+				conf.Quiet = storage.Duration(watchQuiet)
+			}
+			if cmd.Flags().Changed("interval") {
+				conf.Interval = storage.Duration(watchInterval)
+			}
+			return watch(context.Background(), tanker, args[0], conf, os.Stdout)
+		},
+	}
+	watchCmd.Flags().DurationVar(&watchQuiet, "quiet", 0, "commit once no files have changed for this long (default Watch.Quiet)")
+	watchCmd.Flags().DurationVar(&watchInterval, "interval", 0, "also commit this often while files keep changing (default Watch.Interval)")
+
+	var syncInterval time.Duration
+	var syncOnlyOnce bool
+	syncCmd := &cobra.Command{
+		Use:   "sync",
+		Short: "Periodically pull the included files and push local commits",
+		Long: `Periodically pull new commits and the objects of the files included with
+"tanker include", and push local commits and their objects, e.g. to keep a
+dataset repo on a shared analysis server up to date. Runs every
+Sync.Interval until stopped, e.g. by a systemd service. Syncs don't overlap:
+a sync started while another is running is skipped. The status of the last
+sync is written to .git/tanker/sync.json, and shown by "tanker sync status".`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			tanker, err := NewTanker(requireRepo)
+			if err != nil {
+				return err
+			}
+			defer tanker.Close()
+
+			conf := tanker.Config.Sync
+			if cmd.Flags().Changed("interval") {
+				conf.Interval = storage.Duration(syncInterval)
+			}
+			return syncLoop(tanker, conf, syncOnlyOnce, os.Stdout)
+		},
+	}
+	syncCmd.Flags().DurationVar(&syncInterval, "interval", 0, "time between syncs (default Sync.Interval)")
+	syncCmd.Flags().BoolVar(&syncOnlyOnce, "once", false, "sync once and exit, e.g. from cron")
+
+	syncStatusCmd := &cobra.Command{
+		Use:   "status",
+		Short: "Show the status of the last sync",
+		Args:  cobra.NoArgs,
+		RunE: func(_ *cobra.Command, args []string) error {
+			tanker, err := NewTanker(requireRepo)
+			if err != nil {
+				return err
+			}
+			defer tanker.Close()
+
+			return printSyncStatus(tanker, os.Stdout)
+		},
+	}
+	syncCmd.AddCommand(syncStatusCmd)
+
+	namespaceCmd := &cobra.Command{
+		Use:   "namespace",
+		Short: "Show the namespace objects are stored in",
+		Long: `Show the namespace objects are stored in. With Namespace.Template set in the
+config, e.g. to "branches/{branch}", objects are stored under a prefix of
+the base URL for each branch or environment, so that experimental branches
+don't pollute the production object namespace.`,
+		Args: cobra.NoArgs,
+		RunE: func(_ *cobra.Command, args []string) error {
+			tanker, err := NewTanker(requireRepo)
+			if err != nil {
+				return err
+			}
+			defer tanker.Close()
+
+			return printNamespace(tanker.Config, os.Stdout)
+		},
+	}
+
+	var namespaceDryRun bool
+	namespaceMergeCmd := &cobra.Command{
+		Use:   "merge [namespace]",
+		Short: "Move the objects of a namespace to the base URL",
+		Long: `Move the objects of a namespace to the base URL, e.g. once the branch they
+were pushed from is merged to production. The namespace is a prefix such as
+"branches/dev", and defaults to the current one. Objects which are already
+at the base URL are deleted from the namespace.`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(_ *cobra.Command, args []string) error {
+			tanker, err := NewTanker(requireRepo)
+			if err != nil {
+				return err
+			}
+			defer tanker.Close()
+
+			var prefix string
+			if len(args) > 0 {
+				prefix = strings.Trim(args[0], "/")
+			} else {
+				prefix, err = namespacePrefix(tanker.Config.Namespace)
+				if err != nil {
+					return err
+				}
+			}
+			if prefix == "" {
+				return userErrorf("no namespace to merge")
+			}
+			return mergeNamespace(context.Background(), tanker.Config, prefix, namespaceDryRun, os.Stdout)
+		},
+	}
+	namespaceMergeCmd.Flags().BoolVar(&namespaceDryRun, "dry-run", false, "print what would be moved without moving anything")
+	namespaceCmd.AddCommand(namespaceMergeCmd)
+
+	historyCmd := &cobra.Command{
+		Use:   "history",
+		Short: "Inspect the journal of transfers",
+	}
+
+	var historyFormat, historyOut, historySince string
+	historyExportCmd := &cobra.Command{
+		Use:   "export",
+		Short: "Export the journal of transfers as audit records",
+		Long: `Export the journal of the transfers made from this clone, for ingesting
+into a data warehouse. Each record has the time, operation, OID, URL, size,
+version, and duration of a transfer. The formats are csv, json (one object
+per line), and parquet.`,
+		Args: cobra.NoArgs,
+		RunE: func(_ *cobra.Command, args []string) error {
+			since, err := parseSince(historySince)
+			if err != nil {
+				return err
+			}
+			tanker, err := NewTanker(requireRepo)
+			if err != nil {
+				return err
+			}
+			defer tanker.Close()
+
+			out := io.Writer(os.Stdout)
+			if historyOut != "" {
+				fh, err := os.Create(historyOut)
+				if err != nil {
+					return fmt.Errorf("creating output file: %s", err)
+				}
+				defer fh.Close()
+				out = fh
+			}
+			return exportHistory(tanker, historyFormat, since, out)
+		},
+	}
+	historyExportCmd.Flags().StringVar(&historyFormat, "format", "csv", "export format: csv, json, or parquet")
+	historyExportCmd.Flags().StringVarP(&historyOut, "output", "o", "", "write the export to a file instead of stdout")
+	historyExportCmd.Flags().StringVar(&historySince, "since", "", "only export transfers since this date, time, or age, e.g. 2024-01-31 or 30d")
+	historyCmd.AddCommand(historyExportCmd)
+
+	replicateCmd := &cobra.Command{
+		Use:   "replicate",
+		Short: "Copy uploaded objects to the secondary remotes",
+		Long: `Copy the objects uploaded from this clone which are missing from the
+secondary remotes in Replication.URLs. Pushes start this in the background
+once their uploads complete, so it rarely needs to be run by hand, except
+to retry objects which failed.`,
+		Args: cobra.NoArgs,
+		RunE: func(_ *cobra.Command, args []string) error {
+			tanker, err := NewTanker(requireRepo)
+			if err != nil {
+				return err
+			}
+			defer tanker.Close()
+
+			return replicate(context.Background(), tanker, os.Stdout)
+		},
+	}
+
+	var checkUpstreamFix bool
+	checkUpstreamCmd := &cobra.Command{
+		Use:   "check-upstream",
+		Short: "Check that lfs.url and the config's BaseURL agree",
+		Long: `Compare lfs.url in the git config with BaseURL in the tanker config, which
+"tanker init" sets to the same URL, but which drift when either is edited.
+BaseURL is authoritative: transfers always use it, and warn when lfs.url
+disagrees. --fix sets lfs.url to BaseURL, or BaseURL to lfs.url if BaseURL
+isn't set.`,
+		Args: cobra.NoArgs,
+		RunE: func(_ *cobra.Command, args []string) error {
+			tanker, err := NewTanker(requireRepo)
+			if err != nil {
+				return err
+			}
+			defer tanker.Close()
+
+			return checkUpstream(tanker, checkUpstreamFix, os.Stdout)
+		},
+	}
+	checkUpstreamCmd.Flags().BoolVar(&checkUpstreamFix, "fix", false, "reconcile lfs.url and BaseURL")
+
+	repairCmd := &cobra.Command{
+		Use:   "repair",
+		Short: "Copy objects missing from the secondary remotes again",
+		Long: `Check that every object uploaded from this clone is in each secondary
+remote in Replication.URLs, and copy the ones which are missing, including
+ones which the journal records as copied, and ones which failed to copy
+during a push with Replication.Policy set to "optional".`,
+		Args: cobra.NoArgs,
+		RunE: func(_ *cobra.Command, args []string) error {
+			tanker, err := NewTanker(requireRepo)
+			if err != nil {
+				return err
+			}
+			defer tanker.Close()
+
+			return repair(context.Background(), tanker, os.Stdout)
+		},
+	}
+
+	replicationCmd := &cobra.Command{
+		Use:   "replication",
+		Short: "Inspect replication to the secondary remotes",
+	}
+
+	replicationStatusCmd := &cobra.Command{
+		Use:   "status",
+		Short: "Show the objects waiting to be replicated, and the replication lag",
+		Args:  cobra.NoArgs,
+		RunE: func(_ *cobra.Command, args []string) error {
+			tanker, err := NewTanker(requireRepo)
+			if err != nil {
+				return err
+			}
+			defer tanker.Close()
+
+			return printReplicationStatus(tanker.Config, tanker.Paths.Journal, os.Stdout)
+		},
+	}
+	replicationCmd.AddCommand(replicationStatusCmd)
+
+	var pullRetries int
+	var pullYes bool
+	pullCmd := &cobra.Command{
+		Use:   "pull [paths...]",
+		Short: "Run git lfs pull, resuming where an interrupted pull stopped",
+		Long: `Run "git lfs pull" for the given paths, or all LFS files, retrying it when
+it fails. Objects transferred are recorded in a session ledger, so retries,
+and the next "tanker pull" if every retry fails, skip them without checking
+remote storage again. A plan of the download is printed first, and large
+downloads must be confirmed. See Plan.ConfirmSize.`,
+		RunE: func(_ *cobra.Command, args []string) error {
+			tanker, err := NewTanker(requireRepo)
+			if err != nil {
+				return err
+			}
+			defer tanker.Close()
+
+			// Without paths, git-lfs pulls the files included by the config.
+			includes := args
+			if len(includes) == 0 {
+				includes, err = fetchPatterns("lfs.fetchinclude")
+				if err != nil {
+					return err
+				}
+			}
+			excludes, err := fetchPatterns("lfs.fetchexclude")
+			if err != nil {
+				return err
+			}
+			plan, err := pullPlan(includes, excludes)
+			if err != nil {
+				return err
+			}
+			err = confirmPlan(tanker.Config, tanker.Paths.Journal, plan, pullYes, os.Stdin, os.Stdout)
+			if err != nil {
+				return err
+			}
+
+			return pull(tanker, args, pullRetries, newProgressUI(os.Stdout))
+		},
+	}
+	pullCmd.Flags().IntVar(&pullRetries, "retries", 2, "number of times to retry a failed pull")
+	pullCmd.Flags().BoolVarP(&pullYes, "yes", "y", false, "don't ask to confirm large downloads")
+
+	var warmOpts warmOptions
+	warmCmd := &cobra.Command{
+		Use:   "warm --dataset <path>...",
+		Short: "Fill the machine-wide cache with the objects of a dataset",
+		Long: `Download the objects of the LFS files matching the --dataset paths into the
+machine-wide cache at Cache.Dir, so that pulls on this machine copy them from
+the cache instead of downloading them, e.g. in a nightly job on shared CI
+runners. Objects already in the cache are skipped, so an interrupted run
+resumes where it stopped. A plan of the download is printed first, and large
+downloads must be confirmed. See Plan.ConfirmSize.`,
+		Args: cobra.NoArgs,
+		RunE: func(_ *cobra.Command, args []string) error {
+			if len(warmOpts.Dataset) == 0 {
+				return userErrorf("no dataset: use --dataset to give the paths of its files")
+			}
+
+			tanker, err := NewTanker(requireRepo)
+			if err != nil {
+				return err
+			}
+			defer tanker.Close()
+
+			warmOpts.Journal = tanker.Paths.Journal
+			ui := newProgressUI(os.Stdout)
+			if ui == nil {
+				return warm(context.Background(), tanker.Config, warmOpts, os.Stdout, nil)
+			}
+			return warm(context.Background(), tanker.Config, warmOpts, ui, ui)
+		},
+	}
+	warmCmd.Flags().StringSliceVar(&warmOpts.Dataset, "dataset", nil, "paths of the dataset's LFS files, e.g. data/train/**")
+	warmCmd.Flags().StringVar(&warmOpts.Ref, "ref", "", "warm the files at this ref instead of the checkout")
+	warmCmd.Flags().IntVar(&warmOpts.Workers, "workers", 4, "number of objects to download concurrently")
+	warmCmd.Flags().BoolVarP(&warmOpts.Yes, "yes", "y", false, "don't ask to confirm large downloads")
+
+	var sizesTop int
+	sizesCmd := &cobra.Command{
+		Use:   "sizes",
+		Short: "Report the largest LFS objects across the repo's history",
+		Long: `Walk the history of all refs for LFS pointers, and report the largest
+objects they point to, with the paths they were committed at and the commit
+which introduced each, e.g. to decide what to prune or move to cold storage.`,
+		Args: cobra.NoArgs,
+		RunE: func(_ *cobra.Command, args []string) error {
+			tanker, err := NewTanker(requireRepo)
+			if err != nil {
+				return err
+			}
+			defer tanker.Close()
+
+			return reportSizes(sizesTop, os.Stdout)
+		},
+	}
+	sizesCmd.Flags().IntVar(&sizesTop, "top", 50, "number of largest objects to report, or 0 for all")
+
+	costCmd := &cobra.Command{
+		Use:   "cost [paths...]",
+		Short: "Estimate the monthly storage cost, and the egress cost of pulling files",
+		Long: `Estimate the monthly cost of the remote storage, and the egress cost of
+pulling the LFS files matching the given paths which aren't present locally.
+With no paths, the estimate covers every LFS file in the checkout.
+
+Prices are set by the Pricing section of the config.`,
+		RunE: func(_ *cobra.Command, args []string) error {
+			tanker, err := NewTanker(requireRepo)
+			if err != nil {
+				return err
+			}
+			defer tanker.Close()
+
+			return cost(context.Background(), tanker.Config, args)
+		},
+	}
+
+	var publishFormat, publishOut string
+	var publishLock bool
+	var publishRetain time.Duration
+	publishCmd := &cobra.Command{
+		Use:   "publish [paths...]",
+		Short: "Make files publicly downloadable and write a listing of their URLs",
+		Long: `Make the LFS files matching the given paths publicly readable, uploading
+any which are missing from remote storage, and write a listing which maps
+repo paths to download URLs, for sharing datasets with people who don't
+use git. With no paths, every LFS file in the checkout is published.
+
+With --lock, published objects get a hold which keeps them from being
+deleted or overwritten until "tanker unlock" releases it, and with --retain,
+they are also retained for the given time, e.g. 2160h for 90 days.`,
+		RunE: func(_ *cobra.Command, args []string) error {
+			tanker, err := NewTanker(requireRepo)
+			if err != nil {
+				return err
+			}
+			defer tanker.Close()
+
+			out := io.Writer(os.Stdout)
+			if publishOut != "" {
+				fh, err := os.Create(publishOut)
+				if err != nil {
+					return fmt.Errorf("creating output file: %s", err)
+				}
+				defer fh.Close()
+				out = fh
+			}
+			opts := publishOptions{
+				Format: publishFormat,
+				Lock:   publishLock || publishRetain > 0,
+				Retain: publishRetain,
+			}
+			return publish(context.Background(), tanker, args, opts, out)
+		},
+	}
+	publishCmd.Flags().StringVar(&publishFormat, "format", "csv", "listing format: csv, json, or html")
+	publishCmd.Flags().StringVarP(&publishOut, "output", "o", "", "write the listing to a file instead of stdout")
+	publishCmd.Flags().BoolVar(&publishLock, "lock", false, "keep published objects from being deleted or overwritten")
+	publishCmd.Flags().DurationVar(&publishRetain, "retain", 0, "lock, and retain published objects for this long")
+
+	unlockCmd := &cobra.Command{
+		Use:   "unlock [paths...]",
+		Short: "Release the locks placed by \"publish --lock\"",
+		Long: `Release the locks placed by "tanker publish --lock" on the objects of the LFS
+files matching the given paths, or of every LFS file if no paths are given,
+so that they can be deleted or overwritten again. This usually requires
+admin permissions on the bucket.`,
+		RunE: func(_ *cobra.Command, args []string) error {
+			tanker, err := NewTanker(requireRepo)
+			if err != nil {
+				return err
+			}
+			defer tanker.Close()
+			return unlockPublished(context.Background(), tanker, args, os.Stdout)
+		},
+	}
+
+	var packMaxSize string
+	var packPrune bool
+	packCmd := &cobra.Command{
+		Use:   "pack",
+		Short: "Bundle small objects into packs, to speed up pulling many small files",
+		Long: `Bundle the small objects in the local LFS store which aren't packed yet into
+a new pack, and upload it with an index. Clones with Pack.Enabled set in
+their config download packed objects from packs, which is much faster than
+downloading many tiny objects one by one. Unpacked copies are kept unless
+--prune is given, so clones without packs enabled keep working.`,
+		Args: cobra.NoArgs,
+		RunE: func(_ *cobra.Command, args []string) error {
+			tanker, err := NewTanker(requireRepo)
+			if err != nil {
+				return err
+			}
+			defer tanker.Close()
+
+			maxSize := tanker.Config.Pack.MaxObjectSize
+			if packMaxSize != "" {
+				maxSize, err = units.ParseStrictBytes(packMaxSize)
+				if err != nil {
+					return userErrorf("invalid max size %q: %s", packMaxSize, err)
+				}
+			}
+			return packObjects(context.Background(), tanker, maxSize, packPrune)
+		},
+	}
+	packCmd.Flags().StringVar(&packMaxSize, "max-size", "", "only pack objects up to this size, e.g. 512KB (default from config)")
+	packCmd.Flags().BoolVar(&packPrune, "prune", false, "move unpacked copies of packed objects to the trash")
+
+  rootCmd.AddCommand(initCmd)
+  rootCmd.AddCommand(transferCmd)
+  rootCmd.AddCommand(logsCmd)
+  rootCmd.AddCommand(includeCmd)
+  rootCmd.AddCommand(versionCmd)
+  rootCmd.AddCommand(clearCmd)
+	rootCmd.AddCommand(verifyCmd)
+	rootCmd.AddCommand(exportCmd)
+	rootCmd.AddCommand(importCmd)
+	rootCmd.AddCommand(archiveCmd)
+	rootCmd.AddCommand(restoreCmd)
+	rootCmd.AddCommand(rmCmd)
+	rootCmd.AddCommand(trashCmd)
+	rootCmd.AddCommand(sidecarCmd)
+	rootCmd.AddCommand(doctorCmd)
+	rootCmd.AddCommand(loginCmd)
+	rootCmd.AddCommand(restoreRequestCmd)
+	rootCmd.AddCommand(indexCmd)
+	rootCmd.AddCommand(hooksCmd)
+	rootCmd.AddCommand(lsCmd)
+	rootCmd.AddCommand(duCmd)
+	rootCmd.AddCommand(sizesCmd)
+	rootCmd.AddCommand(ciCmd)
+	rootCmd.AddCommand(warmCmd)
+	rootCmd.AddCommand(pullCmd)
+	rootCmd.AddCommand(telemetryCmd)
+	rootCmd.AddCommand(watchCmd)
+	rootCmd.AddCommand(syncCmd)
+	rootCmd.AddCommand(namespaceCmd)
+	rootCmd.AddCommand(historyCmd)
+	rootCmd.AddCommand(replicateCmd)
+	rootCmd.AddCommand(repairCmd)
+	rootCmd.AddCommand(checkUpstreamCmd)
+	rootCmd.AddCommand(replicationCmd)
+	rootCmd.AddCommand(costCmd)
+	rootCmd.AddCommand(publishCmd)
+	rootCmd.AddCommand(unlockCmd)
+	rootCmd.AddCommand(packCmd)
+	cmd, err := rootCmd.ExecuteC()
+	reportUsage(strings.TrimPrefix(cmd.CommandPath(), "tanker "), err)
+	if err != nil {
+		printError(os.Stderr, err)
+		os.Exit(exitCode(err))
+	}
 }
 
 // findRepoRoot finds the root of the repo.
 func findRepoRoot() (string, error) {
   cmd := exec.Command("git", "rev-parse", "--show-toplevel")
+	// git's messages are translated, and the one below is matched.
+	cmd.Env = append(os.Environ(), "LC_ALL=C")
   out, err := cmd.CombinedOutput()
   if err != nil {
-    if strings.HasPrefix(string(out), "fatal: not a git repository") {
-			return "", fmt.Errorf("not in a git repository")
+    if strings.Contains(string(out), "fatal: not a git repository") {
+			return "", errNotInRepo
 		}
     return "", fmt.Errorf("%s", out)
   }
@@ -0,0 +1,83 @@
+package main
+
+// Spanish translations of user-facing messages. See i18n.go.
+func init() {
+	catalogs["es"] = map[string]string{
+		"Error:": "Error:",
+		"hint:":  "sugerencia:",
+
+		// Command errors.
+		"not in a git repository: run this command inside a git repository": "no está en un repositorio git: ejecute este comando dentro de un repositorio git",
+		"initializing data directory: %s":                                   "no se pudo inicializar el directorio de datos: %s",
+		"writing default config file: %s":                                   "no se pudo escribir el archivo de configuración predeterminado: %s",
+		"parsing config: %s":                                                "no se pudo analizar la configuración: %s",
+		"writing config file: %s":                                           "no se pudo escribir el archivo de configuración: %s",
+		"config BaseURL is required":                                        "la configuración requiere BaseURL",
+		"empty URL":                                                         "URL vacía",
+		"missing file list":                                                 "falta la lista de archivos",
+		"no LFS files matched":                                              "ningún archivo LFS coincide",
+		"no LFS files matched %s":                                           "ningún archivo LFS coincide con %s",
+		"invalid budget %q: %s":                                             "presupuesto no válido %q: %s",
+		"invalid max size %q: %s":                                           "tamaño máximo no válido %q: %s",
+		"no dataset: use --dataset to give the paths of its files":          "no hay conjunto de datos: use --dataset para indicar las rutas de sus archivos",
+		"no cache configured: set Cache.Dir in the config":                  "no hay caché configurada: establezca Cache.Dir en la configuración",
+		"%d of %d objects failed, run again to retry them":                  "fallaron %d de %d objetos, ejecute de nuevo para reintentarlos",
+		"no base URL: set TANKER_BASE_URL":                                  "no hay URL base: establezca TANKER_BASE_URL",
+		"no telemetry endpoint: use --endpoint to set one":                  "no hay endpoint de telemetría: use --endpoint para establecerlo",
+		"git lfs pull failed: %s: run \"tanker pull\" again to resume":      "git lfs pull falló: %s: ejecute \"tanker pull\" de nuevo para continuar",
+		"no secondary remotes: set Replication.URLs in the config":          "no hay remotos secundarios: establezca Replication.URLs en la configuración",
+		"unknown format %q, expected csv, json, or parquet":                 "formato desconocido %q, se esperaba csv, json o parquet",
+		"invalid --since %q, expected a date, a time, or an age, e.g. 30d":  "--since no válido %q, se esperaba una fecha, una hora o una antigüedad, p. ej. 30d",
+		"Namespace.Template uses {env}, but no environment is set: set TANKER_ENV or Namespace.Environment": "Namespace.Template usa {env}, pero no hay un entorno establecido: establezca TANKER_ENV o Namespace.Environment",
+		"Namespace.Template uses {branch}, but no branch is checked out: set TANKER_BRANCH":                 "Namespace.Template usa {branch}, pero no hay una rama activa: establezca TANKER_BRANCH",
+		"opening protocol trace: %s": "no se pudo abrir la traza del protocolo: %s",
+		"no namespace to merge":      "no hay un espacio de nombres para fusionar",
+		"unknown Replication.Policy %q, expected background, required, or optional": "Replication.Policy desconocida %q, se esperaba background, required u optional",
+		"another replicator is running, try again once it's done":                   "otro replicador está en ejecución, inténtelo de nuevo cuando termine",
+		"lfs.url is %q but BaseURL is %q: run \"tanker check-upstream --fix\"":      "lfs.url es %q pero BaseURL es %q: ejecute \"tanker check-upstream --fix\"",
+		"neither lfs.url nor BaseURL is set: run \"tanker init\"":                   "ni lfs.url ni BaseURL están establecidas: ejecute \"tanker init\"",
+		"Sidecars: invalid pattern %q":                                              "Sidecars: patrón no válido %q",
+		"Sidecars: invalid suffix %q for pattern %q":                                "Sidecars: sufijo no válido %q para el patrón %q",
+		"Sidecars: no command for pattern %q":                                       "Sidecars: no hay comando para el patrón %q",
+		"object %s has no %q sidecar":                                               "el objeto %s no tiene un archivo auxiliar %q",
+
+		// Remediation hints, from storage.WithHint.
+		"set OS_AUTH_URL, OS_USERNAME, OS_PASSWORD, OS_PROJECT_NAME, and OS_REGION_NAME, " +
+			"e.g. by sourcing your OpenStack RC file, or set them in Storage.Swift in the config; " +
+			"for public containers, set Storage.Swift.Anonymous and StorageURL instead": "establezca OS_AUTH_URL, OS_USERNAME, OS_PASSWORD, OS_PROJECT_NAME y OS_REGION_NAME, " +
+			"p. ej. cargando su archivo RC de OpenStack, o establézcalas en Storage.Swift en la configuración; " +
+			"para contenedores públicos, establezca Storage.Swift.Anonymous y StorageURL en su lugar",
+		"check that Storage.GoogleCloud isn't disabled in the config":                      "compruebe que Storage.GoogleCloud no esté desactivado en la configuración",
+		"check that Storage.S3 isn't disabled in the config":                               "compruebe que Storage.S3 no esté desactivado en la configuración",
+		"check that Storage.FTP isn't disabled in the config":                              "compruebe que Storage.FTP no esté desactivado en la configuración",
+		"set Storage.IPFS.Gateway in the config, e.g. to https://ipfs.io":                  "establezca Storage.IPFS.Gateway en la configuración, p. ej. a https://ipfs.io",
+		"set GLOBUS_ACCESS_TOKEN, or Storage.Globus.AccessToken in the config":             "establezca GLOBUS_ACCESS_TOKEN, o Storage.Globus.AccessToken en la configuración",
+		"install the iRODS icommands and sign in with \"iinit\"":                           "instale los icommands de iRODS e inicie sesión con \"iinit\"",
+		"set Storage.GoogleDrive.ClientID in the config, then run \"tanker login gdrive\"": "establezca Storage.GoogleDrive.ClientID en la configuración y luego ejecute \"tanker login gdrive\"",
+		"set Storage.Dropbox.AppKey in the config, then run \"tanker login dropbox\"":      "establezca Storage.Dropbox.AppKey en la configuración y luego ejecute \"tanker login dropbox\"",
+		"set AZURE_STORAGE_SAS_TOKEN, or AZURE_TENANT_ID, AZURE_CLIENT_ID, and AZURE_CLIENT_SECRET " +
+			"for a service principal, or set them in Storage.ADLS in the config": "establezca AZURE_STORAGE_SAS_TOKEN, o AZURE_TENANT_ID, AZURE_CLIENT_ID y AZURE_CLIENT_SECRET " +
+			"para una entidad de servicio, o establézcalas en Storage.ADLS en la configuración",
+		"the storage credentials were rejected or have expired: refresh them, " +
+			"e.g. \"gcloud auth application-default login\" for gs://, \"aws sso login\" for s3://, " +
+			"\"tanker login\" for gdrive:// and dropbox://, \"ssh-add\" for sftp://, " +
+			"or by sourcing your OpenStack RC file again for swift://": "las credenciales de almacenamiento fueron rechazadas o han caducado: renuévelas, " +
+			"p. ej. con \"gcloud auth application-default login\" para gs://, \"aws sso login\" para s3://, " +
+			"\"tanker login\" para gdrive:// y dropbox://, \"ssh-add\" para sftp://, o cargando de nuevo su archivo RC de OpenStack para swift://",
+		"the credentials are valid, but lack permission: check that the bucket's " +
+			"access policy lets them read and write objects under the base URL": "las credenciales son válidas, pero no tienen permiso: compruebe que la política de acceso " +
+			"del bucket les permita leer y escribir objetos bajo la URL base",
+		"the storage service was unreachable or overloaded, and retries didn't help: " +
+			"try again later, or allow more retries with Storage.Retry.MaxTries": "el servicio de almacenamiento no estaba disponible o estaba sobrecargado, y los reintentos no bastaron: " +
+			"inténtelo más tarde, o permita más reintentos con Storage.Retry.MaxTries",
+		"check that the bucket in the base URL exists, and that the object was pushed; " +
+			"\"tanker verify\" checks the remote objects": "compruebe que el bucket de la URL base exista y que el objeto se haya subido; " +
+			"\"tanker verify\" comprueba los objetos remotos",
+		"the storage host couldn't be resolved: " +
+			"check the host in the base URL, and your network and proxy settings": "no se pudo resolver el host de almacenamiento: " +
+			"compruebe el host de la URL base y la configuración de red y proxy",
+		"the storage host's TLS certificate isn't trusted: if it's signed by a private CA, " +
+			"add the CA to the system's trusted certificates, or set SSL_CERT_FILE": "el certificado TLS del host de almacenamiento no es de confianza: si está firmado por una CA privada, " +
+			"añada la CA a los certificados de confianza del sistema, o establezca SSL_CERT_FILE",
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/buchanae/tanker/storage"
+)
+
+// MirrorConfig configures downloading large objects from mirrors
+// of the base URL.
+type MirrorConfig struct {
+	// Other base URLs which host copies of the same objects, e.g. replicas
+	// in other regions. Large objects are downloaded in stripes, i.e. byte
+	// ranges, fetched from the base URL and the mirrors concurrently.
+	// Mirrors may use a different storage backend than the base URL, but
+	// it must support range requests.
+	URLs []string
+	// Objects smaller than this are downloaded from the base URL only.
+	MinSize int64
+	// Size of each stripe, in bytes.
+	StripeSize int64
+}
+
+// mirrorSource is a base URL from which stripes are downloaded.
+type mirrorSource struct {
+	baseURL string
+	store   storage.Storage
+	ranges  storage.RangeGetter
+}
+
+// stripedDownloader downloads objects in stripes from several sources
+// concurrently. A source which fails is dropped, and its stripes are
+// downloaded from the remaining sources.
+type stripedDownloader struct {
+	sources    []mirrorSource
+	stripeSize int64
+}
+
+// newStripedDownloader returns a downloader for the base URL and its mirrors,
+// or nil if fewer than two of them support range requests.
+func newStripedDownloader(conf Config, store storage.Storage) (*stripedDownloader, error) {
+	d := &stripedDownloader{stripeSize: conf.Mirrors.StripeSize}
+	if d.stripeSize <= 0 {
+		return nil, fmt.Errorf("invalid mirror stripe size %d", d.stripeSize)
+	}
+
+	urls := append([]string{conf.BaseURL}, conf.Mirrors.URLs...)
+	for i, url := range urls {
+		s := store
+		if i > 0 {
+			mc := conf
+			mc.BaseURL = url
+			var err error
+			s, err = newStorage(mc)
+			if err != nil {
+				return nil, fmt.Errorf("configuring mirror %s: %s", url, err)
+			}
+		}
+
+		if err := storage.RangeUnsupported(s, url); err != nil {
+			log.Println("Not downloading stripes from", url, "range requests are not supported", err)
+			continue
+		}
+		d.sources = append(d.sources, mirrorSource{url, s, s.(storage.RangeGetter)})
+	}
+
+	if len(d.sources) < 2 {
+		return nil, nil
+	}
+	return d, nil
+}
+
+// stripe is a byte range of an object.
+type stripe struct {
+	offset, length int64
+}
+
+// download writes the object with the given OID and size to "dest".
+// Bytes are added to "counter" as they're written, for progress reporting,
+// and stripes are slowed by "priority" while an interactive transfer runs.
+func (d *stripedDownloader) download(ctx context.Context, oid string, size int64, dest *os.File, counter *byteCounter, priority *priorityGate) (*storage.Object, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Each stripe is either queued or being downloaded by one source,
+	// so returning a stripe to the queue never blocks.
+	count := (size + d.stripeSize - 1) / d.stripeSize
+	queue := make(chan stripe, count)
+	for off := int64(0); off < size; off += d.stripeSize {
+		length := d.stripeSize
+		if off+length > size {
+			length = size - off
+		}
+		queue <- stripe{off, length}
+	}
+
+	var (
+		remaining = count
+		done      = make(chan struct{})
+		failed    = make(chan struct{})
+		mtx       sync.Mutex
+		errs      []error
+	)
+	if remaining == 0 {
+		close(done)
+	}
+
+	for _, src := range d.sources {
+		go func(src mirrorSource) {
+			url, err := src.store.Join(src.baseURL, oid)
+			for err == nil {
+				var s stripe
+				select {
+				case <-done:
+					return
+				case <-ctx.Done():
+					err = ctx.Err()
+					continue
+				case s = <-queue:
+				}
+
+				err = d.fetch(ctx, src.ranges, url, s, dest, counter, priority)
+				if err != nil {
+					// Leave the stripe to the other sources.
+					queue <- s
+				} else if atomic.AddInt64(&remaining, -1) == 0 {
+					close(done)
+				}
+			}
+
+			select {
+			case <-done:
+				// Canceled after the download completed.
+				return
+			default:
+			}
+
+			errorln("Error downloading stripes from", src.baseURL, err)
+			mtx.Lock()
+			defer mtx.Unlock()
+			errs = append(errs, fmt.Errorf("%s: %s", src.baseURL, err))
+			if len(errs) == len(d.sources) {
+				close(failed)
+			}
+		}(src)
+	}
+
+	select {
+	case <-done:
+	case <-failed:
+		return nil, fmt.Errorf("downloading stripes failed from all sources: %v", errs)
+	}
+
+	// Mirrors, e.g. IPFS gateways, aren't necessarily trusted, and stripes
+	// can't be checked individually, so check the whole object.
+	verifier, err := storage.NewOIDVerifier(oid)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(verifier, io.NewSectionReader(dest, 0, size))
+	if err != nil {
+		return nil, fmt.Errorf("reading downloaded stripes: %s", err)
+	}
+	if err := verifier.Verify(); err != nil {
+		return nil, err
+	}
+
+	base := d.sources[0]
+	url, err := base.store.Join(base.baseURL, oid)
+	if err != nil {
+		return nil, err
+	}
+	return &storage.Object{URL: url, Name: oid, Size: size}, nil
+}
+
+// fetch downloads a single stripe from a source.
+func (d *stripedDownloader) fetch(ctx context.Context, rg storage.RangeGetter, url string, s stripe, dest io.WriterAt, counter *byteCounter, priority *priorityGate) error {
+	w := &offsetWriter{w: dest, offset: s.offset, counter: counter}
+	err := rg.GetRange(ctx, url, s.offset, s.length, priority.writer(ctx, w))
+	if err == nil && w.written != s.length {
+		err = fmt.Errorf("short read at offset %d: got %d of %d bytes", s.offset, w.written, s.length)
+	}
+	if err != nil {
+		// The stripe will be downloaded again, so don't count it twice.
+		counter.add(-w.written)
+	}
+	return err
+}
+
+// offsetWriter writes sequentially to "w", starting at "offset".
+type offsetWriter struct {
+	w       io.WriterAt
+	offset  int64
+	written int64
+	counter *byteCounter
+}
+
+func (o *offsetWriter) Write(p []byte) (int, error) {
+	n, err := o.w.WriteAt(p, o.offset+o.written)
+	o.written += int64(n)
+	o.counter.add(int64(n))
+	return n, err
+}
+
+// byteCounter counts bytes written by concurrent writers,
+// for progress reporting. See watchProgress.
+type byteCounter struct {
+	n int64
+}
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	c.add(int64(len(p)))
+	return len(p), nil
+}
+
+func (c *byteCounter) add(n int64) {
+	atomic.AddInt64(&c.n, n)
+}
+
+// N returns the number of bytes written.
+func (c *byteCounter) N() int64 {
+	return atomic.LoadInt64(&c.n)
+}
+
+// Err always returns nil. It's part of progress.Counter.
+func (c *byteCounter) Err() error {
+	return nil
+}
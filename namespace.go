@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/buchanae/tanker/storage"
+)
+
+// NamespaceConfig configures prefixing object keys with the current branch
+// or environment, so that experimental branches don't pollute the production
+// object namespace. Downloads of objects which aren't in the namespace fall
+// back to the base URL, and "tanker namespace merge" moves a namespace's
+// objects to the base URL once its branch is merged.
+type NamespaceConfig struct {
+	// Template of the prefix added to the base URL. "{branch}" is replaced
+	// by the current branch, or TANKER_BRANCH, and "{env}" by Environment,
+	// or TANKER_ENV, e.g. "branches/{branch}" or "{env}". Empty disables
+	// namespaces.
+	Template string
+	// Name of the environment, e.g. "dev", "staging", or "prod".
+	Environment string
+	// Branches which use the base URL itself, e.g. "main".
+	Production []string
+}
+
+// unsafeKeyChars matches characters which aren't kept in namespace names.
+var unsafeKeyChars = regexp.MustCompile(`[^A-Za-z0-9._/-]+`)
+
+// namespacePrefix returns the prefix of the current namespace, or an empty
+// string if objects are stored under the base URL itself.
+func namespacePrefix(conf NamespaceConfig) (string, error) {
+	if conf.Template == "" {
+		return "", nil
+	}
+
+	prefix := conf.Template
+	if strings.Contains(prefix, "{branch}") {
+		branch, err := currentBranch()
+		if err != nil {
+			return "", err
+		}
+		if containsString(conf.Production, branch) {
+			return "", nil
+		}
+		prefix = strings.Replace(prefix, "{branch}", branch, -1)
+	}
+	if strings.Contains(prefix, "{env}") {
+		env := os.Getenv("TANKER_ENV")
+		if env == "" {
+			env = conf.Environment
+		}
+		if env == "" {
+			return "", userErrorf("Namespace.Template uses {env}, but no environment is set: set TANKER_ENV or Namespace.Environment")
+		}
+		prefix = strings.Replace(prefix, "{env}", env, -1)
+	}
+
+	prefix = unsafeKeyChars.ReplaceAllString(prefix, "-")
+	prefix = strings.Trim(path.Clean("/"+prefix), "/")
+	return prefix, nil
+}
+
+// currentBranch returns TANKER_BRANCH, or the branch checked out.
+func currentBranch() (string, error) {
+	if b := os.Getenv("TANKER_BRANCH"); b != "" {
+		return b, nil
+	}
+	out, err := exec.Command("git", "symbolic-ref", "--quiet", "--short", "HEAD").Output()
+	if err != nil {
+		// e.g. a detached HEAD in CI, which doesn't name the branch.
+		return "", userErrorf("Namespace.Template uses {branch}, but no branch is checked out: set TANKER_BRANCH")
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// printNamespace prints the current namespace and its URL.
+func printNamespace(conf Config, out io.Writer) error {
+	prefix, err := namespacePrefix(conf.Namespace)
+	if err != nil {
+		return err
+	}
+	if prefix == "" {
+		fmt.Fprintln(out, "no namespace, objects are stored at", conf.BaseURL)
+		return nil
+	}
+	store, err := newStorage(conf)
+	if err != nil {
+		return err
+	}
+	url, err := store.Join(conf.BaseURL, prefix)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(out, "namespace:", prefix)
+	fmt.Fprintln(out, "objects are stored at", url)
+	return nil
+}
+
+// mergeNamespace moves the objects in a namespace to the base URL, e.g.
+// once the branch they were pushed from is merged to production. Objects
+// already at the base URL with the same size are deleted from the namespace
+// instead.
+func mergeNamespace(ctx context.Context, conf Config, prefix string, dryRun bool, out io.Writer) error {
+	// The namespace is given explicitly, so the store must not add one.
+	conf.Namespace = NamespaceConfig{}
+	store, err := newStorage(conf)
+	if err != nil {
+		return err
+	}
+	nsURL, err := store.Join(conf.BaseURL, prefix)
+	if err != nil {
+		return err
+	}
+
+	listing, err := store.List(ctx, nsURL, storage.ListOptions{Recursive: true})
+	if err != nil {
+		return fmt.Errorf("listing namespace %s: %s", prefix, err)
+	}
+
+	var moved, deleted int
+	for _, obj := range listing {
+		oid := objectOid(obj)
+		if oid == "" {
+			continue
+		}
+		dst, err := store.Join(conf.BaseURL, oid)
+		if err != nil {
+			return err
+		}
+
+		existing, err := store.Stat(ctx, dst)
+		if err == nil && existing.Size == obj.Size {
+			if dryRun {
+				fmt.Fprintln(out, "would delete", obj.URL, "which is already at", dst)
+			} else if err := store.Delete(ctx, obj.URL); err != nil {
+				return fmt.Errorf("deleting %s: %s", obj.URL, err)
+			}
+			deleted++
+			continue
+		}
+
+		if dryRun {
+			fmt.Fprintln(out, "would move", obj.URL, "to", dst)
+		} else {
+			if err := store.Move(ctx, obj.URL, dst); err != nil {
+				return fmt.Errorf("moving %s: %s", obj.URL, err)
+			}
+			log.Println("Moved", obj.URL, dst)
+		}
+		moved++
+	}
+
+	if dryRun {
+		fmt.Fprintf(out, "would move %d objects and delete %d duplicates from namespace %s\n", moved, deleted, prefix)
+	} else {
+		fmt.Fprintf(out, "moved %d objects and deleted %d duplicates from namespace %s\n", moved, deleted, prefix)
+	}
+	return nil
+}
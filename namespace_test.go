@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buchanae/tanker/storage"
+)
+
+// statStorage is a storage mock which has every object.
+type statStorage struct {
+	storage.Storage
+}
+
+func (s *statStorage) Join(url, path string) (string, error) {
+	return url + "/" + path, nil
+}
+
+func (s *statStorage) Stat(ctx context.Context, url string) (*storage.Object, error) {
+	return &storage.Object{URL: url}, nil
+}
+
+// External transfer commands upload objects to the URLs in the namespace.
+func TestNamespaceExternalPut(t *testing.T) {
+	t.Setenv("TANKER_ENV", "")
+	dir := t.TempDir()
+	got := filepath.Join(dir, "url")
+
+	conf := DefaultConfig()
+	conf.BaseURL = "mock://bucket/data"
+	conf.Namespace.Template = "{env}"
+	conf.Namespace.Environment = "dev"
+	conf.Storage.External = []storage.ExternalConfig{{
+		Scheme:     "mock",
+		PutCommand: []string{"sh", "-c", `printf %s "$1" > "$0"`, got, "{dst}"},
+		MinSize:    1,
+	}}
+	store, err := wrapStorage(conf, &statStorage{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oid := "bf3e3e2af9366a3b704ae0c31de5afa64193ebabffde2091936ad2e7510bc03a"
+	src := filepath.Join(dir, "src")
+	if err := ioutil.WriteFile(src, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fh, err := os.Open(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+
+	url, err := store.Join(conf.BaseURL, oid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err := store.Put(context.Background(), url, fh, storage.PutOptions{Size: 7, SourcePath: src})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "mock://bucket/data/dev/" + oid
+	b, err := ioutil.ReadFile(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != want {
+		t.Errorf("put command uploaded to %q, expected %q", b, want)
+	}
+	if obj.URL != want {
+		t.Errorf("put returned %q, expected %q", obj.URL, want)
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/buchanae/tanker/storage"
+)
+
+// Packs bundle many small objects into one tar file, to avoid the per-request
+// overhead of storing and fetching each tiny object separately:
+//
+//	<base>/packs/pack-<hash>.tar  tar files with one "<oid>" entry per object
+//	<base>/packs/index.json       maps each packed OID to its pack and offset
+//
+// Packs are created by "tanker pack" from objects in the local LFS store.
+// Uploads still store each object at "<base>/<oid>", so repos work the same
+// with or without packs; downloads check the index first when PackConfig
+// is enabled.
+const (
+	packDir       = "packs"
+	packIndexName = "index.json"
+)
+
+// PackConfig configures packing of small objects.
+type PackConfig struct {
+	// Look up objects in packs when downloading.
+	Enabled bool
+	// Objects up to this size, in bytes, are packed by "tanker pack".
+	MaxObjectSize int64
+}
+
+// packIndex maps packed OIDs to their location.
+type packIndex struct {
+	Version int
+	Objects map[string]packEntry
+}
+
+// packEntry locates an object's content inside a pack.
+type packEntry struct {
+	Pack string
+	// Offset of the object's content from the start of the pack.
+	Offset int64
+	Size   int64
+}
+
+// loadPackIndex downloads the pack index. A missing index is empty.
+func loadPackIndex(ctx context.Context, store storage.Storage, baseURL string) (*packIndex, error) {
+	idx := &packIndex{Version: 1, Objects: map[string]packEntry{}}
+
+	url, err := packURL(store, baseURL, packIndexName)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	_, err = store.Get(ctx, url, &buf)
+	if storage.KindOf(err) == storage.NotFoundError {
+		return idx, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("downloading pack index: %s", err)
+	}
+
+	err = json.Unmarshal(buf.Bytes(), idx)
+	if err != nil {
+		return nil, fmt.Errorf("parsing pack index: %s", err)
+	}
+	return idx, nil
+}
+
+// savePackIndex uploads the pack index, replacing the existing one.
+func savePackIndex(ctx context.Context, store storage.Storage, baseURL string, idx *packIndex) error {
+	b, err := json.MarshalIndent(idx, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshaling pack index: %s", err)
+	}
+	url, err := packURL(store, baseURL, packIndexName)
+	if err != nil {
+		return err
+	}
+	_, err = store.Put(ctx, url, bytes.NewReader(b), storage.PutOptions{
+		ContentType: "application/json",
+		Size:        int64(len(b)),
+	})
+	if err != nil {
+		return fmt.Errorf("uploading pack index: %s", err)
+	}
+	return nil
+}
+
+// packURL returns the URL of a file in the packs directory.
+func packURL(store storage.Storage, baseURL, name string) (string, error) {
+	url, err := store.Join(baseURL, packDir)
+	if err != nil {
+		return "", err
+	}
+	return store.Join(url, name)
+}
+
+// packObjects bundles the small objects in the local LFS store which aren't
+// packed yet into a new pack, uploads it, and updates the index. If "prune"
+// is true, the unpacked copies of the newly packed objects are moved to the
+// trash.
+func packObjects(ctx context.Context, t *Tanker, maxSize int64, prune bool) error {
+	store, err := newStorage(t.Config)
+	if err != nil {
+		return err
+	}
+
+	idx, err := loadPackIndex(ctx, store, t.Config.BaseURL)
+	if err != nil {
+		return err
+	}
+
+	files, err := lsFiles("--all")
+	if err != nil {
+		return err
+	}
+
+	// Choose the objects to pack.
+	var oids []string
+	seen := map[string]bool{}
+	for _, f := range files {
+		if seen[f.Oid] || !f.Present {
+			continue
+		}
+		seen[f.Oid] = true
+		if _, ok := idx.Objects[f.Oid]; ok {
+			continue
+		}
+		st, err := os.Stat(lfsObjectPath(t.Paths.Git, f.Oid))
+		if err != nil || st.Size() > maxSize {
+			continue
+		}
+		oids = append(oids, f.Oid)
+	}
+	if len(oids) == 0 {
+		fmt.Println("nothing to pack")
+		return nil
+	}
+
+	tmp, err := ioutil.TempFile(t.Paths.Data, "pack-")
+	if err != nil {
+		return fmt.Errorf("creating pack: %s", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+	entries, err := writePack(io.MultiWriter(tmp, hash), t.Paths.Git, oids)
+	if err != nil {
+		return fmt.Errorf("writing pack: %s", err)
+	}
+
+	name := fmt.Sprintf("pack-%x.tar", hash.Sum(nil)[:16])
+	url, err := packURL(store, t.Config.BaseURL, name)
+	if err != nil {
+		return err
+	}
+
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return fmt.Errorf("rewinding pack: %s", err)
+	}
+
+	log.Println("Uploading pack", url)
+	_, err = store.Put(ctx, url, tmp, storage.PutOptions{
+		ContentType: "application/x-tar",
+		Size:        size,
+		ACL:         t.Config.ACL,
+	})
+	if err != nil {
+		return fmt.Errorf("uploading pack: %s", err)
+	}
+
+	for oid, e := range entries {
+		e.Pack = name
+		idx.Objects[oid] = e
+	}
+	err = savePackIndex(ctx, store, t.Config.BaseURL, idx)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("packed %d objects into %s (%s)\n", len(entries), name, formatBytes(size))
+
+	if !prune {
+		return nil
+	}
+
+	// Only trash the unpacked copies which exist.
+	var existing []string
+	for _, oid := range oids {
+		url, err := store.Join(t.Config.BaseURL, oid)
+		if err != nil {
+			return err
+		}
+		if _, err := store.Stat(ctx, url); err == nil {
+			existing = append(existing, oid)
+		}
+	}
+	return trashObjects(ctx, store, t.Config.BaseURL, existing)
+}
+
+// writePack writes the given objects from the local LFS store as a tar
+// to "w", and returns the location of each object's content.
+func writePack(w io.Writer, gitDir string, oids []string) (map[string]packEntry, error) {
+	cw := &countingWriter{w: w}
+	tw := tar.NewWriter(cw)
+	entries := map[string]packEntry{}
+
+	for _, oid := range oids {
+		b, err := ioutil.ReadFile(lfsObjectPath(gitDir, oid))
+		if err != nil {
+			return nil, err
+		}
+		err = tw.WriteHeader(&tar.Header{
+			Name:    oid,
+			Mode:    0644,
+			Size:    int64(len(b)),
+			ModTime: time.Now(),
+		})
+		if err != nil {
+			return nil, err
+		}
+		// The header has been written, so the content starts here.
+		entries[oid] = packEntry{Offset: cw.n, Size: int64(len(b))}
+		if _, err := tw.Write(b); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// packReader serves downloads from packs. The index is downloaded once,
+// on first use, and packs are cached locally since a pack usually holds
+// several objects of the same pull.
+type packReader struct {
+	store    storage.Storage
+	baseURL  string
+	cacheDir string
+
+	once   sync.Once
+	idx    *packIndex
+	idxErr error
+}
+
+// lookup returns the location of a packed object, if it's packed.
+func (p *packReader) lookup(ctx context.Context, oid string) (packEntry, bool) {
+	p.once.Do(func() {
+		p.idx, p.idxErr = loadPackIndex(ctx, p.store, p.baseURL)
+		if p.idxErr != nil {
+			errorln("Error loading pack index, downloading objects individually", p.idxErr)
+		}
+	})
+	if p.idx == nil {
+		return packEntry{}, false
+	}
+	e, ok := p.idx.Objects[oid]
+	return e, ok
+}
+
+// extract writes a packed object to "dest", downloading its pack if it
+// isn't cached yet, and verifies the content against the OID.
+func (p *packReader) extract(ctx context.Context, oid string, e packEntry, dest io.Writer) (*storage.Object, error) {
+	url, err := packURL(p.store, p.baseURL, e.Pack)
+	if err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(p.cacheDir, e.Pack)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		err := p.fetch(ctx, url, path)
+		if err != nil {
+			return nil, fmt.Errorf("downloading pack %s: %s", e.Pack, err)
+		}
+	}
+
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	verifier, err := storage.NewOIDVerifier(oid)
+	if err != nil {
+		return nil, err
+	}
+	r := io.NewSectionReader(fh, e.Offset, e.Size)
+	_, err = io.Copy(io.MultiWriter(dest, verifier), r)
+	if err != nil {
+		return nil, fmt.Errorf("extracting object from pack %s: %s", e.Pack, err)
+	}
+	if err := verifier.Verify(); err != nil {
+		return nil, fmt.Errorf("pack %s: %s", e.Pack, err)
+	}
+
+	return &storage.Object{URL: url, Name: oid, Size: e.Size}, nil
+}
+
+// fetch downloads a pack into the cache.
+func (p *packReader) fetch(ctx context.Context, url, path string) error {
+	err := storage.EnsureDir(p.cacheDir)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(p.cacheDir, "tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	_, err = p.store.Get(ctx, url, tmp)
+	if err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// PlanConfig configures the plan printed before large downloads, e.g. by
+// "tanker pull".
+type PlanConfig struct {
+	// Ask for confirmation before downloading more than this many bytes.
+	// --yes skips the question. Zero means never ask.
+	ConfirmSize int64
+}
+
+// transferPlan describes the objects a command is about to download.
+type transferPlan struct {
+	Objects int
+	Bytes   int64
+}
+
+// planThroughputSamples is the number of recent downloads in the journal
+// used to measure throughput.
+const planThroughputSamples = 100
+
+// pullPlan returns the plan for pulling the LFS files in the checkout which
+// match the include patterns and don't match the exclude patterns, and
+// whose objects aren't present locally.
+func pullPlan(includes, excludes []string) (transferPlan, error) {
+	var args []string
+	if len(includes) > 0 {
+		args = append(args, "--include", strings.Join(includes, ","))
+	}
+	if len(excludes) > 0 {
+		args = append(args, "--exclude", strings.Join(excludes, ","))
+	}
+	files, err := lsFiles(args...)
+	if err != nil {
+		return transferPlan{}, err
+	}
+	sizes, err := lsFileSizes(args...)
+	if err != nil {
+		return transferPlan{}, err
+	}
+
+	var plan transferPlan
+	seen := map[string]bool{}
+	for _, f := range files {
+		if f.Present || seen[f.Oid] {
+			continue
+		}
+		seen[f.Oid] = true
+		plan.Objects++
+		plan.Bytes += sizes[f.Oid]
+	}
+	return plan, nil
+}
+
+// recentThroughput returns the throughput of the most recent downloads in
+// the journal, in bytes per second, or zero if none were measured.
+func recentThroughput(journal string) float64 {
+	entries, err := readJournal(journal)
+	if err != nil {
+		errorln("Error reading journal", err)
+		return 0
+	}
+
+	var bytes int64
+	var elapsed time.Duration
+	samples := 0
+	for i := len(entries) - 1; i >= 0 && samples < planThroughputSamples; i-- {
+		e := entries[i]
+		if e.Op != "download" || e.Duration <= 0 {
+			continue
+		}
+		bytes += e.Size
+		elapsed += e.Duration
+		samples++
+	}
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(bytes) / elapsed.Seconds()
+}
+
+// confirmPlan prints the plan: the number of objects, their size, the
+// estimated duration at the throughput of recent downloads, and the egress
+// cost. If the plan is larger than Plan.ConfirmSize, it asks the user to
+// confirm on "in", unless "yes" is set, and returns an error if they don't.
+// Without a terminal to ask on, large plans require "yes".
+func confirmPlan(conf Config, journal string, plan transferPlan, yes bool, in *os.File, out io.Writer) error {
+	if plan.Objects == 0 {
+		return nil
+	}
+
+	fmt.Fprintf(out, "plan: download %d objects, %s\n", plan.Objects, formatBytes(plan.Bytes))
+	if rate := recentThroughput(journal); rate > 0 {
+		eta := time.Duration(float64(plan.Bytes) / rate * float64(time.Second))
+		fmt.Fprintf(out, "estimated time: %s, at %s/s measured in recent downloads\n",
+			eta.Round(time.Second), formatBytes(int64(rate)))
+	} else {
+		fmt.Fprintln(out, "estimated time: unknown, no recent downloads were measured")
+	}
+	if p := pricingFor(conf); p.EgressPerGB > 0 {
+		fmt.Fprintf(out, "estimated egress cost: %.2f\n", p.EgressCost(plan.Bytes))
+	}
+
+	if yes || conf.Plan.ConfirmSize <= 0 || plan.Bytes <= conf.Plan.ConfirmSize {
+		return nil
+	}
+	if !isTerminal(in) {
+		return fmt.Errorf("download is larger than Plan.ConfirmSize (%s): use --yes to proceed",
+			formatBytes(conf.Plan.ConfirmSize))
+	}
+
+	fmt.Fprint(out, "proceed? [y/N] ")
+	answer, _ := bufio.NewReader(in).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return nil
+	}
+	return fmt.Errorf("canceled")
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Transfers run at a priority, so that background transfers, e.g. those of
+// "tanker sync", yield to interactive ones, e.g. a "git lfs pull" run by the
+// user, when both run at once. The priority of an invocation is set by
+// TANKER_PRIORITY, which git-lfs passes on to the transfer agents it starts.
+//
+// Interactive agents hold a shared lock on a lock file in the user's cache
+// dir while they run, so the lock is held by any interactive transfer on the
+// machine. While it's held, background agents start no new objects, and
+// slow the transfers in progress to PriorityConfig.BackgroundRate. Objects
+// transferred by external commands, see storage.ExternalConfig, wait to
+// start, but the commands move the data themselves, so they aren't slowed.
+
+// priorityEnv is the environment variable which sets the priority of the
+// transfers of an invocation: "interactive", the default, or "background".
+const priorityEnv = "TANKER_PRIORITY"
+
+const backgroundPriority = "background"
+
+// priorityPollInterval is how often background agents check for
+// interactive transfers.
+const priorityPollInterval = time.Second
+
+// PriorityConfig configures how background transfers yield to
+// interactive ones.
+type PriorityConfig struct {
+	// Bytes per second that the transfers in progress of each background
+	// agent are slowed to while an interactive transfer runs. Zero doesn't
+	// slow them, but they still start no new objects.
+	BackgroundRate int64
+}
+
+// runInBackground makes the transfers of this process, and of the processes
+// it starts, e.g. "git lfs pull", yield to interactive transfers.
+func runInBackground() {
+	os.Setenv(priorityEnv, backgroundPriority)
+}
+
+// priorityGate coordinates the transfers of one agent with the transfers
+// of other agents. A nil *priorityGate does nothing.
+type priorityGate struct {
+	background bool
+	path       string
+	limiter    *rate.Limiter
+	// Set while an interactive transfer runs. Only tracked by
+	// background agents.
+	yielding atomic.Bool
+	// Stops watching for interactive transfers, or releases the lock
+	// of an interactive agent.
+	stop func()
+}
+
+// newPriorityGate starts coordinating the agent's transfers at the
+// priority set by TANKER_PRIORITY. Failures are logged, and disable it.
+func newPriorityGate(conf PriorityConfig) *priorityGate {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		errorln("Error finding priority lock, transfers won't be prioritized", err)
+		return nil
+	}
+	dir = filepath.Join(dir, "tanker")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		errorln("Error creating priority lock dir, transfers won't be prioritized", err)
+		return nil
+	}
+	g := &priorityGate{
+		background: os.Getenv(priorityEnv) == backgroundPriority,
+		path:       filepath.Join(dir, "interactive"),
+	}
+
+	if !g.background {
+		unlock, err := lockFile(g.path, false)
+		if err != nil {
+			errorln("Error taking priority lock, background transfers won't yield", err)
+			return nil
+		}
+		g.stop = unlock
+		return g
+	}
+
+	if conf.BackgroundRate > 0 {
+		g.limiter = rate.NewLimiter(rate.Limit(conf.BackgroundRate), throttleChunk(conf.BackgroundRate))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		g.watch(ctx)
+	}()
+	g.stop = func() {
+		cancel()
+		wg.Wait()
+	}
+	return g
+}
+
+// close stops coordinating the agent's transfers.
+func (g *priorityGate) close() {
+	if g != nil {
+		g.stop()
+	}
+}
+
+// watch tracks whether an interactive transfer runs, until "ctx" is done.
+func (g *priorityGate) watch(ctx context.Context) {
+	ticker := time.NewTicker(priorityPollInterval)
+	defer ticker.Stop()
+	for {
+		running := g.interactiveRunning()
+		if running != g.yielding.Load() {
+			if running {
+				log.Println("Yielding to interactive transfers")
+			} else {
+				log.Println("Interactive transfers finished, resuming")
+			}
+			g.yielding.Store(running)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// interactiveRunning returns true if an interactive agent holds the lock.
+func (g *priorityGate) interactiveRunning() bool {
+	fh, err := os.OpenFile(g.path+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return false
+	}
+	defer fh.Close()
+	ok, err := tryLock(fh, true)
+	if err != nil {
+		return false
+	}
+	if ok {
+		unlock(fh)
+	}
+	return !ok
+}
+
+// wait blocks a background agent from starting an object while an
+// interactive transfer runs.
+func (g *priorityGate) wait(ctx context.Context) error {
+	if g == nil || !g.background {
+		return nil
+	}
+	for g.yielding.Load() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(priorityPollInterval):
+		}
+	}
+	return nil
+}
+
+// throttle slows "n" bytes of a background transfer while an interactive
+// transfer runs. "n" must be at most the limiter's burst.
+func (g *priorityGate) throttle(ctx context.Context, n int) error {
+	if g == nil || g.limiter == nil || !g.yielding.Load() {
+		return nil
+	}
+	return g.limiter.WaitN(ctx, n)
+}
+
+// throttleChunk returns the size of the chunks throttled transfers are
+// read or written in, which is the limiter's burst.
+func throttleChunk(bytesPerSec int64) int {
+	const max = 256 * 1024
+	if bytesPerSec < max {
+		return int(bytesPerSec)
+	}
+	return max
+}
+
+// reader returns "r", slowed while an interactive transfer runs.
+func (g *priorityGate) reader(ctx context.Context, r io.Reader) io.Reader {
+	if g == nil || g.limiter == nil {
+		return r
+	}
+	return &throttledReader{ctx, r, g}
+}
+
+// writer returns "w", slowed while an interactive transfer runs.
+func (g *priorityGate) writer(ctx context.Context, w io.Writer) io.Writer {
+	if g == nil || g.limiter == nil {
+		return w
+	}
+	return &throttledWriter{ctx, w, g}
+}
+
+type throttledReader struct {
+	ctx context.Context
+	r   io.Reader
+	g   *priorityGate
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if burst := t.g.limiter.Burst(); len(p) > burst {
+		p = p[:burst]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		if werr := t.g.throttle(t.ctx, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+type throttledWriter struct {
+	ctx context.Context
+	w   io.Writer
+	g   *priorityGate
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	var written int
+	burst := t.g.limiter.Burst()
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > burst {
+			chunk = chunk[:burst]
+		}
+		if err := t.g.throttle(t.ctx, len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := t.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
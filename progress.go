@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/units"
+)
+
+// progressQuiet holds the global --quiet flag, which turns progress bars off.
+var progressQuiet bool
+
+// progressMaxBars is the number of file bars shown at once. Files beyond
+// it are only counted in the total.
+const progressMaxBars = 8
+
+// progressRedraw limits how often the bars are redrawn.
+const progressRedraw = 100 * time.Millisecond
+
+// progressUI draws a progress bar for each file being transferred, and one
+// for the whole command, on a terminal. Lines written to it are printed
+// above the bars. A nil *progressUI is valid, and draws nothing.
+type progressUI struct {
+	out io.Writer
+	mtx sync.Mutex
+	// Files in progress, in the order they started.
+	files []*progressBar
+	// Files which finished, whose late updates are ignored.
+	finished map[string]bool
+	// Number of files in total and completed, and bytes transferred by
+	// completed files.
+	total, done int
+	doneBytes   int64
+	// Number of lines drawn last time, which are drawn over next time.
+	lines int
+	drawn time.Time
+}
+
+type progressBar struct {
+	name        string
+	bytes, size int64
+}
+
+// newProgressUI returns a progressUI drawing to "out", or nil if "out"
+// isn't a terminal or --quiet is set.
+func newProgressUI(out *os.File) *progressUI {
+	if progressQuiet || !isTerminal(out) {
+		return nil
+	}
+	return &progressUI{out: out, finished: map[string]bool{}}
+}
+
+func isTerminal(f *os.File) bool {
+	if os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// setTotal sets the total number of files.
+func (p *progressUI) setTotal(files int) {
+	if p == nil {
+		return
+	}
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.total = files
+	p.draw(false)
+}
+
+// update sets the progress of a file, adding its bar if it's new.
+func (p *progressUI) update(name string, bytes, size int64) {
+	if p == nil {
+		return
+	}
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.finished[name] {
+		return
+	}
+	bar := p.bar(name)
+	bar.bytes, bar.size = bytes, size
+	p.draw(false)
+}
+
+// finish removes a file's bar, and counts it as done.
+func (p *progressUI) finish(name string) {
+	if p == nil {
+		return
+	}
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	for i, bar := range p.files {
+		if bar.name == name {
+			p.finished[name] = true
+			p.doneBytes += bar.bytes
+			p.done++
+			p.files = append(p.files[:i], p.files[i+1:]...)
+			p.draw(false)
+			return
+		}
+	}
+}
+
+// Write prints lines above the bars.
+func (p *progressUI) Write(b []byte) (int, error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.clear()
+	n, err := p.out.Write(b)
+	p.draw(true)
+	return n, err
+}
+
+// close draws the final state of the bars.
+func (p *progressUI) close() {
+	if p == nil {
+		return
+	}
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.draw(true)
+}
+
+func (p *progressUI) bar(name string) *progressBar {
+	for _, bar := range p.files {
+		if bar.name == name {
+			return bar
+		}
+	}
+	bar := &progressBar{name: name}
+	p.files = append(p.files, bar)
+	return bar
+}
+
+// clear erases the lines drawn last time, leaving the cursor at the first.
+func (p *progressUI) clear() {
+	for i := 0; i < p.lines; i++ {
+		fmt.Fprint(p.out, "\x1b[1A\x1b[2K")
+	}
+	p.lines = 0
+}
+
+// draw redraws the bars, at most every progressRedraw unless forced.
+// Nothing is drawn before there's progress to show.
+func (p *progressUI) draw(force bool) {
+	if p.total == 0 && len(p.files) == 0 {
+		return
+	}
+	if !force && time.Since(p.drawn) < progressRedraw {
+		return
+	}
+	p.drawn = time.Now()
+	p.clear()
+
+	var b strings.Builder
+	var bytes int64
+	for i, bar := range p.files {
+		bytes += bar.bytes
+		if i < progressMaxBars {
+			fmt.Fprintf(&b, "%s %s\n", progressLine(bar.bytes, bar.size), bar.name)
+			p.lines++
+		}
+	}
+	if more := len(p.files) - progressMaxBars; more > 0 {
+		fmt.Fprintf(&b, "  ... and %d more\n", more)
+		p.lines++
+	}
+	fmt.Fprintf(&b, "%s %d/%d files, %s\n", progressLine(int64(p.done), int64(p.total)),
+		p.done, p.total, units.Base2Bytes(p.doneBytes+bytes).Round(1))
+	p.lines++
+	io.WriteString(p.out, b.String())
+}
+
+// progressLine draws a bar "n" of "size" full, and its percentage.
+func progressLine(n, size int64) string {
+	const width = 30
+	filled := 0
+	pct := 0
+	if size > 0 {
+		filled = int(n * width / size)
+		pct = int(n * 100 / size)
+	}
+	if filled > width {
+		filled, pct = width, 100
+	}
+	return fmt.Sprintf("[%s%s] %3d%%", strings.Repeat("=", filled), strings.Repeat(" ", width-filled), pct)
+}
+
+// progressWriter counts the bytes written to it as a file's progress.
+type progressWriter struct {
+	ui   *progressUI
+	name string
+	size int64
+	n    int64
+}
+
+func (w *progressWriter) Write(b []byte) (int, error) {
+	w.n += int64(len(b))
+	w.ui.update(w.name, w.n, w.size)
+	return len(b), nil
+}
+
+// followLFSProgress reads the progress file git-lfs writes when
+// GIT_LFS_PROGRESS is set, and shows it in the UI, until "stop" is closed.
+// Each line of the file is "<direction> <file>/<files> <bytes>/<size> <name>".
+func followLFSProgress(ui *progressUI, path string, stop <-chan struct{}) {
+	var fh *os.File
+	var reader *bufio.Reader
+	defer func() {
+		if fh != nil {
+			fh.Close()
+		}
+	}()
+
+	// The last line may be partly written.
+	partial := ""
+	ticker := time.NewTicker(progressRedraw)
+	defer ticker.Stop()
+	for stopped := false; !stopped; {
+		// Read once more after stopping, for the last lines.
+		select {
+		case <-stop:
+			stopped = true
+		case <-ticker.C:
+		}
+
+		if fh == nil {
+			if f, err := os.Open(path); err == nil {
+				fh, reader = f, bufio.NewReader(f)
+			}
+		}
+		for reader != nil {
+			line, err := reader.ReadString('\n')
+			partial += line
+			if err != nil {
+				break
+			}
+			parseLFSProgress(ui, strings.TrimSuffix(partial, "\n"))
+			partial = ""
+		}
+	}
+}
+
+func parseLFSProgress(ui *progressUI, line string) {
+	fields := strings.SplitN(line, " ", 4)
+	if len(fields) != 4 {
+		return
+	}
+	files := strings.SplitN(fields[1], "/", 2)
+	bytes := strings.SplitN(fields[2], "/", 2)
+	if len(files) != 2 || len(bytes) != 2 {
+		return
+	}
+	total, _ := strconv.Atoi(files[1])
+	n, _ := strconv.ParseInt(bytes[0], 10, 64)
+	size, _ := strconv.ParseInt(bytes[1], 10, 64)
+	name := fields[3]
+
+	ui.setTotal(total)
+	ui.update(name, n, size)
+	if n >= size {
+		ui.finish(name)
+	}
+}
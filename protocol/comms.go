@@ -0,0 +1,132 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+// Comms manages communication with git-lfs.
+// https://github.com/git-lfs/git-lfs/blob/master/docs/custom-transfers.md
+//
+// Comms is safe for concurrent use by multiple senders,
+// e.g. progress watchers running alongside the transfer loop.
+type Comms struct {
+	mtx     sync.Mutex
+	enc     *json.Encoder
+	scanner *bufio.Scanner
+	// Mirrors messages to a trace file, if set. See Trace.
+	trace *tracer
+	// Called with each message sent, if set. See OnSend.
+	onSend func(Message)
+}
+
+// DefaultComms communicates with git-lfs over stdin/stdout.
+func DefaultComms() *Comms {
+	return NewComms(os.Stdin, os.Stdout)
+}
+
+// NewComms reads messages from "in" and writes messages to "out".
+func NewComms(in io.Reader, out io.Writer) *Comms {
+
+	// Read git-lfs messages from in (usually stdin)
+	scanner := bufio.NewScanner(in)
+	// Write git-lfs messages to out (usually stdout)
+	enc := json.NewEncoder(out)
+
+	return &Comms{
+		enc:     enc,
+		scanner: scanner,
+	}
+}
+
+// Input reads the next message from git-lfs. When the input is closed,
+// a TerminateMessage is returned.
+func (c *Comms) Input() (Message, error) {
+	more := c.scanner.Scan()
+	err := c.scanner.Err()
+	if err != nil {
+		return nil, fmt.Errorf("scanning for input message: %s", err)
+	}
+	if err == io.EOF || !more {
+		return &TerminateMessage{}, nil
+	}
+	c.mtx.Lock()
+	trace := c.trace
+	c.mtx.Unlock()
+	trace.record("in", c.scanner.Bytes())
+	return Decode(c.scanner.Bytes())
+}
+
+// Initialized signals to git-lfs that tanker has successfully initialized.
+func (c *Comms) Initialized() {
+	c.Send(&InitResponse{})
+}
+
+// InitError signals to git-lfs that tanker failed to initialize.
+func (c *Comms) InitError(err error) {
+	log.Println("Sending init error", err)
+	c.Send(&InitResponse{
+		Error: &ErrorDetail{
+			Code:    InitErrorCode,
+			Message: err.Error(),
+		},
+	})
+}
+
+// Send writes a message to git-lfs.
+func (c *Comms) Send(msg Message) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	err := c.enc.Encode(msg)
+	if err != nil {
+		return fmt.Errorf("sending message: %s", err)
+	}
+	if c.trace != nil {
+		if b, err := json.Marshal(msg); err == nil {
+			c.trace.record("out", b)
+		}
+	}
+	if c.onSend != nil {
+		c.onSend(msg)
+	}
+	return nil
+}
+
+// OnSend calls "f" with each message sent to git-lfs, e.g. to track the
+// progress of transfers. "f" is called while sending, so it must not send.
+func (c *Comms) OnSend(f func(Message)) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.onSend = f
+}
+
+// SendError reports a failed transfer of the given object to git-lfs.
+func (c *Comms) SendError(oid string, err error) {
+	log.Println("Sending error", oid, err)
+	// We're ignoring the error from Send();
+	// if the send fails, there's not a lot we can do.
+	c.Send(&ErrorMessage{
+		Event: "complete",
+		Oid:   oid,
+		Error: ErrorDetail{
+			// TODO is there a better code?
+			Code:    TransferErrorCode,
+			Message: err.Error(),
+		},
+	})
+}
+
+// SendComplete reports a successful transfer of the given object to git-lfs.
+// For downloads, "path" is where the object was written.
+func (c *Comms) SendComplete(oid, path string) error {
+	return c.Send(&CompleteMessage{
+		Event: "complete",
+		Oid:   oid,
+		Path:  path,
+	})
+}
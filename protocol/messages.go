@@ -0,0 +1,144 @@
+// Package protocol implements the git-lfs custom transfer protocol:
+// line-delimited JSON messages exchanged with git-lfs over stdin/stdout.
+//
+// https://github.com/git-lfs/git-lfs/blob/master/docs/custom-transfers.md
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Error codes sent to git-lfs.
+const (
+	// TransferErrorCode reports a failed upload or download of one object.
+	TransferErrorCode = 1
+	// InitErrorCode reports that the agent failed to initialize.
+	InitErrorCode = 32
+)
+
+// Message is implemented by all protocol messages.
+type Message interface {
+	isMessage()
+}
+
+// genericMessage is used to get the "event" field,
+// in order to determine what type of message to parse.
+type genericMessage struct {
+	Event string `json:"event"`
+}
+
+// InitMessage is the first message sent by git-lfs.
+type InitMessage struct {
+	Event               string `json:"event"`
+	Operation           string `json:"operation"`
+	Remote              string `json:"remote"`
+	Concurrent          bool   `json:"concurrent"`
+	ConcurrentTransfers int    `json:"concurrenttransfers"`
+}
+
+// InitResponse is the response to an init message.
+// An empty response means success.
+type InitResponse struct {
+	Error *ErrorDetail `json:"error,omitempty"`
+}
+
+// UploadMessage asks the agent to upload the file at Path.
+type UploadMessage struct {
+	Event string `json:"event"`
+	Oid   string `json:"oid"`
+	Size  int    `json:"size"`
+	Path  string `json:"path"`
+}
+
+// DownloadMessage asks the agent to download an object.
+type DownloadMessage struct {
+	Event string `json:"event"`
+	Oid   string `json:"oid"`
+	Size  int    `json:"size"`
+}
+
+// ProgressMessage reports the progress of an upload or download.
+type ProgressMessage struct {
+	Event          string `json:"event"`
+	Oid            string `json:"oid"`
+	BytesSoFar     int    `json:"bytesSoFar"`
+	BytesSinceLast int    `json:"bytesSinceLast"`
+}
+
+// CompleteMessage reports a successful upload or download.
+// For downloads, Path is where the object was written.
+type CompleteMessage struct {
+	Event string `json:"event"`
+	Oid   string `json:"oid"`
+	Path  string `json:"path,omitempty"`
+}
+
+// ErrorMessage reports a failed upload or download. Per the protocol,
+// it's a "complete" event with an error.
+type ErrorMessage struct {
+	Event string      `json:"event"`
+	Oid   string      `json:"oid"`
+	Error ErrorDetail `json:"error"`
+}
+
+// ErrorDetail describes an error sent to git-lfs.
+type ErrorDetail struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// TerminateMessage is the last message sent by git-lfs.
+type TerminateMessage struct {
+	Event string `json:"event"`
+}
+
+// UnknownMessage is a message with an event type this version of tanker
+// doesn't know, e.g. one added by a newer git-lfs. Such messages should be
+// skipped rather than ending the session.
+type UnknownMessage struct {
+	Event string `json:"event"`
+	// The object the message refers to, if any.
+	Oid string `json:"oid"`
+}
+
+func (m *InitMessage) isMessage()      {}
+func (m *InitResponse) isMessage()     {}
+func (m *UploadMessage) isMessage()    {}
+func (m *DownloadMessage) isMessage()  {}
+func (m *ProgressMessage) isMessage()  {}
+func (m *CompleteMessage) isMessage()  {}
+func (m *ErrorMessage) isMessage()     {}
+func (m *TerminateMessage) isMessage() {}
+func (m *UnknownMessage) isMessage()   {}
+
+// Decode parses a single message sent by git-lfs.
+func Decode(line []byte) (Message, error) {
+
+	// Determine the type of the message by looking for the "event" field.
+	var generic genericMessage
+	err := json.Unmarshal(line, &generic)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshaling message wrapper: %s", err)
+	}
+
+	var msg Message
+	switch generic.Event {
+	case "init":
+		msg = &InitMessage{}
+	case "upload":
+		msg = &UploadMessage{}
+	case "download":
+		msg = &DownloadMessage{}
+	case "terminate":
+		msg = &TerminateMessage{}
+	default:
+		msg = &UnknownMessage{}
+	}
+
+	err = json.Unmarshal(line, msg)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshaling %s message: %s", generic.Event, err)
+	}
+	return msg, nil
+}
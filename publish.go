@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buchanae/tanker/storage"
+)
+
+// publishEntry maps a file in the repo to a URL it can be downloaded from.
+type publishEntry struct {
+	Path string
+	Oid  string
+	Size int64
+	URL  string
+}
+
+// publishOptions configures "tanker publish".
+type publishOptions struct {
+	// Listing format: csv, json, or html.
+	Format string
+	// Lock published objects, so they can't be deleted or overwritten.
+	Lock bool
+	// Also retain locked objects for this long, even once unlocked.
+	Retain time.Duration
+}
+
+// publish makes the objects of the LFS files matching "paths" publicly
+// readable, uploading any which are missing from remote storage, and writes
+// a listing of their public URLs to "out" in the given format.
+// With no paths, every LFS file in the checkout is published.
+func publish(ctx context.Context, t *Tanker, paths []string, opts publishOptions, out io.Writer) error {
+	write, ok := publishFormats[opts.Format]
+	if !ok {
+		return fmt.Errorf("unknown format %q, expected csv, json, or html", opts.Format)
+	}
+
+	store, err := newStorage(t.Config)
+	if err != nil {
+		return err
+	}
+	pub, ok := store.(storage.Publisher)
+	if !ok {
+		return fmt.Errorf("storage for %s can't publish objects", t.Config.BaseURL)
+	}
+	locker, ok := store.(storage.Locker)
+	if opts.Lock && !ok {
+		return fmt.Errorf("storage for %s can't lock objects", t.Config.BaseURL)
+	}
+	var until time.Time
+	if opts.Retain > 0 {
+		until = time.Now().Add(opts.Retain)
+	}
+
+	files, err := publishFiles(paths)
+	if err != nil {
+		return err
+	}
+
+	published := map[string]*storage.Object{}
+	publicURLs := map[string]string{}
+	var entries []publishEntry
+
+	for _, f := range files {
+		if _, ok := published[f.Oid]; !ok {
+			obj, public, err := publishObject(ctx, t, store, pub, f)
+			if err != nil {
+				return fmt.Errorf("publishing %q: %s", f.Path, err)
+			}
+			published[f.Oid] = obj
+			publicURLs[f.Oid] = public
+			log.Println("Published", f.Path, public)
+
+			if opts.Lock {
+				if err := lockObject(ctx, t, store, locker, f, until); err != nil {
+					return fmt.Errorf("locking %q: %s", f.Path, err)
+				}
+			}
+		}
+
+		entries = append(entries, publishEntry{
+			Path: f.Path,
+			Oid:  f.Oid,
+			Size: published[f.Oid].Size,
+			URL:  publicURLs[f.Oid],
+		})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Path < entries[j].Path
+	})
+	return write(out, entries)
+}
+
+// publishFiles returns the LFS files matching "paths", or every LFS file
+// in the checkout if there are no paths.
+func publishFiles(paths []string) ([]lfsFile, error) {
+	var args []string
+	if len(paths) > 0 {
+		args = []string{"--include", strings.Join(paths, ",")}
+	}
+	files, err := lsFiles(args...)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no LFS files to publish")
+	}
+	return files, nil
+}
+
+func lockObject(ctx context.Context, t *Tanker, store storage.Storage, locker storage.Locker, f lfsFile, until time.Time) error {
+	url, err := store.Join(t.Config.BaseURL, f.Oid)
+	if err != nil {
+		return err
+	}
+	if err := locker.Lock(ctx, url, until); err != nil {
+		return err
+	}
+	log.Println("Locked", f.Path, url)
+	return nil
+}
+
+// unlockPublished releases the locks placed by "tanker publish --lock" on the objects
+// of the LFS files matching "paths", so that they can be deleted again.
+// This usually requires admin permissions on the bucket.
+func unlockPublished(ctx context.Context, t *Tanker, paths []string, out io.Writer) error {
+	store, err := newStorage(t.Config)
+	if err != nil {
+		return err
+	}
+	locker, ok := store.(storage.Locker)
+	if !ok {
+		return fmt.Errorf("storage for %s can't lock objects", t.Config.BaseURL)
+	}
+	files, err := publishFiles(paths)
+	if err != nil {
+		return err
+	}
+
+	unlocked := map[string]bool{}
+	for _, f := range files {
+		if unlocked[f.Oid] {
+			continue
+		}
+		url, err := store.Join(t.Config.BaseURL, f.Oid)
+		if err != nil {
+			return err
+		}
+		if err := locker.Unlock(ctx, url); err != nil {
+			return fmt.Errorf("unlocking %q: %s", f.Path, err)
+		}
+		unlocked[f.Oid] = true
+		log.Println("Unlocked", f.Path, url)
+	}
+	fmt.Fprintf(out, "unlocked %d objects\n", len(unlocked))
+	return nil
+}
+
+// publishObject makes a single object public, uploading it first
+// if it's missing from remote storage.
+func publishObject(ctx context.Context, t *Tanker, store storage.Storage, pub storage.Publisher, f lfsFile) (*storage.Object, string, error) {
+	url, err := store.Join(t.Config.BaseURL, f.Oid)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Not every backend reports missing objects as NotFoundError,
+	// so any Stat error leads to an upload if the object is available.
+	obj, err := store.Stat(ctx, url)
+	if storage.KindOf(err) == storage.NotFoundError || (err != nil && f.Present) {
+		if !f.Present {
+			return nil, "", fmt.Errorf("object is missing from remote storage and not present locally")
+		}
+		obj, err = uploadPublic(ctx, t, store, url, f)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	public, err := pub.Publish(ctx, url)
+	if err != nil {
+		return nil, "", err
+	}
+	return obj, public, nil
+}
+
+// uploadPublic uploads an object from the local LFS store with a public-read ACL.
+func uploadPublic(ctx context.Context, t *Tanker, store storage.Storage, url string, f lfsFile) (*storage.Object, error) {
+	fh, err := os.Open(lfsObjectPath(t.Paths.Git, f.Oid))
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	log.Println("Uploading", f.Oid, url)
+	opts, body := putOptions(t.Config, f.Path, fh)
+	opts.ACL = storage.ACLPublicRead
+	return store.Put(ctx, url, body, opts)
+}
+
+var publishFormats = map[string]func(io.Writer, []publishEntry) error{
+	"csv":  writePublishCSV,
+	"json": writePublishJSON,
+	"html": writePublishHTML,
+}
+
+func writePublishCSV(w io.Writer, entries []publishEntry) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"path", "oid", "size", "url"})
+	for _, e := range entries {
+		cw.Write([]string{e.Path, e.Oid, strconv.FormatInt(e.Size, 10), e.URL})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func writePublishJSON(w io.Writer, entries []publishEntry) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(entries)
+}
+
+var publishHTML = template.Must(template.New("index").Funcs(template.FuncMap{
+	"bytes": formatBytes,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Dataset index</title></head>
+<body>
+<table>
+<tr><th>Path</th><th>Size</th><th>SHA-256</th></tr>
+{{- range . }}
+<tr><td><a href="{{ .URL }}">{{ .Path }}</a></td><td>{{ bytes .Size }}</td><td><code>{{ .Oid }}</code></td></tr>
+{{- end }}
+</table>
+</body>
+</html>
+`))
+
+func writePublishHTML(w io.Writer, entries []publishEntry) error {
+	return publishHTML.Execute(w, entries)
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// QuotaConfig caps the disk space used by downloads, so that tanker doesn't
+// fill shared home directories.
+type QuotaConfig struct {
+	// Largest size, in bytes, of the directory downloads are written to
+	// before git-lfs moves them, .git/tanker/data by default. Downloads
+	// which would take it over fail. Zero means no limit.
+	Data int64
+	// Size, in bytes, of the cache at Cache.Dir above which the least
+	// recently used objects are evicted to make room for new ones.
+	// Zero means no limit.
+	CacheSoft int64
+	// Largest size, in bytes, of the cache. Objects which don't fit, even
+	// after evicting, fail to download. Zero means no limit.
+	CacheHard int64
+}
+
+// dirQuota enforces a hard limit on the size of a directory which several
+// downloads write to concurrently. A nil *dirQuota has no limit.
+type dirQuota struct {
+	dir   string
+	limit int64
+	// Name of the limit's setting, for errors.
+	setting string
+
+	mtx sync.Mutex
+	// Bytes reserved by downloads in progress. Their partial files are
+	// counted too, which overestimates the usage a little.
+	reserved int64
+}
+
+func newDataQuota(conf Config, dir string) *dirQuota {
+	if conf.Quota.Data <= 0 {
+		return nil
+	}
+	return &dirQuota{dir: dir, limit: conf.Quota.Data, setting: "Quota.Data"}
+}
+
+// reserve reserves room for an object of the given size, or fails if the
+// directory would go over its limit. The returned func releases the room
+// once the object is written, or has failed.
+func (q *dirQuota) reserve(oid string, size int64) (func(), error) {
+	if q == nil {
+		return func() {}, nil
+	}
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	used, err := dirSize(q.dir)
+	if err != nil {
+		return nil, fmt.Errorf("checking quota: %s", err)
+	}
+	if used+q.reserved+size > q.limit {
+		return nil, fmt.Errorf("downloading %s (%s) would take %s over its quota of %s, with %s used: free up space or raise %s",
+			oid, formatBytes(size), q.dir, formatBytes(q.limit), formatBytes(used+q.reserved), q.setting)
+	}
+	q.reserved += size
+	return func() {
+		q.mtx.Lock()
+		defer q.mtx.Unlock()
+		q.reserved -= size
+	}, nil
+}
+
+// dirSize returns the total size of the files under "dir".
+func dirSize(dir string) (int64, error) {
+	var total int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total, err
+}
+
+// cacheEntry is an object in the cache.
+type cacheEntry struct {
+	path string
+	size int64
+	// Time the object was last used, see copyFromCache.
+	used time.Time
+	// Set for objects added by this process, which may still be
+	// being written, so they aren't evicted.
+	added bool
+}
+
+// cacheQuota keeps the cache within Quota.CacheSoft and Quota.CacheHard
+// while objects are added to it. The cache is listed once, and objects
+// added or evicted are tracked from then on. A nil *cacheQuota has no limits.
+type cacheQuota struct {
+	conf QuotaConfig
+	dir  string
+
+	mtx     sync.Mutex
+	loaded  bool
+	entries []*cacheEntry
+	total   int64
+}
+
+func newCacheQuota(conf Config) *cacheQuota {
+	if conf.Cache.Dir == "" || (conf.Quota.CacheSoft <= 0 && conf.Quota.CacheHard <= 0) {
+		return nil
+	}
+	return &cacheQuota{conf: conf.Quota, dir: conf.Cache.Dir}
+}
+
+// reserve makes room in the cache for an object of the given size, evicting
+// the least recently used objects as needed, or fails if the object doesn't
+// fit. The returned func releases the room if adding the object failed.
+func (q *cacheQuota) reserve(oid string, size int64) (func(), error) {
+	if q == nil {
+		return func() {}, nil
+	}
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	if !q.loaded {
+		if err := q.load(); err != nil {
+			return nil, fmt.Errorf("checking cache quota: %s", err)
+		}
+		q.loaded = true
+	}
+
+	if soft := q.conf.CacheSoft; soft > 0 && q.total+size > soft {
+		var evicted int
+		var freed int64
+		// Entries are sorted, least recently used first, and added
+		// entries are last.
+		for len(q.entries) > 0 && !q.entries[0].added && q.total+size > soft {
+			e := q.entries[0]
+			q.entries = q.entries[1:]
+			if err := os.Remove(e.path); err != nil && !os.IsNotExist(err) {
+				// e.g. another user's object in a shared cache.
+				debugln("Error evicting cached object", e.path, err)
+				continue
+			}
+			q.total -= e.size
+			freed += e.size
+			evicted++
+		}
+		if evicted > 0 {
+			log.Println("Evicted", evicted, "objects,", formatBytes(freed), "from cache", q.dir)
+		}
+	}
+
+	if hard := q.conf.CacheHard; hard > 0 && q.total+size > hard {
+		return nil, fmt.Errorf("caching %s (%s) would take %s over its quota of %s, with %s used: free up space or raise Quota.CacheHard",
+			oid, formatBytes(size), q.dir, formatBytes(hard), formatBytes(q.total))
+	}
+
+	e := &cacheEntry{path: cachePath(q.dir, oid), size: size, used: time.Now(), added: true}
+	q.entries = append(q.entries, e)
+	q.total += size
+	return func() {
+		q.mtx.Lock()
+		defer q.mtx.Unlock()
+		for i, x := range q.entries {
+			if x == e {
+				q.entries = append(q.entries[:i], q.entries[i+1:]...)
+				q.total -= e.size
+				break
+			}
+		}
+	}, nil
+}
+
+// load lists the objects in the cache, least recently used first.
+func (q *cacheQuota) load() error {
+	err := filepath.Walk(q.dir, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			q.entries = append(q.entries, &cacheEntry{path: path, size: info.Size(), used: info.ModTime()})
+			q.total += info.Size()
+		}
+		return nil
+	})
+	sort.Slice(q.entries, func(i, j int) bool {
+		return q.entries[i].used.Before(q.entries[j].used)
+	})
+	return err
+}
@@ -0,0 +1,550 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/units"
+	"github.com/buchanae/tanker/storage"
+)
+
+// ReplicationConfig configures replication of uploaded objects to secondary
+// remotes. By default, uploads complete once the object is in the base URL,
+// then "tanker replicate", started in the background at the end of each push,
+// copies new objects to the secondary remotes. Copies are recorded in the
+// journal, and "tanker replication status" shows the replication lag.
+type ReplicationConfig struct {
+	// Base URLs of the secondary remotes, e.g. buckets in other regions.
+	// They may use a different storage backend than the base URL.
+	URLs []string
+	// Number of objects copied at once.
+	Concurrency int
+	// When objects are copied to the secondary remotes:
+	//
+	//   - "background", the default: by "tanker replicate", after the push.
+	//   - "required": during the push, after each upload. An object which
+	//     can't be copied to every secondary remote fails to upload.
+	//   - "optional": during the push, but a secondary remote failing only
+	//     logs a warning and queues the object for "tanker repair", so that
+	//     an unreachable mirror doesn't fail the push.
+	Policy string
+}
+
+// Replication policies, see ReplicationConfig.Policy.
+const (
+	replicateBackground = "background"
+	replicateRequired   = "required"
+	replicateOptional   = "optional"
+)
+
+// replicaState is the replication state of one secondary remote.
+type replicaState struct {
+	URL string
+	// Uploaded objects not yet copied to the remote, by OID.
+	Pending map[string]journalEntry
+	// Time of the last copy to the remote.
+	LastCopy time.Time
+	// Objects which failed to copy during a push, queued for
+	// "tanker repair", by OID.
+	Repairs map[string]journalEntry
+}
+
+// replicationState reads the journal and returns the state of each
+// secondary remote. Every object uploaded from this clone is replicated.
+func replicationState(conf Config, journal string) ([]*replicaState, error) {
+	entries, err := readJournal(journal)
+	if err != nil {
+		return nil, err
+	}
+
+	states := map[string]*replicaState{}
+	var list []*replicaState
+	for _, url := range conf.Replication.URLs {
+		s := &replicaState{
+			URL:     url,
+			Pending: map[string]journalEntry{},
+			Repairs: map[string]journalEntry{},
+		}
+		states[url] = s
+		list = append(list, s)
+	}
+
+	for _, e := range entries {
+		switch e.Op {
+		case "upload":
+			for _, s := range list {
+				if _, ok := s.Pending[e.Oid]; !ok {
+					s.Pending[e.Oid] = e
+				}
+			}
+		case "replicate":
+			s, ok := states[e.Replica]
+			if !ok {
+				continue
+			}
+			delete(s.Pending, e.Oid)
+			delete(s.Repairs, e.Oid)
+			if e.Time.After(s.LastCopy) {
+				s.LastCopy = e.Time
+			}
+		case "repair":
+			if s, ok := states[e.Replica]; ok {
+				s.Repairs[e.Oid] = e
+			}
+		}
+	}
+	return list, nil
+}
+
+// replicate copies the uploaded objects which are missing from the
+// secondary remotes. Only one replicator runs at a time; if another one
+// is running, this returns without doing anything, since that one will
+// pick up the new objects.
+func replicate(ctx context.Context, t *Tanker, out io.Writer) error {
+	conf := t.Config
+	if len(conf.Replication.URLs) == 0 {
+		return userErrorf("no secondary remotes: set Replication.URLs in the config")
+	}
+
+	unlock, err := lockFileWait(filepath.Join(t.Paths.Tanker, "replication"), true, 0)
+	if err != nil {
+		log.Println("Skipping replication, another replicator is running", err)
+		fmt.Fprintln(out, "another replicator is running")
+		return nil
+	}
+	defer unlock()
+
+	primary, err := newStorage(conf)
+	if err != nil {
+		return err
+	}
+
+	// Objects uploaded while replicating are picked up by another pass.
+	for {
+		states, err := replicationState(conf, t.Paths.Journal)
+		if err != nil {
+			return err
+		}
+		pending := 0
+		for _, s := range states {
+			pending += len(s.Pending)
+		}
+		if pending == 0 {
+			fmt.Fprintln(out, "all objects are replicated")
+			return nil
+		}
+
+		failed := 0
+		for _, s := range states {
+			failed += replicateTo(ctx, t, primary, s, out)
+		}
+		if failed > 0 {
+			return withExitCode(exitPartial, fmt.Errorf("failed to replicate %d objects", failed))
+		}
+	}
+}
+
+// replicateTo copies the pending objects of one secondary remote, and
+// returns the number of objects which failed.
+func replicateTo(ctx context.Context, t *Tanker, primary storage.Storage, s *replicaState, out io.Writer) int {
+	rc := t.Config
+	rc.BaseURL = s.URL
+	replica, err := newStorage(rc)
+	if err != nil {
+		errorln("Error configuring secondary remote", s.URL, err)
+		fmt.Fprintf(out, "%s: %s\n", s.URL, err)
+		return len(s.Pending)
+	}
+
+	// Oldest uploads first, to keep the lag down.
+	var queue []journalEntry
+	for _, e := range s.Pending {
+		queue = append(queue, e)
+	}
+	sort.Slice(queue, func(i, j int) bool {
+		return queue[i].Time.Before(queue[j].Time)
+	})
+
+	concurrency := t.Config.Replication.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	jobs := make(chan journalEntry)
+	var wg sync.WaitGroup
+	var mtx sync.Mutex
+	failed := 0
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range jobs {
+				if err := replicateObject(ctx, t, primary, replica, s.URL, e); err != nil {
+					errorln("Error replicating", e.Oid, s.URL, err)
+					mtx.Lock()
+					failed++
+					fmt.Fprintf(out, "failed to copy %s to %s: %s\n", e.Oid, s.URL, err)
+					mtx.Unlock()
+				}
+			}
+		}()
+	}
+	for _, e := range queue {
+		jobs <- e
+	}
+	close(jobs)
+	wg.Wait()
+
+	fmt.Fprintf(out, "%s: copied %d objects\n", s.URL, len(queue)-failed)
+	return failed
+}
+
+// replicateObject copies one object to a secondary remote, from the local
+// LFS store if it's there, otherwise from the base URL, and records the copy
+// in the journal. Objects which are already there with the same size aren't
+// copied again.
+func replicateObject(ctx context.Context, t *Tanker, primary, replica storage.Storage, replicaURL string, e journalEntry) error {
+	url, err := replica.Join(replicaURL, e.Oid)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+
+	obj, err := replica.Stat(ctx, url)
+	if err != nil || obj.Size != e.Size {
+		src, err := replicaSource(ctx, t, primary, e.Oid)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+
+		opts, body := putOptions(t.Config, e.Oid, src)
+		opts.Size = e.Size
+		obj, err = replica.Put(ctx, url, body, opts)
+		if err != nil {
+			return err
+		}
+		log.Println("Replicated", e.Oid, url)
+	}
+
+	return appendJournal(t.Paths.Journal, journalEntry{
+		Time:     time.Now(),
+		Op:       "replicate",
+		Oid:      e.Oid,
+		URL:      obj.URL,
+		Size:     obj.Size,
+		Version:  obj.Version,
+		Duration: time.Since(start),
+		Replica:  replicaURL,
+	})
+}
+
+// replicaSource opens the content of an object to copy. Objects missing
+// from the local LFS store are downloaded from the base URL to a temp file,
+// which is removed when it's closed.
+func replicaSource(ctx context.Context, t *Tanker, primary storage.Storage, oid string) (io.ReadCloser, error) {
+	if fh, err := os.Open(lfsObjectPath(t.Paths.Git, oid)); err == nil {
+		return fh, nil
+	}
+
+	url, err := primary.Join(t.Config.BaseURL, oid)
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempFile(t.Paths.Data, "replicate-")
+	if err != nil {
+		return nil, fmt.Errorf("creating temp file: %s", err)
+	}
+	src := tempFile{tmp}
+
+	if _, err := primary.Get(ctx, url, tmp); err != nil {
+		src.Close()
+		return nil, fmt.Errorf("downloading %s: %s", url, err)
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		src.Close()
+		return nil, err
+	}
+	return src, nil
+}
+
+// tempFile is a file which is removed when it's closed.
+type tempFile struct {
+	*os.File
+}
+
+func (f tempFile) Close() error {
+	err := f.File.Close()
+	os.Remove(f.Name())
+	return err
+}
+
+// startReplicator starts "tanker replicate" in the background, so that
+// new uploads are copied to the secondary remotes without holding up
+// the push. Errors are logged.
+func startReplicator() {
+	exe, err := os.Executable()
+	if err != nil {
+		errorln("Error starting replicator", err)
+		return
+	}
+	cmd := exec.Command(exe, "replicate", "--quiet")
+	if err := cmd.Start(); err != nil {
+		errorln("Error starting replicator", err)
+		return
+	}
+	log.Println("Started replicator", cmd.Process.Pid)
+	cmd.Process.Release()
+}
+
+// printReplicationStatus prints the number and size of the objects waiting
+// to be copied to each secondary remote, and the replication lag, i.e. how
+// long ago the oldest of them was uploaded.
+func printReplicationStatus(conf Config, journal string, out io.Writer) error {
+	if len(conf.Replication.URLs) == 0 {
+		return userErrorf("no secondary remotes: set Replication.URLs in the config")
+	}
+	states, err := replicationState(conf, journal)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range states {
+		var bytes int64
+		var oldest time.Time
+		for _, e := range s.Pending {
+			bytes += e.Size
+			if oldest.IsZero() || e.Time.Before(oldest) {
+				oldest = e.Time
+			}
+		}
+
+		fmt.Fprintln(out, s.URL)
+		fmt.Fprintf(out, "  pending: %d objects, %s\n", len(s.Pending), units.Base2Bytes(bytes).Round(1))
+		if len(s.Pending) > 0 {
+			fmt.Fprintf(out, "  lag: %s\n", time.Since(oldest).Round(time.Second))
+		}
+		if !s.LastCopy.IsZero() {
+			fmt.Fprintf(out, "  last copy: %s\n", s.LastCopy.Format(time.RFC3339))
+		}
+		if len(s.Repairs) > 0 {
+			var last journalEntry
+			for _, e := range s.Repairs {
+				if e.Time.After(last.Time) {
+					last = e
+				}
+			}
+			fmt.Fprintf(out, "  queued for repair: %d objects, run \"tanker repair\"\n", len(s.Repairs))
+			fmt.Fprintf(out, "  last failure: %s\n", last.Error)
+		}
+	}
+	return nil
+}
+
+// replicaTarget is a secondary remote which uploads are copied to during
+// pushes, see ReplicationConfig.Policy.
+type replicaTarget struct {
+	url   string
+	store storage.Storage
+}
+
+// pushReplicas returns the secondary remotes which uploads are copied to
+// during pushes, i.e. none unless Replication.Policy is "required" or
+// "optional".
+func pushReplicas(conf Config) ([]replicaTarget, error) {
+	switch conf.Replication.Policy {
+	case "", replicateBackground:
+		return nil, nil
+	case replicateRequired, replicateOptional:
+	default:
+		return nil, userErrorf("unknown Replication.Policy %q, expected background, required, or optional", conf.Replication.Policy)
+	}
+
+	var targets []replicaTarget
+	for _, url := range conf.Replication.URLs {
+		rc := conf
+		rc.BaseURL = url
+		s, err := newStorage(rc)
+		if err != nil {
+			return nil, fmt.Errorf("configuring secondary remote %s: %s", url, err)
+		}
+		targets = append(targets, replicaTarget{url, s})
+	}
+	return targets, nil
+}
+
+// replicateUpload copies an object which was just uploaded to the base URL
+// to the secondary remotes. With the "optional" policy, copies which fail
+// are logged and queued for "tanker repair" instead of failing the upload.
+func (a *agent) replicateUpload(ctx context.Context, oid, path string, size int64) error {
+	for _, r := range a.replicas {
+		err := a.copyToReplica(ctx, r, oid, path, size)
+		if err == nil {
+			continue
+		}
+		if a.conf.Replication.Policy != replicateOptional {
+			return fmt.Errorf("copying to secondary remote %s: %s", r.url, err)
+		}
+
+		errorln("Warning: failed to copy", oid, "to secondary remote", r.url, "queued for \"tanker repair\":", err)
+		qerr := appendJournal(a.journal, journalEntry{
+			Time:    time.Now(),
+			Op:      "repair",
+			Oid:     oid,
+			Size:    size,
+			Replica: r.url,
+			Error:   err.Error(),
+		})
+		if qerr != nil {
+			errorln("Error queueing repair", oid, r.url, qerr)
+		}
+	}
+	return nil
+}
+
+// copyToReplica copies the file at "path" to a secondary remote, and
+// records the copy in the journal.
+func (a *agent) copyToReplica(ctx context.Context, r replicaTarget, oid, path string, size int64) error {
+	url, err := r.store.Join(r.url, oid)
+	if err != nil {
+		return err
+	}
+	src, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("opening source file %q: %s", path, err)
+	}
+	defer src.Close()
+
+	start := time.Now()
+	opts, body := putOptions(a.conf, path, src)
+	opts.Size = size
+	obj, err := r.store.Put(ctx, url, body, opts)
+	if _, ok := err.(*storage.ErrObjectExists); ok {
+		obj, err = r.store.Stat(ctx, url)
+	}
+	if err != nil {
+		return err
+	}
+	log.Println("Replicated", oid, url)
+
+	return appendJournal(a.journal, journalEntry{
+		Time:     time.Now(),
+		Op:       "replicate",
+		Oid:      oid,
+		URL:      obj.URL,
+		Size:     obj.Size,
+		Version:  obj.Version,
+		Duration: time.Since(start),
+		Replica:  r.url,
+	})
+}
+
+// repair re-syncs the secondary remotes: every object uploaded from this
+// clone is checked on each of them, including ones the journal records as
+// copied, and objects which are missing, or queued for repair by the
+// "optional" policy, are copied again.
+func repair(ctx context.Context, t *Tanker, out io.Writer) error {
+	conf := t.Config
+	if len(conf.Replication.URLs) == 0 {
+		return userErrorf("no secondary remotes: set Replication.URLs in the config")
+	}
+
+	unlock, err := lockFileWait(filepath.Join(t.Paths.Tanker, "replication"), true, 0)
+	if err != nil {
+		return userErrorf("another replicator is running, try again once it's done")
+	}
+	defer unlock()
+
+	primary, err := newStorage(conf)
+	if err != nil {
+		return err
+	}
+	states, err := replicationState(conf, t.Paths.Journal)
+	if err != nil {
+		return err
+	}
+	entries, err := readJournal(t.Paths.Journal)
+	if err != nil {
+		return err
+	}
+	uploads := map[string]journalEntry{}
+	for _, e := range entries {
+		if e.Op == "upload" {
+			uploads[e.Oid] = e
+		}
+	}
+
+	failed := 0
+	for _, s := range states {
+		missing, err := missingReplicas(ctx, t.Config, s.URL, uploads)
+		if err != nil {
+			errorln("Error checking secondary remote", s.URL, err)
+			fmt.Fprintf(out, "%s: %s\n", s.URL, err)
+			failed += len(s.Pending)
+			continue
+		}
+		fmt.Fprintf(out, "%s: %d of %d objects missing\n", s.URL, len(missing), len(uploads))
+		for oid, e := range missing {
+			s.Pending[oid] = e
+		}
+		failed += replicateTo(ctx, t, primary, s, out)
+	}
+	if failed > 0 {
+		return withExitCode(exitPartial, fmt.Errorf("failed to repair %d objects", failed))
+	}
+	return nil
+}
+
+// missingReplicas returns the objects which are missing from a secondary
+// remote, or have the wrong size there.
+func missingReplicas(ctx context.Context, conf Config, replicaURL string, uploads map[string]journalEntry) (map[string]journalEntry, error) {
+	rc := conf
+	rc.BaseURL = replicaURL
+	replica, err := newStorage(rc)
+	if err != nil {
+		return nil, err
+	}
+
+	concurrency := conf.Replication.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	jobs := make(chan journalEntry)
+	var wg sync.WaitGroup
+	var mtx sync.Mutex
+	missing := map[string]journalEntry{}
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range jobs {
+				url, err := replica.Join(replicaURL, e.Oid)
+				if err == nil {
+					var obj *storage.Object
+					obj, err = replica.Stat(ctx, url)
+					if err == nil && obj.Size == e.Size {
+						continue
+					}
+				}
+				debugln("Missing replica", e.Oid, replicaURL, err)
+				mtx.Lock()
+				missing[e.Oid] = e
+				mtx.Unlock()
+			}
+		}()
+	}
+	for _, e := range uploads {
+		jobs <- e
+	}
+	close(jobs)
+	wg.Wait()
+	return missing, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/buchanae/tanker/storage"
+)
+
+// RestoreConfig configures downloads of objects in archive tiers,
+// e.g. Azure's Archive tier, which must be restored before they can be
+// downloaded. Restores can take hours. See "tanker restore-request".
+type RestoreConfig struct {
+	// How long a download waits for an archived object to be restored,
+	// requesting the restore if needed. Zero means downloads of archived
+	// objects fail immediately, with an error explaining how to restore
+	// them. Waits count towards ObjectTimeout.
+	Wait storage.Duration
+	// How often to check whether a restore has finished, while waiting.
+	PollInterval storage.Duration
+}
+
+// requestRestores starts restoring the archived objects with the given
+// OIDs, and writes the status of each to "out". Objects which aren't
+// archived, or are already being restored, are skipped.
+func requestRestores(ctx context.Context, conf Config, oids []string, out io.Writer) error {
+	store, err := newStorage(conf)
+	if err != nil {
+		return err
+	}
+	restorer, ok := store.(storage.Restorer)
+	if !ok {
+		return fmt.Errorf("storage for %s has no archive tiers", conf.BaseURL)
+	}
+
+	var failed int
+	for _, oid := range oids {
+		url, err := store.Join(conf.BaseURL, oid)
+		if err != nil {
+			return err
+		}
+
+		obj, err := store.Stat(ctx, url)
+		if err != nil {
+			errorln("Error checking", url, err)
+			failed++
+			continue
+		}
+		switch {
+		case !obj.Archived:
+			fmt.Fprintf(out, "%s\tnot archived\n", oid)
+		case obj.Restoring:
+			fmt.Fprintf(out, "%s\talready restoring\n", oid)
+		default:
+			if err := restorer.RequestRestore(ctx, url); err != nil {
+				errorln("Error requesting restore of", url, err)
+				failed++
+				continue
+			}
+			log.Println("Requested restore of", url)
+			fmt.Fprintf(out, "%s\trestore requested\n", oid)
+		}
+	}
+
+	if failed > 0 {
+		return withExitCode(exitPartial, fmt.Errorf("%d of %d restore requests failed, see the log for details", failed, len(oids)))
+	}
+	return nil
+}
+
+// waitForRestore waits for the archived object at "url" to be restored,
+// according to the config, requesting the restore first unless one is
+// in progress. "archived" is the error returned by downloading it.
+func waitForRestore(ctx context.Context, store storage.Storage, conf RestoreConfig, url string, archived *storage.ErrArchived) error {
+	if conf.Wait <= 0 {
+		return fmt.Errorf("%s; set Restore.Wait in the config to have downloads wait for restores", archived)
+	}
+
+	if !archived.Restoring {
+		restorer, ok := store.(storage.Restorer)
+		if !ok {
+			return archived
+		}
+		if err := restorer.RequestRestore(ctx, url); err != nil {
+			return fmt.Errorf("requesting restore of archived object: %s", err)
+		}
+		log.Println("Requested restore of archived object", url)
+	}
+
+	wait := time.Duration(conf.Wait)
+	interval := time.Duration(conf.PollInterval)
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	start := time.Now()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		elapsed := time.Since(start).Round(time.Second)
+		obj, err := store.Stat(ctx, url)
+		if err != nil {
+			errorln("Error checking restore of", url, err)
+		} else if !obj.Archived {
+			log.Println("Restore of", url, "finished after", elapsed)
+			return nil
+		}
+
+		if elapsed >= wait {
+			return fmt.Errorf("restore of archived object %s didn't finish within %s; "+
+				"it continues in the background, so try again later", url, wait)
+		}
+		log.Println("Waiting for restore of", url, "elapsed", elapsed, "of", wait)
+	}
+}
+
+// unpresentOids returns the OIDs of the LFS files in the checkout
+// whose content hasn't been downloaded.
+func unpresentOids() ([]string, error) {
+	files, err := lsFiles()
+	if err != nil {
+		return nil, err
+	}
+	var oids []string
+	for _, f := range files {
+		if !f.Present {
+			oids = append(oids, f.Oid)
+		}
+	}
+	if len(oids) == 0 {
+		return nil, fmt.Errorf("all LFS files are already downloaded")
+	}
+	return oids, nil
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buchanae/tanker/storage"
+)
+
+// The shared index lists the objects in remote storage, so that pushes can
+// skip objects which are already there with a few small downloads, instead
+// of asking the backend about each object, which is slow on some control
+// planes:
+//
+//	<base>/oid-index/base.gz            compacted list of OIDs and sizes
+//	<base>/oid-index/delta-<time>-<id>.gz  objects uploaded by one session
+//
+// Each transfer session writes its own delta, so sessions never overwrite
+// each other's updates. Compaction merges the deltas into the base. Entries
+// lost to concurrent compactions only cause uploads which could have been
+// skipped, never skipped uploads.
+const (
+	sharedIndexDir  = "oid-index"
+	sharedIndexBase = "base.gz"
+	sharedDeltaPre  = "delta-"
+)
+
+// SharedIndexConfig configures the shared index of remote objects.
+type SharedIndexConfig struct {
+	// Skip uploading objects which the shared index lists with the same
+	// size, and add uploaded objects to it. Like Index.SkipKnownUploads,
+	// this trusts that nothing deleted the objects since they were listed.
+	Enabled bool
+	// Compact the shared index at the end of a push once it has this many
+	// deltas. Zero means it's only compacted by "tanker index compact".
+	CompactAfter int
+}
+
+// sharedIndex is the shared index as loaded by one transfer session,
+// plus the objects the session uploaded. A nil *sharedIndex is valid,
+// and knows no objects.
+type sharedIndex struct {
+	store   storage.Storage
+	baseURL string
+
+	mtx    sync.Mutex
+	loaded bool
+	sizes  map[string]int64
+	deltas []string
+	added  map[string]int64
+}
+
+func newSharedIndex(conf Config, store storage.Storage) *sharedIndex {
+	if !conf.Index.Shared.Enabled {
+		return nil
+	}
+	return &sharedIndex{
+		store:   store,
+		baseURL: conf.BaseURL,
+		added:   map[string]int64{},
+	}
+}
+
+// known returns true if the shared index lists the object with the given
+// size. The index is downloaded on first use, so sessions which only
+// download objects don't pay for it. Failing to load it is logged, and
+// treated as an empty index.
+func (x *sharedIndex) known(ctx context.Context, oid string, size int64) bool {
+	if x == nil {
+		return false
+	}
+	x.mtx.Lock()
+	defer x.mtx.Unlock()
+	if !x.loaded {
+		x.loaded = true
+		sizes, deltas, err := loadSharedIndex(ctx, x.store, x.baseURL)
+		if err != nil {
+			errorln("Error loading shared index", err)
+		}
+		x.sizes, x.deltas = sizes, deltas
+	}
+	s, ok := x.sizes[oid]
+	return ok && s == size
+}
+
+// add records an object uploaded in this session.
+func (x *sharedIndex) add(oid string, size int64) {
+	if x == nil {
+		return
+	}
+	x.mtx.Lock()
+	defer x.mtx.Unlock()
+	x.added[oid] = size
+}
+
+// flush uploads the objects added in this session as a new delta, and
+// compacts the index if it has enough deltas. Errors are logged.
+func (x *sharedIndex) flush(ctx context.Context, compactAfter int) {
+	if x == nil {
+		return
+	}
+	x.mtx.Lock()
+	defer x.mtx.Unlock()
+	if len(x.added) == 0 {
+		return
+	}
+
+	id := make([]byte, 4)
+	rand.Read(id)
+	name := fmt.Sprintf("%s%d-%x.gz", sharedDeltaPre, time.Now().UnixNano(), id)
+	if err := putSharedIndex(ctx, x.store, x.baseURL, name, x.added); err != nil {
+		errorln("Error updating shared index", err)
+		return
+	}
+	log.Println("Added", len(x.added), "objects to the shared index")
+	x.added = map[string]int64{}
+
+	if compactAfter > 0 && len(x.deltas)+1 >= compactAfter {
+		if _, err := compactSharedIndex(ctx, x.store, x.baseURL); err != nil {
+			errorln("Error compacting shared index", err)
+		}
+	}
+}
+
+// loadSharedIndex downloads the base and the deltas of the shared index,
+// and returns the objects they list, and the URLs of the deltas.
+// A missing index is empty.
+func loadSharedIndex(ctx context.Context, store storage.Storage, baseURL string) (map[string]int64, []string, error) {
+	sizes := map[string]int64{}
+	dir, err := store.Join(baseURL, sharedIndexDir)
+	if err != nil {
+		return sizes, nil, err
+	}
+	listing, err := store.List(ctx, dir, storage.ListOptions{})
+	if storage.KindOf(err) == storage.NotFoundError {
+		return sizes, nil, nil
+	}
+	if err != nil {
+		return sizes, nil, fmt.Errorf("listing shared index: %s", err)
+	}
+
+	var deltas []string
+	for _, obj := range listing {
+		name := path.Base(obj.Name)
+		if obj.Dir || (name != sharedIndexBase && !strings.HasPrefix(name, sharedDeltaPre)) {
+			continue
+		}
+		if err := getSharedIndex(ctx, store, obj.URL, sizes); err != nil {
+			return sizes, nil, err
+		}
+		if name != sharedIndexBase {
+			deltas = append(deltas, obj.URL)
+		}
+	}
+	return sizes, deltas, nil
+}
+
+// getSharedIndex downloads one file of the shared index into "sizes".
+// Each line of a file is "<oid> <size>".
+func getSharedIndex(ctx context.Context, store storage.Storage, url string, sizes map[string]int64) error {
+	var buf bytes.Buffer
+	if _, err := store.Get(ctx, url, &buf); err != nil {
+		return fmt.Errorf("downloading shared index %s: %s", url, err)
+	}
+	zr, err := gzip.NewReader(&buf)
+	if err != nil {
+		return fmt.Errorf("reading shared index %s: %s", url, err)
+	}
+	scanner := bufio.NewScanner(zr)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || !isOID(fields[0]) {
+			continue
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		sizes[fields[0]] = size
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("reading shared index %s: %s", url, err)
+	}
+	return nil
+}
+
+// putSharedIndex uploads one file of the shared index.
+func putSharedIndex(ctx context.Context, store storage.Storage, baseURL, name string, sizes map[string]int64) error {
+	oids := make([]string, 0, len(sizes))
+	for oid := range sizes {
+		oids = append(oids, oid)
+	}
+	sort.Strings(oids)
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	for _, oid := range oids {
+		fmt.Fprintf(zw, "%s %d\n", oid, sizes[oid])
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	dir, err := store.Join(baseURL, sharedIndexDir)
+	if err != nil {
+		return err
+	}
+	url, err := store.Join(dir, name)
+	if err != nil {
+		return err
+	}
+	_, err = store.Put(ctx, url, &buf, storage.PutOptions{
+		ContentType: "application/gzip",
+		Size:        int64(buf.Len()),
+	})
+	if err != nil {
+		return fmt.Errorf("uploading shared index %s: %s", name, err)
+	}
+	return nil
+}
+
+// compactSharedIndex merges the deltas of the shared index into its base,
+// and returns the number of objects in the new base.
+func compactSharedIndex(ctx context.Context, store storage.Storage, baseURL string) (int, error) {
+	sizes, deltas, err := loadSharedIndex(ctx, store, baseURL)
+	if err != nil {
+		return 0, err
+	}
+	if err := putSharedIndex(ctx, store, baseURL, sharedIndexBase, sizes); err != nil {
+		return 0, err
+	}
+	// Deltas written since the listing are kept for the next compaction.
+	for _, url := range deltas {
+		if err := store.Delete(ctx, url); err != nil {
+			return 0, fmt.Errorf("deleting shared index delta: %s", err)
+		}
+	}
+	log.Println("Compacted", len(deltas), "deltas into the shared index")
+	return len(sizes), nil
+}
+
+// writeSharedIndex replaces the shared index with the objects in remote
+// storage, from a full listing, e.g. after objects were deleted.
+func writeSharedIndex(ctx context.Context, conf Config, out io.Writer) error {
+	store, err := newStorage(conf)
+	if err != nil {
+		return err
+	}
+	_, deltas, err := loadSharedIndex(ctx, store, conf.BaseURL)
+	if err != nil {
+		return err
+	}
+	listing, err := store.List(ctx, conf.BaseURL, storage.ListOptions{Recursive: true})
+	if err != nil {
+		return fmt.Errorf("listing objects: %s", err)
+	}
+	sizes := map[string]int64{}
+	for _, obj := range listing {
+		if oid := objectOid(obj); oid != "" {
+			sizes[oid] = obj.Size
+		}
+	}
+	if err := putSharedIndex(ctx, store, conf.BaseURL, sharedIndexBase, sizes); err != nil {
+		return err
+	}
+	for _, url := range deltas {
+		if err := store.Delete(ctx, url); err != nil {
+			return fmt.Errorf("deleting shared index delta: %s", err)
+		}
+	}
+	fmt.Fprintf(out, "shared index lists %d objects\n", len(sizes))
+	return nil
+}
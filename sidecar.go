@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/buchanae/tanker/storage"
+)
+
+// Data derived from an object, e.g. the index of a BAM file or an image's
+// thumbnail, can be stored next to it as a sidecar, at "<base>/<oid>.<suffix>",
+// like signatures. After an object is uploaded, the generators whose pattern
+// matches one of the object's files in the repo run, and their output is
+// uploaded. Sidecars are optional: a generator which fails is logged, and
+// doesn't fail the upload. "tanker sidecar get" downloads sidecars.
+
+// SidecarConfig configures generating sidecar files for uploaded objects.
+type SidecarConfig struct {
+	Generators []SidecarGenerator
+}
+
+// SidecarGenerator generates one kind of sidecar.
+type SidecarGenerator struct {
+	// Glob of the files in the repo the generator applies to, e.g. "*.bam".
+	// A pattern without a "/" matches file names in any directory.
+	Pattern string
+	// Suffix of the sidecar, e.g. "bai" for "<oid>.bai".
+	Suffix string
+	// Command which writes the sidecar, and its arguments. "{in}" is
+	// replaced by the path of the object's content, which has the file's
+	// name in the repo, "{out}" by the path the sidecar must be written
+	// to, which is "{in}.<suffix>", "{path}" by the file's path in the repo,
+	// and "{oid}" by the object's OID, e.g. ["samtools", "index", "{in}"]
+	// or ["convert", "{in}[0]", "-thumbnail", "256x256", "png:{out}"].
+	Command []string
+}
+
+// sidecarURL returns the URL of an object's sidecar.
+func sidecarURL(store storage.Storage, baseURL, oid, suffix string) (string, error) {
+	return store.Join(baseURL, oid+"."+suffix)
+}
+
+// validateSidecars checks the generators in the config.
+func validateSidecars(conf SidecarConfig) error {
+	for _, g := range conf.Generators {
+		if _, err := path.Match(g.Pattern, ""); err != nil || g.Pattern == "" {
+			return userErrorf("Sidecars: invalid pattern %q", g.Pattern)
+		}
+		if g.Suffix == "" || strings.ContainsAny(g.Suffix, "/\\") || g.Suffix == "sig" {
+			return userErrorf("Sidecars: invalid suffix %q for pattern %q", g.Suffix, g.Pattern)
+		}
+		if len(g.Command) == 0 {
+			return userErrorf("Sidecars: no command for pattern %q", g.Pattern)
+		}
+	}
+	return nil
+}
+
+// matchesFile returns true if the generator applies to the file at "p".
+func (g SidecarGenerator) matchesFile(p string) bool {
+	if !strings.Contains(g.Pattern, "/") {
+		p = path.Base(p)
+	}
+	ok, _ := path.Match(g.Pattern, p)
+	return ok
+}
+
+// sidecarGenerators runs the generators for the uploads of one transfer
+// session. A nil *sidecarGenerators is valid, and generates nothing.
+type sidecarGenerators struct {
+	conf  Config
+	store storage.Storage
+
+	// The paths of the files in the repo, by OID, listed on first use.
+	once  sync.Once
+	paths map[string][]string
+}
+
+func newSidecarGenerators(conf Config, store storage.Storage) *sidecarGenerators {
+	if len(conf.Sidecars.Generators) == 0 {
+		return nil
+	}
+	return &sidecarGenerators{conf: conf, store: store}
+}
+
+// repoPaths returns the paths of the files in the repo, in any ref,
+// whose content is "oid".
+func (s *sidecarGenerators) repoPaths(oid string) []string {
+	s.once.Do(func() {
+		s.paths = map[string][]string{}
+		files, err := lsFiles("--all")
+		if err != nil {
+			errorln("Warning: can't generate sidecars:", err)
+			return
+		}
+		for _, f := range files {
+			s.paths[f.Oid] = append(s.paths[f.Oid], f.Path)
+		}
+	})
+	return s.paths[oid]
+}
+
+// generate runs the generators which apply to an uploaded object, whose
+// content is at "src", and uploads the sidecars. Failures are logged.
+func (s *sidecarGenerators) generate(ctx context.Context, oid, src string) {
+	if s == nil {
+		return
+	}
+	done := map[string]bool{}
+	for _, p := range s.repoPaths(oid) {
+		for _, g := range s.conf.Sidecars.Generators {
+			if done[g.Suffix] || !g.matchesFile(p) {
+				continue
+			}
+			done[g.Suffix] = true
+			if err := s.run(ctx, g, oid, src, p); err != nil {
+				errorln("Warning: failed to generate", g.Suffix, "sidecar of", p+":", err)
+			}
+		}
+	}
+}
+
+// run generates one sidecar of the file at "repoPath" and uploads it.
+func (s *sidecarGenerators) run(ctx context.Context, g SidecarGenerator, oid, src, repoPath string) error {
+	dir, err := ioutil.TempDir("", "tanker-sidecar-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	// The content is linked under the file's name, as tools may rely on
+	// its extension.
+	in := filepath.Join(dir, path.Base(repoPath))
+	if err := os.Symlink(src, in); err != nil {
+		in = src
+	}
+	out := in + "." + g.Suffix
+	args := make([]string, len(g.Command))
+	r := strings.NewReplacer("{in}", in, "{out}", out, "{path}", repoPath, "{oid}", oid)
+	for i, a := range g.Command {
+		args[i] = r.Replace(a)
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Dir = dir
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("running %s: %s: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+
+	fh, err := os.Open(out)
+	if err != nil {
+		return fmt.Errorf("%s wrote no sidecar: %s", args[0], err)
+	}
+	defer fh.Close()
+	info, err := fh.Stat()
+	if err != nil {
+		return err
+	}
+
+	url, err := sidecarURL(s.store, s.conf.BaseURL, oid, g.Suffix)
+	if err != nil {
+		return err
+	}
+	opts, body := putOptions(s.conf, out, fh)
+	opts.Size = info.Size()
+	_, err = s.store.Put(ctx, url, body, opts)
+	if _, ok := err.(*storage.ErrObjectExists); ok {
+		// With Immutable set, the sidecar from an earlier push is kept.
+		err = nil
+	}
+	if err != nil {
+		return fmt.Errorf("uploading sidecar: %s", err)
+	}
+	log.Println("Uploaded sidecar", url)
+	return nil
+}
+
+// getSidecars downloads the sidecars with the given suffix of objects,
+// given as OIDs or paths of LFS files in the repo. A file's sidecar is
+// written next to it, as "<path>.<suffix>", e.g. "reads.bam.bai", and an
+// OID's in the current directory, as "<oid>.<suffix>".
+func getSidecars(ctx context.Context, t *Tanker, suffix string, args []string) error {
+	store, err := newStorage(t.Config)
+	if err != nil {
+		return err
+	}
+
+	type target struct{ oid, dest string }
+	var targets []target
+	var paths []string
+	for _, arg := range args {
+		if isOID(arg) {
+			targets = append(targets, target{arg, arg + "." + suffix})
+		} else {
+			paths = append(paths, arg)
+		}
+	}
+	if len(paths) > 0 {
+		files, err := lsFiles("--include", strings.Join(paths, ","))
+		if err != nil {
+			return err
+		}
+		if len(files) == 0 {
+			return userErrorf("no LFS files matched %s", strings.Join(paths, ", "))
+		}
+		for _, f := range files {
+			targets = append(targets, target{f.Oid, f.Path + "." + suffix})
+		}
+	}
+
+	for _, tg := range targets {
+		url, err := sidecarURL(store, t.Config.BaseURL, tg.oid, suffix)
+		if err != nil {
+			return err
+		}
+		if err := downloadFile(ctx, store, url, tg.dest); storage.KindOf(err) == storage.NotFoundError {
+			return userErrorf("object %s has no %q sidecar", tg.oid, suffix)
+		} else if err != nil {
+			return err
+		}
+		fmt.Println(tg.dest)
+	}
+	return nil
+}
+
+// downloadFile downloads the object at "url" to "dest", through a temporary
+// file, so that "dest" is only replaced once the download is complete.
+func downloadFile(ctx context.Context, store storage.Storage, url, dest string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(dest), "."+filepath.Base(dest)+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = store.Get(ctx, url, tmp)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dest)
+}
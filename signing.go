@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/buchanae/tanker/storage"
+)
+
+// Uploaded objects can be signed with GPG, so that consumers can prove who
+// uploaded a dataset. Each object gets a detached signature stored next to
+// it, at "<base>/<oid>.sig". The signature covers a statement of the object's
+// OID and size, in the style of an LFS pointer, rather than its content:
+// git-lfs checks downloaded content against the OID, so signing the OID
+// proves the same without reading the object again.
+const signatureSuffix = ".sig"
+
+// SigningConfig configures signing uploads and verifying downloads.
+type SigningConfig struct {
+	// Sign each uploaded object with this GPG key, e.g. a fingerprint or
+	// an email address. Empty disables signing. Objects stored inline,
+	// see InlineConfig, aren't signed.
+	Key string
+	// Check the signature of each object before downloading it, and fail
+	// the download if the signature is missing or invalid.
+	Verify bool
+	// Fingerprints, or long key IDs, of the keys whose signatures are
+	// trusted. Empty trusts a valid signature by any key in the keyring.
+	TrustedKeys []string
+	// GPG command to run. Empty means "gpg".
+	Program string
+}
+
+// signedStatement returns the text signed for an object.
+func signedStatement(oid string, size int64) []byte {
+	return []byte(fmt.Sprintf("tanker object\noid %s\nsize %d\n", storage.PointerOID(oid), size))
+}
+
+// signatureURL returns the URL of an object's signature.
+func signatureURL(store storage.Storage, baseURL, oid string) (string, error) {
+	return store.Join(baseURL, oid+signatureSuffix)
+}
+
+func gpgProgram(conf SigningConfig) string {
+	if conf.Program != "" {
+		return conf.Program
+	}
+	return "gpg"
+}
+
+// signObject signs an object and uploads its signature.
+func signObject(ctx context.Context, store storage.Storage, conf Config, oid string, size int64) error {
+	var sig, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, gpgProgram(conf.Signing),
+		"--batch", "--yes", "--detach-sign", "--armor",
+		"--local-user", conf.Signing.Key, "--output", "-")
+	cmd.Stdin = bytes.NewReader(signedStatement(oid, size))
+	cmd.Stdout = &sig
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("signing object: %s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	url, err := signatureURL(store, conf.BaseURL, oid)
+	if err != nil {
+		return err
+	}
+	_, err = store.Put(ctx, url, &sig, storage.PutOptions{
+		ContentType: "application/pgp-signature",
+		Size:        int64(sig.Len()),
+		ACL:         conf.ACL,
+	})
+	if err != nil {
+		return fmt.Errorf("uploading signature: %s", err)
+	}
+	return nil
+}
+
+// verifyObject downloads an object's signature and checks it, returning
+// the fingerprint of the key which signed it.
+func verifyObject(ctx context.Context, store storage.Storage, conf Config, oid string, size int64) (string, error) {
+	url, err := signatureURL(store, conf.BaseURL, oid)
+	if err != nil {
+		return "", err
+	}
+	var sig bytes.Buffer
+	_, err = store.Get(ctx, url, &sig)
+	if storage.KindOf(err) == storage.NotFoundError {
+		return "", fmt.Errorf("object %s isn't signed", oid)
+	}
+	if err != nil {
+		return "", fmt.Errorf("downloading signature: %s", err)
+	}
+
+	// gpg reads the signature from a file, and the signed data from stdin.
+	tmp, err := ioutil.TempFile("", "tanker-sig-")
+	if err != nil {
+		return "", fmt.Errorf("writing signature: %s", err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(sig.Bytes())
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", fmt.Errorf("writing signature: %s", err)
+	}
+
+	var status, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, gpgProgram(conf.Signing),
+		"--batch", "--status-fd", "1", "--verify", tmp.Name(), "-")
+	cmd.Stdin = bytes.NewReader(signedStatement(oid, size))
+	cmd.Stdout = &status
+	cmd.Stderr = &stderr
+	runErr := cmd.Run()
+
+	fpr := validSignature(status.String())
+	if runErr != nil || fpr == "" {
+		return "", fmt.Errorf("invalid signature on object %s: %s", oid, strings.TrimSpace(stderr.String()))
+	}
+	if !trustedKey(conf.Signing.TrustedKeys, fpr) {
+		return "", fmt.Errorf("object %s is signed by untrusted key %s", oid, fpr)
+	}
+	return fpr, nil
+}
+
+// validSignature returns the fingerprint of the primary key which made
+// a valid signature, from gpg's status output, or an empty string.
+func validSignature(status string) string {
+	for _, line := range strings.Split(status, "\n") {
+		// "[GNUPG:] VALIDSIG <fpr> <date> ... [<primary key fpr>]"
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[0] != "[GNUPG:]" || fields[1] != "VALIDSIG" {
+			continue
+		}
+		if len(fields) >= 12 {
+			return fields[11]
+		}
+		return fields[2]
+	}
+	return ""
+}
+
+// trustedKey returns true if the fingerprint matches a trusted key, or if
+// there are no trusted keys.
+func trustedKey(trusted []string, fpr string) bool {
+	if len(trusted) == 0 {
+		return true
+	}
+	fpr = strings.ToUpper(fpr)
+	for _, k := range trusted {
+		k = strings.ToUpper(strings.Replace(k, " ", "", -1))
+		if k != "" && strings.HasSuffix(fpr, k) {
+			return true
+		}
+	}
+	return false
+}
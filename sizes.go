@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os/exec"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// historyObject is an LFS object found in the repo's history.
+type historyObject struct {
+	Oid  string
+	Size int64
+	// Commit which first added the object, and its date.
+	Commit, Date string
+	// Paths the object has been committed at.
+	Paths []string
+}
+
+// historyObjects walks the history of all refs for LFS pointers, and returns
+// the LFS objects they point to.
+func historyObjects() ([]*historyObject, error) {
+	// Oldest commits first, so the first commit seen with an object is
+	// the one which introduced it.
+	out, err := exec.Command("git", "log", "--all", "--reverse", "--raw", "-z",
+		"--no-abbrev", "--no-renames", "--diff-filter=AM", "--format=commit %H %as").Output()
+	if err != nil {
+		return nil, fmt.Errorf("reading git history: %s", err)
+	}
+
+	// Each commit is "commit <sha> <date>\0", followed by its changes,
+	// each "\n:<mode> <mode> <sha> <sha> <status>\0<path>\0".
+	type change struct {
+		commit, date, path string
+		blob               *gitBlob
+	}
+	var changes []change
+	blobs := map[string]*gitBlob{}
+	var commit, date string
+	fields := strings.Split(string(out), "\x00")
+	for i := 0; i < len(fields); i++ {
+		f := strings.TrimPrefix(fields[i], "\n")
+		if strings.HasPrefix(f, "commit ") {
+			parts := strings.Fields(f)
+			if len(parts) == 3 {
+				commit, date = parts[1], parts[2]
+			}
+			continue
+		}
+		meta := strings.Fields(f)
+		if !strings.HasPrefix(f, ":") || len(meta) != 5 || i+1 >= len(fields) {
+			continue
+		}
+		i++
+		if meta[1] == "160000" {
+			// Submodule.
+			continue
+		}
+		sha := meta[3]
+		if blobs[sha] == nil {
+			blobs[sha] = &gitBlob{Sha: sha}
+		}
+		changes = append(changes, change{commit, date, fields[i], blobs[sha]})
+	}
+
+	var unique []*gitBlob
+	for _, b := range blobs {
+		unique = append(unique, b)
+	}
+	if err := readPointers(unique); err != nil {
+		return nil, fmt.Errorf("reading LFS pointers: %s", err)
+	}
+
+	var objects []*historyObject
+	byOid := map[string]*historyObject{}
+	for _, c := range changes {
+		if !c.blob.LFS {
+			continue
+		}
+		obj, ok := byOid[c.blob.Oid]
+		if !ok {
+			obj = &historyObject{Oid: c.blob.Oid, Size: c.blob.Size, Commit: c.commit, Date: c.date}
+			byOid[obj.Oid] = obj
+			objects = append(objects, obj)
+		}
+		if !containsString(obj.Paths, c.path) {
+			obj.Paths = append(obj.Paths, c.path)
+		}
+	}
+	return objects, nil
+}
+
+// reportSizes writes the "top" largest LFS objects in the repo's history
+// to "out", with their paths and the commits which introduced them.
+// Zero means all objects.
+func reportSizes(top int, out io.Writer) error {
+	objects, err := historyObjects()
+	if err != nil {
+		return err
+	}
+	if len(objects) == 0 {
+		return fmt.Errorf("no LFS objects found in history")
+	}
+
+	var total int64
+	for _, obj := range objects {
+		total += obj.Size
+	}
+	sort.SliceStable(objects, func(i, j int) bool {
+		return objects[i].Size > objects[j].Size
+	})
+	shown := objects
+	if top > 0 && len(shown) > top {
+		shown = shown[:top]
+	}
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SIZE\tOID\tCOMMIT\tDATE\tPATHS")
+	for _, obj := range shown {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", formatBytes(obj.Size), obj.Oid[:12],
+			obj.Commit[:10], obj.Date, strings.Join(obj.Paths, ", "))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "\n%d LFS objects in history, %s in total\n", len(objects), formatBytes(total))
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/buchanae/tanker/protocol"
+)
+
+// statusInterval is how often the status file is rewritten.
+const statusInterval = time.Second
+
+// agentStatus is the content of .git/tanker/status.json, which is written
+// while "tanker transfer" runs, so that monitoring scripts can observe the
+// agent's progress. The file is removed when the agent exits, but one left
+// behind by a killed agent may be stale: check that Updated is recent, or
+// that PID is still running.
+type agentStatus struct {
+	PID int `json:"pid"`
+	// "upload" or "download", from git-lfs' init message.
+	Operation string    `json:"operation"`
+	Started   time.Time `json:"started"`
+	// Last time the file was written, about every second.
+	Updated time.Time `json:"updated"`
+	// Transfers in progress, oldest first.
+	Active    []*activeTransfer `json:"active"`
+	Completed int               `json:"completed"`
+	Failed    int               `json:"failed"`
+	LastError *statusError      `json:"lastError,omitempty"`
+}
+
+// activeTransfer is an upload or download in progress.
+type activeTransfer struct {
+	Oid        string    `json:"oid"`
+	Size       int       `json:"size"`
+	BytesSoFar int       `json:"bytesSoFar"`
+	Started    time.Time `json:"started"`
+}
+
+// statusError is the last transfer which failed.
+type statusError struct {
+	Oid     string    `json:"oid"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+// statusFile tracks the transfers in progress from the messages exchanged
+// with git-lfs, and writes them to the status file. A nil *statusFile
+// tracks nothing.
+type statusFile struct {
+	path string
+
+	mtx    sync.Mutex
+	status agentStatus
+	active map[string]*activeTransfer
+}
+
+func newStatusFile(path string) *statusFile {
+	if path == "" {
+		return nil
+	}
+	return &statusFile{
+		path: path,
+		status: agentStatus{
+			PID:     os.Getpid(),
+			Started: time.Now(),
+		},
+		active: map[string]*activeTransfer{},
+	}
+}
+
+// received tracks a message received from git-lfs.
+func (s *statusFile) received(m protocol.Message) {
+	if s == nil {
+		return
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	switch msg := m.(type) {
+	case *protocol.InitMessage:
+		s.status.Operation = msg.Operation
+	case *protocol.UploadMessage:
+		s.active[msg.Oid] = &activeTransfer{Oid: msg.Oid, Size: msg.Size, Started: time.Now()}
+	case *protocol.DownloadMessage:
+		s.active[msg.Oid] = &activeTransfer{Oid: msg.Oid, Size: msg.Size, Started: time.Now()}
+	}
+}
+
+// sent tracks a message sent to git-lfs. See protocol.Comms.OnSend.
+func (s *statusFile) sent(m protocol.Message) {
+	if s == nil {
+		return
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	switch msg := m.(type) {
+	case *protocol.ProgressMessage:
+		if t, ok := s.active[msg.Oid]; ok {
+			t.BytesSoFar = msg.BytesSoFar
+		}
+	case *protocol.CompleteMessage:
+		delete(s.active, msg.Oid)
+		s.status.Completed++
+	case *protocol.ErrorMessage:
+		delete(s.active, msg.Oid)
+		s.status.Failed++
+		s.status.LastError = &statusError{
+			Oid:     msg.Oid,
+			Message: msg.Error.Message,
+			Time:    time.Now(),
+		}
+	}
+}
+
+// start writes the status file every statusInterval until the returned
+// func is called, which removes it.
+func (s *statusFile) start() (stop func()) {
+	if s == nil {
+		return func() {}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(statusInterval)
+		defer ticker.Stop()
+		for {
+			if err := s.write(); err != nil {
+				debugln("Error writing status file", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+		os.Remove(s.path)
+	}
+}
+
+func (s *statusFile) write() error {
+	s.mtx.Lock()
+	status := s.status
+	status.Updated = time.Now()
+	status.Active = make([]*activeTransfer, 0, len(s.active))
+	for _, t := range s.active {
+		c := *t
+		status.Active = append(status.Active, &c)
+	}
+	s.mtx.Unlock()
+
+	sort.Slice(status.Active, func(i, j int) bool {
+		a, b := status.Active[i], status.Active[j]
+		if !a.Started.Equal(b.Started) {
+			return a.Started.Before(b.Started)
+		}
+		return a.Oid < b.Oid
+	})
+	b, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, append(b, '\n'), 0644)
+}
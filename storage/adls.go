@@ -0,0 +1,509 @@
+//go:build !noadls
+// +build !noadls
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	urllib "net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+func init() {
+	Register("abfss", Backend{
+		Name: "adls",
+		New: func(c Config) (Storage, error) {
+			return NewADLS(c.ADLS)
+		},
+		Enabled: func(c Config) bool { return c.ADLS.Valid() },
+		ValidateURL: func(url string) error {
+			u, err := (&ADLS{}).parse(url)
+			if err != nil {
+				return err
+			}
+			if !strings.Contains(u.bucket, "@") {
+				return &ErrInvalidURL{"adls"}
+			}
+			return nil
+		},
+	})
+}
+
+const (
+	// Version of the Data Lake Storage REST API.
+	adlsAPIVersion = "2021-06-08"
+	// Uploads are appended in chunks of this size, each buffered in memory.
+	adlsChunkSize = 8 * 1024 * 1024
+)
+
+// ADLS provides access to Azure Data Lake Storage Gen2, i.e. storage
+// accounts with a hierarchical namespace, through the Data Lake REST API.
+//
+// URLs are the same as Spark and Hadoop use:
+// "abfss://<filesystem>@<account>.dfs.core.windows.net/<path>".
+// Directories are real, so List reports them, and Move renames atomically.
+//
+// Files in the Archive access tier are reported as Archived by Stat,
+// and are rehydrated to ADLSConfig.RestoreTier by RequestRestore.
+type ADLS struct {
+	client *http.Client
+	sas    urllib.Values
+	conf   ADLSConfig
+}
+
+// NewADLS creates an ADLS client, authorized with a SAS token if configured,
+// or else with an Azure AD service principal.
+func NewADLS(conf ADLSConfig) (*ADLS, error) {
+	sas := firstNonEmpty(conf.SASToken, os.Getenv("AZURE_STORAGE_SAS_TOKEN"))
+	if sas != "" {
+		q, err := urllib.ParseQuery(strings.TrimPrefix(sas, "?"))
+		if err != nil {
+			return nil, fmt.Errorf("parsing SAS token: %s", err)
+		}
+		return &ADLS{client: sharedClient, sas: q, conf: conf}, nil
+	}
+
+	tenant := firstNonEmpty(conf.TenantID, os.Getenv("AZURE_TENANT_ID"))
+	cc := &clientcredentials.Config{
+		ClientID:     firstNonEmpty(conf.ClientID, os.Getenv("AZURE_CLIENT_ID")),
+		ClientSecret: firstNonEmpty(conf.ClientSecret, os.Getenv("AZURE_CLIENT_SECRET")),
+		TokenURL:     "https://login.microsoftonline.com/" + tenant + "/oauth2/v2.0/token",
+		Scopes:       []string{"https://storage.azure.com/.default"},
+	}
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, sharedClient)
+	return &ADLS{client: cc.Client(ctx), conf: conf}, nil
+}
+
+// Stat returns information about the object at the given storage URL.
+// The Data Lake API doesn't report access tiers, so this uses the Blob API.
+func (a *ADLS) Stat(ctx context.Context, url string) (*Object, error) {
+	resp, err := a.blobRequest(ctx, url, "HEAD", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.Header.Get("X-Ms-Meta-Hdi_isfolder") == "true" {
+		return nil, &ErrNotFound{"adls", url}
+	}
+
+	obj := a.object(url, resp.Header)
+	obj.StorageClass = resp.Header.Get("X-Ms-Access-Tier")
+	obj.Archived = obj.StorageClass == "Archive"
+	// While rehydrating, the tier is still "Archive" and the archive status
+	// is e.g. "rehydrate-pending-to-hot".
+	obj.Restoring = strings.HasPrefix(resp.Header.Get("X-Ms-Archive-Status"), "rehydrate-pending")
+	return obj, nil
+}
+
+func (a *ADLS) object(url string, h http.Header) *Object {
+	u, _ := a.parse(url)
+	modtime, _ := time.Parse(http.TimeFormat, h.Get("Last-Modified"))
+	size, _ := strconv.ParseInt(h.Get("Content-Length"), 10, 64)
+	obj := &Object{
+		URL:          url,
+		Name:         u.path,
+		ETag:         strings.Trim(h.Get("Etag"), `"`),
+		LastModified: modtime,
+		Size:         size,
+	}
+	if sum := base64ToHex(h.Get("Content-Md5")); sum != "" {
+		obj.Checksum = sum
+		obj.ChecksumType = ChecksumMD5
+	}
+	return obj
+}
+
+// List lists the objects at the given URL. Unless the listing is recursive,
+// subdirectories are listed as objects with Dir set. See ListOptions.
+func (a *ADLS) List(ctx context.Context, url string, opts ListOptions) ([]*Object, error) {
+	u, err := a.parse(url)
+	if err != nil {
+		return nil, err
+	}
+	fsURL := ADLSProtocol + u.bucket
+
+	q := urllib.Values{
+		"resource":  {"filesystem"},
+		"recursive": {strconv.FormatBool(opts.Recursive)},
+	}
+	if dir := strings.Trim(u.path, "/"); dir != "" {
+		q.Set("directory", dir)
+	}
+
+	var objects []*Object
+	for {
+		resp, err := a.request(ctx, url, "GET", fsURL, q, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Paths []struct {
+				Name          string      `json:"name"`
+				IsDirectory   interface{} `json:"isDirectory"`
+				ContentLength interface{} `json:"contentLength"`
+				LastModified  string      `json:"lastModified"`
+				ETag          string      `json:"etag"`
+			} `json:"paths"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, &adlsError{"decoding listing", url, 0, "", err}
+		}
+
+		for _, p := range page.Paths {
+			// The API returns some booleans and numbers as strings.
+			isDir := fmt.Sprint(p.IsDirectory) == "true"
+			if isDir && opts.Recursive {
+				continue
+			}
+			size, _ := strconv.ParseInt(fmt.Sprint(p.ContentLength), 10, 64)
+			modtime, _ := time.Parse(http.TimeFormat, p.LastModified)
+			objects = append(objects, &Object{
+				URL:          fsURL + "/" + p.Name,
+				Name:         p.Name,
+				ETag:         strings.Trim(p.ETag, `"`),
+				LastModified: modtime,
+				Size:         size,
+				Dir:          isDir,
+			})
+		}
+
+		cont := resp.Header.Get("X-Ms-Continuation")
+		if cont == "" {
+			return objects, nil
+		}
+		q.Set("continuation", cont)
+	}
+}
+
+// Get copies an object from ADLS to "dest".
+func (a *ADLS) Get(ctx context.Context, url string, dest io.Writer) (*Object, error) {
+	resp, err := a.request(ctx, url, "GET", url, nil, nil, nil)
+	if err != nil {
+		return nil, a.archivedError(ctx, url, err)
+	}
+	defer resp.Body.Close()
+
+	_, copyErr := io.Copy(dest, ContextReader(ctx, resp.Body))
+	if copyErr != nil {
+		return nil, &adlsError{"copying file", url, 0, "", copyErr}
+	}
+	return a.object(url, resp.Header), nil
+}
+
+// GetRange copies part of an object from ADLS to "dest".
+func (a *ADLS) GetRange(ctx context.Context, url string, offset, length int64, dest io.Writer) error {
+	header := http.Header{"Range": {rangeHeader(offset, length)}}
+	resp, err := a.request(ctx, url, "GET", url, nil, header, nil)
+	if err != nil {
+		return a.archivedError(ctx, url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return &adlsError{"range request ignored", url, resp.StatusCode, "", nil}
+	}
+	_, copyErr := io.Copy(dest, ContextReader(ctx, resp.Body))
+	if copyErr != nil {
+		return &adlsError{"copying file", url, 0, "", copyErr}
+	}
+	return nil
+}
+
+// archivedError returns ErrArchived if "err" is the error of reading
+// an archived file, or else "err".
+func (a *ADLS) archivedError(ctx context.Context, url string, err error) error {
+	e, ok := err.(*adlsError)
+	if !ok || e.errorCode != "BlobArchived" {
+		return err
+	}
+	restoring := false
+	if obj, err := a.Stat(ctx, url); err == nil {
+		restoring = obj.Restoring
+	}
+	return &ErrArchived{"adls", url, restoring}
+}
+
+// RequestRestore starts rehydrating an archived file to
+// ADLSConfig.RestoreTier, which takes up to 15 hours at "Standard"
+// priority.
+func (a *ADLS) RequestRestore(ctx context.Context, url string) error {
+	header := http.Header{
+		"X-Ms-Access-Tier":        {firstNonEmpty(a.conf.RestoreTier, "Hot")},
+		"X-Ms-Rehydrate-Priority": {firstNonEmpty(a.conf.RestorePriority, "Standard")},
+	}
+	resp, err := a.blobRequest(ctx, url, "PUT", urllib.Values{"comp": {"tier"}}, header)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Put copies an object from "src" to ADLS. The file is created, its content
+// appended in chunks, and then flushed, which makes it visible and sets its
+// MD5. Missing parent directories are created.
+func (a *ADLS) Put(ctx context.Context, url string, src io.Reader, opts PutOptions) (*Object, error) {
+	header := http.Header{}
+	if opts.IfNotExists {
+		header.Set("If-None-Match", "*")
+	}
+	resp, err := a.request(ctx, url, "PUT", url, urllib.Values{"resource": {"file"}}, header, nil)
+	if e, ok := err.(*adlsError); ok && opts.IfNotExists &&
+		(e.code == http.StatusConflict || e.code == http.StatusPreconditionFailed) {
+		return nil, &ErrObjectExists{"adls", url}
+	}
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	src = ContextReader(ctx, src)
+	hash := md5.New()
+	buf := make([]byte, adlsChunkSize)
+	var pos int64
+	for {
+		n, readErr := io.ReadFull(src, buf)
+		if n > 0 {
+			hash.Write(buf[:n])
+			q := urllib.Values{"action": {"append"}, "position": {strconv.FormatInt(pos, 10)}}
+			resp, err := a.request(ctx, url, "PATCH", url, q, nil, bytes.NewReader(buf[:n]))
+			if err != nil {
+				return nil, err
+			}
+			resp.Body.Close()
+			pos += int64(n)
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			return nil, &adlsError{"reading file", url, 0, "", readErr}
+		}
+	}
+
+	sum := hash.Sum(nil)
+	header = http.Header{"X-Ms-Content-Md5": {base64.StdEncoding.EncodeToString(sum)}}
+	if opts.ContentType != "" {
+		header.Set("X-Ms-Content-Type", opts.ContentType)
+	}
+	q := urllib.Values{"action": {"flush"}, "position": {strconv.FormatInt(pos, 10)}}
+	resp, err = a.request(ctx, url, "PATCH", url, q, header, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	obj := a.object(url, resp.Header)
+	obj.Size = pos
+	obj.Checksum = hex.EncodeToString(sum)
+	obj.ChecksumType = ChecksumMD5
+	return obj, nil
+}
+
+// Delete deletes the object at the given URL.
+func (a *ADLS) Delete(ctx context.Context, url string) error {
+	resp, err := a.request(ctx, url, "DELETE", url, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Move renames an object within a filesystem, atomically.
+func (a *ADLS) Move(ctx context.Context, src, dst string) error {
+	s, err := a.parse(src)
+	if err != nil {
+		return err
+	}
+	d, err := a.parse(dst)
+	if err != nil {
+		return err
+	}
+	if s.bucket != d.bucket {
+		return &ErrUnsupportedOperation{"adls", "copy", "objects can only be moved within a filesystem"}
+	}
+
+	fs := s.bucket[:strings.Index(s.bucket, "@")]
+	header := http.Header{"X-Ms-Rename-Source": {"/" + fs + "/" + escapePath(s.path)}}
+	resp, err := a.request(ctx, src, "PUT", dst, nil, header, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Join joins the given URL with the given subpath.
+func (a *ADLS) Join(url, path string) (string, error) {
+	return strings.TrimSuffix(url, "/") + "/" + path, nil
+}
+
+// UnsupportedOperations describes which operations are not supported
+// for the given URL.
+func (a *ADLS) UnsupportedOperations(url string) UnsupportedOperations {
+	u, err := a.parse(url)
+	if err != nil {
+		return AllUnsupported(err)
+	}
+	if !strings.Contains(u.bucket, "@") {
+		return AllUnsupported(&ErrInvalidURL{"adls"})
+	}
+	return UnsupportedOperations{
+		ACL: &ErrUnsupportedOperation{"adls", "acl", "Data Lake Storage uses POSIX ACLs, which aren't implemented"},
+	}
+}
+
+// request sends a request to the Data Lake endpoint for the path at
+// "target", e.g. a file or a filesystem URL. "url" is the storage URL being
+// operated on, for errors. Responses other than 2xx are returned as errors.
+func (a *ADLS) request(ctx context.Context, url, method, target string, q urllib.Values, header http.Header, body io.Reader) (*http.Response, error) {
+	httpURL, err := a.httpURL(target, q, false)
+	if err != nil {
+		return nil, err
+	}
+	return a.send(ctx, url, method, httpURL, header, body)
+}
+
+// blobRequest sends a request to the Blob endpoint of the same account,
+// for the operations which only it supports, e.g. access tiers.
+func (a *ADLS) blobRequest(ctx context.Context, url, method string, q urllib.Values, header http.Header) (*http.Response, error) {
+	httpURL, err := a.httpURL(url, q, true)
+	if err != nil {
+		return nil, err
+	}
+	return a.send(ctx, url, method, httpURL, header, nil)
+}
+
+// httpURL returns the HTTP URL of the Data Lake or Blob endpoint for the
+// path at "target", with the SAS token and query "q".
+func (a *ADLS) httpURL(target string, q urllib.Values, blob bool) (string, error) {
+	u, err := a.parse(target)
+	if err != nil {
+		return "", err
+	}
+	i := strings.Index(u.bucket, "@")
+	if i < 0 {
+		return "", &ErrInvalidURL{"adls"}
+	}
+	fs, host := u.bucket[:i], u.bucket[i+1:]
+	if blob {
+		host = strings.Replace(host, ".dfs.", ".blob.", 1)
+	}
+
+	query := urllib.Values{}
+	for k, v := range a.sas {
+		query[k] = v
+	}
+	for k, v := range q {
+		query[k] = v
+	}
+	httpURL := "https://" + host + "/" + fs
+	if u.path != "" {
+		httpURL += "/" + escapePath(u.path)
+	}
+	if len(query) > 0 {
+		httpURL += "?" + query.Encode()
+	}
+	return httpURL, nil
+}
+
+// send sends a request. Responses other than 2xx are returned as errors.
+func (a *ADLS) send(ctx context.Context, url, method, httpURL string, header http.Header, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, httpURL, body)
+	if err != nil {
+		return nil, &adlsError{"creating request", url, 0, "", err}
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("X-Ms-Version", adlsAPIVersion)
+
+	resp, err := a.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, &adlsError{strings.ToLower(method), url, 0, "", err}
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, &ErrNotFound{"adls", url}
+	}
+	return nil, &adlsError{strings.ToLower(method), url, resp.StatusCode, resp.Header.Get("X-Ms-Error-Code"), nil}
+}
+
+// parse splits an ABFS URL into the "<filesystem>@<host>" part, as the
+// bucket, and the path.
+func (a *ADLS) parse(rawurl string) (*urlparts, error) {
+	if !strings.HasPrefix(rawurl, ADLSProtocol) {
+		return nil, &ErrUnsupportedProtocol{"adls"}
+	}
+
+	path := strings.TrimPrefix(rawurl, ADLSProtocol)
+	if path == "" {
+		return nil, &ErrInvalidURL{"adls"}
+	}
+
+	split := strings.SplitN(path, "/", 2)
+	url := &urlparts{}
+	if len(split) > 0 {
+		url.bucket = split[0]
+	}
+	if len(split) == 2 {
+		url.path = split[1]
+	}
+	return url, nil
+}
+
+func firstNonEmpty(vals ...string) string {
+	for _, v := range vals {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+type adlsError struct {
+	msg, url string
+	// HTTP status code and Azure error code of the response, if any.
+	code      int
+	errorCode string
+	err       error
+}
+
+func (e *adlsError) Error() string {
+	switch {
+	case e.errorCode != "":
+		return fmt.Sprintf("adls: %s: %s: %d %s", e.msg, e.url, e.code, e.errorCode)
+	case e.code != 0:
+		return fmt.Sprintf("adls: %s: %s: %d %s", e.msg, e.url, e.code, http.StatusText(e.code))
+	}
+	return fmt.Sprintf("adls: %s: %s: %v", e.msg, e.url, e.err)
+}
+
+// Kind classifies the error. See ErrorKind.
+func (e *adlsError) Kind() ErrorKind {
+	if e.code != 0 {
+		return classifyHTTPStatus(e.code)
+	}
+	return classifyNetError(e.err)
+}
@@ -0,0 +1,354 @@
+package storage
+
+import (
+	"os"
+	"os/exec"
+)
+
+// The configuration and URL protocols of the built-in backends are defined
+// here, rather than with the backends, so that the Config stays the same
+// when backends are excluded by build tags. See Register.
+
+const SwiftProtocol = "swift://"
+
+// SwiftConfig configures the OpenStack Swift object storage backend.
+type SwiftConfig struct {
+	Disabled   bool
+	UserName   string
+	Password   string
+	AuthURL    string
+	TenantName string
+	TenantID   string
+	RegionName string
+	// Size of chunks to use for large object creation.
+	// Defaults to 500 MB if not set or set below 10 MB.
+	// The max number of chunks for a single object is 1000.
+	ChunkSizeBytes int64
+	// Number of chunks to aim for when the size of an object is known before
+	// it's uploaded. The chunk size is derived from the object size, clamped
+	// to the limits of Swift, and ChunkSizeBytes is used only for objects of
+	// unknown size. Set to zero to always use ChunkSizeBytes.
+	TargetChunkCount int
+	// Number of chunks of a large object to upload concurrently.
+	// Each chunk in flight is buffered in memory, so memory use grows
+	// with UploadConcurrency * chunk size. Defaults to 1.
+	UploadConcurrency int
+	// Deprecated: unused, kept so that existing configs still parse, and
+	// a warning is logged when it's set. Set Retry.Backends with Scheme
+	// "swift" to tune retries on Swift.
+	MaxRetries int `json:",omitempty"`
+	// Read public containers without credentials. Requires StorageURL,
+	// since there's no sign in to look it up. Uploads aren't supported.
+	Anonymous bool
+	// Storage URL of the account, e.g.
+	// "https://swift.example.com/v1/AUTH_project". Defaults to
+	// $OS_STORAGE_URL.
+	StorageURL string
+}
+
+// Valid validates the SwiftConfig configuration.
+func (s SwiftConfig) Valid() bool {
+	user := s.UserName != "" || os.Getenv("OS_USERNAME") != ""
+	password := s.Password != "" || os.Getenv("OS_PASSWORD") != ""
+	authURL := s.AuthURL != "" || os.Getenv("OS_AUTH_URL") != ""
+	tenantName := s.TenantName != "" || os.Getenv("OS_TENANT_NAME") != "" || os.Getenv("OS_PROJECT_NAME") != ""
+	tenantID := s.TenantID != "" || os.Getenv("OS_TENANT_ID") != "" || os.Getenv("OS_PROJECT_ID") != ""
+	region := s.RegionName != "" || os.Getenv("OS_REGION_NAME") != ""
+
+	valid := user && password && authURL && tenantName && tenantID && region
+	if s.Anonymous {
+		valid = s.StorageURL != "" || os.Getenv("OS_STORAGE_URL") != ""
+	}
+
+	return !s.Disabled && valid
+}
+
+// The gs url protocol
+const GSProtocol = "gs://"
+
+// GoogleCloudConfig describes configuration for the Google Cloud storage backend.
+type GoogleCloudConfig struct {
+	Disabled bool
+	// If no account file is provided then storage will try to use Google Application
+	// Default Credentials to authorize and authenticate the client.
+	CredentialsFile string
+	// Read public objects without looking for credentials at all, e.g. on
+	// machines with no Google Cloud account. Uploads aren't supported.
+	Anonymous bool
+}
+
+// Valid validates the Config configuration.
+func (g GoogleCloudConfig) Valid() bool {
+	return !g.Disabled
+}
+
+const S3Protocol = "s3://"
+
+// S3Config configures the Amazon S3 storage backend, which also works with
+// S3-compatible stores, e.g. MinIO or Ceph. Credentials are found the same
+// way as the AWS CLI finds them: AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY,
+// then the profile in ~/.aws/credentials and ~/.aws/config, including SSO
+// and assumed roles, then the IAM role of the EC2 instance or ECS task.
+type S3Config struct {
+	Disabled bool
+	// Profile in the shared config files. Defaults to $AWS_PROFILE,
+	// or "default".
+	Profile string
+	// Region of the buckets, e.g. "eu-west-1". Defaults to $AWS_REGION, or
+	// the profile's region. If neither is set, each bucket's region is
+	// looked up.
+	Region string
+	// Endpoint of an S3-compatible store, e.g. "https://minio.example.com".
+	// Empty means Amazon S3.
+	Endpoint string
+	// Address buckets as "<endpoint>/<bucket>", rather than as subdomains
+	// of the endpoint, which many S3-compatible stores require.
+	ForcePathStyle bool
+	// Size of the parts of multipart uploads, which are used for objects
+	// larger than one part. Each part in flight is buffered in memory.
+	// Raised as needed to fit large objects in 10,000 parts. Defaults to
+	// 64 MB, and can't be less than 5 MB.
+	PartSize int64
+	// Number of parts of an upload to send concurrently. Defaults to 4.
+	UploadConcurrency int
+	// Read public buckets without credentials, with unsigned requests.
+	// Uploads aren't supported.
+	Anonymous bool
+	// Number of days restored copies of objects in Glacier storage
+	// classes are kept for. Defaults to 7.
+	RestoreDays int64
+	// Retrieval tier of restores: "Standard", "Bulk", or "Expedited".
+	// Defaults to "Standard".
+	RestoreTier string
+}
+
+// Valid validates the S3Config configuration. Credentials are looked up
+// on use, since they may come from an instance's IAM role.
+func (c S3Config) Valid() bool {
+	return !c.Disabled
+}
+
+const FTPProtocol = "ftp://"
+
+// FTPConfig configures the http storage backend.
+type FTPConfig struct {
+	Disabled bool
+	// Timeout duration for http GET calls
+	Timeout Duration
+	// Login used for servers which have no entry in the .netrc file,
+	// and whose URL has no user, e.g. "anonymous".
+	User     string
+	Password string
+	// Path of a .netrc file with logins for FTP servers. Empty means
+	// $NETRC or ~/.netrc.
+	NetrcFile string
+	// Don't read logins from the .netrc file.
+	IgnoreNetrc bool
+	// Follow symbolic links in List and Stat, e.g. for mirrored archives
+	// with a "latest" link to a release directory. Links which would
+	// cause a cycle aren't followed. When false, links are reported as
+	// objects with Object.Link set to the link's target.
+	FollowLinks bool
+}
+
+// Valid validates the FTPConfig configuration.
+func (h FTPConfig) Valid() bool {
+	return !h.Disabled
+}
+
+const SFTPProtocol = "sftp://"
+
+// SFTPConfig configures the SFTP storage backend, for SSH servers, e.g. an
+// institution's file server. Host aliases, users, ports, identity files,
+// known_hosts files, and ProxyJump are read from ~/.ssh/config, as ssh does.
+type SFTPConfig struct {
+	Disabled bool
+	// Login for servers whose URL has no user, and which the ssh config
+	// has no User for. Empty means the current user.
+	User string
+	// Private key. Empty uses the ssh config's IdentityFile for the host,
+	// then the keys of ssh-agent and ~/.ssh/id_ed25519, id_ecdsa, and id_rsa.
+	IdentityFile string
+	// known_hosts file which server keys are checked against. Empty uses
+	// the ssh config's UserKnownHostsFile for the host, or ~/.ssh/known_hosts.
+	KnownHostsFile string
+	// Path of the ssh config file. Empty means ~/.ssh/config.
+	SSHConfigFile string
+	// Don't read the ssh config file.
+	IgnoreSSHConfig bool
+	// Path of a .netrc file with passwords, for servers which allow
+	// password logins. Keys are tried first. Empty means $NETRC or ~/.netrc.
+	NetrcFile string
+	// Don't read passwords from the .netrc file.
+	IgnoreNetrc bool
+}
+
+// Valid validates the SFTPConfig configuration.
+func (c SFTPConfig) Valid() bool {
+	return !c.Disabled
+}
+
+const IPFSProtocol = "ipfs://"
+
+// IPFSConfig configures the IPFS storage backend, which downloads
+// public datasets through an IPFS HTTP gateway.
+type IPFSConfig struct {
+	Disabled bool
+	// URL of the HTTP gateway, e.g. "https://ipfs.io" or a local node's
+	// gateway at "http://127.0.0.1:8080".
+	Gateway string
+}
+
+// Valid validates the IPFSConfig configuration.
+func (c IPFSConfig) Valid() bool {
+	return !c.Disabled && c.Gateway != ""
+}
+
+const GlobusProtocol = "globus://"
+
+// GlobusConfig configures the Globus storage backend, which moves objects
+// with Globus transfer tasks.
+type GlobusConfig struct {
+	Disabled bool
+	// OAuth2 access token for the Globus Transfer API.
+	// Defaults to the GLOBUS_ACCESS_TOKEN environment variable.
+	AccessToken string
+	// ID of the local endpoint, e.g. a Globus Connect Personal endpoint
+	// on this machine, which uploads and downloads go through.
+	LocalEndpoint string
+	// Local directory where files are staged for transfer. It must be
+	// accessible through the local endpoint.
+	StagingDir string
+	// Path of StagingDir as seen by the local endpoint, if it differs,
+	// e.g. "/~/tanker-staging". Defaults to StagingDir.
+	StagingPath string
+	// How often to poll the status of transfer tasks.
+	PollInterval Duration
+}
+
+// Valid validates the GlobusConfig configuration.
+func (c GlobusConfig) Valid() bool {
+	token := c.AccessToken != "" || os.Getenv("GLOBUS_ACCESS_TOKEN") != ""
+	return !c.Disabled && token
+}
+
+const IRODSProtocol = "irods://"
+
+// IRODSConfig configures the iRODS storage backend. The connection and
+// credentials are those of the icommands, see "iinit".
+type IRODSConfig struct {
+	Disabled bool
+	// Storage resource to upload to and download from, e.g. "demoResc".
+	// Empty means the grid's default resource.
+	Resource string
+	// Number of threads for parallel transfers of large objects.
+	// Zero lets iRODS decide.
+	Threads int
+	// Directory for temporary files, which hold objects being transferred.
+	// Empty means the system's temporary directory.
+	TempDir string
+}
+
+// Valid validates the IRODSConfig configuration.
+func (c IRODSConfig) Valid() bool {
+	_, err := exec.LookPath("iquest")
+	return !c.Disabled && err == nil
+}
+
+const GDriveProtocol = "gdrive://"
+
+// GoogleDriveConfig configures the Google Drive storage backend.
+// Sign in with "tanker login gdrive".
+type GoogleDriveConfig struct {
+	Disabled bool
+	// OAuth client of type "TVs and Limited Input devices",
+	// created in the Google Cloud console.
+	ClientID     string
+	ClientSecret string
+}
+
+// Valid validates the GoogleDriveConfig configuration.
+func (c GoogleDriveConfig) Valid() bool {
+	return !c.Disabled && c.ClientID != ""
+}
+
+const DropboxProtocol = "dropbox://"
+
+// DropboxConfig configures the Dropbox storage backend.
+// Sign in with "tanker login dropbox".
+type DropboxConfig struct {
+	Disabled bool
+	// App key of a Dropbox app, created in the Dropbox App Console.
+	AppKey string
+}
+
+// Valid validates the DropboxConfig configuration.
+func (c DropboxConfig) Valid() bool {
+	return !c.Disabled && c.AppKey != ""
+}
+
+const ADLSProtocol = "abfss://"
+
+// ADLSConfig configures the Azure Data Lake Storage Gen2 backend.
+// Requests are authorized with a SAS token if set, or else with
+// an Azure AD service principal.
+type ADLSConfig struct {
+	Disabled bool
+	// Shared access signature, e.g. "sv=...&sig=...".
+	// Defaults to the AZURE_STORAGE_SAS_TOKEN environment variable.
+	SASToken string
+	// Service principal credentials. Default to the AZURE_TENANT_ID,
+	// AZURE_CLIENT_ID, and AZURE_CLIENT_SECRET environment variables.
+	TenantID     string
+	ClientID     string
+	ClientSecret string
+	// Access tier which archived files are restored to, "Hot" or "Cool".
+	// Defaults to "Hot".
+	RestoreTier string
+	// Rehydration priority of restores, "Standard" or "High".
+	// Defaults to "Standard".
+	RestorePriority string
+}
+
+// Valid validates the ADLSConfig configuration.
+func (c ADLSConfig) Valid() bool {
+	sas := c.SASToken != "" || os.Getenv("AZURE_STORAGE_SAS_TOKEN") != ""
+	tenant := c.TenantID != "" || os.Getenv("AZURE_TENANT_ID") != ""
+	client := c.ClientID != "" || os.Getenv("AZURE_CLIENT_ID") != ""
+	secret := c.ClientSecret != "" || os.Getenv("AZURE_CLIENT_SECRET") != ""
+
+	return !c.Disabled && (sas || (tenant && client && secret))
+}
+
+// WebDAV URLs: "dav://" is served over HTTP and "davs://" over HTTPS.
+const (
+	WebDAVProtocol       = "dav://"
+	WebDAVSecureProtocol = "davs://"
+)
+
+// WebDAVConfig configures the WebDAV backend, e.g. for Nextcloud or
+// ownCloud, whose base URLs look like
+// "davs://cloud.example.org/remote.php/dav/files/<user>/lfs".
+// Requests are authorized with a bearer token if set, or else with
+// basic auth.
+type WebDAVConfig struct {
+	Disabled bool
+	// Bearer token, e.g. an OAuth2 access token.
+	// Defaults to the WEBDAV_TOKEN environment variable.
+	Token string
+	// Login for basic auth, for servers whose URL has no user. Credentials
+	// in the URL come first, then the .netrc file, then these.
+	User string
+	// Password for basic auth, e.g. a Nextcloud app password.
+	// Defaults to the WEBDAV_PASSWORD environment variable.
+	Password string
+	// Path of a .netrc file with logins. Empty means $NETRC or ~/.netrc.
+	NetrcFile string
+	// Don't read logins from the .netrc file.
+	IgnoreNetrc bool
+}
+
+// Valid validates the WebDAVConfig configuration.
+func (c WebDAVConfig) Valid() bool {
+	return !c.Disabled
+}
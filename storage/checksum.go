@@ -0,0 +1,47 @@
+package storage
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"hash/crc32"
+)
+
+// Checksum types, as reported in Object.ChecksumType.
+const (
+	ChecksumMD5    = "md5"
+	ChecksumCRC32C = "crc32c"
+	ChecksumSHA256 = "sha256"
+)
+
+// NewChecksumHash returns a hash which computes checksums of the given type,
+// formatted as in Object.Checksum by HexChecksum. It returns nil if the type
+// is unknown.
+func NewChecksumHash(typ string) hash.Hash {
+	switch typ {
+	case ChecksumMD5:
+		return md5.New()
+	case ChecksumCRC32C:
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	case ChecksumSHA256:
+		return sha256.New()
+	}
+	return nil
+}
+
+// HexChecksum formats the sum of a hash returned by NewChecksumHash.
+func HexChecksum(h hash.Hash) string {
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// base64ToHex converts a base64 encoded checksum, as returned by
+// some APIs, to hex. It returns an empty string if "s" is invalid.
+func base64ToHex(s string) string {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,498 @@
+//go:build !nodropbox
+// +build !nodropbox
+
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"golang.org/x/oauth2"
+)
+
+func init() {
+	Register("dropbox", Backend{
+		Name: "dropbox",
+		New: func(c Config) (Storage, error) {
+			return NewDropbox(c.Dropbox)
+		},
+		Enabled: func(c Config) bool { return c.Dropbox.Valid() },
+		ValidateURL: func(url string) error {
+			_, err := (&Dropbox{}).parse(url)
+			return err
+		},
+		Login: func(ctx context.Context, c Config, in io.Reader, out io.Writer) error {
+			return LoginDropbox(ctx, c.Dropbox, in, out)
+		},
+	})
+}
+
+const (
+	dropboxAPI     = "https://api.dropboxapi.com/2/"
+	dropboxContent = "https://content.dropboxapi.com/2/"
+	// Objects larger than this are uploaded in chunks, with an upload
+	// session. Each chunk is buffered in memory.
+	dropboxChunkSize = 16 * 1024 * 1024
+)
+
+// Dropbox provides access to files in Dropbox, signed in as a user with
+// "tanker login dropbox".
+//
+// URLs are of the form "dropbox://<path>", e.g. "dropbox://lab/data"
+// for the "/lab/data" folder.
+type Dropbox struct {
+	client *http.Client
+}
+
+// dropboxOAuthConfig returns the OAuth config for signing in to Dropbox.
+// The app key identifies a public client, so there's no secret.
+func dropboxOAuthConfig(conf DropboxConfig) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID: conf.AppKey,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:   "https://www.dropbox.com/oauth2/authorize",
+			TokenURL:  "https://api.dropboxapi.com/oauth2/token",
+			AuthStyle: oauth2.AuthStyleInParams,
+		},
+	}
+}
+
+// NewDropbox creates a Dropbox client using the cached login.
+func NewDropbox(conf DropboxConfig) (*Dropbox, error) {
+	client, err := oauthClient("dropbox", dropboxOAuthConfig(conf))
+	if err != nil {
+		return nil, err
+	}
+	return &Dropbox{client}, nil
+}
+
+// LoginDropbox signs in to Dropbox. Dropbox doesn't support device codes,
+// so the user visits a URL, possibly on another machine, and pastes the
+// code shown there. The token is cached in the user's config dir.
+func LoginDropbox(ctx context.Context, conf DropboxConfig, in io.Reader, out io.Writer) error {
+	if conf.AppKey == "" {
+		return fmt.Errorf("Dropbox.AppKey isn't configured")
+	}
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, sharedClient)
+	oc := dropboxOAuthConfig(conf)
+
+	verifier := oauth2.GenerateVerifier()
+	authURL := oc.AuthCodeURL("",
+		oauth2.S256ChallengeOption(verifier),
+		// Get a refresh token, for long lived access.
+		oauth2.SetAuthURLParam("token_access_type", "offline"))
+	fmt.Fprintf(out, "To sign in to Dropbox, visit this URL and allow access:\n\n  %s\n\nThen enter the code: ", authURL)
+
+	code, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && code == "" {
+		return fmt.Errorf("reading code: %s", err)
+	}
+	tok, err := oc.Exchange(ctx, strings.TrimSpace(code), oauth2.VerifierOption(verifier))
+	if err != nil {
+		return fmt.Errorf("exchanging code: %s", err)
+	}
+	if err := saveToken("dropbox", tok); err != nil {
+		return fmt.Errorf("caching token: %s", err)
+	}
+	fmt.Fprintln(out, "Signed in.")
+	return nil
+}
+
+// Stat returns information about the object at the given storage URL.
+func (d *Dropbox) Stat(ctx context.Context, url string) (*Object, error) {
+	p, err := d.parse(url)
+	if err != nil {
+		return nil, err
+	}
+	var md dropboxMetadata
+	err = d.rpc(ctx, url, "files/get_metadata", map[string]string{"path": p}, &md)
+	if err != nil {
+		return nil, err
+	}
+	if md.Tag != "file" {
+		return nil, &ErrNotFound{"dropbox", url}
+	}
+	return md.object(), nil
+}
+
+// List lists the objects at the given URL. See ListOptions.
+func (d *Dropbox) List(ctx context.Context, url string, opts ListOptions) ([]*Object, error) {
+	p, err := d.parse(url)
+	if err != nil {
+		return nil, err
+	}
+
+	var objects []*Object
+	var page struct {
+		Entries []dropboxMetadata `json:"entries"`
+		Cursor  string            `json:"cursor"`
+		HasMore bool              `json:"has_more"`
+	}
+	err = d.rpc(ctx, url, "files/list_folder", map[string]interface{}{
+		"path":      p,
+		"recursive": opts.Recursive,
+	}, &page)
+
+	for {
+		if err != nil {
+			return nil, err
+		}
+		for _, md := range page.Entries {
+			switch {
+			case md.Tag == "file":
+				objects = append(objects, md.object())
+			case md.Tag == "folder" && !opts.Recursive:
+				obj := md.object()
+				obj.Dir = true
+				objects = append(objects, obj)
+			}
+		}
+		if !page.HasMore {
+			return objects, nil
+		}
+		cursor := page.Cursor
+		page.Entries = nil
+		err = d.rpc(ctx, url, "files/list_folder/continue", map[string]string{"cursor": cursor}, &page)
+	}
+}
+
+// Get copies an object from Dropbox to "dest".
+func (d *Dropbox) Get(ctx context.Context, url string, dest io.Writer) (*Object, error) {
+	p, err := d.parse(url)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := d.content(ctx, url, "files/download", map[string]string{"path": p}, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var md dropboxMetadata
+	if err := json.Unmarshal([]byte(resp.Header.Get("Dropbox-API-Result")), &md); err != nil {
+		return nil, &dropboxError{"parsing metadata", url, 0, "", err}
+	}
+
+	_, copyErr := io.Copy(dest, ContextReader(ctx, resp.Body))
+	if copyErr != nil {
+		return nil, &dropboxError{"copying file", url, 0, "", copyErr}
+	}
+	return md.object(), nil
+}
+
+// GetRange copies part of an object from Dropbox to "dest".
+func (d *Dropbox) GetRange(ctx context.Context, url string, offset, length int64, dest io.Writer) error {
+	p, err := d.parse(url)
+	if err != nil {
+		return err
+	}
+	header := http.Header{"Range": {rangeHeader(offset, length)}}
+	resp, err := d.content(ctx, url, "files/download", map[string]string{"path": p}, nil, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return &dropboxError{"range request ignored", url, resp.StatusCode, "", nil}
+	}
+	_, copyErr := io.Copy(dest, ContextReader(ctx, resp.Body))
+	if copyErr != nil {
+		return &dropboxError{"copying file", url, 0, "", copyErr}
+	}
+	return nil
+}
+
+// Put copies an object from "src" to Dropbox. Objects larger than one chunk
+// are uploaded with an upload session.
+func (d *Dropbox) Put(ctx context.Context, url string, src io.Reader, opts PutOptions) (*Object, error) {
+	p, err := d.parse(url)
+	if err != nil {
+		return nil, err
+	}
+	commit := map[string]interface{}{
+		"path":       p,
+		"mode":       "overwrite",
+		"autorename": false,
+		"mute":       true,
+	}
+	if opts.IfNotExists {
+		commit["mode"] = "add"
+	}
+
+	src = ContextReader(ctx, src)
+	buf := make([]byte, dropboxChunkSize)
+	n, err := io.ReadFull(src, buf)
+
+	var md dropboxMetadata
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		// The object fits in one request.
+		err = d.upload(ctx, url, "files/upload", commit, buf[:n], &md)
+	case err != nil:
+		return nil, &dropboxError{"reading file", url, 0, "", err}
+	default:
+		err = d.uploadSession(ctx, url, src, buf, commit, &md)
+	}
+
+	if err != nil {
+		if e, ok := err.(*dropboxError); ok && strings.Contains(e.summary, "conflict") {
+			return nil, &ErrObjectExists{"dropbox", url}
+		}
+		return nil, err
+	}
+	return md.object(), nil
+}
+
+// uploadSession uploads an object in chunks. "buf" holds the first chunk.
+func (d *Dropbox) uploadSession(ctx context.Context, url string, src io.Reader, buf []byte, commit map[string]interface{}, md *dropboxMetadata) error {
+	var session struct {
+		ID string `json:"session_id"`
+	}
+	err := d.upload(ctx, url, "files/upload_session/start", map[string]bool{"close": false}, buf, &session)
+	if err != nil {
+		return err
+	}
+	offset := int64(len(buf))
+
+	for {
+		n, err := io.ReadFull(src, buf)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return &dropboxError{"reading file", url, 0, "", err}
+		}
+		cursor := map[string]interface{}{"session_id": session.ID, "offset": offset}
+
+		if last {
+			arg := map[string]interface{}{"cursor": cursor, "commit": commit}
+			return d.upload(ctx, url, "files/upload_session/finish", arg, buf[:n], md)
+		}
+
+		arg := map[string]interface{}{"cursor": cursor, "close": false}
+		err = d.upload(ctx, url, "files/upload_session/append_v2", arg, buf[:n], nil)
+		if err != nil {
+			return err
+		}
+		offset += int64(n)
+	}
+}
+
+// upload sends "data" to a content endpoint and decodes the JSON response
+// into "out", if not nil.
+func (d *Dropbox) upload(ctx context.Context, url, endpoint string, arg interface{}, data []byte, out interface{}) error {
+	header := http.Header{"Content-Type": {"application/octet-stream"}}
+	resp, err := d.content(ctx, url, endpoint, arg, bytes.NewReader(data), header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return &dropboxError{"decoding response to " + endpoint, url, 0, "", err}
+	}
+	return nil
+}
+
+// Delete deletes the object at the given URL.
+func (d *Dropbox) Delete(ctx context.Context, url string) error {
+	p, err := d.parse(url)
+	if err != nil {
+		return err
+	}
+	return d.rpc(ctx, url, "files/delete_v2", map[string]string{"path": p}, nil)
+}
+
+// Move moves an object to a new URL.
+func (d *Dropbox) Move(ctx context.Context, src, dst string) error {
+	s, err := d.parse(src)
+	if err != nil {
+		return err
+	}
+	t, err := d.parse(dst)
+	if err != nil {
+		return err
+	}
+	return d.rpc(ctx, src, "files/move_v2", map[string]interface{}{
+		"from_path":  s,
+		"to_path":    t,
+		"autorename": false,
+	}, nil)
+}
+
+// Join joins the given URL with the given subpath.
+func (d *Dropbox) Join(url, path string) (string, error) {
+	return strings.TrimSuffix(url, "/") + "/" + path, nil
+}
+
+// UnsupportedOperations describes which operations are not supported
+// for the given URL.
+func (d *Dropbox) UnsupportedOperations(url string) UnsupportedOperations {
+	if _, err := d.parse(url); err != nil {
+		return AllUnsupported(err)
+	}
+	return UnsupportedOperations{
+		ACL: &ErrUnsupportedOperation{"dropbox", "acl", "share files with Dropbox instead"},
+	}
+}
+
+// rpc calls an RPC endpoint, e.g. "files/get_metadata", with a JSON
+// argument, and decodes the JSON response into "out", if not nil.
+func (d *Dropbox) rpc(ctx context.Context, url, endpoint string, arg, out interface{}) error {
+	b, err := json.Marshal(arg)
+	if err != nil {
+		return &dropboxError{"encoding request", url, 0, "", err}
+	}
+	req, err := http.NewRequest("POST", dropboxAPI+endpoint, bytes.NewReader(b))
+	if err != nil {
+		return &dropboxError{"creating request", url, 0, "", err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := d.do(ctx, url, endpoint, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return &dropboxError{"decoding response to " + endpoint, url, 0, "", err}
+	}
+	return nil
+}
+
+// content calls a content endpoint, e.g. "files/download", which takes its
+// argument in the Dropbox-API-Arg header. The caller must close the
+// response body.
+func (d *Dropbox) content(ctx context.Context, url, endpoint string, arg interface{}, body io.Reader, header http.Header) (*http.Response, error) {
+	a, err := dropboxArg(arg)
+	if err != nil {
+		return nil, &dropboxError{"encoding request", url, 0, "", err}
+	}
+	req, err := http.NewRequest("POST", dropboxContent+endpoint, body)
+	if err != nil {
+		return nil, &dropboxError{"creating request", url, 0, "", err}
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Dropbox-API-Arg", a)
+	return d.do(ctx, url, endpoint, req)
+}
+
+// do sends a request. Responses other than 2xx are returned as errors.
+func (d *Dropbox) do(ctx context.Context, url, endpoint string, req *http.Request) (*http.Response, error) {
+	resp, err := d.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, &dropboxError{endpoint, url, 0, "", err}
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	// Endpoint specific errors, e.g. a missing file, are 409 responses
+	// with a summary such as "path/not_found/..".
+	var apiErr struct {
+		Summary string `json:"error_summary"`
+	}
+	json.NewDecoder(resp.Body).Decode(&apiErr)
+	if resp.StatusCode == http.StatusConflict && strings.Contains(apiErr.Summary, "not_found") {
+		return nil, &ErrNotFound{"dropbox", url}
+	}
+	return nil, &dropboxError{endpoint, url, resp.StatusCode, apiErr.Summary, nil}
+}
+
+func (d *Dropbox) parse(rawurl string) (string, error) {
+	if !strings.HasPrefix(rawurl, DropboxProtocol) {
+		return "", &ErrUnsupportedProtocol{"dropbox"}
+	}
+	p := strings.Trim(strings.TrimPrefix(rawurl, DropboxProtocol), "/")
+	if p == "" {
+		// The API names the root folder with an empty path.
+		return "", nil
+	}
+	return "/" + p, nil
+}
+
+// dropboxArg encodes the argument of a content endpoint as JSON which is
+// safe to use in an HTTP header, i.e. with non-ASCII characters escaped.
+func dropboxArg(arg interface{}) (string, error) {
+	b, err := json.Marshal(arg)
+	if err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	for _, r := range string(b) {
+		switch {
+		case r < 0x80:
+			sb.WriteRune(r)
+		case r > 0xffff:
+			r1, r2 := utf16.EncodeRune(r)
+			fmt.Fprintf(&sb, `\u%04x\u%04x`, r1, r2)
+		default:
+			fmt.Fprintf(&sb, `\u%04x`, r)
+		}
+	}
+	return sb.String(), nil
+}
+
+// dropboxMetadata describes a file or folder.
+type dropboxMetadata struct {
+	Tag            string `json:".tag"`
+	PathDisplay    string `json:"path_display"`
+	Size           int64  `json:"size"`
+	ServerModified string `json:"server_modified"`
+	Rev            string `json:"rev"`
+}
+
+func (md dropboxMetadata) object() *Object {
+	modtime, _ := time.Parse(time.RFC3339, md.ServerModified)
+	name := strings.TrimPrefix(md.PathDisplay, "/")
+	return &Object{
+		URL:          DropboxProtocol + name,
+		Name:         name,
+		ETag:         md.Rev,
+		LastModified: modtime,
+		Size:         md.Size,
+	}
+}
+
+type dropboxError struct {
+	msg, url string
+	// HTTP status code and error summary of the API's response, if any.
+	code    int
+	summary string
+	err     error
+}
+
+func (e *dropboxError) Error() string {
+	switch {
+	case e.summary != "":
+		return fmt.Sprintf("dropbox: %s: %s: %s", e.msg, e.url, e.summary)
+	case e.code != 0:
+		return fmt.Sprintf("dropbox: %s: %s: %d %s", e.msg, e.url, e.code, http.StatusText(e.code))
+	}
+	return fmt.Sprintf("dropbox: %s: %s: %v", e.msg, e.url, e.err)
+}
+
+// Kind classifies the error. See ErrorKind.
+func (e *dropboxError) Kind() ErrorKind {
+	if e.code != 0 {
+		return classifyHTTPStatus(e.code)
+	}
+	return classifyNetError(e.err)
+}
@@ -1,6 +1,14 @@
 package storage
 
-import "fmt"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	urllib "net/url"
+	"time"
+)
 
 // ErrUnsupportedProtocol is returned by SupportsGet / SupportsPut when a url's
 // protocol is unsupported by that backend
@@ -21,3 +29,264 @@ type ErrInvalidURL struct {
 func (e *ErrInvalidURL) Error() string {
 	return fmt.Sprintf("%s: invalid url", e.backend)
 }
+
+// ErrObjectExists is returned by Put when PutOptions.IfNotExists is set
+// and an object already exists at the URL.
+type ErrObjectExists struct {
+	backend, url string
+}
+
+func (e *ErrObjectExists) Error() string {
+	return fmt.Sprintf("%s: object already exists: %s", e.backend, e.url)
+}
+
+// ErrArchived is returned by Get when the object is in an archive tier
+// and must be restored before it can be downloaded. See Restorer.
+type ErrArchived struct {
+	backend, url string
+	// Restoring is set when a restore is already in progress.
+	Restoring bool
+}
+
+func (e *ErrArchived) Error() string {
+	if e.Restoring {
+		return fmt.Sprintf("%s: object is archived and its restore hasn't finished yet: %s", e.backend, e.url)
+	}
+	return fmt.Sprintf("%s: object is archived and must be restored before downloading, "+
+		"e.g. with \"tanker restore-request\": %s", e.backend, e.url)
+}
+
+// ErrNotFound is returned when there is no object at a URL, by backends
+// which have no more specific error of their own.
+type ErrNotFound struct {
+	backend, url string
+}
+
+func (e *ErrNotFound) Error() string {
+	return fmt.Sprintf("%s: object not found: %s", e.backend, e.url)
+}
+
+// ErrNotConfigured is returned when a URL's backend is disabled or is
+// missing required config, e.g. credentials.
+type ErrNotConfigured struct {
+	backend string
+}
+
+func (e *ErrNotConfigured) Error() string {
+	return fmt.Sprintf("the %s storage backend is disabled or not configured", e.backend)
+}
+
+// ErrUnsupportedOperation describes an operation which a backend can't perform.
+// See UnsupportedOperations.
+type ErrUnsupportedOperation struct {
+	backend, op, reason string
+}
+
+func (e *ErrUnsupportedOperation) Error() string {
+	if e.reason == "" {
+		return fmt.Sprintf("%s: %s is not supported", e.backend, e.op)
+	}
+	return fmt.Sprintf("%s: %s is not supported: %s", e.backend, e.op, e.reason)
+}
+
+// ErrInterrupted is returned by operations which stopped before completing
+// because their context was done. Storage libraries report a user's Ctrl-C,
+// a deadline, and a stalled connection with the same "context canceled"
+// errors, so Cause tells them apart. See Interrupted.
+type ErrInterrupted struct {
+	Cause InterruptCause
+	// Why the context was done, if it says more than Cause, e.g.
+	// *ErrStalled, or the signal which interrupted tanker.
+	Reason error
+	// The operation's error.
+	Err error
+}
+
+// InterruptCause is the reason an operation was interrupted.
+type InterruptCause int
+
+const (
+	// Canceled, e.g. by Ctrl-C, or because git-lfs ended the transfer.
+	Canceled InterruptCause = iota
+	// Out of time, e.g. the per-object timeout.
+	DeadlineExceeded
+	// No data was transferred for too long. See ErrStalled.
+	Stalled
+)
+
+func (c InterruptCause) String() string {
+	switch c {
+	case DeadlineExceeded:
+		return "deadline exceeded"
+	case Stalled:
+		return "stalled"
+	}
+	return "canceled"
+}
+
+func (e *ErrInterrupted) Error() string {
+	if e.Reason != nil {
+		return fmt.Sprintf("%s (%s): %s", e.Cause, e.Reason, e.Err)
+	}
+	return fmt.Sprintf("%s: %s", e.Cause, e.Err)
+}
+
+func (e *ErrInterrupted) Unwrap() error {
+	return e.Err
+}
+
+// Kind classifies the error. Stalled operations may succeed on another
+// connection, so they're transient. See ErrorKind.
+func (e *ErrInterrupted) Kind() ErrorKind {
+	if e.Cause == Stalled {
+		return TransientError
+	}
+	return InterruptedError
+}
+
+// ErrStalled is the cause of contexts canceled because a transfer made no
+// progress for too long, e.g. on a hung connection which was never closed.
+// See context.WithCancelCause.
+type ErrStalled struct {
+	Timeout time.Duration
+}
+
+func (e *ErrStalled) Error() string {
+	return fmt.Sprintf("no data transferred for %s", e.Timeout)
+}
+
+// Interrupted returns an *ErrInterrupted describing why the operation which
+// failed with "err" was interrupted, if "ctx" is done. Otherwise, or if
+// "err" is nil or already describes the interruption, "err" is returned.
+func Interrupted(ctx context.Context, err error) error {
+	if err == nil || ctx.Err() == nil {
+		return err
+	}
+	var ie *ErrInterrupted
+	if errors.As(err, &ie) {
+		return err
+	}
+
+	ie = &ErrInterrupted{Cause: Canceled, Err: err}
+	if ctx.Err() == context.DeadlineExceeded {
+		ie.Cause = DeadlineExceeded
+	}
+	var stalled *ErrStalled
+	if cause := context.Cause(ctx); errors.As(cause, &stalled) {
+		ie.Cause = Stalled
+		ie.Reason = cause
+	} else if cause != ctx.Err() {
+		ie.Reason = cause
+	}
+	return ie
+}
+
+// ErrorKind classifies storage errors, so that callers such as the Retrier
+// can tell errors worth retrying from errors which will just happen again.
+type ErrorKind int
+
+const (
+	// The error couldn't be classified. Unknown errors are not retried.
+	UnknownError ErrorKind = iota
+	// A temporary failure, e.g. a 5xx or 429 response or a network timeout.
+	TransientError
+	// The credentials were rejected, e.g. an expired Swift token.
+	// Backends re-authenticate on the next request, so these are retried.
+	AuthError
+	// The request isn't allowed, e.g. a 403 response.
+	PermissionError
+	// The object or bucket doesn't exist.
+	NotFoundError
+	// The request is invalid and will fail the same way again,
+	// e.g. a malformed URL or a 4xx response other than those above.
+	InvalidError
+	// The operation was canceled or ran out of time. See ErrInterrupted.
+	InterruptedError
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case TransientError:
+		return "transient"
+	case AuthError:
+		return "auth"
+	case PermissionError:
+		return "permission"
+	case NotFoundError:
+		return "not found"
+	case InvalidError:
+		return "invalid"
+	case InterruptedError:
+		return "interrupted"
+	}
+	return "unknown"
+}
+
+// Retriable returns true if errors of this kind may succeed when retried.
+func (k ErrorKind) Retriable() bool {
+	return k == TransientError || k == AuthError
+}
+
+// KindOf returns the kind of a storage error. Backend errors describe their
+// own kind via a Kind() method; other errors are classified by type.
+func KindOf(err error) ErrorKind {
+	switch e := err.(type) {
+	case nil:
+		return UnknownError
+	case interface{ Kind() ErrorKind }:
+		return e.Kind()
+	case *ErrInvalidURL, *ErrUnsupportedProtocol, *ErrUnsupportedOperation, *ErrObjectExists, *ErrArchived,
+		*ErrNotConfigured:
+		return InvalidError
+	case *ErrNotFound:
+		return NotFoundError
+	}
+	if err == context.Canceled {
+		return InterruptedError
+	}
+	return classifyNetError(err)
+}
+
+// IsRetriable returns true if the operation which returned "err"
+// may succeed when retried.
+func IsRetriable(err error) bool {
+	return KindOf(err).Retriable()
+}
+
+// classifyHTTPStatus classifies an error response by its HTTP status code.
+func classifyHTTPStatus(code int) ErrorKind {
+	switch {
+	case code == 401:
+		return AuthError
+	case code == 403:
+		return PermissionError
+	case code == 404:
+		return NotFoundError
+	// 498 is Swift's rate limit status.
+	case code == 408 || code == 429 || code == 498:
+		return TransientError
+	case code >= 500:
+		return TransientError
+	case code >= 400:
+		return InvalidError
+	}
+	return UnknownError
+}
+
+// classifyNetError classifies errors from the network layer,
+// e.g. timeouts, refused connections, and connections closed mid-response.
+func classifyNetError(err error) ErrorKind {
+	if e, ok := err.(*urllib.Error); ok {
+		err = e.Err
+	}
+	if err == io.ErrUnexpectedEOF {
+		return TransientError
+	}
+	if _, ok := err.(*net.OpError); ok {
+		return TransientError
+	}
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return TransientError
+	}
+	return UnknownError
+}
@@ -0,0 +1,286 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// ExternalConfig configures an external transfer command, e.g. Aspera's
+// "ascp", used to download and upload large objects in place of the
+// storage backend. Stat, List, and the other operations stay native.
+//
+// Commands are lists of arguments, run without a shell. These placeholders
+// are replaced in each argument:
+//
+//	{src}     the source: a storage URL for GetCommand, a local file for PutCommand
+//	{dst}     the destination: a local file for GetCommand, a storage URL for PutCommand
+//	{bucket}  the bucket, container, or host of the storage URL
+//	{path}    the object's path within the bucket
+//
+// e.g. ["ascp", "-l", "1g", "user@host:/data/{path}", "{dst}"]
+type ExternalConfig struct {
+	// URL scheme of the backend which uses these commands, e.g. "swift".
+	Scheme string
+	// Command used to download objects. Empty means downloads are native.
+	GetCommand []string
+	// Command used to upload objects. Empty means uploads are native.
+	PutCommand []string
+	// Objects smaller than this are transferred natively.
+	MinSize int64
+	// Directory for temporary files, which hold downloads until they're
+	// copied to their destination. Empty means the system's temporary
+	// directory.
+	TempDir string
+}
+
+// ExternalTransfer wraps a Storage backend, using external commands
+// to transfer large objects according to an ExternalConfig.
+type ExternalTransfer struct {
+	Backend Storage
+	conf    ExternalConfig
+}
+
+// NewExternalTransfer returns an ExternalTransfer wrapping the given backend.
+func NewExternalTransfer(backend Storage, conf ExternalConfig) *ExternalTransfer {
+	return &ExternalTransfer{backend, conf}
+}
+
+// Stat returns information about the object at the given storage URL.
+func (e *ExternalTransfer) Stat(ctx context.Context, url string) (*Object, error) {
+	return e.Backend.Stat(ctx, url)
+}
+
+// List lists the objects at the given storage URL.
+func (e *ExternalTransfer) List(ctx context.Context, url string, opts ListOptions) ([]*Object, error) {
+	return e.Backend.List(ctx, url, opts)
+}
+
+// Get copies an object from storage to "dest". Large objects are downloaded
+// by GetCommand to a temporary file, which is then copied to "dest".
+func (e *ExternalTransfer) Get(ctx context.Context, url string, dest io.Writer) (*Object, error) {
+	if len(e.conf.GetCommand) == 0 {
+		return e.Backend.Get(ctx, url, dest)
+	}
+	obj, err := e.Backend.Stat(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	if obj.Size < e.conf.MinSize {
+		return e.Backend.Get(ctx, url, dest)
+	}
+
+	tmp, err := ioutil.TempFile(e.conf.TempDir, "tanker-external-")
+	if err != nil {
+		return nil, fmt.Errorf("creating temporary file: %s", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	err = e.run(ctx, e.conf.GetCommand, url, url, tmp.Name())
+	if err != nil {
+		return nil, err
+	}
+
+	// The command may have replaced the file, so open it again.
+	fh, err := os.Open(tmp.Name())
+	if err != nil {
+		return nil, fmt.Errorf("opening downloaded file: %s", err)
+	}
+	defer fh.Close()
+
+	_, err = io.Copy(dest, ContextReader(ctx, fh))
+	if err != nil {
+		return nil, fmt.Errorf("copying downloaded file: %s", err)
+	}
+	return obj, nil
+}
+
+// GetVersion copies a specific version of an object from storage to "dest",
+// natively. The backend must implement VersionGetter.
+func (e *ExternalTransfer) GetVersion(ctx context.Context, url, version string, dest io.Writer) (*Object, error) {
+	vg, ok := e.Backend.(VersionGetter)
+	if !ok {
+		return nil, &ErrUnsupportedOperation{"external transfer", "get version", "backend isn't versioned"}
+	}
+	return vg.GetVersion(ctx, url, version, dest)
+}
+
+// GetRange copies part of an object from storage to "dest", natively.
+// The backend must implement RangeGetter.
+func (e *ExternalTransfer) GetRange(ctx context.Context, url string, offset, length int64, dest io.Writer) error {
+	rg, ok := e.Backend.(RangeGetter)
+	if !ok {
+		return &ErrUnsupportedOperation{"external transfer", "range", "not implemented by backend"}
+	}
+	return rg.GetRange(ctx, url, offset, length, dest)
+}
+
+// Put copies an object from "src" to storage. Large objects are uploaded
+// by PutCommand, from PutOptions.SourcePath if set, or else from a copy of
+// "src" in a temporary file. Objects of unknown size are uploaded natively.
+//
+// IfNotExists is checked before the command runs, so it doesn't guard
+// against concurrent uploads.
+func (e *ExternalTransfer) Put(ctx context.Context, url string, src io.Reader, opts PutOptions) (*Object, error) {
+	if len(e.conf.PutCommand) == 0 || opts.Size == 0 || opts.Size < e.conf.MinSize {
+		return e.Backend.Put(ctx, url, src, opts)
+	}
+
+	if opts.IfNotExists {
+		_, err := e.Backend.Stat(ctx, url)
+		if err == nil {
+			return nil, &ErrObjectExists{"external transfer", url}
+		}
+		if KindOf(err) != NotFoundError {
+			return nil, err
+		}
+	}
+
+	path := opts.SourcePath
+	if path == "" {
+		tmp, err := ioutil.TempFile(e.conf.TempDir, "tanker-external-")
+		if err != nil {
+			return nil, fmt.Errorf("creating temporary file: %s", err)
+		}
+		defer os.Remove(tmp.Name())
+
+		_, copyErr := io.Copy(tmp, ContextReader(ctx, src))
+		closeErr := tmp.Close()
+		if copyErr != nil {
+			return nil, fmt.Errorf("copying file: %s", copyErr)
+		}
+		if closeErr != nil {
+			return nil, fmt.Errorf("copying file: %s", closeErr)
+		}
+		path = tmp.Name()
+	}
+
+	err := e.run(ctx, e.conf.PutCommand, url, path, url)
+	if err != nil {
+		return nil, err
+	}
+	return e.Backend.Stat(ctx, url)
+}
+
+// Publish makes an object publicly readable and returns its public URL.
+// The backend must implement Publisher.
+func (e *ExternalTransfer) Publish(ctx context.Context, url string) (string, error) {
+	p, ok := e.Backend.(Publisher)
+	if !ok {
+		return "", &ErrUnsupportedOperation{"external transfer", "publish", "backend can't publish objects"}
+	}
+	return p.Publish(ctx, url)
+}
+
+// RequestRestore starts restoring an archived object.
+// The backend must implement Restorer.
+func (e *ExternalTransfer) RequestRestore(ctx context.Context, url string) error {
+	rs, ok := e.Backend.(Restorer)
+	if !ok {
+		return &ErrUnsupportedOperation{"external transfer", "restore", "backend has no archive tiers"}
+	}
+	return rs.RequestRestore(ctx, url)
+}
+
+// Lock protects an object from being deleted or overwritten.
+// The backend must implement Locker.
+func (e *ExternalTransfer) Lock(ctx context.Context, url string, until time.Time) error {
+	l, ok := e.Backend.(Locker)
+	if !ok {
+		return &ErrUnsupportedOperation{"external transfer", "lock", "backend can't lock objects"}
+	}
+	return l.Lock(ctx, url, until)
+}
+
+// Unlock releases the lock on an object.
+// The backend must implement Locker.
+func (e *ExternalTransfer) Unlock(ctx context.Context, url string) error {
+	l, ok := e.Backend.(Locker)
+	if !ok {
+		return &ErrUnsupportedOperation{"external transfer", "unlock", "backend can't lock objects"}
+	}
+	return l.Unlock(ctx, url)
+}
+
+// Delete deletes the object at the given storage URL.
+func (e *ExternalTransfer) Delete(ctx context.Context, url string) error {
+	return e.Backend.Delete(ctx, url)
+}
+
+// Move moves an object to a new URL within the same storage system.
+func (e *ExternalTransfer) Move(ctx context.Context, src, dst string) error {
+	return e.Backend.Move(ctx, src, dst)
+}
+
+// Join joins the given URL with the given subpath.
+func (e *ExternalTransfer) Join(url, path string) (string, error) {
+	return e.Backend.Join(url, path)
+}
+
+// UnsupportedOperations describes which operations are not supported
+// for the given URL.
+func (e *ExternalTransfer) UnsupportedOperations(url string) UnsupportedOperations {
+	return e.Backend.UnsupportedOperations(url)
+}
+
+// Reauthenticate passes through to the backend, if it can re-authenticate.
+func (e *ExternalTransfer) Reauthenticate(ctx context.Context) error {
+	if ra, ok := e.Backend.(Reauthenticator); ok {
+		return ra.Reauthenticate(ctx)
+	}
+	return nil
+}
+
+// RetryAfter passes through the backend's backoff hint, if it has one.
+func (e *ExternalTransfer) RetryAfter() time.Duration {
+	if h, ok := e.Backend.(RetryAfterHint); ok {
+		return h.RetryAfter()
+	}
+	return 0
+}
+
+// run runs an external transfer command for the object at "url",
+// with the placeholders replaced.
+func (e *ExternalTransfer) run(ctx context.Context, command []string, url, src, dst string) error {
+	u := splitURL(url)
+	r := strings.NewReplacer(
+		"{src}", src,
+		"{dst}", dst,
+		"{bucket}", u.bucket,
+		"{path}", u.path,
+	)
+	args := make([]string, len(command))
+	for i, arg := range command {
+		args[i] = r.Replace(arg)
+	}
+
+	var output bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("external transfer command %q failed: %s: %s",
+			args[0], err, strings.TrimSpace(output.String()))
+	}
+	return nil
+}
+
+// splitURL splits a storage URL of the form "<scheme>://<bucket>/<path>".
+func splitURL(url string) urlparts {
+	if i := strings.Index(url, "://"); i >= 0 {
+		url = url[i+3:]
+	}
+	split := strings.SplitN(url, "/", 2)
+	u := urlparts{bucket: split[0]}
+	if len(split) == 2 {
+		u.path = split[1]
+	}
+	return u
+}
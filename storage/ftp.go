@@ -1,9 +1,13 @@
+//go:build !noftp
+// +build !noftp
+
 package storage
 
 import (
 	"context"
 	"fmt"
 	"io"
+	"net"
 	"net/textproto"
 	urllib "net/url"
 	pathlib "path"
@@ -12,27 +16,31 @@ import (
 	"github.com/jlaffaye/ftp"
 )
 
-const FTPProtocol = "ftp://"
-
-// FTPConfig configures the http storage backend.
-type FTPConfig struct {
-	Disabled bool
-	// Timeout duration for http GET calls
-	Timeout  Duration
-	User     string
-	Password string
-}
-
-// Valid validates the FTPConfig configuration.
-func (h FTPConfig) Valid() bool {
-	return !h.Disabled
-}
-
 // FTP provides read access to public URLs.
 type FTP struct {
 	conf FTPConfig
 }
 
+func init() {
+	Register("ftp", Backend{
+		Name: "ftpStorage",
+		New: func(c Config) (Storage, error) {
+			return NewFTP(c.FTP)
+		},
+		Enabled: func(c Config) bool { return c.FTP.Valid() },
+		ValidateURL: func(url string) error {
+			u, err := urllib.Parse(url)
+			if err != nil {
+				return &ftpError{"parsing URL", err}
+			}
+			if u.Host == "" {
+				return &ErrInvalidURL{"ftpStorage"}
+			}
+			return nil
+		},
+	})
+}
+
 // NewFTP creates a new FTP instance.
 func NewFTP(conf FTPConfig) (*FTP, error) {
 	return &FTP{conf: conf}, nil
@@ -58,77 +66,158 @@ func (b *FTP) Get(ctx context.Context, url string, dest io.Writer) (*Object, err
 	return client.Get(ctx, url, dest)
 }
 
+// GetRange copies part of a file from a given URL to the host.
+func (b *FTP) GetRange(ctx context.Context, url string, offset, length int64, dest io.Writer) error {
+	client, err := connect(url, b.conf)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	return client.GetRange(ctx, url, offset, length, dest)
+}
+
 // Put copies a file from a the host to the remote FTP server.
-func (b *FTP) Put(ctx context.Context, url string, src io.Reader) (*Object, error) {
+// FTP has no conditional writes, so PutOptions.IfNotExists is implemented
+// by checking for an existing file first, which is subject to races.
+func (b *FTP) Put(ctx context.Context, url string, src io.Reader, opts PutOptions) (*Object, error) {
 	client, err := connect(url, b.conf)
 	if err != nil {
 		return nil, err
 	}
 	defer client.Close()
+
+	if opts.ACL != "" {
+		return nil, &ErrUnsupportedOperation{"ftpStorage", "acl", "FTP has no access controls"}
+	}
+	if opts.IfNotExists {
+		if _, err := client.Stat(ctx, url); err == nil {
+			return nil, &ErrObjectExists{"ftpStorage", url}
+		}
+	}
 	return client.Put(ctx, url, src)
 }
 
+// Publish returns the URL of the file without credentials. FTP has no access
+// controls, so the file is only public if the server allows anonymous access.
+func (b *FTP) Publish(ctx context.Context, url string) (string, error) {
+	u, err := urllib.Parse(url)
+	if err != nil {
+		return "", &ftpError{"parsing URL", err}
+	}
+	u.User = nil
+	return u.String(), nil
+}
+
+// Delete deletes a file from the remote FTP server.
+func (b *FTP) Delete(ctx context.Context, url string) error {
+	client, err := connect(url, b.conf)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	return client.Delete(ctx, url)
+}
+
+// Move renames a file on the remote FTP server.
+// Both URLs must refer to the same server.
+func (b *FTP) Move(ctx context.Context, src, dst string) error {
+	client, err := connect(src, b.conf)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	return client.Move(ctx, src, dst)
+}
+
+// UnsupportedOperations describes which operations are not supported
+// for the given URL.
+func (b *FTP) UnsupportedOperations(url string) UnsupportedOperations {
+	u, err := urllib.Parse(url)
+	if err != nil {
+		return AllUnsupported(&ftpError{"parsing URL", err})
+	}
+	if u.Scheme != "ftp" {
+		return AllUnsupported(&ErrUnsupportedProtocol{"ftpStorage"})
+	}
+	if u.Host == "" {
+		return AllUnsupported(&ErrInvalidURL{"ftpStorage"})
+	}
+	return UnsupportedOperations{
+		ACL: &ErrUnsupportedOperation{"ftpStorage", "acl", "FTP has no access controls"},
+	}
+}
+
 // Join joins the given URL with the given subpath.
 func (b *FTP) Join(url, path string) (string, error) {
 	return ftpJoin(url, path)
 }
 
-// List is not supported by FTP storage.
-func (b *FTP) List(ctx context.Context, url string) ([]*Object, error) {
+// List lists the files under the given URL.
+func (b *FTP) List(ctx context.Context, url string, opts ListOptions) ([]*Object, error) {
 	client, err := connect(url, b.conf)
 	if err != nil {
 		return nil, err
 	}
 	defer client.Close()
-	return client.List(ctx, url)
+	return client.List(ctx, url, opts)
 }
 
 // ftpclient exists implements the storage API and reuses an FTP client
 // for recursive calls.
 type ftpclient struct {
 	client *ftp.ServerConn
+	conf   FTPConfig
 }
 
 func connect(url string, conf FTPConfig) (*ftpclient, error) {
 	u, err := urllib.Parse(url)
 	if err != nil {
-		return nil, fmt.Errorf("ftpStorage: parsing URL: %s", err)
+		return nil, &ftpError{"parsing URL", err}
 	}
 
 	host := u.Host
 	if u.Port() == "" {
-		if u.Scheme == "sftp" {
-			host += ":22"
-		} else {
-			host += ":21"
-		}
+		host += ":21"
 	}
 
-	client, err := ftp.Dial(host)
+	client, err := ftp.Dial(host, ftp.DialWithDialFunc(func(network, addr string) (net.Conn, error) {
+		return dialContext(context.Background(), network, addr)
+	}))
 	if err != nil {
-		return nil, fmt.Errorf("ftpStorage: connecting to server: %v", err)
+		return nil, &ftpError{"connecting to server", err}
 	}
 
-	user := conf.User
-	pass := conf.Password
+	user, pass := ftpLogin(u, conf)
+	err = client.Login(user, pass)
+	if err != nil {
+		return nil, &ftpError{"logging in", err}
+	}
+	return &ftpclient{client, conf}, nil
+}
 
+// ftpLogin returns the login for the server of "u". Credentials in the URL
+// come first, then the .netrc file, like curl, then the config.
+func ftpLogin(u *urllib.URL, conf FTPConfig) (user, pass string) {
 	if u.User != nil {
 		user = u.User.Username()
-		// "anonymous" doesn't make sense if there's a username,
-		// so clear it. Then check if the password is set by the URL.
-		p, ok := u.User.Password()
-		if !ok {
-			pass = ""
-		} else {
-			pass = p
+		if p, ok := u.User.Password(); ok {
+			return user, p
+		}
+		// "anonymous" doesn't make sense if there's a username, so the
+		// password is empty unless the .netrc file has one for the user.
+		if !conf.IgnoreNetrc {
+			if _, p, ok := netrcLogin(conf.NetrcFile, u.Hostname(), user); ok {
+				return user, p
+			}
 		}
+		return user, ""
 	}
-
-	err = client.Login(user, pass)
-	if err != nil {
-		return nil, fmt.Errorf("ftpStorage: logging in: %v", err)
+	if !conf.IgnoreNetrc {
+		if l, p, ok := netrcLogin(conf.NetrcFile, u.Hostname(), ""); ok {
+			return l, p
+		}
 	}
-	return &ftpclient{client}, nil
+	return conf.User, conf.Password
 }
 
 func (b *ftpclient) Close() {
@@ -140,28 +229,56 @@ func (b *ftpclient) Close() {
 func (b *ftpclient) Stat(ctx context.Context, url string) (*Object, error) {
 	u, err := urllib.Parse(url)
 	if err != nil {
-		return nil, fmt.Errorf("ftpStorage: parsing URL: %s", err)
+		return nil, &ftpError{"parsing URL", err}
 	}
 
-	resp, err := b.client.List(u.Path)
+	return b.stat(url, u.Path, 0)
+}
+
+// maxLinkHops limits the number of links Stat follows, in case of cycles.
+const maxLinkHops = 16
+
+// stat returns information about the file at server path "p",
+// reported as the object at "url", which differs from "p" when
+// following a link.
+func (b *ftpclient) stat(url, p string, hops int) (*Object, error) {
+	resp, err := b.client.List(p)
 	if err != nil {
-		return nil, fmt.Errorf("ftpStorage: listing path: %q %v", u.Path, err)
+		return nil, &ftpError{fmt.Sprintf("listing path %q", p), err}
 	}
 
 	if len(resp) != 1 {
-		return nil, fmt.Errorf("ftpStorage: object not found: %s", url)
+		return nil, &ErrNotFound{"ftpStorage", url}
 	}
 
 	r := resp[0]
+	name, err := ftpName(url)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.Type == ftp.EntryTypeLink {
+		if !b.conf.FollowLinks {
+			return &Object{
+				URL:          url,
+				Name:         name,
+				LastModified: r.Time,
+				Link:         r.Target,
+			}, nil
+		}
+		if hops >= maxLinkHops {
+			return nil, fmt.Errorf("ftpStorage: too many levels of symbolic links: %s", url)
+		}
+		return b.stat(url, linkTarget(p, r.Target), hops+1)
+	}
 
-	// TODO there is a "link" file type. can we support that?
 	if r.Type != ftp.EntryTypeFile {
 		return nil, fmt.Errorf("ftpStorage: stat on non-regular file type: %s", url)
 	}
 
 	return &Object{
 		URL:          url,
-		Name:         strings.TrimPrefix(u.Path, "/"),
+		Name:         name,
 		LastModified: r.Time,
 		Size:         int64(r.Size),
 	}, nil
@@ -176,55 +293,128 @@ func (b *ftpclient) Get(ctx context.Context, url string, dest io.Writer) (*Objec
 
 	src, err := b.client.Retr(obj.Name)
 	if err != nil {
-		return nil, fmt.Errorf("ftpStorage: executing RETR request: %s", err)
+		return nil, &ftpError{"executing RETR request", err}
 	}
 	defer src.Close()
 
 	_, copyErr := io.Copy(dest, ContextReader(ctx, src))
 
 	if copyErr != nil {
-		return nil, fmt.Errorf("ftpStorage: copying file: %s", copyErr)
+		return nil, &ftpError{"copying file", copyErr}
 	}
 
 	return obj, err
 }
 
+// GetRange copies part of a file from a given URL to the host.
+// FTP can only restart a download at an offset, so the transfer is
+// aborted once "length" bytes have been read.
+func (b *ftpclient) GetRange(ctx context.Context, url string, offset, length int64, dest io.Writer) error {
+	u, err := urllib.Parse(url)
+	if err != nil {
+		return &ftpError{"parsing URL", err}
+	}
+
+	src, err := b.client.RetrFrom(u.Path, uint64(offset))
+	if err != nil {
+		return &ftpError{"executing RETR request", err}
+	}
+	// Closing an aborted transfer fails, which doesn't matter once
+	// the range has been read.
+	defer src.Close()
+
+	_, copyErr := io.CopyN(dest, ContextReader(ctx, src), length)
+	if copyErr != nil {
+		return &ftpError{"copying file", copyErr}
+	}
+	return nil
+}
+
 func (b *ftpclient) Put(ctx context.Context, url string, src io.Reader) (*Object, error) {
 
 	u, err := urllib.Parse(url)
 	if err != nil {
-		return nil, fmt.Errorf("ftpStorage: parsing URL: %s", err)
+		return nil, &ftpError{"parsing URL", err}
 	}
 
 	dirpath, name := pathlib.Split(u.Path)
-	if dirpath != "" {
-		for _, dir := range strings.Split(strings.Trim(dirpath, "/"), "/") {
-			err := b.client.ChangeDir(dir)
+	err = b.mkdirs(dirpath)
+	if err != nil {
+		return nil, err
+	}
+
+	err = b.client.Stor(name, src)
+	if err != nil {
+		return nil, &ftpError{fmt.Sprintf("uploading file for %q", url), err}
+	}
+
+	return b.Stat(ctx, url)
+}
+
+// mkdirs changes the working directory to "dirpath", creating directories as needed.
+func (b *ftpclient) mkdirs(dirpath string) error {
+	if dirpath == "" {
+		return nil
+	}
+	for _, dir := range strings.Split(strings.Trim(dirpath, "/"), "/") {
+		err := b.client.ChangeDir(dir)
+		if isUnavailable(err) {
+			// Directory doesn't exist. Create it.
+			err = b.client.MakeDir(dir)
+			// It's possible that the directory was created by a concurrent process.
+			// In that case, allow the ChangeDir call below to retry.
 			if isUnavailable(err) {
-				// Directory doesn't exist. Create it.
-				err = b.client.MakeDir(dir)
-				// It's possible that the directory was created by a concurrent process.
-				// In that case, allow the ChangeDir call below to retry.
-				if isUnavailable(err) {
-					err = nil
-				}
-				if err == nil {
-					err = b.client.ChangeDir(dir)
-				}
+				err = nil
 			}
-
-			if err != nil {
-				return nil, fmt.Errorf("ftpStorage: changing directory to %q: %v", dir, err)
+			if err == nil {
+				err = b.client.ChangeDir(dir)
 			}
 		}
+
+		if err != nil {
+			return &ftpError{fmt.Sprintf("changing directory to %q", dir), err}
+		}
 	}
+	return nil
+}
 
-	err = b.client.Stor(name, src)
+func (b *ftpclient) Delete(ctx context.Context, url string) error {
+	u, err := urllib.Parse(url)
 	if err != nil {
-		return nil, fmt.Errorf("ftpStorage: uploading file for %q: %v", url, err)
+		return &ftpError{"parsing URL", err}
 	}
 
-	return b.Stat(ctx, url)
+	err = b.client.Delete(u.Path)
+	if err != nil {
+		return &ftpError{fmt.Sprintf("deleting file %q", url), err}
+	}
+	return nil
+}
+
+func (b *ftpclient) Move(ctx context.Context, src, dst string) error {
+	su, err := urllib.Parse(src)
+	if err != nil {
+		return &ftpError{"parsing URL", err}
+	}
+	du, err := urllib.Parse(dst)
+	if err != nil {
+		return &ftpError{"parsing URL", err}
+	}
+	if su.Host != du.Host {
+		return fmt.Errorf("ftpStorage: can't move files between servers: %s to %s", src, dst)
+	}
+
+	dirpath, _ := pathlib.Split(du.Path)
+	err = b.mkdirs(dirpath)
+	if err != nil {
+		return err
+	}
+
+	err = b.client.Rename(su.Path, du.Path)
+	if err != nil {
+		return &ftpError{fmt.Sprintf("renaming %q to %q", src, dst), err}
+	}
+	return nil
 }
 
 func isUnavailable(err error) bool {
@@ -232,15 +422,26 @@ func isUnavailable(err error) bool {
 	return ok && e.Code == ftp.StatusFileUnavailable
 }
 
-func (b *ftpclient) List(ctx context.Context, url string) ([]*Object, error) {
+func (b *ftpclient) List(ctx context.Context, url string, opts ListOptions) ([]*Object, error) {
+	u, err := urllib.Parse(url)
+	if err != nil {
+		return nil, &ftpError{"parsing URL", err}
+	}
+	return b.list(ctx, url, u.Path, opts, nil)
+}
+
+// list lists the server path "dir", reporting objects under "url", which
+// differs from "dir" when following a link. "chain" holds the directories
+// being listed by the callers, so that link cycles can be detected.
+func (b *ftpclient) list(ctx context.Context, url, dir string, opts ListOptions, chain []string) ([]*Object, error) {
 	u, err := urllib.Parse(url)
 	if err != nil {
-		return nil, fmt.Errorf("ftpStorage: parsing URL: %s", err)
+		return nil, &ftpError{"parsing URL", err}
 	}
 
-	resp, err := b.client.List(u.Path)
+	resp, err := b.client.List(dir)
 	if err != nil {
-		return nil, fmt.Errorf("ftpStorage: listing path: %q %v", u.Path, err)
+		return nil, &ftpError{fmt.Sprintf("listing path %q", dir), err}
 	}
 
 	// Special case where the user called List on a regular file.
@@ -256,7 +457,8 @@ func (b *ftpclient) List(ctx context.Context, url string) ([]*Object, error) {
 		}, nil
 	}
 
-	// List the objects, recursively.
+	// List the objects, recursively unless opts.Recursive is false.
+	chain = append(chain, ftpClean(dir))
 	var objects []*Object
 	for _, r := range resp {
 		switch r.Type {
@@ -271,15 +473,66 @@ func (b *ftpclient) List(ctx context.Context, url string) ([]*Object, error) {
 				return nil, err
 			}
 
-			sub, err := b.List(ctx, joined)
+			if !opts.Recursive {
+				objects = append(objects, &Object{
+					URL:  joined + "/",
+					Name: strings.TrimPrefix(pathlib.Join(u.Path, r.Name), "/") + "/",
+					Dir:  true,
+				})
+				continue
+			}
+
+			sub, err := b.list(ctx, joined, pathlib.Join(dir, r.Name), opts, chain)
 			if err != nil {
 				return nil, err
 			}
 			objects = append(objects, sub...)
 
 		case ftp.EntryTypeLink:
-			// Link type is currently not supported. Skip it.
-			// TODO there is a "EntryTypeLink" type. can we support that?
+			joined, err := ftpJoin(url, r.Name)
+			if err != nil {
+				return nil, err
+			}
+			name := strings.TrimPrefix(pathlib.Join(u.Path, r.Name), "/")
+			target := linkTarget(pathlib.Join(dir, r.Name), r.Target)
+
+			if !b.conf.FollowLinks || isLinkCycle(target, chain) {
+				objects = append(objects, &Object{
+					URL:          joined,
+					Name:         name,
+					LastModified: r.Time,
+					Link:         r.Target,
+				})
+				continue
+			}
+
+			sub, err := b.list(ctx, joined, target, opts, chain)
+			if KindOf(err) == NotFoundError {
+				// Broken link. Report it instead of failing the whole listing.
+				objects = append(objects, &Object{
+					URL:          joined,
+					Name:         name,
+					LastModified: r.Time,
+					Link:         r.Target,
+				})
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			// A link to a file lists as that single file. A link to a directory
+			// is shown as a directory unless listing recursively.
+			isFile := len(sub) == 1 && sub[0].URL == joined
+			if !isFile && !opts.Recursive {
+				objects = append(objects, &Object{
+					URL:  joined + "/",
+					Name: name + "/",
+					Dir:  true,
+				})
+				continue
+			}
+			objects = append(objects, sub...)
 
 		case ftp.EntryTypeFile:
 			joined, err := ftpJoin(url, r.Name)
@@ -299,7 +552,71 @@ func (b *ftpclient) List(ctx context.Context, url string) ([]*Object, error) {
 	return objects, nil
 }
 
+// ftpName returns the object name of the given URL, i.e. its path
+// without the leading "/".
+func ftpName(url string) (string, error) {
+	u, err := urllib.Parse(url)
+	if err != nil {
+		return "", &ftpError{"parsing URL", err}
+	}
+	return strings.TrimPrefix(u.Path, "/"), nil
+}
+
+// ftpClean cleans a server path, making it absolute.
+func ftpClean(p string) string {
+	return pathlib.Clean("/" + p)
+}
+
+// linkTarget resolves the target of the link at server path "link".
+// Relative targets are relative to the link's directory.
+func linkTarget(link, target string) string {
+	if pathlib.IsAbs(target) {
+		return pathlib.Clean(target)
+	}
+	return ftpClean(pathlib.Join(pathlib.Dir(link), target))
+}
+
+// isLinkCycle returns true if following a link to "target" would list
+// one of the directories in "chain" again, i.e. "target" is one of them
+// or one of their parents.
+func isLinkCycle(target string, chain []string) bool {
+	for _, dir := range chain {
+		if target == "/" || dir == target || strings.HasPrefix(dir, target+"/") {
+			return true
+		}
+	}
+	return false
+}
+
 // ftpJoin joins the given URL with the given subpath.
 func ftpJoin(url, path string) (string, error) {
 	return strings.TrimSuffix(url, "/") + "/" + path, nil
 }
+
+type ftpError struct {
+	msg string
+	err error
+}
+
+func (e *ftpError) Error() string {
+	return fmt.Sprintf("ftpStorage: %s: %v", e.msg, e.err)
+}
+
+// Kind classifies the error. See ErrorKind.
+func (e *ftpError) Kind() ErrorKind {
+	if tpErr, ok := e.err.(*textproto.Error); ok {
+		switch {
+		// 4xx replies are transient negative completions in FTP,
+		// e.g. 421 service not available or 450 file busy.
+		case tpErr.Code >= 400 && tpErr.Code < 500:
+			return TransientError
+		case tpErr.Code == ftp.StatusNotLoggedIn:
+			return PermissionError
+		case tpErr.Code == ftp.StatusFileUnavailable:
+			return NotFoundError
+		default:
+			return InvalidError
+		}
+	}
+	return classifyNetError(e.err)
+}
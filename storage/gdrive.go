@@ -0,0 +1,482 @@
+//go:build !nogdrive
+// +build !nogdrive
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+)
+
+func init() {
+	Register("gdrive", Backend{
+		Name: "gdrive",
+		New: func(c Config) (Storage, error) {
+			return NewGoogleDrive(c.GoogleDrive)
+		},
+		Enabled:     func(c Config) bool { return c.GoogleDrive.Valid() },
+		ValidateURL: bucketValidator("gdrive", (&GoogleDrive{}).parse),
+		Login: func(ctx context.Context, c Config, in io.Reader, out io.Writer) error {
+			return LoginGoogleDrive(ctx, c.GoogleDrive, out)
+		},
+	})
+}
+
+const driveFolderType = "application/vnd.google-apps.folder"
+
+// Fields of files returned by the Drive API.
+const driveFileFields = "id, name, size, modifiedTime, md5Checksum, mimeType, parents"
+
+// GoogleDrive provides access to files in Google Drive, signed in as a user
+// with "tanker login gdrive".
+//
+// URLs are of the form "gdrive://<folder-id>/<path>", where the folder ID
+// is "root" for My Drive, or the ID of another folder, e.g. in a shared
+// drive. Drive identifies files by ID rather than path, so paths are
+// resolved one folder at a time, and missing folders are created on upload.
+// Drive allows several files with the same name in a folder; the first one
+// found is used.
+//
+// The login only grants access to files created by tanker, so objects
+// uploaded by other apps aren't visible.
+type GoogleDrive struct {
+	svc *drive.Service
+}
+
+// driveOAuthConfig returns the OAuth config for signing in to Drive.
+func driveOAuthConfig(conf GoogleDriveConfig) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     conf.ClientID,
+		ClientSecret: conf.ClientSecret,
+		Endpoint:     google.Endpoint,
+		// Device code logins are limited to this scope.
+		Scopes: []string{drive.DriveFileScope},
+	}
+}
+
+// NewGoogleDrive creates a Google Drive client using the cached login.
+func NewGoogleDrive(conf GoogleDriveConfig) (*GoogleDrive, error) {
+	client, err := oauthClient("gdrive", driveOAuthConfig(conf))
+	if err != nil {
+		return nil, err
+	}
+	svc, err := drive.New(client)
+	if err != nil {
+		return nil, err
+	}
+	return &GoogleDrive{svc}, nil
+}
+
+// LoginGoogleDrive signs in to Google Drive with a device code, which the
+// user enters in a browser, possibly on another machine. The token is
+// cached in the user's config dir.
+func LoginGoogleDrive(ctx context.Context, conf GoogleDriveConfig, out io.Writer) error {
+	if conf.ClientID == "" {
+		return fmt.Errorf("GoogleDrive.ClientID isn't configured")
+	}
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, sharedClient)
+	oc := driveOAuthConfig(conf)
+
+	resp, err := oc.DeviceAuth(ctx)
+	if err != nil {
+		return fmt.Errorf("requesting device code: %s", err)
+	}
+	fmt.Fprintf(out, "To sign in to Google Drive, visit %s and enter the code %s\n",
+		resp.VerificationURI, resp.UserCode)
+
+	tok, err := oc.DeviceAccessToken(ctx, resp)
+	if err != nil {
+		return fmt.Errorf("waiting for sign in: %s", err)
+	}
+	if err := saveToken("gdrive", tok); err != nil {
+		return fmt.Errorf("caching token: %s", err)
+	}
+	fmt.Fprintln(out, "Signed in.")
+	return nil
+}
+
+// Stat returns information about the object at the given storage URL.
+func (g *GoogleDrive) Stat(ctx context.Context, url string) (*Object, error) {
+	u, err := g.parse(url)
+	if err != nil {
+		return nil, err
+	}
+	f, err := g.resolve(ctx, url, u.bucket, u.path)
+	if err != nil {
+		return nil, err
+	}
+	if f.MimeType == driveFolderType {
+		return nil, &ErrNotFound{"gdrive", url}
+	}
+	return g.object(url, u.path, f), nil
+}
+
+// List lists the objects at the given URL. See ListOptions.
+func (g *GoogleDrive) List(ctx context.Context, url string, opts ListOptions) ([]*Object, error) {
+	u, err := g.parse(url)
+	if err != nil {
+		return nil, err
+	}
+	folder, err := g.resolve(ctx, url, u.bucket, u.path)
+	if err != nil {
+		return nil, err
+	}
+	return g.list(ctx, url, u.bucket, folder.Id, dirPrefix(u.path), opts)
+}
+
+func (g *GoogleDrive) list(ctx context.Context, url, root, folderID, prefix string, opts ListOptions) ([]*Object, error) {
+	var objects []*Object
+	q := fmt.Sprintf("'%s' in parents and trashed = false", driveEscape(folderID))
+	call := g.svc.Files.List().Q(q).
+		Fields(googleapi.Field("nextPageToken, files(" + driveFileFields + ")")).
+		SupportsAllDrives(true).
+		IncludeItemsFromAllDrives(true)
+
+	err := call.Pages(ctx, func(files *drive.FileList) error {
+		for _, f := range files.Files {
+			p := prefix + f.Name
+			objURL := GDriveProtocol + root + "/" + p
+
+			if f.MimeType != driveFolderType {
+				objects = append(objects, g.object(objURL, p, f))
+				continue
+			}
+			if !opts.Recursive {
+				objects = append(objects, &Object{URL: objURL, Name: p, Dir: true})
+				continue
+			}
+			sub, err := g.list(ctx, objURL, root, f.Id, p+"/", opts)
+			if err != nil {
+				return err
+			}
+			objects = append(objects, sub...)
+		}
+		return nil
+	})
+	if err != nil {
+		if _, ok := err.(*driveError); ok {
+			return nil, err
+		}
+		return nil, &driveError{"listing folder", url, err}
+	}
+	return objects, nil
+}
+
+// Get copies an object from Google Drive to "dest".
+func (g *GoogleDrive) Get(ctx context.Context, url string, dest io.Writer) (*Object, error) {
+	obj, f, err := g.stat(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := g.svc.Files.Get(f.Id).SupportsAllDrives(true).Context(ctx).Download()
+	if err != nil {
+		return nil, &driveError{"downloading file", url, err}
+	}
+	defer resp.Body.Close()
+
+	_, copyErr := io.Copy(dest, ContextReader(ctx, resp.Body))
+	if copyErr != nil {
+		return nil, &driveError{"copying file", url, copyErr}
+	}
+	return obj, nil
+}
+
+// GetRange copies part of an object from Google Drive to "dest".
+func (g *GoogleDrive) GetRange(ctx context.Context, url string, offset, length int64, dest io.Writer) error {
+	_, f, err := g.stat(ctx, url)
+	if err != nil {
+		return err
+	}
+
+	call := g.svc.Files.Get(f.Id).SupportsAllDrives(true).Context(ctx)
+	call.Header().Set("Range", rangeHeader(offset, length))
+	resp, err := call.Download()
+	if err != nil {
+		return &driveError{"downloading file", url, err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return &driveError{"downloading file", url, fmt.Errorf("range request ignored: %s", resp.Status)}
+	}
+	_, copyErr := io.Copy(dest, ContextReader(ctx, resp.Body))
+	if copyErr != nil {
+		return &driveError{"copying file", url, copyErr}
+	}
+	return nil
+}
+
+// Put copies an object from "src" to Google Drive, replacing the content
+// of an existing file with the same name. IfNotExists is checked before
+// the upload, so it doesn't guard against concurrent uploads.
+func (g *GoogleDrive) Put(ctx context.Context, url string, src io.Reader, opts PutOptions) (*Object, error) {
+	u, err := g.parse(url)
+	if err != nil {
+		return nil, err
+	}
+	dir, name := path.Split(u.path)
+	if name == "" {
+		return nil, &ErrInvalidURL{"gdrive"}
+	}
+
+	parent, err := g.mkdirs(ctx, url, u.bucket, dir)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := g.child(ctx, url, parent, name)
+	if err != nil && KindOf(err) != NotFoundError {
+		return nil, err
+	}
+	if existing != nil && opts.IfNotExists {
+		return nil, &ErrObjectExists{"gdrive", url}
+	}
+
+	var media []googleapi.MediaOption
+	if opts.ContentType != "" {
+		media = append(media, googleapi.ContentType(opts.ContentType))
+	}
+	var f *drive.File
+	if existing != nil {
+		f, err = g.svc.Files.Update(existing.Id, &drive.File{}).
+			Media(src, media...).
+			Fields(driveFileFields).
+			SupportsAllDrives(true).
+			Context(ctx).Do()
+	} else {
+		f, err = g.svc.Files.Create(&drive.File{Name: name, Parents: []string{parent}}).
+			Media(src, media...).
+			Fields(driveFileFields).
+			SupportsAllDrives(true).
+			Context(ctx).Do()
+	}
+	if err != nil {
+		return nil, &driveError{"uploading file", url, err}
+	}
+	return g.object(url, u.path, f), nil
+}
+
+// Delete deletes the object at the given URL. The file is deleted
+// permanently, not moved to the Drive trash.
+func (g *GoogleDrive) Delete(ctx context.Context, url string) error {
+	_, f, err := g.stat(ctx, url)
+	if err != nil {
+		return err
+	}
+	err = g.svc.Files.Delete(f.Id).SupportsAllDrives(true).Context(ctx).Do()
+	if err != nil {
+		return &driveError{"deleting file", url, err}
+	}
+	return nil
+}
+
+// Move moves an object to a new URL under the same folder ID.
+func (g *GoogleDrive) Move(ctx context.Context, src, dst string) error {
+	d, err := g.parse(dst)
+	if err != nil {
+		return err
+	}
+	s, err := g.parse(src)
+	if err != nil {
+		return err
+	}
+	if s.bucket != d.bucket {
+		return &ErrUnsupportedOperation{"gdrive", "copy", "objects can only be moved within a folder ID"}
+	}
+
+	_, f, err := g.stat(ctx, src)
+	if err != nil {
+		return err
+	}
+	dir, name := path.Split(d.path)
+	parent, err := g.mkdirs(ctx, dst, d.bucket, dir)
+	if err != nil {
+		return err
+	}
+
+	_, err = g.svc.Files.Update(f.Id, &drive.File{Name: name}).
+		AddParents(parent).
+		RemoveParents(strings.Join(f.Parents, ",")).
+		SupportsAllDrives(true).
+		Context(ctx).Do()
+	if err != nil {
+		return &driveError{"moving file", src, err}
+	}
+	return nil
+}
+
+// Join joins the given URL with the given subpath.
+func (g *GoogleDrive) Join(url, path string) (string, error) {
+	return strings.TrimSuffix(url, "/") + "/" + path, nil
+}
+
+// UnsupportedOperations describes which operations are not supported
+// for the given URL.
+func (g *GoogleDrive) UnsupportedOperations(url string) UnsupportedOperations {
+	u, err := g.parse(url)
+	if err != nil {
+		return AllUnsupported(err)
+	}
+	if u.bucket == "" {
+		return AllUnsupported(&ErrInvalidURL{"gdrive"})
+	}
+	return UnsupportedOperations{
+		ACL: &ErrUnsupportedOperation{"gdrive", "acl", "share files with Drive instead"},
+	}
+}
+
+// stat returns the object and the Drive file at "url".
+func (g *GoogleDrive) stat(ctx context.Context, url string) (*Object, *drive.File, error) {
+	u, err := g.parse(url)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := g.resolve(ctx, url, u.bucket, u.path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if f.MimeType == driveFolderType {
+		return nil, nil, &ErrNotFound{"gdrive", url}
+	}
+	return g.object(url, u.path, f), f, nil
+}
+
+// resolve finds the file or folder at path "p" under the given folder.
+func (g *GoogleDrive) resolve(ctx context.Context, url, folderID, p string) (*drive.File, error) {
+	f := &drive.File{Id: folderID, MimeType: driveFolderType}
+	for _, name := range strings.Split(p, "/") {
+		if name == "" {
+			continue
+		}
+		if f.MimeType != driveFolderType {
+			return nil, &ErrNotFound{"gdrive", url}
+		}
+		var err error
+		f, err = g.child(ctx, url, f.Id, name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// mkdirs finds the folder at path "p" under the given folder, creating
+// missing folders, and returns its ID.
+func (g *GoogleDrive) mkdirs(ctx context.Context, url, folderID, p string) (string, error) {
+	for _, name := range strings.Split(p, "/") {
+		if name == "" {
+			continue
+		}
+		f, err := g.child(ctx, url, folderID, name)
+		if err != nil && KindOf(err) != NotFoundError {
+			return "", err
+		}
+		if f == nil {
+			f, err = g.svc.Files.Create(&drive.File{
+				Name:     name,
+				MimeType: driveFolderType,
+				Parents:  []string{folderID},
+			}).Fields("id").SupportsAllDrives(true).Context(ctx).Do()
+			if err != nil {
+				return "", &driveError{"creating folder " + name, url, err}
+			}
+		}
+		folderID = f.Id
+	}
+	return folderID, nil
+}
+
+// child finds the file or folder with the given name in a folder.
+func (g *GoogleDrive) child(ctx context.Context, url, folderID, name string) (*drive.File, error) {
+	q := fmt.Sprintf("'%s' in parents and name = '%s' and trashed = false",
+		driveEscape(folderID), driveEscape(name))
+	files, err := g.svc.Files.List().Q(q).
+		Fields(googleapi.Field("files(" + driveFileFields + ")")).
+		PageSize(1).
+		SupportsAllDrives(true).
+		IncludeItemsFromAllDrives(true).
+		Context(ctx).Do()
+	if err != nil {
+		return nil, &driveError{"finding " + name, url, err}
+	}
+	if len(files.Files) == 0 {
+		return nil, &ErrNotFound{"gdrive", url}
+	}
+	return files.Files[0], nil
+}
+
+func (g *GoogleDrive) object(url, name string, f *drive.File) *Object {
+	modtime, _ := time.Parse(time.RFC3339, f.ModifiedTime)
+	obj := &Object{
+		URL:          url,
+		Name:         name,
+		LastModified: modtime,
+		Size:         f.Size,
+	}
+	if f.Md5Checksum != "" {
+		obj.Checksum = f.Md5Checksum
+		obj.ChecksumType = ChecksumMD5
+	}
+	return obj
+}
+
+func (g *GoogleDrive) parse(rawurl string) (*urlparts, error) {
+	if !strings.HasPrefix(rawurl, GDriveProtocol) {
+		return nil, &ErrUnsupportedProtocol{"gdrive"}
+	}
+
+	path := strings.TrimPrefix(rawurl, GDriveProtocol)
+	if path == "" {
+		return nil, &ErrInvalidURL{"gdrive"}
+	}
+
+	split := strings.SplitN(path, "/", 2)
+	url := &urlparts{}
+	if len(split) > 0 {
+		url.bucket = split[0]
+	}
+	if len(split) == 2 {
+		url.path = split[1]
+	}
+	return url, nil
+}
+
+// driveEscape escapes a string for use in a quoted Drive query value.
+func driveEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s)
+}
+
+type driveError struct {
+	msg, url string
+	err      error
+}
+
+func (e *driveError) Error() string {
+	return fmt.Sprintf("gdrive: %s: %s: %v", e.msg, e.url, e.err)
+}
+
+// Kind classifies the error. See ErrorKind.
+func (e *driveError) Kind() ErrorKind {
+	if apiErr, ok := e.err.(*googleapi.Error); ok {
+		return classifyHTTPStatus(apiErr.Code)
+	}
+	return classifyNetError(e.err)
+}
+
+// RetryAfter returns the delay requested by the server's Retry-After header.
+func (e *driveError) RetryAfter() time.Duration {
+	if apiErr, ok := e.err.(*googleapi.Error); ok {
+		return parseRetryAfter(apiErr.Header)
+	}
+	return 0
+}
@@ -0,0 +1,511 @@
+//go:build !noglobus
+// +build !noglobus
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	urllib "net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func init() {
+	Register("globus", Backend{
+		Name: "globus",
+		New: func(c Config) (Storage, error) {
+			return NewGlobus(c.Globus)
+		},
+		Enabled:     func(c Config) bool { return c.Globus.Valid() },
+		ValidateURL: bucketValidator("globus", (&Globus{}).parse),
+	})
+}
+
+const globusTransferAPI = "https://transfer.api.globus.org/v0.10"
+
+// Globus moves objects with Globus transfer tasks, between a collection
+// ("endpoint") holding the objects and a local endpoint, e.g. Globus Connect
+// Personal or a site's data transfer node.
+//
+// URLs are of the form "globus://<endpoint-id>/<path>". Globus transfers
+// files between endpoints, not streams, so uploads and downloads go through
+// a staging directory on the local endpoint: an upload is copied there
+// before the task is submitted, and a download is copied from there once
+// the task succeeds. Progress reported to git-lfs covers those copies;
+// while a task runs, tanker sends heartbeats.
+type Globus struct {
+	conf  GlobusConfig
+	token string
+}
+
+// NewGlobus creates a Globus client from the given config.
+func NewGlobus(conf GlobusConfig) (*Globus, error) {
+	token := conf.AccessToken
+	if token == "" {
+		token = os.Getenv("GLOBUS_ACCESS_TOKEN")
+	}
+	if conf.StagingPath == "" {
+		conf.StagingPath = conf.StagingDir
+	}
+	if conf.PollInterval <= 0 {
+		conf.PollInterval = Duration(5 * time.Second)
+	}
+	return &Globus{conf: conf, token: token}, nil
+}
+
+// Stat returns information about the object at the given storage URL.
+func (g *Globus) Stat(ctx context.Context, url string) (*Object, error) {
+	u, err := g.parse(url)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, name := path.Split("/" + u.path)
+	entries, err := g.ls(ctx, url, u.bucket, dir, "name:"+name)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.Name == name && e.Type != "dir" {
+			return g.object(url, u.path, e), nil
+		}
+	}
+	return nil, &ErrNotFound{"globus", url}
+}
+
+// List lists the objects at the given URL. See ListOptions.
+func (g *Globus) List(ctx context.Context, url string, opts ListOptions) ([]*Object, error) {
+	u, err := g.parse(url)
+	if err != nil {
+		return nil, err
+	}
+	return g.list(ctx, url, u.bucket, dirPrefix(u.path), opts)
+}
+
+func (g *Globus) list(ctx context.Context, url, endpoint, dir string, opts ListOptions) ([]*Object, error) {
+	entries, err := g.ls(ctx, url, endpoint, "/"+dir, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var objects []*Object
+	for _, e := range entries {
+		p := dir + e.Name
+		objURL := GlobusProtocol + endpoint + "/" + p
+
+		if e.Type != "dir" {
+			objects = append(objects, g.object(objURL, p, e))
+			continue
+		}
+		if !opts.Recursive {
+			objects = append(objects, &Object{URL: objURL, Name: p, Dir: true})
+			continue
+		}
+
+		sub, err := g.list(ctx, objURL, endpoint, p+"/", opts)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, sub...)
+	}
+	return objects, nil
+}
+
+// Get copies an object from Globus to "dest", by transferring it to the
+// staging directory first.
+func (g *Globus) Get(ctx context.Context, url string, dest io.Writer) (*Object, error) {
+	u, err := g.parse(url)
+	if err != nil {
+		return nil, err
+	}
+	obj, err := g.Stat(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+
+	staged, err := g.stage()
+	if err != nil {
+		return nil, &globusError{"creating staging file", url, 0, err}
+	}
+	defer os.Remove(staged.Name())
+	defer staged.Close()
+
+	err = g.transfer(ctx, url, u.bucket, "/"+u.path, g.conf.LocalEndpoint, g.stagingPath(staged))
+	if err != nil {
+		return nil, err
+	}
+
+	// Globus replaces the file, so open it again.
+	fh, err := os.Open(staged.Name())
+	if err != nil {
+		return nil, &globusError{"opening staged file", url, 0, err}
+	}
+	defer fh.Close()
+
+	_, copyErr := io.Copy(dest, ContextReader(ctx, fh))
+	if copyErr != nil {
+		return nil, &globusError{"copying file", url, 0, copyErr}
+	}
+	return obj, nil
+}
+
+// Put copies an object from "src" to Globus, by copying it to the staging
+// directory and transferring it from there. IfNotExists is checked before
+// the transfer is submitted, so it doesn't guard against concurrent uploads.
+func (g *Globus) Put(ctx context.Context, url string, src io.Reader, opts PutOptions) (*Object, error) {
+	u, err := g.parse(url)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.IfNotExists {
+		_, err := g.Stat(ctx, url)
+		if err == nil {
+			return nil, &ErrObjectExists{"globus", url}
+		}
+		if KindOf(err) != NotFoundError {
+			return nil, err
+		}
+	}
+
+	staged, err := g.stage()
+	if err != nil {
+		return nil, &globusError{"creating staging file", url, 0, err}
+	}
+	defer os.Remove(staged.Name())
+
+	_, copyErr := io.Copy(staged, ContextReader(ctx, src))
+	closeErr := staged.Close()
+	if copyErr != nil {
+		return nil, &globusError{"copying file", url, 0, copyErr}
+	}
+	if closeErr != nil {
+		return nil, &globusError{"copying file", url, 0, closeErr}
+	}
+
+	err = g.transfer(ctx, url, g.conf.LocalEndpoint, g.stagingPath(staged), u.bucket, "/"+u.path)
+	if err != nil {
+		return nil, err
+	}
+	return g.Stat(ctx, url)
+}
+
+// Delete deletes the object at the given URL, with a Globus delete task.
+func (g *Globus) Delete(ctx context.Context, url string) error {
+	u, err := g.parse(url)
+	if err != nil {
+		return err
+	}
+	id, err := g.submissionID(ctx, url)
+	if err != nil {
+		return err
+	}
+
+	req := map[string]interface{}{
+		"DATA_TYPE":     "delete",
+		"submission_id": id,
+		"endpoint":      u.bucket,
+		"DATA": []map[string]interface{}{
+			{"DATA_TYPE": "delete_item", "path": "/" + u.path},
+		},
+	}
+	var task globusTaskID
+	if err := g.api(ctx, url, "POST", "/delete", nil, req, &task); err != nil {
+		return err
+	}
+	return g.wait(ctx, url, task.TaskID)
+}
+
+// Move renames an object within a Globus endpoint.
+func (g *Globus) Move(ctx context.Context, src, dst string) error {
+	s, err := g.parse(src)
+	if err != nil {
+		return err
+	}
+	d, err := g.parse(dst)
+	if err != nil {
+		return err
+	}
+	if s.bucket != d.bucket {
+		return &ErrUnsupportedOperation{"globus", "copy", "objects can only be moved within an endpoint"}
+	}
+
+	req := map[string]interface{}{
+		"DATA_TYPE": "rename",
+		"old_path":  "/" + s.path,
+		"new_path":  "/" + d.path,
+	}
+	return g.api(ctx, src, "POST", "/operation/endpoint/"+s.bucket+"/rename", nil, req, nil)
+}
+
+// Join joins the given URL with the given subpath.
+func (g *Globus) Join(url, path string) (string, error) {
+	return strings.TrimSuffix(url, "/") + "/" + path, nil
+}
+
+// UnsupportedOperations describes which operations are not supported
+// for the given URL.
+func (g *Globus) UnsupportedOperations(url string) UnsupportedOperations {
+	u, err := g.parse(url)
+	if err != nil {
+		return AllUnsupported(err)
+	}
+	if u.bucket == "" {
+		return AllUnsupported(&ErrInvalidURL{"globus"})
+	}
+
+	ops := UnsupportedOperations{
+		Range: &ErrUnsupportedOperation{"globus", "range", "Globus transfers whole files"},
+		ACL:   &ErrUnsupportedOperation{"globus", "acl", "not implemented"},
+	}
+	if g.conf.LocalEndpoint == "" || g.conf.StagingDir == "" {
+		reason := "the local endpoint and staging directory aren't configured"
+		ops.Get = &ErrUnsupportedOperation{"globus", "get", reason}
+		ops.Put = &ErrUnsupportedOperation{"globus", "put", reason}
+	}
+	return ops
+}
+
+// stage creates a file in the staging directory.
+func (g *Globus) stage() (*os.File, error) {
+	if err := EnsureDir(g.conf.StagingDir); err != nil {
+		return nil, err
+	}
+	return ioutil.TempFile(g.conf.StagingDir, "tanker-globus-")
+}
+
+// stagingPath returns the path of a staged file on the local endpoint.
+func (g *Globus) stagingPath(staged *os.File) string {
+	return path.Join(g.conf.StagingPath, filepath.Base(staged.Name()))
+}
+
+// transfer submits a task transferring a single file, and waits for it.
+func (g *Globus) transfer(ctx context.Context, url, srcEndpoint, srcPath, dstEndpoint, dstPath string) error {
+	id, err := g.submissionID(ctx, url)
+	if err != nil {
+		return err
+	}
+
+	req := map[string]interface{}{
+		"DATA_TYPE":            "transfer",
+		"submission_id":        id,
+		"source_endpoint":      srcEndpoint,
+		"destination_endpoint": dstEndpoint,
+		"verify_checksum":      true,
+		"DATA": []map[string]interface{}{
+			{
+				"DATA_TYPE":        "transfer_item",
+				"source_path":      srcPath,
+				"destination_path": dstPath,
+			},
+		},
+	}
+	var task globusTaskID
+	if err := g.api(ctx, url, "POST", "/transfer", nil, req, &task); err != nil {
+		return err
+	}
+	return g.wait(ctx, url, task.TaskID)
+}
+
+// submissionID gets an ID which makes a task submission idempotent,
+// so that retried submissions don't start a task twice.
+func (g *Globus) submissionID(ctx context.Context, url string) (string, error) {
+	var resp struct {
+		Value string `json:"value"`
+	}
+	err := g.api(ctx, url, "GET", "/submission_id", nil, nil, &resp)
+	return resp.Value, err
+}
+
+// wait polls the status of a task until it's done. If "ctx" is canceled,
+// the task is canceled too.
+func (g *Globus) wait(ctx context.Context, url, taskID string) error {
+	ticker := time.NewTicker(time.Duration(g.conf.PollInterval))
+	defer ticker.Stop()
+
+	for {
+		var task globusTask
+		err := g.api(ctx, url, "GET", "/task/"+taskID, nil, nil, &task)
+		if err != nil && ctx.Err() == nil {
+			return err
+		}
+
+		switch task.Status {
+		case "SUCCEEDED":
+			return nil
+		case "FAILED":
+			msg := "task " + taskID + " failed"
+			if task.FatalError != nil {
+				msg += ": " + task.FatalError.Description
+			}
+			return &globusError{msg, url, 0, nil}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			// Don't leave the task running. Canceling is best effort,
+			// so its error is ignored.
+			g.api(context.Background(), url, "POST", "/task/"+taskID+"/cancel", nil, nil, nil)
+			return ctx.Err()
+		}
+	}
+}
+
+// ls lists a directory on an endpoint.
+func (g *Globus) ls(ctx context.Context, url, endpoint, dir, filter string) ([]globusFile, error) {
+	q := urllib.Values{"path": {dir}}
+	if filter != "" {
+		q.Set("filter", filter)
+	}
+	var resp struct {
+		Data []globusFile `json:"DATA"`
+	}
+	err := g.api(ctx, url, "GET", "/operation/endpoint/"+endpoint+"/ls", q, nil, &resp)
+	return resp.Data, err
+}
+
+func (g *Globus) object(url, name string, f globusFile) *Object {
+	modtime, _ := time.Parse("2006-01-02 15:04:05-07:00", f.LastModified)
+	return &Object{
+		URL:          url,
+		Name:         name,
+		LastModified: modtime,
+		Size:         f.Size,
+	}
+}
+
+// api calls the Globus Transfer API. "body" and "out", if not nil, are
+// encoded as and decoded from JSON. "url" is the storage URL being
+// operated on, for errors.
+func (g *Globus) api(ctx context.Context, url, method, resource string, q urllib.Values, body, out interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return &globusError{"encoding request", url, 0, err}
+		}
+		reqBody = bytes.NewReader(b)
+	}
+
+	apiURL := globusTransferAPI + resource
+	if q != nil {
+		apiURL += "?" + q.Encode()
+	}
+	req, err := http.NewRequest(method, apiURL, reqBody)
+	if err != nil {
+		return &globusError{"creating request", url, 0, err}
+	}
+	req.Header.Set("Authorization", "Bearer "+g.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := sharedClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return &globusError{method + " " + resource, url, 0, err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return &ErrNotFound{"globus", url}
+	}
+	if resp.StatusCode/100 != 2 {
+		var apiErr struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		msg := method + " " + resource
+		if apiErr.Message != "" {
+			msg += ": " + apiErr.Code + ": " + apiErr.Message
+		}
+		return &globusError{msg, url, resp.StatusCode, nil}
+	}
+
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return &globusError{"decoding response to " + method + " " + resource, url, 0, err}
+		}
+	}
+	return nil
+}
+
+func (g *Globus) parse(rawurl string) (*urlparts, error) {
+	if !strings.HasPrefix(rawurl, GlobusProtocol) {
+		return nil, &ErrUnsupportedProtocol{"globus"}
+	}
+
+	path := strings.TrimPrefix(rawurl, GlobusProtocol)
+	if path == "" {
+		return nil, &ErrInvalidURL{"globus"}
+	}
+
+	split := strings.SplitN(path, "/", 2)
+	url := &urlparts{}
+	if len(split) > 0 {
+		url.bucket = split[0]
+	}
+	if len(split) == 2 {
+		url.path = split[1]
+	}
+	return url, nil
+}
+
+// globusFile is an entry in a directory listing.
+type globusFile struct {
+	Name         string `json:"name"`
+	Type         string `json:"type"`
+	Size         int64  `json:"size"`
+	LastModified string `json:"last_modified"`
+}
+
+type globusTaskID struct {
+	TaskID string `json:"task_id"`
+}
+
+type globusTask struct {
+	Status     string `json:"status"`
+	FatalError *struct {
+		Code        string `json:"code"`
+		Description string `json:"description"`
+	} `json:"fatal_error"`
+}
+
+type globusError struct {
+	msg, url string
+	// HTTP status code of the API's response, if any.
+	code int
+	err  error
+}
+
+func (e *globusError) Error() string {
+	if e.code != 0 {
+		return fmt.Sprintf("globus: %s: %s: %d %s", e.msg, e.url, e.code, http.StatusText(e.code))
+	}
+	if e.err == nil {
+		return fmt.Sprintf("globus: %s: %s", e.msg, e.url)
+	}
+	return fmt.Sprintf("globus: %s: %s: %v", e.msg, e.url, e.err)
+}
+
+// Kind classifies the error. See ErrorKind.
+func (e *globusError) Kind() ErrorKind {
+	if e.code != 0 {
+		return classifyHTTPStatus(e.code)
+	}
+	if e.err == nil {
+		// A failed task, which Globus has already retried.
+		return UnknownError
+	}
+	return classifyNetError(e.err)
+}
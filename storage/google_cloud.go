@@ -1,3 +1,6 @@
+//go:build !nogcs
+// +build !nogcs
+
 package storage
 
 import (
@@ -6,41 +9,51 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/storage/v1"
 )
 
-// The gs url protocol
-const GSProtocol = "gs://"
-
-// GoogleCloudConfig describes configuration for the Google Cloud storage backend.
-type GoogleCloudConfig struct {
-	Disabled bool
-	// If no account file is provided then storage will try to use Google Application
-	// Default Credentials to authorize and authenticate the client.
-	CredentialsFile string
-}
-
-// Valid validates the Config configuration.
-func (g GoogleCloudConfig) Valid() bool {
-	return !g.Disabled
-}
-
 // GoogleCloud provides access to an GS object store.
 type GoogleCloud struct {
 	svc *storage.Service
+	// Set when no credentials were found, in which case
+	// only public objects can be read.
+	authErr error
+	// Access tokens, or nil when there are no credentials.
+	tokens *resettableTokenSource
+}
+
+func init() {
+	Register("gs", Backend{
+		Name: "googleStorage",
+		New: func(c Config) (Storage, error) {
+			return NewGoogleCloud(c.GoogleCloud)
+		},
+		Enabled:     func(c Config) bool { return c.GoogleCloud.Valid() },
+		ValidateURL: bucketValidator("googleStorage", (&GoogleCloud{}).parse),
+	})
 }
 
 // NewGoogleCloud creates an GoogleCloud client instance, give an endpoint URL
 // and a set of authentication credentials.
 func NewGoogleCloud(conf GoogleCloudConfig) (*GoogleCloud, error) {
-	ctx := context.Background()
-	client := &http.Client{}
-
-	if conf.CredentialsFile != "" {
+	// Authenticated clients wrap the shared client's transport,
+	// so that connections are reused across all operations.
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, sharedClient)
+	client := sharedClient
+	var authErr error
+	var newSource func() (oauth2.TokenSource, error)
+
+	if conf.Anonymous {
+		authErr = fmt.Errorf("anonymous access is configured")
+	} else if conf.CredentialsFile != "" {
 		// Pull the client configuration (e.g. auth) from a given account file.
 		// This is likely downloaded from Google Cloud manually via IAM & Admin > Service accounts.
 		bytes, rerr := ioutil.ReadFile(conf.CredentialsFile)
@@ -52,22 +65,76 @@ func NewGoogleCloud(conf GoogleCloudConfig) (*GoogleCloud, error) {
 		if tserr != nil {
 			return nil, tserr
 		}
-		client = config.Client(ctx)
+		newSource = func() (oauth2.TokenSource, error) {
+			return config.TokenSource(ctx), nil
+		}
 	} else {
 		// Pull the information (auth and other config) from the environment,
 		// which is useful when this code is running in a Google Compute instance.
-		defClient, err := google.DefaultClient(ctx, storage.CloudPlatformScope)
+		_, err := google.FindDefaultCredentials(ctx, storage.CloudPlatformScope)
 		if err == nil {
-			client = defClient
+			newSource = func() (oauth2.TokenSource, error) {
+				creds, err := google.FindDefaultCredentials(ctx, storage.CloudPlatformScope)
+				if err != nil {
+					return nil, err
+				}
+				return creds.TokenSource, nil
+			}
+		} else {
+			authErr = fmt.Errorf("no credentials found: %s", err)
 		}
 	}
 
+	var tokens *resettableTokenSource
+	if newSource != nil {
+		tokens = &resettableTokenSource{newSource: newSource}
+		client = oauth2.NewClient(ctx, tokens)
+	}
+
 	svc, cerr := storage.New(client)
 	if cerr != nil {
 		return nil, cerr
 	}
 
-	return &GoogleCloud{svc}, nil
+	return &GoogleCloud{svc, authErr, tokens}, nil
+}
+
+// Reauthenticate drops the cached access token, so that the next request
+// gets a new one, e.g. when a token is revoked before it expires.
+func (gs *GoogleCloud) Reauthenticate(ctx context.Context) error {
+	if gs.tokens != nil {
+		gs.tokens.reset()
+	}
+	return nil
+}
+
+// resettableTokenSource is a token source whose cached token can be dropped.
+// The token sources of the google package cache tokens until they expire,
+// so resetting creates a new source.
+type resettableTokenSource struct {
+	newSource func() (oauth2.TokenSource, error)
+
+	mtx sync.Mutex
+	src oauth2.TokenSource
+}
+
+func (r *resettableTokenSource) Token() (*oauth2.Token, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.src == nil {
+		src, err := r.newSource()
+		if err != nil {
+			return nil, err
+		}
+		r.src = src
+	}
+	return r.src.Token()
+}
+
+func (r *resettableTokenSource) reset() {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.src = nil
 }
 
 // Stat returns information about the object at the given storage URL.
@@ -79,21 +146,39 @@ func (gs *GoogleCloud) Stat(ctx context.Context, url string) (*Object, error) {
 
 	obj, err := gs.svc.Objects.Get(u.bucket, u.path).Context(ctx).Do()
 	if err != nil {
-		return nil, fmt.Errorf("googleStorage: calling stat on object %s: %v", url, err)
+		return nil, &gsError{fmt.Sprintf("calling stat on object %s", url), err}
 	}
 
+	return gs.object(url, obj), nil
+}
+
+// object converts a Google Cloud object resource to an Object.
+func (gs *GoogleCloud) object(url string, obj *storage.Object) *Object {
 	modtime, _ := time.Parse(time.RFC3339, obj.Updated)
-	return &Object{
+	o := &Object{
 		URL:          url,
 		Name:         obj.Name,
 		ETag:         obj.Etag,
 		Size:         int64(obj.Size),
 		LastModified: modtime,
-	}, nil
+		Version:      strconv.FormatInt(obj.Generation, 10),
+	}
+	// Composite objects have no MD5, but always have a CRC32C.
+	if obj.Md5Hash != "" {
+		o.Checksum = base64ToHex(obj.Md5Hash)
+		o.ChecksumType = ChecksumMD5
+	} else if obj.Crc32c != "" {
+		o.Checksum = base64ToHex(obj.Crc32c)
+		o.ChecksumType = ChecksumCRC32C
+	}
+	if o.Checksum == "" {
+		o.ChecksumType = ""
+	}
+	return o
 }
 
 // List lists the objects at the given url.
-func (gs *GoogleCloud) List(ctx context.Context, url string) ([]*Object, error) {
+func (gs *GoogleCloud) List(ctx context.Context, url string, opts ListOptions) ([]*Object, error) {
 	u, err := gs.parse(url)
 	if err != nil {
 		return nil, err
@@ -101,23 +186,28 @@ func (gs *GoogleCloud) List(ctx context.Context, url string) ([]*Object, error)
 
 	var objects []*Object
 
-	err = gs.svc.Objects.List(u.bucket).Prefix(u.path).Pages(ctx,
+	call := gs.svc.Objects.List(u.bucket).Prefix(u.path)
+	if !opts.Recursive {
+		call = call.Prefix(dirPrefix(u.path)).Delimiter("/")
+	}
+
+	err = call.Pages(ctx,
 		func(objs *storage.Objects) error {
 
+			for _, prefix := range objs.Prefixes {
+				objects = append(objects, &Object{
+					URL:  GSProtocol + u.bucket + "/" + prefix,
+					Name: prefix,
+					Dir:  true,
+				})
+			}
+
 			for _, obj := range objs.Items {
 				if strings.HasSuffix(obj.Name, "/") {
 					continue
 				}
 
-				modtime, _ := time.Parse(time.RFC3339, obj.Updated)
-
-				objects = append(objects, &Object{
-					URL:          GSProtocol + obj.Bucket + "/" + obj.Name,
-					Name:         obj.Name,
-					ETag:         obj.Etag,
-					Size:         int64(obj.Size),
-					LastModified: modtime,
-				})
+				objects = append(objects, gs.object(GSProtocol+obj.Bucket+"/"+obj.Name, obj))
 			}
 			return nil
 		})
@@ -142,34 +232,235 @@ func (gs *GoogleCloud) Get(ctx context.Context, url string, dest io.Writer) (*Ob
 
 	resp, err := gs.svc.Objects.Get(u.bucket, u.path).Context(ctx).Download()
 	if err != nil {
-		return nil, fmt.Errorf("googleStorage: getting object %s: %v", url, err)
+		return nil, &gsError{fmt.Sprintf("getting object %s", url), err}
 	}
 
 	_, copyErr := io.Copy(dest, ContextReader(ctx, resp.Body))
 
 	if copyErr != nil {
-		return nil, fmt.Errorf("googleStorage: copying file: %v", copyErr)
+		return nil, &gsError{"copying file", copyErr}
 	}
 
 	return obj, nil
 }
 
+// GetRange copies part of an object from GS to the host path.
+func (gs *GoogleCloud) GetRange(ctx context.Context, url string, offset, length int64, dest io.Writer) error {
+	u, err := gs.parse(url)
+	if err != nil {
+		return err
+	}
+
+	call := gs.svc.Objects.Get(u.bucket, u.path).Context(ctx)
+	call.Header().Set("Range", rangeHeader(offset, length))
+	resp, err := call.Download()
+	if err != nil {
+		return &gsError{fmt.Sprintf("getting object %s", url), err}
+	}
+	defer resp.Body.Close()
+
+	_, copyErr := io.Copy(dest, ContextReader(ctx, resp.Body))
+	if copyErr != nil {
+		return &gsError{"copying file", copyErr}
+	}
+	return nil
+}
+
+// GetVersion copies a specific generation of an object from GS to the host path.
+func (gs *GoogleCloud) GetVersion(ctx context.Context, url, version string, dest io.Writer) (*Object, error) {
+	generation, err := strconv.ParseInt(version, 10, 64)
+	if err != nil {
+		return nil, &gsError{fmt.Sprintf("invalid generation %q", version), err}
+	}
+
+	u, err := gs.parse(url)
+	if err != nil {
+		return nil, err
+	}
+
+	meta, err := gs.svc.Objects.Get(u.bucket, u.path).Generation(generation).Context(ctx).Do()
+	if err != nil {
+		return nil, &gsError{fmt.Sprintf("calling stat on object %s generation %d", url, generation), err}
+	}
+
+	resp, err := gs.svc.Objects.Get(u.bucket, u.path).Generation(generation).Context(ctx).Download()
+	if err != nil {
+		return nil, &gsError{fmt.Sprintf("getting object %s generation %d", url, generation), err}
+	}
+	defer resp.Body.Close()
+
+	_, copyErr := io.Copy(dest, ContextReader(ctx, resp.Body))
+	if copyErr != nil {
+		return nil, &gsError{"copying file", copyErr}
+	}
+
+	return gs.object(url, meta), nil
+}
+
 // Put copies an object (file) from the host path to GS.
-func (gs *GoogleCloud) Put(ctx context.Context, url string, src io.Reader) (*Object, error) {
+func (gs *GoogleCloud) Put(ctx context.Context, url string, src io.Reader, opts PutOptions) (*Object, error) {
 	u, err := gs.parse(url)
 	if err != nil {
 		return nil, err
 	}
 
 	obj := &storage.Object{
-		Name: u.path,
+		Name:        u.path,
+		ContentType: opts.ContentType,
+	}
+
+	call := gs.svc.Objects.Insert(u.bucket, obj).Media(ContextReader(ctx, src))
+	switch opts.ACL {
+	case "":
+	case ACLPrivate:
+		call = call.PredefinedAcl("private")
+	case ACLPublicRead:
+		call = call.PredefinedAcl("publicRead")
+	default:
+		return nil, ValidateACL(opts.ACL)
+	}
+	if opts.IfNotExists {
+		// Generation 0 matches only if there is no live version of the object.
+		call = call.IfGenerationMatch(0)
+	}
+
+	created, err := call.Do()
+	if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusPreconditionFailed {
+		return nil, &ErrObjectExists{"googleStorage", url}
+	}
+	if err != nil {
+		return nil, &gsError{fmt.Sprintf("uploading object %s", url), err}
+	}
+	// The response is the created object's resource.
+	return gs.object(url, created), nil
+}
+
+// Publish grants read access on the object to all users,
+// and returns the object's public URL.
+func (gs *GoogleCloud) Publish(ctx context.Context, url string) (string, error) {
+	u, err := gs.parse(url)
+	if err != nil {
+		return "", err
+	}
+
+	acl := &storage.ObjectAccessControl{Entity: "allUsers", Role: "READER"}
+	_, err = gs.svc.ObjectAccessControls.Insert(u.bucket, u.path, acl).Context(ctx).Do()
+	if err != nil {
+		return "", &gsError{fmt.Sprintf("publishing object %s", url), err}
+	}
+	return "https://storage.googleapis.com/" + u.bucket + "/" + escapePath(u.path), nil
+}
+
+// Lock places an event-based hold on the object. If "until" isn't zero,
+// the object also gets an unlocked retention period, which requires
+// object retention to be enabled on the bucket. If the bucket has a
+// retention policy, its period starts when the hold is released.
+func (gs *GoogleCloud) Lock(ctx context.Context, url string, until time.Time) error {
+	u, err := gs.parse(url)
+	if err != nil {
+		return err
+	}
+
+	patch := &storage.Object{EventBasedHold: true}
+	if !until.IsZero() {
+		patch.Retention = &storage.ObjectRetention{
+			Mode:            "Unlocked",
+			RetainUntilTime: until.UTC().Format(time.RFC3339),
+		}
+	}
+	_, err = gs.svc.Objects.Patch(u.bucket, u.path, patch).Context(ctx).Do()
+	if err != nil {
+		return &gsError{fmt.Sprintf("locking object %s", url), err}
+	}
+	return nil
+}
+
+// Unlock releases the hold on the object and removes its retention period,
+// which requires the storage.objects.overrideUnlockedRetention permission.
+func (gs *GoogleCloud) Unlock(ctx context.Context, url string) error {
+	u, err := gs.parse(url)
+	if err != nil {
+		return err
+	}
+
+	patch := &storage.Object{
+		// false and nil are only sent when listed explicitly.
+		ForceSendFields: []string{"EventBasedHold"},
+		NullFields:      []string{"Retention"},
+	}
+	_, err = gs.svc.Objects.Patch(u.bucket, u.path, patch).
+		OverrideUnlockedRetention(true).Context(ctx).Do()
+	if err != nil {
+		return &gsError{fmt.Sprintf("unlocking object %s", url), err}
 	}
+	return nil
+}
+
+// Delete deletes the object at the given url.
+func (gs *GoogleCloud) Delete(ctx context.Context, url string) error {
+	u, err := gs.parse(url)
+	if err != nil {
+		return err
+	}
+
+	err = gs.svc.Objects.Delete(u.bucket, u.path).Context(ctx).Do()
+	if err != nil {
+		return &gsError{fmt.Sprintf("deleting object %s", url), err}
+	}
+	return nil
+}
 
-	_, err = gs.svc.Objects.Insert(u.bucket, obj).Media(ContextReader(ctx, src)).Do()
+// Move moves an object to a new url. The object is rewritten server-side,
+// then the original is deleted.
+func (gs *GoogleCloud) Move(ctx context.Context, src, dst string) error {
+	su, err := gs.parse(src)
 	if err != nil {
-		return nil, fmt.Errorf("googleStorage: uploading object %s: %v", url, err)
+		return err
 	}
-	return gs.Stat(ctx, url)
+	du, err := gs.parse(dst)
+	if err != nil {
+		return err
+	}
+
+	// Large objects may need multiple rewrite calls to complete.
+	var token string
+	for {
+		call := gs.svc.Objects.Rewrite(su.bucket, su.path, du.bucket, du.path, &storage.Object{})
+		if token != "" {
+			call = call.RewriteToken(token)
+		}
+		resp, err := call.Context(ctx).Do()
+		if err != nil {
+			return &gsError{fmt.Sprintf("copying object %s to %s", src, dst), err}
+		}
+		if resp.Done {
+			break
+		}
+		token = resp.RewriteToken
+	}
+
+	return gs.Delete(ctx, src)
+}
+
+// UnsupportedOperations describes which operations are not supported
+// for the given URL.
+func (gs *GoogleCloud) UnsupportedOperations(url string) UnsupportedOperations {
+	u, err := gs.parse(url)
+	if err != nil {
+		return AllUnsupported(err)
+	}
+	if u.bucket == "" {
+		return AllUnsupported(&ErrInvalidURL{"googleStorage"})
+	}
+
+	ops := UnsupportedOperations{}
+	if gs.authErr != nil {
+		// Anonymous clients can only read public objects.
+		ops.Put = &ErrUnsupportedOperation{"googleStorage", "put", gs.authErr.Error()}
+		ops.Delete = &ErrUnsupportedOperation{"googleStorage", "delete", gs.authErr.Error()}
+		ops.Copy = &ErrUnsupportedOperation{"googleStorage", "copy", gs.authErr.Error()}
+	}
+	return ops
 }
 
 // Join joins the given URL with the given subpath.
@@ -197,3 +488,28 @@ func (gs *GoogleCloud) parse(rawurl string) (*urlparts, error) {
 	}
 	return url, nil
 }
+
+type gsError struct {
+	msg string
+	err error
+}
+
+func (e *gsError) Error() string {
+	return fmt.Sprintf("googleStorage: %s: %v", e.msg, e.err)
+}
+
+// Kind classifies the error. See ErrorKind.
+func (e *gsError) Kind() ErrorKind {
+	if apiErr, ok := e.err.(*googleapi.Error); ok {
+		return classifyHTTPStatus(apiErr.Code)
+	}
+	return classifyNetError(e.err)
+}
+
+// RetryAfter returns the delay requested by the server's Retry-After header.
+func (e *gsError) RetryAfter() time.Duration {
+	if apiErr, ok := e.err.(*googleapi.Error); ok {
+		return parseRetryAfter(apiErr.Header)
+	}
+	return 0
+}
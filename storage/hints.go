@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+// ErrHinted wraps an error of a common failure mode with advice on how
+// to fix it, so that users see what to do instead of a raw SDK error.
+// See WithHint.
+type ErrHinted struct {
+	Err  error
+	Hint string
+}
+
+func (e *ErrHinted) Error() string {
+	return e.Err.Error() + "\nhint: " + e.Hint
+}
+
+// Unwrap returns the wrapped error.
+func (e *ErrHinted) Unwrap() error {
+	return e.Err
+}
+
+// Kind returns the kind of the wrapped error.
+func (e *ErrHinted) Kind() ErrorKind {
+	return KindOf(e.Err)
+}
+
+// setupHints describe how to configure each backend, by backend name.
+var setupHints = map[string]string{
+	"swift": "set OS_AUTH_URL, OS_USERNAME, OS_PASSWORD, OS_PROJECT_NAME, and OS_REGION_NAME, " +
+		"e.g. by sourcing your OpenStack RC file, or set them in Storage.Swift in the config; " +
+		"for public containers, set Storage.Swift.Anonymous and StorageURL instead",
+	"googleStorage": "check that Storage.GoogleCloud isn't disabled in the config",
+	"s3":            "check that Storage.S3 isn't disabled in the config",
+	"ftpStorage":    "check that Storage.FTP isn't disabled in the config",
+	"sftp":          "check that Storage.SFTP isn't disabled in the config",
+	"ipfs":          "set Storage.IPFS.Gateway in the config, e.g. to https://ipfs.io",
+	"globus":        "set GLOBUS_ACCESS_TOKEN, or Storage.Globus.AccessToken in the config",
+	"irods":         "install the iRODS icommands and sign in with \"iinit\"",
+	"gdrive":        "set Storage.GoogleDrive.ClientID in the config, then run \"tanker login gdrive\"",
+	"dropbox":       "set Storage.Dropbox.AppKey in the config, then run \"tanker login dropbox\"",
+	"adls": "set AZURE_STORAGE_SAS_TOKEN, or AZURE_TENANT_ID, AZURE_CLIENT_ID, and AZURE_CLIENT_SECRET " +
+		"for a service principal, or set them in Storage.ADLS in the config",
+	"webdav": "check that Storage.WebDAV isn't disabled in the config",
+}
+
+// kindHints describe how to fix errors by kind.
+var kindHints = map[ErrorKind]string{
+	AuthError: "the storage credentials were rejected or have expired: refresh them, " +
+		"e.g. \"gcloud auth application-default login\" for gs://, \"aws sso login\" for s3://, " +
+		"\"tanker login\" for gdrive:// and dropbox://, \"ssh-add\" for sftp://, " +
+		"or by sourcing your OpenStack RC file again for swift://",
+	PermissionError: "the credentials are valid, but lack permission: check that the bucket's " +
+		"access policy lets them read and write objects under the base URL",
+	TransientError: "the storage service was unreachable or overloaded, and retries didn't help: " +
+		"try again later, or allow more retries with Storage.Retry.MaxTries",
+	NotFoundError: "check that the bucket in the base URL exists, and that the object was pushed; " +
+		"\"tanker verify\" checks the remote objects",
+}
+
+// WithHint wraps "err" in an ErrHinted if it's a common failure mode with
+// known remediation, and otherwise returns it unchanged.
+func WithHint(err error) error {
+	if err == nil {
+		return nil
+	}
+	var hinted *ErrHinted
+	if errors.As(err, &hinted) {
+		return err
+	}
+	if hint := hintFor(err); hint != "" {
+		return &ErrHinted{err, hint}
+	}
+	return err
+}
+
+func hintFor(err error) string {
+	var notConfigured *ErrNotConfigured
+	if errors.As(err, &notConfigured) {
+		return setupHints[notConfigured.backend]
+	}
+
+	// Some SDKs flatten network errors into strings, so check the message too.
+	var dns *net.DNSError
+	if errors.As(err, &dns) || strings.Contains(err.Error(), "no such host") {
+		return "the storage host couldn't be resolved: " +
+			"check the host in the base URL, and your network and proxy settings"
+	}
+	if strings.Contains(err.Error(), "x509: certificate") {
+		return "the storage host's TLS certificate isn't trusted: if it's signed by a private CA, " +
+			"add the CA to the system's trusted certificates, or set SSL_CERT_FILE"
+	}
+	return kindHints[KindOf(err)]
+}
@@ -0,0 +1,233 @@
+//go:build !noipfs
+// +build !noipfs
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+func init() {
+	Register("ipfs", Backend{
+		Name: "ipfs",
+		New: func(c Config) (Storage, error) {
+			return NewIPFS(c.IPFS)
+		},
+		Enabled:     func(c Config) bool { return c.IPFS.Valid() },
+		ValidateURL: bucketValidator("ipfs", (&IPFS{}).parse),
+	})
+}
+
+// IPFS provides read-only access to objects published on IPFS, through an
+// HTTP gateway. This backend is experimental.
+//
+// The base URL names an IPFS directory, "ipfs://<cid>", containing files
+// named by their OID, e.g. created with "ipfs add -r" on a copy of the
+// objects. Since gateways aren't trusted, downloads of objects named by
+// an OID are checked against it. Uploads must go to conventional storage,
+// so IPFS is most useful as a mirror, see MirrorConfig, or as the base URL
+// of read-only clones.
+type IPFS struct {
+	gateway string
+}
+
+// NewIPFS creates an IPFS client using the given gateway.
+func NewIPFS(conf IPFSConfig) (*IPFS, error) {
+	return &IPFS{gateway: strings.TrimSuffix(conf.Gateway, "/")}, nil
+}
+
+// Stat returns information about the object at the given storage URL.
+func (b *IPFS) Stat(ctx context.Context, url string) (*Object, error) {
+	resp, err := b.request(ctx, "HEAD", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return b.object(url, resp), nil
+}
+
+func (b *IPFS) object(url string, resp *http.Response) *Object {
+	u, _ := b.parse(url)
+	modtime, _ := time.Parse(http.TimeFormat, resp.Header.Get("Last-Modified"))
+	return &Object{
+		URL:          url,
+		Name:         u.path,
+		ETag:         strings.Trim(resp.Header.Get("Etag"), `"`),
+		LastModified: modtime,
+		Size:         resp.ContentLength,
+	}
+}
+
+// List is not supported, since gateways only list directories as HTML.
+func (b *IPFS) List(ctx context.Context, url string, opts ListOptions) ([]*Object, error) {
+	return nil, &ErrUnsupportedOperation{"ipfs", "list", "not implemented"}
+}
+
+// Get copies an object from IPFS to "dest". If the object is named by
+// an OID, its content is checked against it.
+func (b *IPFS) Get(ctx context.Context, url string, dest io.Writer) (*Object, error) {
+	resp, err := b.request(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	obj := b.object(url, resp)
+	oid := obj.Name[strings.LastIndex(obj.Name, "/")+1:]
+	w := dest
+	verifier, _ := NewOIDVerifier(oid)
+	if verifier != nil {
+		w = io.MultiWriter(dest, verifier)
+	}
+
+	_, copyErr := io.Copy(w, ContextReader(ctx, resp.Body))
+	if copyErr != nil {
+		return nil, &ipfsError{"copying file", url, 0, copyErr}
+	}
+	if verifier != nil {
+		if err := verifier.Verify(); err != nil {
+			return nil, fmt.Errorf("ipfs: content of %s doesn't match its OID: %s", url, err)
+		}
+	}
+	return obj, nil
+}
+
+// GetRange copies part of an object from IPFS to "dest". The content
+// can't be checked against the OID; callers downloading a whole object
+// in parts should check it themselves.
+func (b *IPFS) GetRange(ctx context.Context, url string, offset, length int64, dest io.Writer) error {
+	resp, err := b.request(ctx, "GET", url, http.Header{"Range": {rangeHeader(offset, length)}})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return &ipfsError{"gateway ignored range request", url, resp.StatusCode, nil}
+	}
+	_, copyErr := io.Copy(dest, ContextReader(ctx, resp.Body))
+	if copyErr != nil {
+		return &ipfsError{"copying file", url, 0, copyErr}
+	}
+	return nil
+}
+
+// Put is not supported: IPFS content is published by adding it to a node.
+func (b *IPFS) Put(ctx context.Context, url string, src io.Reader, opts PutOptions) (*Object, error) {
+	return nil, &ErrUnsupportedOperation{"ipfs", "put", "IPFS is read-only"}
+}
+
+// Delete is not supported: IPFS content is immutable.
+func (b *IPFS) Delete(ctx context.Context, url string) error {
+	return &ErrUnsupportedOperation{"ipfs", "delete", "IPFS is read-only"}
+}
+
+// Move is not supported: IPFS content is immutable.
+func (b *IPFS) Move(ctx context.Context, src, dst string) error {
+	return &ErrUnsupportedOperation{"ipfs", "copy", "IPFS is read-only"}
+}
+
+// Join joins the given URL with the given subpath.
+func (b *IPFS) Join(url, path string) (string, error) {
+	return strings.TrimSuffix(url, "/") + "/" + path, nil
+}
+
+// UnsupportedOperations describes which operations are not supported
+// for the given URL.
+func (b *IPFS) UnsupportedOperations(url string) UnsupportedOperations {
+	u, err := b.parse(url)
+	if err != nil {
+		return AllUnsupported(err)
+	}
+	if u.bucket == "" {
+		return AllUnsupported(&ErrInvalidURL{"ipfs"})
+	}
+	readOnly := "IPFS is read-only"
+	return UnsupportedOperations{
+		Put:    &ErrUnsupportedOperation{"ipfs", "put", readOnly},
+		List:   &ErrUnsupportedOperation{"ipfs", "list", "not implemented"},
+		Delete: &ErrUnsupportedOperation{"ipfs", "delete", readOnly},
+		Copy:   &ErrUnsupportedOperation{"ipfs", "copy", readOnly},
+		ACL:    &ErrUnsupportedOperation{"ipfs", "acl", readOnly},
+	}
+}
+
+// request sends a request for the object at "url" to the gateway.
+// Responses other than 2xx are returned as errors.
+func (b *IPFS) request(ctx context.Context, method, url string, header http.Header) (*http.Response, error) {
+	u, err := b.parse(url)
+	if err != nil {
+		return nil, err
+	}
+
+	gwURL := b.gateway + "/ipfs/" + u.bucket + "/" + escapePath(u.path)
+	req, err := http.NewRequest(method, gwURL, nil)
+	if err != nil {
+		return nil, &ipfsError{"creating request", url, 0, err}
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	resp, err := sharedClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, &ipfsError{"requesting " + gwURL, url, 0, err}
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, &ErrNotFound{"ipfs", url}
+	}
+	if resp.StatusCode/100 != 2 {
+		resp.Body.Close()
+		return nil, &ipfsError{"requesting " + gwURL, url, resp.StatusCode, nil}
+	}
+	return resp, nil
+}
+
+func (b *IPFS) parse(rawurl string) (*urlparts, error) {
+	if !strings.HasPrefix(rawurl, IPFSProtocol) {
+		return nil, &ErrUnsupportedProtocol{"ipfs"}
+	}
+
+	path := strings.TrimPrefix(rawurl, IPFSProtocol)
+	if path == "" {
+		return nil, &ErrInvalidURL{"ipfs"}
+	}
+
+	split := strings.SplitN(path, "/", 2)
+	url := &urlparts{}
+	if len(split) > 0 {
+		url.bucket = split[0]
+	}
+	if len(split) == 2 {
+		url.path = split[1]
+	}
+	return url, nil
+}
+
+type ipfsError struct {
+	msg, url string
+	// HTTP status code of the gateway's response, if any.
+	code int
+	err  error
+}
+
+func (e *ipfsError) Error() string {
+	if e.code != 0 {
+		return fmt.Sprintf("ipfs: %s: %s: %d %s", e.msg, e.url, e.code, http.StatusText(e.code))
+	}
+	return fmt.Sprintf("ipfs: %s: %s: %v", e.msg, e.url, e.err)
+}
+
+// Kind classifies the error. See ErrorKind.
+func (e *ipfsError) Kind() ErrorKind {
+	if e.code != 0 {
+		return classifyHTTPStatus(e.code)
+	}
+	return classifyNetError(e.err)
+}
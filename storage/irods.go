@@ -0,0 +1,397 @@
+//go:build !noirods
+// +build !noirods
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	Register("irods", Backend{
+		Name: "irods",
+		New: func(c Config) (Storage, error) {
+			return NewIRODS(c.IRODS)
+		},
+		Enabled:     func(c Config) bool { return c.IRODS.Valid() },
+		ValidateURL: bucketValidator("irods", (&IRODS{}).parse),
+	})
+}
+
+// IRODS provides access to an iRODS data grid, using the icommands
+// (iquest, iget, iput, etc.), which must be installed and authenticated,
+// e.g. with "iinit".
+//
+// URLs are of the form "irods://<zone>/<path>", for the logical path
+// "/<zone>/<path>". Transfers go through temporary files, so that the
+// icommands can use parallel transfers for large objects.
+type IRODS struct {
+	conf IRODSConfig
+}
+
+// NewIRODS creates an iRODS client from the given config.
+func NewIRODS(conf IRODSConfig) (*IRODS, error) {
+	return &IRODS{conf: conf}, nil
+}
+
+// Stat returns information about the object at the given storage URL.
+func (b *IRODS) Stat(ctx context.Context, url string) (*Object, error) {
+	p, err := b.logicalPath(url)
+	if err != nil {
+		return nil, err
+	}
+
+	coll, name := path.Split(p)
+	rows, err := b.query(ctx, url, "%s\t%s\t%s\t%s\t%s\n",
+		"SELECT COLL_NAME, DATA_NAME, DATA_SIZE, DATA_MODIFY_TIME, DATA_CHECKSUM"+
+			" WHERE COLL_NAME = '"+strings.TrimSuffix(coll, "/")+"' AND DATA_NAME = '"+name+"'")
+	if err != nil {
+		return nil, err
+	}
+	objs := b.objects(url, rows)
+	if len(objs) == 0 {
+		return nil, &ErrNotFound{"irods", url}
+	}
+	return objs[0], nil
+}
+
+// List lists the objects at the given URL. See ListOptions.
+func (b *IRODS) List(ctx context.Context, url string, opts ListOptions) ([]*Object, error) {
+	p, err := b.logicalPath(url)
+	if err != nil {
+		return nil, err
+	}
+	coll := strings.TrimSuffix(p, "/")
+
+	cond := "COLL_NAME = '" + coll + "'"
+	if opts.Recursive {
+		cond += " || like '" + coll + "/%'"
+	}
+	rows, err := b.query(ctx, url, "%s\t%s\t%s\t%s\t%s\n",
+		"SELECT COLL_NAME, DATA_NAME, DATA_SIZE, DATA_MODIFY_TIME, DATA_CHECKSUM WHERE "+cond)
+	if err != nil {
+		return nil, err
+	}
+	objects := b.objects(url, rows)
+	if opts.Recursive {
+		return objects, nil
+	}
+
+	// Subcollections are listed as pseudo-directories.
+	colls, err := b.query(ctx, url, "%s\n",
+		"SELECT COLL_NAME WHERE COLL_PARENT_NAME = '"+coll+"'")
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range colls {
+		sub := strings.TrimPrefix(row[0], "/")
+		objects = append(objects, &Object{
+			URL:  IRODSProtocol + sub,
+			Name: strings.TrimPrefix(sub, b.zone(url)+"/"),
+			Dir:  true,
+		})
+	}
+	return objects, nil
+}
+
+// objects converts rows of COLL_NAME, DATA_NAME, DATA_SIZE,
+// DATA_MODIFY_TIME, and DATA_CHECKSUM to objects. iRODS returns a row
+// for each replica of an object; only the first is used.
+func (b *IRODS) objects(url string, rows [][]string) []*Object {
+	zone := b.zone(url)
+	seen := map[string]bool{}
+
+	var objects []*Object
+	for _, row := range rows {
+		if len(row) != 5 {
+			continue
+		}
+		p := strings.TrimPrefix(path.Join(row[0], row[1]), "/")
+		if seen[p] {
+			continue
+		}
+		seen[p] = true
+
+		size, _ := strconv.ParseInt(row[2], 10, 64)
+		obj := &Object{
+			URL:  IRODSProtocol + p,
+			Name: strings.TrimPrefix(p, zone+"/"),
+			Size: size,
+		}
+		if secs, err := strconv.ParseInt(row[3], 10, 64); err == nil {
+			obj.LastModified = time.Unix(secs, 0)
+		}
+		setIRODSChecksum(obj, row[4])
+		objects = append(objects, obj)
+	}
+	return objects
+}
+
+// setIRODSChecksum sets the object's checksum from DATA_CHECKSUM, which is
+// either "sha2:" followed by a base64 SHA-256, or a hex MD5, depending on
+// the grid's default hash scheme. It's empty unless a checksum was computed,
+// e.g. with "iput -k".
+func setIRODSChecksum(obj *Object, sum string) {
+	switch {
+	case strings.HasPrefix(sum, "sha2:"):
+		if hex := base64ToHex(strings.TrimPrefix(sum, "sha2:")); hex != "" {
+			obj.Checksum = hex
+			obj.ChecksumType = ChecksumSHA256
+		}
+	case len(sum) == 32:
+		obj.Checksum = sum
+		obj.ChecksumType = ChecksumMD5
+	}
+}
+
+// Get copies an object from iRODS to "dest", through a temporary file.
+func (b *IRODS) Get(ctx context.Context, url string, dest io.Writer) (*Object, error) {
+	p, err := b.logicalPath(url)
+	if err != nil {
+		return nil, err
+	}
+	obj, err := b.Stat(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+
+	tmp, err := ioutil.TempFile(b.conf.TempDir, "tanker-irods-")
+	if err != nil {
+		return nil, &irodsError{"creating temporary file", url, "", err}
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	args := append([]string{"-f"}, b.transferArgs()...)
+	if obj.Checksum != "" {
+		// Verify the checksum after the transfer.
+		args = append(args, "-K")
+	}
+	_, err = b.run(ctx, url, "iget", append(args, p, tmp.Name())...)
+	if err != nil {
+		return nil, err
+	}
+
+	_, copyErr := io.Copy(dest, ContextReader(ctx, tmp))
+	if copyErr != nil {
+		return nil, &irodsError{"copying file", url, "", copyErr}
+	}
+	return obj, nil
+}
+
+// Put copies an object from "src" to iRODS, through a temporary file.
+// The iRODS server computes a checksum of the object.
+func (b *IRODS) Put(ctx context.Context, url string, src io.Reader, opts PutOptions) (*Object, error) {
+	p, err := b.logicalPath(url)
+	if err != nil {
+		return nil, err
+	}
+
+	tmp, err := ioutil.TempFile(b.conf.TempDir, "tanker-irods-")
+	if err != nil {
+		return nil, &irodsError{"creating temporary file", url, "", err}
+	}
+	defer os.Remove(tmp.Name())
+
+	_, copyErr := io.Copy(tmp, ContextReader(ctx, src))
+	closeErr := tmp.Close()
+	if copyErr != nil {
+		return nil, &irodsError{"copying file", url, "", copyErr}
+	}
+	if closeErr != nil {
+		return nil, &irodsError{"copying file", url, "", closeErr}
+	}
+
+	args := append([]string{"-k"}, b.transferArgs()...)
+	if !opts.IfNotExists {
+		args = append(args, "-f")
+	}
+	_, err = b.run(ctx, url, "iput", append(args, tmp.Name(), p)...)
+	if opts.IfNotExists && err != nil && strings.Contains(err.Error(), "OVERWRITE_WITHOUT_FORCE_FLAG") {
+		return nil, &ErrObjectExists{"irods", url}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return b.Stat(ctx, url)
+}
+
+// Delete deletes the object at the given URL, bypassing the trash.
+func (b *IRODS) Delete(ctx context.Context, url string) error {
+	p, err := b.logicalPath(url)
+	if err != nil {
+		return err
+	}
+	_, err = b.run(ctx, url, "irm", "-f", p)
+	return err
+}
+
+// Move moves an object within the data grid.
+func (b *IRODS) Move(ctx context.Context, src, dst string) error {
+	s, err := b.logicalPath(src)
+	if err != nil {
+		return err
+	}
+	d, err := b.logicalPath(dst)
+	if err != nil {
+		return err
+	}
+	_, err = b.run(ctx, src, "imv", s, d)
+	return err
+}
+
+// Join joins the given URL with the given subpath.
+func (b *IRODS) Join(url, path string) (string, error) {
+	return strings.TrimSuffix(url, "/") + "/" + path, nil
+}
+
+// UnsupportedOperations describes which operations are not supported
+// for the given URL.
+func (b *IRODS) UnsupportedOperations(url string) UnsupportedOperations {
+	u, err := b.parse(url)
+	if err != nil {
+		return AllUnsupported(err)
+	}
+	if u.bucket == "" {
+		return AllUnsupported(&ErrInvalidURL{"irods"})
+	}
+	return UnsupportedOperations{
+		Range: &ErrUnsupportedOperation{"irods", "range", "not implemented"},
+		ACL:   &ErrUnsupportedOperation{"irods", "acl", "not implemented"},
+	}
+}
+
+// transferArgs returns the iget/iput arguments for the configured
+// resource and number of transfer threads.
+func (b *IRODS) transferArgs() []string {
+	var args []string
+	if b.conf.Resource != "" {
+		args = append(args, "-R", b.conf.Resource)
+	}
+	if b.conf.Threads > 0 {
+		args = append(args, "-N", strconv.Itoa(b.conf.Threads))
+	}
+	return args
+}
+
+// query runs a GenQuery with iquest, returning the tab separated
+// fields of each row. No rows isn't an error.
+func (b *IRODS) query(ctx context.Context, url, format, q string) ([][]string, error) {
+	out, err := b.run(ctx, url, "iquest", "--no-page", format, q)
+	if err != nil && strings.Contains(err.Error(), "CAT_NO_ROWS_FOUND") {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var rows [][]string
+	for _, line := range strings.Split(out, "\n") {
+		if line == "" || strings.HasPrefix(line, "CAT_NO_ROWS_FOUND") {
+			continue
+		}
+		rows = append(rows, strings.Split(line, "\t"))
+	}
+	return rows, nil
+}
+
+// run runs an icommand and returns its stdout.
+func (b *IRODS) run(ctx context.Context, url, name string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		// Some icommands report errors on stdout.
+		output := strings.TrimSpace(stderr.String() + "\n" + stdout.String())
+		return stdout.String(), &irodsError{name, url, output, err}
+	}
+	return stdout.String(), nil
+}
+
+// logicalPath returns the iRODS logical path of a URL.
+// Paths are quoted in queries, so they can't contain quotes.
+func (b *IRODS) logicalPath(url string) (string, error) {
+	u, err := b.parse(url)
+	if err != nil {
+		return "", err
+	}
+	if u.bucket == "" || strings.Contains(u.path, "'") {
+		return "", &ErrInvalidURL{"irods"}
+	}
+	return "/" + u.bucket + "/" + u.path, nil
+}
+
+// zone returns the zone of a URL.
+func (b *IRODS) zone(url string) string {
+	u, err := b.parse(url)
+	if err != nil {
+		return ""
+	}
+	return u.bucket
+}
+
+func (b *IRODS) parse(rawurl string) (*urlparts, error) {
+	if !strings.HasPrefix(rawurl, IRODSProtocol) {
+		return nil, &ErrUnsupportedProtocol{"irods"}
+	}
+
+	path := strings.TrimPrefix(rawurl, IRODSProtocol)
+	if path == "" {
+		return nil, &ErrInvalidURL{"irods"}
+	}
+
+	split := strings.SplitN(path, "/", 2)
+	url := &urlparts{}
+	if len(split) > 0 {
+		url.bucket = split[0]
+	}
+	if len(split) == 2 {
+		url.path = split[1]
+	}
+	return url, nil
+}
+
+type irodsError struct {
+	msg, url string
+	// Output of the failed icommand, if any.
+	output string
+	err    error
+}
+
+func (e *irodsError) Error() string {
+	if e.output != "" {
+		return fmt.Sprintf("irods: %s: %s: %v: %s", e.msg, e.url, e.err, e.output)
+	}
+	return fmt.Sprintf("irods: %s: %s: %v", e.msg, e.url, e.err)
+}
+
+// Kind classifies the error by the iRODS error code in the output of
+// the icommand. See ErrorKind.
+func (e *irodsError) Kind() ErrorKind {
+	switch {
+	case strings.Contains(e.output, "does not exist"),
+		strings.Contains(e.output, "USER_FILE_DOES_NOT_EXIST"),
+		strings.Contains(e.output, "CAT_UNKNOWN_FILE"),
+		strings.Contains(e.output, "CAT_UNKNOWN_COLLECTION"):
+		return NotFoundError
+	case strings.Contains(e.output, "CAT_NO_ACCESS_PERMISSION"):
+		return PermissionError
+	case strings.Contains(e.output, "SYS_SOCK_CONNECT_ERR"),
+		strings.Contains(e.output, "SYS_HEADER_READ_LEN_ERR"),
+		strings.Contains(e.output, "USER_SOCK_CONNECT_TIMEDOUT"):
+		return TransientError
+	}
+	return UnknownError
+}
@@ -0,0 +1,195 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"strings"
+	"time"
+)
+
+// Namespace wraps a Storage backend, moving every URL under a root URL into
+// a namespace below it, e.g. "gs://bucket/data/<oid>" to
+// "gs://bucket/data/branches/dev/<oid>", so that experimental branches or
+// environments don't mix their objects with production's.
+//
+// Reads of objects which aren't in the namespace fall back to the root,
+// so that objects uploaded to production before the namespace existed can
+// still be downloaded.
+type Namespace struct {
+	Backend Storage
+	// The root URL, and the namespace's URL below it.
+	root, ns string
+}
+
+// NewNamespace returns a Namespace wrapping the given backend, which moves
+// URLs under "root" into the "prefix" subpath of it.
+func NewNamespace(backend Storage, root, prefix string) (*Namespace, error) {
+	root = strings.TrimSuffix(root, "/")
+	ns, err := backend.Join(root, prefix)
+	if err != nil {
+		return nil, err
+	}
+	return &Namespace{backend, root, strings.TrimSuffix(ns, "/")}, nil
+}
+
+// URL returns the URL of the namespace.
+func (n *Namespace) URL() string {
+	return n.ns
+}
+
+// mapURL returns the URL in the namespace for a URL under the root.
+// Other URLs, including ones already in the namespace, are returned as-is.
+func (n *Namespace) mapURL(url string) string {
+	trimmed := strings.TrimSuffix(url, "/")
+	switch {
+	case trimmed == n.ns || strings.HasPrefix(url, n.ns+"/"):
+		return url
+	case trimmed == n.root:
+		return n.ns
+	case strings.HasPrefix(url, n.root+"/"):
+		return n.ns + url[len(n.root):]
+	}
+	return url
+}
+
+// fallback returns true if a read of "url" which failed with "err" should
+// be retried at the root.
+func (n *Namespace) fallback(url string, err error) bool {
+	return err != nil && KindOf(err) == NotFoundError && n.mapURL(url) != url
+}
+
+// Stat returns information about the object at the given storage URL,
+// falling back to the root if it isn't in the namespace.
+func (n *Namespace) Stat(ctx context.Context, url string) (*Object, error) {
+	obj, err := n.Backend.Stat(ctx, n.mapURL(url))
+	if n.fallback(url, err) {
+		return n.Backend.Stat(ctx, url)
+	}
+	return obj, err
+}
+
+// List lists the objects at the given storage URL in the namespace.
+func (n *Namespace) List(ctx context.Context, url string, opts ListOptions) ([]*Object, error) {
+	return n.Backend.List(ctx, n.mapURL(url), opts)
+}
+
+// Get copies an object from storage to "dest", falling back to the root
+// if it isn't in the namespace.
+func (n *Namespace) Get(ctx context.Context, url string, dest io.Writer) (*Object, error) {
+	obj, err := n.Backend.Get(ctx, n.mapURL(url), dest)
+	if n.fallback(url, err) {
+		return n.Backend.Get(ctx, url, dest)
+	}
+	return obj, err
+}
+
+// GetVersion copies a specific version of an object from storage to "dest".
+// The backend must implement VersionGetter.
+func (n *Namespace) GetVersion(ctx context.Context, url, version string, dest io.Writer) (*Object, error) {
+	vg, ok := n.Backend.(VersionGetter)
+	if !ok {
+		return nil, &ErrUnsupportedOperation{"namespace", "get version", "backend isn't versioned"}
+	}
+	obj, err := vg.GetVersion(ctx, n.mapURL(url), version, dest)
+	if n.fallback(url, err) {
+		return vg.GetVersion(ctx, url, version, dest)
+	}
+	return obj, err
+}
+
+// GetRange copies part of an object from storage to "dest".
+// The backend must implement RangeGetter.
+func (n *Namespace) GetRange(ctx context.Context, url string, offset, length int64, dest io.Writer) error {
+	rg, ok := n.Backend.(RangeGetter)
+	if !ok {
+		return &ErrUnsupportedOperation{"namespace", "range", "not implemented by backend"}
+	}
+	err := rg.GetRange(ctx, n.mapURL(url), offset, length, dest)
+	if n.fallback(url, err) {
+		return rg.GetRange(ctx, url, offset, length, dest)
+	}
+	return err
+}
+
+// Put copies an object from "src" to storage, in the namespace.
+func (n *Namespace) Put(ctx context.Context, url string, src io.Reader, opts PutOptions) (*Object, error) {
+	return n.Backend.Put(ctx, n.mapURL(url), src, opts)
+}
+
+// Publish makes an object publicly readable and returns its public URL.
+// The backend must implement Publisher.
+func (n *Namespace) Publish(ctx context.Context, url string) (string, error) {
+	p, ok := n.Backend.(Publisher)
+	if !ok {
+		return "", &ErrUnsupportedOperation{"namespace", "publish", "backend can't publish objects"}
+	}
+	return p.Publish(ctx, n.mapURL(url))
+}
+
+// RequestRestore starts restoring an archived object.
+// The backend must implement Restorer.
+func (n *Namespace) RequestRestore(ctx context.Context, url string) error {
+	rs, ok := n.Backend.(Restorer)
+	if !ok {
+		return &ErrUnsupportedOperation{"namespace", "restore", "backend has no archive tiers"}
+	}
+	return rs.RequestRestore(ctx, n.mapURL(url))
+}
+
+// Lock protects an object from being deleted or overwritten.
+// The backend must implement Locker.
+func (n *Namespace) Lock(ctx context.Context, url string, until time.Time) error {
+	l, ok := n.Backend.(Locker)
+	if !ok {
+		return &ErrUnsupportedOperation{"namespace", "lock", "backend can't lock objects"}
+	}
+	return l.Lock(ctx, n.mapURL(url), until)
+}
+
+// Unlock releases the lock on an object.
+// The backend must implement Locker.
+func (n *Namespace) Unlock(ctx context.Context, url string) error {
+	l, ok := n.Backend.(Locker)
+	if !ok {
+		return &ErrUnsupportedOperation{"namespace", "unlock", "backend can't lock objects"}
+	}
+	return l.Unlock(ctx, n.mapURL(url))
+}
+
+// Delete deletes the object at the given storage URL in the namespace.
+func (n *Namespace) Delete(ctx context.Context, url string) error {
+	return n.Backend.Delete(ctx, n.mapURL(url))
+}
+
+// Move moves an object to a new URL within the namespace.
+func (n *Namespace) Move(ctx context.Context, src, dst string) error {
+	return n.Backend.Move(ctx, n.mapURL(src), n.mapURL(dst))
+}
+
+// Join joins the given URL with the given subpath. URLs are moved into
+// the namespace when they're used, not when they're joined.
+func (n *Namespace) Join(url, path string) (string, error) {
+	return n.Backend.Join(url, path)
+}
+
+// UnsupportedOperations describes which operations are not supported
+// for the given URL.
+func (n *Namespace) UnsupportedOperations(url string) UnsupportedOperations {
+	return n.Backend.UnsupportedOperations(n.mapURL(url))
+}
+
+// Reauthenticate passes through to the backend, if it can re-authenticate.
+func (n *Namespace) Reauthenticate(ctx context.Context) error {
+	if ra, ok := n.Backend.(Reauthenticator); ok {
+		return ra.Reauthenticate(ctx)
+	}
+	return nil
+}
+
+// RetryAfter passes through the backend's backoff hint, if it has one.
+func (n *Namespace) RetryAfter() time.Duration {
+	if h, ok := n.Backend.(RetryAfterHint); ok {
+		return h.RetryAfter()
+	}
+	return 0
+}
@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// netrcEntry is a "machine" or "default" entry of a .netrc file.
+type netrcEntry struct {
+	machine  string
+	login    string
+	password string
+}
+
+// netrcPath returns the path of the .netrc file: "path" if it's set,
+// otherwise $NETRC or ~/.netrc, like curl.
+func netrcPath(path string) string {
+	if path != "" {
+		return path
+	}
+	if p := os.Getenv("NETRC"); p != "" {
+		return p
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".netrc")
+}
+
+// netrcLogin returns the login and password in the .netrc file at "path"
+// for "host". If "user" isn't empty, only entries for that login match.
+// A missing or unreadable file has no entries.
+func netrcLogin(path, host, user string) (login, password string, ok bool) {
+	path = netrcPath(path)
+	if path == "" {
+		return "", "", false
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", "", false
+	}
+
+	var def *netrcEntry
+	for _, e := range parseNetrc(string(b)) {
+		if user != "" && e.login != user {
+			continue
+		}
+		if e.machine == host {
+			return e.login, e.password, true
+		}
+		if e.machine == "" && def == nil {
+			def = e
+		}
+	}
+	if def != nil {
+		return def.login, def.password, true
+	}
+	return "", "", false
+}
+
+// parseNetrc parses the entries of a .netrc file. The "default" entry has
+// an empty machine. Macro definitions are skipped.
+func parseNetrc(data string) []*netrcEntry {
+	var entries []*netrcEntry
+	var cur *netrcEntry
+
+	lines := strings.Split(data, "\n")
+	for i := 0; i < len(lines); i++ {
+		fields := strings.Fields(lines[i])
+		for j := 0; j < len(fields); j++ {
+			if strings.HasPrefix(fields[j], "#") {
+				break
+			}
+			next := func() string {
+				if j+1 < len(fields) {
+					j++
+					return fields[j]
+				}
+				return ""
+			}
+
+			switch fields[j] {
+			case "machine":
+				cur = &netrcEntry{machine: next()}
+				entries = append(entries, cur)
+			case "default":
+				cur = &netrcEntry{}
+				entries = append(entries, cur)
+			case "login":
+				if cur != nil {
+					cur.login = next()
+				} else {
+					next()
+				}
+			case "password":
+				if cur != nil {
+					cur.password = next()
+				} else {
+					next()
+				}
+			case "account":
+				next()
+			case "macdef":
+				// A macro runs until the next empty line.
+				for i+1 < len(lines) && strings.TrimSpace(lines[i+1]) != "" {
+					i++
+				}
+				j = len(fields)
+				cur = nil
+			}
+		}
+	}
+	return entries
+}
@@ -0,0 +1,109 @@
+//go:build !nogdrive || !nodropbox
+// +build !nogdrive !nodropbox
+
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/oauth2"
+)
+
+// OAuth tokens of backends which sign in as a user, e.g. Google Drive,
+// are obtained with "tanker login" and cached in the user's config dir,
+// so that they're shared by all repos. Refreshed tokens are written back
+// to the cache.
+
+// tokenCachePath returns the path of the cached token for a backend.
+func tokenCachePath(backend string) (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("finding user config dir: %s", err)
+	}
+	return filepath.Join(dir, "tanker", backend+"-token.json"), nil
+}
+
+func loadToken(backend string) (*oauth2.Token, error) {
+	path, err := tokenCachePath(backend)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("not logged in: run \"tanker login %s\"", backend)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading cached token: %s", err)
+	}
+
+	tok := &oauth2.Token{}
+	if err := json.Unmarshal(b, tok); err != nil {
+		return nil, fmt.Errorf("parsing cached token %s: %s", path, err)
+	}
+	return tok, nil
+}
+
+func saveToken(backend string, tok *oauth2.Token) error {
+	path, err := tokenCachePath(backend)
+	if err != nil {
+		return err
+	}
+	if err := EnsurePath(path); err != nil {
+		return fmt.Errorf("creating token cache dir: %s", err)
+	}
+	b, err := json.Marshal(tok)
+	if err != nil {
+		return err
+	}
+	// Tokens are credentials, so only the user may read them.
+	return ioutil.WriteFile(path, b, 0600)
+}
+
+// oauthClient returns an HTTP client authorized with the backend's cached
+// token, which is refreshed as needed.
+func oauthClient(backend string, conf *oauth2.Config) (*http.Client, error) {
+	tok, err := loadToken(backend)
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, sharedClient)
+	ts := &cachingTokenSource{
+		backend: backend,
+		src:     conf.TokenSource(ctx, tok),
+		last:    tok.AccessToken,
+	}
+	return oauth2.NewClient(ctx, oauth2.ReuseTokenSource(tok, ts)), nil
+}
+
+// cachingTokenSource writes refreshed tokens to the token cache.
+type cachingTokenSource struct {
+	backend string
+	src     oauth2.TokenSource
+
+	mtx  sync.Mutex
+	last string
+}
+
+func (c *cachingTokenSource) Token() (*oauth2.Token, error) {
+	tok, err := c.src.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if tok.AccessToken != c.last {
+		c.last = tok.AccessToken
+		// Failing to cache the token only means it's refreshed again
+		// next time, so the error is ignored.
+		saveToken(c.backend, tok)
+	}
+	return tok, nil
+}
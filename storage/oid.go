@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strings"
+	"sync"
+)
+
+// Hasher is a hash algorithm which LFS OIDs are computed with, e.g. SHA-256
+// for "oid sha256:<hex>" in a pointer file.
+//
+// OIDs are the lowercase hex digests of objects. The first hasher registered
+// for a digest length owns the bare OIDs of that length, e.g. sha256 owns
+// 64 digits. OIDs of the other hashers are prefixed with their name and "-",
+// e.g. "sha3-256-<hex>", so that they can be told apart.
+type Hasher struct {
+	// Name of the algorithm in pointer files, e.g. "sha256".
+	Name string
+	// Length of the algorithm's digests in hex digits, e.g. 64.
+	Len int
+	New func() hash.Hash
+}
+
+var (
+	hashersMtx sync.RWMutex
+	hashers    []Hasher
+)
+
+func init() {
+	RegisterHasher(Hasher{Name: "sha256", Len: sha256.Size * 2, New: sha256.New})
+	RegisterHasher(Hasher{Name: "sha512", Len: sha512.Size * 2, New: sha512.New})
+}
+
+// RegisterHasher makes a hash algorithm available for OIDs, like Register
+// does for storage backends. It panics if the name is already registered.
+func RegisterHasher(h Hasher) {
+	hashersMtx.Lock()
+	defer hashersMtx.Unlock()
+
+	if h.New == nil || h.Len <= 0 || h.Name == "" {
+		panic("storage: RegisterHasher called with an incomplete Hasher " + h.Name)
+	}
+	for _, r := range hashers {
+		if r.Name == h.Name {
+			panic("storage: RegisterHasher called twice for " + h.Name)
+		}
+	}
+	hashers = append(hashers, h)
+}
+
+// ParseOID returns the hasher of an OID and its hex digest, and false if
+// the OID isn't the digest of a registered hasher.
+func ParseOID(oid string) (Hasher, string, bool) {
+	hashersMtx.RLock()
+	defer hashersMtx.RUnlock()
+
+	for i, h := range hashers {
+		digest := oid
+		if !ownsLen(i) {
+			if !strings.HasPrefix(oid, h.Name+"-") {
+				continue
+			}
+			digest = oid[len(h.Name)+1:]
+		}
+		if len(digest) == h.Len && isLowerHex(digest) {
+			return h, digest, true
+		}
+	}
+	return Hasher{}, "", false
+}
+
+// ownsLen returns true if hashers[i] is the first registered for its length.
+// It must be called with hashersMtx held.
+func ownsLen(i int) bool {
+	for _, h := range hashers[:i] {
+		if h.Len == hashers[i].Len {
+			return false
+		}
+	}
+	return true
+}
+
+func isLowerHex(s string) bool {
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// IsOID returns true if the given string looks like an LFS OID.
+func IsOID(s string) bool {
+	_, _, ok := ParseOID(s)
+	return ok
+}
+
+// OIDFromPointer returns the OID of the value of a pointer file's "oid"
+// line, e.g. "sha256:<hex>", and false if its algorithm isn't registered.
+func OIDFromPointer(value string) (string, bool) {
+	i := strings.Index(value, ":")
+	if i < 0 {
+		return "", false
+	}
+	name, digest := value[:i], value[i+1:]
+
+	hashersMtx.RLock()
+	defer hashersMtx.RUnlock()
+	for j, h := range hashers {
+		if h.Name != name {
+			continue
+		}
+		if len(digest) != h.Len || !isLowerHex(digest) {
+			return "", false
+		}
+		if ownsLen(j) {
+			return digest, true
+		}
+		return name + "-" + digest, true
+	}
+	return "", false
+}
+
+// PointerOID returns the value of a pointer file's "oid" line for an OID,
+// e.g. "sha256:<hex>". It returns "oid" unchanged if it isn't valid.
+func PointerOID(oid string) string {
+	h, digest, ok := ParseOID(oid)
+	if !ok {
+		return oid
+	}
+	return h.Name + ":" + digest
+}
+
+// OIDVerifier hashes content written to it, and checks it against an OID.
+type OIDVerifier struct {
+	hash.Hash
+	hasher Hasher
+	digest string
+}
+
+// NewOIDVerifier returns a verifier for the content of the given OID.
+func NewOIDVerifier(oid string) (*OIDVerifier, error) {
+	h, digest, ok := ParseOID(oid)
+	if !ok {
+		return nil, fmt.Errorf("unrecognized OID %q: not the digest of a known hash algorithm", oid)
+	}
+	return &OIDVerifier{Hash: h.New(), hasher: h, digest: digest}, nil
+}
+
+// Verify returns an error if the content written doesn't match the OID.
+func (v *OIDVerifier) Verify() error {
+	if sum := hex.EncodeToString(v.Sum(nil)); sum != v.digest {
+		return fmt.Errorf("checksum mismatch: got %s %s", v.hasher.Name, sum)
+	}
+	return nil
+}
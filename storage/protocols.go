@@ -0,0 +1,157 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Backend describes how to create the storage backend for a URL scheme.
+// See Register.
+type Backend struct {
+	// Name of the backend, used in errors, e.g. "swift".
+	Name string
+	// New creates the backend.
+	New func(Config) (Storage, error)
+	// Enabled reports whether the backend is enabled and configured,
+	// e.g. has credentials.
+	// If nil, the backend is always enabled.
+	Enabled func(Config) bool
+	// ValidateURL checks that a base URL is well formed, e.g. that it names
+	// a bucket, without connecting to the storage system. Optional.
+	ValidateURL func(url string) error
+	// Login signs in interactively, e.g. with an OAuth device code, for
+	// backends which act as a user. Instructions are written to "out",
+	// and answers, if any, are read from "in". Optional. See Login.
+	Login func(ctx context.Context, conf Config, in io.Reader, out io.Writer) error
+}
+
+var (
+	registryMtx sync.RWMutex
+	// Registered backends, by URL scheme.
+	registry = map[string]Backend{}
+)
+
+// Register makes a storage backend available for URLs with the given scheme,
+// e.g. "swift" for "swift://" URLs. The built-in backends register themselves
+// from init functions, and library consumers can register their own backends
+// the same way. Register panics if the scheme is already registered.
+func Register(scheme string, b Backend) {
+	registryMtx.Lock()
+	defer registryMtx.Unlock()
+
+	if b.New == nil {
+		panic("storage: Register backend with nil New for scheme " + scheme)
+	}
+	if _, dup := registry[scheme]; dup {
+		panic("storage: Register called twice for scheme " + scheme)
+	}
+	registry[scheme] = b
+}
+
+// Scheme returns the scheme of a storage URL, e.g. "gs" for "gs://bucket",
+// or an empty string if it has none.
+func Scheme(url string) string {
+	i := strings.Index(url, "://")
+	if i < 0 {
+		return ""
+	}
+	return url[:i]
+}
+
+// lookup returns the backend registered for the given URL's scheme.
+func lookup(url string) (Backend, bool) {
+	scheme := Scheme(url)
+	if scheme == "" {
+		return Backend{}, false
+	}
+
+	registryMtx.RLock()
+	defer registryMtx.RUnlock()
+	b, ok := registry[scheme]
+	return b, ok
+}
+
+// Protocols returns the URL prefixes of the registered backends,
+// e.g. "gs://", sorted.
+func Protocols() []string {
+	registryMtx.RLock()
+	defer registryMtx.RUnlock()
+
+	var prefixes []string
+	for scheme := range registry {
+		prefixes = append(prefixes, scheme+"://")
+	}
+	sort.Strings(prefixes)
+	return prefixes
+}
+
+// NewStorage creates the storage backend registered for the given URL's scheme.
+func NewStorage(url string, conf Config) (Storage, error) {
+	b, ok := lookup(url)
+	if !ok {
+		return nil, fmt.Errorf("failed to find matching storage backend for %q", url)
+	}
+	if b.Enabled != nil && !b.Enabled(conf) {
+		return nil, &ErrNotConfigured{b.Name}
+	}
+	setHTTPConfig(conf.HTTP)
+	setProxyConfig(conf.Proxies)
+	s, err := b.New(conf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure %s storage backend: %s", b.Name, err)
+	}
+	return s, nil
+}
+
+// ValidateURL checks that a base URL has a registered scheme, is well
+// formed, and that its backend is enabled by the config. It doesn't
+// connect to the storage system.
+func ValidateURL(url string, conf Config) error {
+	b, ok := lookup(url)
+	if !ok {
+		return fmt.Errorf("unsupported protocol in %q: supported protocols are %s",
+			url, strings.Join(Protocols(), ", "))
+	}
+	if b.ValidateURL != nil {
+		if err := b.ValidateURL(url); err != nil {
+			return fmt.Errorf("invalid URL %q: %s", url, err)
+		}
+	}
+	if b.Enabled != nil && !b.Enabled(conf) {
+		return &ErrNotConfigured{b.Name}
+	}
+	return nil
+}
+
+// Login signs in to the backend registered for the given scheme,
+// e.g. "gdrive". See Backend.Login.
+func Login(ctx context.Context, scheme string, conf Config, in io.Reader, out io.Writer) error {
+	b, ok := lookup(scheme + "://")
+	if !ok {
+		return fmt.Errorf("unsupported protocol %q: supported protocols are %s",
+			scheme, strings.Join(Protocols(), ", "))
+	}
+	if b.Login == nil {
+		return fmt.Errorf("the %s storage backend doesn't need a login", b.Name)
+	}
+	return b.Login(ctx, conf, in, out)
+}
+
+// bucketValidator returns a URL validator for backends with URLs of the
+// form "<scheme>://<bucket>/<path>".
+func bucketValidator(backend string, parse func(string) (*urlparts, error)) func(string) error {
+	return func(url string) error {
+		u, err := parse(url)
+		if err != nil {
+			return err
+		}
+		if u.bucket == "" {
+			return &ErrInvalidURL{backend}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,239 @@
+package storage
+
+import (
+	"context"
+	"io"
+	urllib "net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimitConfig limits the rate of requests made to each storage host,
+// so that many concurrent transfers don't collectively overwhelm it.
+//
+// Control calls (Stat, List, Delete, Move) are limited separately from data
+// calls (Get, Put), since a few large streams shouldn't starve the cheap
+// calls, and a burst of cheap calls shouldn't delay the streams.
+type RateLimitConfig struct {
+	// Requests per second for control calls. Zero means unlimited.
+	ControlRate float64
+	// Maximum burst of control calls.
+	ControlBurst int
+	// Requests per second for data calls. Zero means unlimited.
+	DataRate float64
+	// Maximum burst of data calls.
+	DataBurst int
+}
+
+// Limiters are per-host and shared by all RateLimiter instances,
+// so that separate clients of the same host share one budget.
+var limiters = struct {
+	sync.Mutex
+	m map[string]*rate.Limiter
+}{m: map[string]*rate.Limiter{}}
+
+// hostLimiter returns the shared limiter for the given host and call class.
+func hostLimiter(host, class string, r float64, burst int) *rate.Limiter {
+	if r <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+
+	key := class + " " + host
+	limiters.Lock()
+	defer limiters.Unlock()
+	l, ok := limiters.m[key]
+	if !ok {
+		l = rate.NewLimiter(rate.Limit(r), burst)
+		limiters.m[key] = l
+	}
+	return l
+}
+
+// RateLimiter wraps a Storage backend, limiting the rate of requests
+// per host according to a RateLimitConfig.
+type RateLimiter struct {
+	Backend Storage
+	conf    RateLimitConfig
+}
+
+// NewRateLimiter returns a RateLimiter wrapping the given backend.
+func NewRateLimiter(backend Storage, conf RateLimitConfig) *RateLimiter {
+	return &RateLimiter{backend, conf}
+}
+
+// wait blocks until a request to the host of "url" is allowed.
+func (r *RateLimiter) wait(ctx context.Context, url string, data bool) error {
+	host := url
+	if u, err := urllib.Parse(url); err == nil {
+		host = u.Scheme + "://" + u.Host
+	}
+
+	var l *rate.Limiter
+	if data {
+		l = hostLimiter(host, "data", r.conf.DataRate, r.conf.DataBurst)
+	} else {
+		l = hostLimiter(host, "control", r.conf.ControlRate, r.conf.ControlBurst)
+	}
+	if l == nil {
+		return nil
+	}
+	return l.Wait(ctx)
+}
+
+// Stat returns information about the object at the given storage URL.
+func (r *RateLimiter) Stat(ctx context.Context, url string) (*Object, error) {
+	if err := r.wait(ctx, url, false); err != nil {
+		return nil, err
+	}
+	return r.Backend.Stat(ctx, url)
+}
+
+// List lists the objects at the given storage URL.
+func (r *RateLimiter) List(ctx context.Context, url string, opts ListOptions) ([]*Object, error) {
+	if err := r.wait(ctx, url, false); err != nil {
+		return nil, err
+	}
+	return r.Backend.List(ctx, url, opts)
+}
+
+// Get copies an object from storage to "dest".
+func (r *RateLimiter) Get(ctx context.Context, url string, dest io.Writer) (*Object, error) {
+	if err := r.wait(ctx, url, true); err != nil {
+		return nil, err
+	}
+	return r.Backend.Get(ctx, url, dest)
+}
+
+// GetVersion copies a specific version of an object from storage to "dest".
+// The backend must implement VersionGetter.
+func (r *RateLimiter) GetVersion(ctx context.Context, url, version string, dest io.Writer) (*Object, error) {
+	vg, ok := r.Backend.(VersionGetter)
+	if !ok {
+		return nil, &ErrUnsupportedOperation{"rate limiter", "get version", "backend isn't versioned"}
+	}
+	if err := r.wait(ctx, url, true); err != nil {
+		return nil, err
+	}
+	return vg.GetVersion(ctx, url, version, dest)
+}
+
+// GetRange copies part of an object from storage to "dest".
+// The backend must implement RangeGetter.
+func (r *RateLimiter) GetRange(ctx context.Context, url string, offset, length int64, dest io.Writer) error {
+	rg, ok := r.Backend.(RangeGetter)
+	if !ok {
+		return &ErrUnsupportedOperation{"rate limiter", "range", "not implemented by backend"}
+	}
+	if err := r.wait(ctx, url, true); err != nil {
+		return err
+	}
+	return rg.GetRange(ctx, url, offset, length, dest)
+}
+
+// Put copies an object from "src" to storage.
+func (r *RateLimiter) Put(ctx context.Context, url string, src io.Reader, opts PutOptions) (*Object, error) {
+	if err := r.wait(ctx, url, true); err != nil {
+		return nil, err
+	}
+	return r.Backend.Put(ctx, url, src, opts)
+}
+
+// Publish makes an object publicly readable and returns its public URL.
+// The backend must implement Publisher.
+func (r *RateLimiter) Publish(ctx context.Context, url string) (string, error) {
+	p, ok := r.Backend.(Publisher)
+	if !ok {
+		return "", &ErrUnsupportedOperation{"rate limiter", "publish", "backend can't publish objects"}
+	}
+	if err := r.wait(ctx, url, false); err != nil {
+		return "", err
+	}
+	return p.Publish(ctx, url)
+}
+
+// RequestRestore starts restoring an archived object.
+// The backend must implement Restorer.
+func (r *RateLimiter) RequestRestore(ctx context.Context, url string) error {
+	rs, ok := r.Backend.(Restorer)
+	if !ok {
+		return &ErrUnsupportedOperation{"rate limiter", "restore", "backend has no archive tiers"}
+	}
+	if err := r.wait(ctx, url, false); err != nil {
+		return err
+	}
+	return rs.RequestRestore(ctx, url)
+}
+
+// Lock protects an object from being deleted or overwritten.
+// The backend must implement Locker.
+func (r *RateLimiter) Lock(ctx context.Context, url string, until time.Time) error {
+	l, ok := r.Backend.(Locker)
+	if !ok {
+		return &ErrUnsupportedOperation{"rate limiter", "lock", "backend can't lock objects"}
+	}
+	if err := r.wait(ctx, url, false); err != nil {
+		return err
+	}
+	return l.Lock(ctx, url, until)
+}
+
+// Unlock releases the lock on an object.
+// The backend must implement Locker.
+func (r *RateLimiter) Unlock(ctx context.Context, url string) error {
+	l, ok := r.Backend.(Locker)
+	if !ok {
+		return &ErrUnsupportedOperation{"rate limiter", "unlock", "backend can't lock objects"}
+	}
+	if err := r.wait(ctx, url, false); err != nil {
+		return err
+	}
+	return l.Unlock(ctx, url)
+}
+
+// Delete deletes the object at the given storage URL.
+func (r *RateLimiter) Delete(ctx context.Context, url string) error {
+	if err := r.wait(ctx, url, false); err != nil {
+		return err
+	}
+	return r.Backend.Delete(ctx, url)
+}
+
+// Move moves an object to a new URL within the same storage system.
+func (r *RateLimiter) Move(ctx context.Context, src, dst string) error {
+	if err := r.wait(ctx, src, false); err != nil {
+		return err
+	}
+	return r.Backend.Move(ctx, src, dst)
+}
+
+// Join joins the given URL with the given subpath.
+func (r *RateLimiter) Join(url, path string) (string, error) {
+	return r.Backend.Join(url, path)
+}
+
+// UnsupportedOperations describes which operations are not supported
+// for the given URL.
+func (r *RateLimiter) UnsupportedOperations(url string) UnsupportedOperations {
+	return r.Backend.UnsupportedOperations(url)
+}
+
+// Reauthenticate passes through to the backend, if it can re-authenticate.
+func (r *RateLimiter) Reauthenticate(ctx context.Context) error {
+	if ra, ok := r.Backend.(Reauthenticator); ok {
+		return ra.Reauthenticate(ctx)
+	}
+	return nil
+}
+
+// RetryAfter passes through the backend's backoff hint, if it has one.
+func (r *RateLimiter) RetryAfter() time.Duration {
+	if h, ok := r.Backend.(RetryAfterHint); ok {
+		return h.RetryAfter()
+	}
+	return 0
+}
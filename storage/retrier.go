@@ -0,0 +1,448 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"time"
+)
+
+// RetryConfig configures retries of failed storage operations.
+// Only errors classified as retriable are retried, see ErrorKind.
+//
+// The settings can be overridden for single operations, e.g. more attempts
+// for Stat, which is cheap, than for Put, and for single backends, e.g.
+//
+//	Retry:
+//	  MaxTries: 5
+//	  Stat:
+//	    MaxTries: 10
+//	  Backends:
+//	  - Scheme: swift
+//	    MaxTries: 8
+//
+// Backend overrides replace the general settings, and operation overrides
+// apply over both. See Config.RetryFor.
+type RetryConfig struct {
+	// Maximum number of attempts per operation. 1 disables retries.
+	MaxTries int
+	// Delay before the first retry. The delay doubles with each retry,
+	// up to MaxInterval.
+	InitialInterval Duration
+	MaxInterval     Duration
+	// When the server sends a backoff hint, e.g. a Retry-After header on a
+	// 429 or 503 response, wait as long as it asks, up to MaxRetryAfter,
+	// instead of the exponential delay.
+	MaxRetryAfter Duration
+	// Overrides for single operations. Get covers ranged and versioned
+	// downloads, and Delete covers Move.
+	Stat, List, Get, Put, Delete RetryOverride
+	// Overrides for the backends of the given URL schemes.
+	Backends []BackendRetryConfig
+}
+
+// RetryOverride overrides retry settings. Zero fields aren't overridden.
+type RetryOverride struct {
+	MaxTries        int
+	InitialInterval Duration
+	MaxInterval     Duration
+}
+
+// BackendRetryConfig overrides retry settings for a backend.
+type BackendRetryConfig struct {
+	// URL scheme of the backend, e.g. "swift".
+	Scheme string
+	RetryOverride
+}
+
+// apply returns the general settings of "c" overridden by "o".
+// Operation overrides still apply over them.
+func (c RetryConfig) apply(o RetryOverride) RetryConfig {
+	if o.MaxTries > 0 {
+		c.MaxTries = o.MaxTries
+	}
+	if o.InitialInterval > 0 {
+		c.InitialInterval = o.InitialInterval
+	}
+	if o.MaxInterval > 0 {
+		c.MaxInterval = o.MaxInterval
+	}
+	return c
+}
+
+// RetryFor returns the retry settings of the backend of the given URL.
+func (c Config) RetryFor(url string) RetryConfig {
+	conf := c.Retry
+	scheme := Scheme(url)
+	for _, b := range c.Retry.Backends {
+		if b.Scheme == scheme {
+			conf = conf.apply(b.RetryOverride)
+		}
+	}
+	return conf
+}
+
+// retryOp names the operations which can be configured separately.
+type retryOp int
+
+const (
+	opStat retryOp = iota
+	opList
+	opGet
+	opPut
+	opDelete
+	// Other operations only use the general settings.
+	opOther
+)
+
+// settings returns the settings of an operation: its override, if any,
+// over the general settings.
+func (c RetryConfig) settings(op retryOp) RetryOverride {
+	s := RetryOverride{c.MaxTries, c.InitialInterval, c.MaxInterval}
+	var o RetryOverride
+	switch op {
+	case opStat:
+		o = c.Stat
+	case opList:
+		o = c.List
+	case opGet:
+		o = c.Get
+	case opPut:
+		o = c.Put
+	case opDelete:
+		o = c.Delete
+	}
+	if o.MaxTries > 0 {
+		s.MaxTries = o.MaxTries
+	}
+	if o.InitialInterval > 0 {
+		s.InitialInterval = o.InitialInterval
+	}
+	if o.MaxInterval > 0 {
+		s.MaxInterval = o.MaxInterval
+	}
+	if s.MaxTries < 1 {
+		s.MaxTries = 1
+	}
+	return s
+}
+
+// RetryAfterHint is implemented by errors, or by backends, which know how
+// long the server asked clients to wait before retrying.
+type RetryAfterHint interface {
+	RetryAfter() time.Duration
+}
+
+// Retrier wraps a Storage backend, retrying operations which fail
+// with retriable errors, e.g. a 503 response or a network timeout.
+//
+// Get and Put stream data, so they're only retried if nothing was written
+// to "dest" yet, or if the "src" of a Put can be rewound with io.Seeker.
+// Downloads which fail partway resume where they stopped, if the backend
+// can read ranges, since objects don't change.
+//
+// Operations which fail with AuthError are retried after calling the
+// backend's Reauthenticate, if it has one, so that credentials which expire
+// in the middle of a long session are refreshed.
+type Retrier struct {
+	Backend Storage
+	conf    RetryConfig
+}
+
+// NewRetrier returns a Retrier wrapping the given backend. Use
+// Config.RetryFor for the backend's settings.
+func NewRetrier(backend Storage, conf RetryConfig) *Retrier {
+	return &Retrier{backend, conf}
+}
+
+// retry calls "f" until it succeeds, fails with an error which isn't
+// retriable, or runs out of the operation's attempts. "canRetry" is called
+// after a failure to check whether the operation can be safely repeated.
+func (r *Retrier) retry(ctx context.Context, op retryOp, f func() error, canRetry func() bool) error {
+	s := r.conf.settings(op)
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || !IsRetriable(err) || attempt >= s.MaxTries {
+			return Interrupted(ctx, err)
+		}
+		if canRetry != nil && !canRetry() {
+			return Interrupted(ctx, err)
+		}
+		if KindOf(err) == AuthError {
+			if rerr := r.Reauthenticate(ctx); rerr != nil {
+				return fmt.Errorf("%s; re-authenticating: %s", err, rerr)
+			}
+		}
+
+		delay := s.backoff(attempt)
+		if hint := r.retryAfter(err); hint > delay {
+			delay = hint
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return Interrupted(ctx, err)
+		}
+	}
+}
+
+// backoff returns the delay before the given retry attempt: exponential,
+// capped at MaxInterval, with jitter so that concurrent transfers which
+// failed together don't all retry at the same moment.
+func (s RetryOverride) backoff(attempt int) time.Duration {
+	d := time.Duration(s.InitialInterval)
+	max := time.Duration(s.MaxInterval)
+	for i := 1; i < attempt && (max <= 0 || d < max); i++ {
+		d *= 2
+	}
+	if max > 0 && d > max {
+		d = max
+	}
+	if d <= 0 {
+		return 0
+	}
+	// Pick a random delay between d/2 and d.
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// retryAfter returns the server's backoff hint for the given error, if any,
+// capped at MaxRetryAfter. Hints on the error itself are preferred over
+// connection-wide hints from the backend.
+func (r *Retrier) retryAfter(err error) time.Duration {
+	var d time.Duration
+	if h, ok := err.(RetryAfterHint); ok {
+		d = h.RetryAfter()
+	} else if h, ok := r.Backend.(RetryAfterHint); ok {
+		d = h.RetryAfter()
+	}
+	if max := time.Duration(r.conf.MaxRetryAfter); d > max {
+		d = max
+	}
+	return d
+}
+
+// Stat returns information about the object at the given storage URL.
+func (r *Retrier) Stat(ctx context.Context, url string) (obj *Object, err error) {
+	err = r.retry(ctx, opStat, func() error {
+		obj, err = r.Backend.Stat(ctx, url)
+		return err
+	}, nil)
+	return obj, err
+}
+
+// List lists the objects at the given storage URL.
+func (r *Retrier) List(ctx context.Context, url string, opts ListOptions) (objs []*Object, err error) {
+	err = r.retry(ctx, opList, func() error {
+		objs, err = r.Backend.List(ctx, url, opts)
+		return err
+	}, nil)
+	return objs, err
+}
+
+// Get copies an object from storage to "dest".
+func (r *Retrier) Get(ctx context.Context, url string, dest io.Writer) (obj *Object, err error) {
+	w := &countingWriter{w: dest}
+	err = r.retry(ctx, opGet, func() error {
+		if w.n > 0 {
+			obj, err = r.resume(ctx, url, w)
+			return err
+		}
+		obj, err = r.Backend.Get(ctx, url, w)
+		return err
+	}, func() bool {
+		return w.n == 0 || r.canResume(url)
+	})
+	return obj, err
+}
+
+// canResume returns true if a download of "url" which failed partway can
+// be resumed with a range request.
+func (r *Retrier) canResume(url string) bool {
+	return RangeUnsupported(r.Backend, url) == nil
+}
+
+// resume downloads the rest of an object, after the "w.n" bytes which
+// a failed attempt wrote.
+func (r *Retrier) resume(ctx context.Context, url string, w *countingWriter) (*Object, error) {
+	obj, err := r.Backend.Stat(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	if w.n >= obj.Size {
+		return obj, nil
+	}
+	err = r.Backend.(RangeGetter).GetRange(ctx, url, w.n, obj.Size-w.n, w)
+	if err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+// GetVersion copies a specific version of an object from storage to "dest".
+// The backend must implement VersionGetter.
+func (r *Retrier) GetVersion(ctx context.Context, url, version string, dest io.Writer) (obj *Object, err error) {
+	vg, ok := r.Backend.(VersionGetter)
+	if !ok {
+		return nil, &ErrUnsupportedOperation{"retrier", "get version", "backend isn't versioned"}
+	}
+
+	w := &countingWriter{w: dest}
+	err = r.retry(ctx, opGet, func() error {
+		obj, err = vg.GetVersion(ctx, url, version, w)
+		return err
+	}, func() bool {
+		return w.n == 0
+	})
+	return obj, err
+}
+
+// GetRange copies part of an object from storage to "dest".
+// The backend must implement RangeGetter.
+func (r *Retrier) GetRange(ctx context.Context, url string, offset, length int64, dest io.Writer) error {
+	rg, ok := r.Backend.(RangeGetter)
+	if !ok {
+		return &ErrUnsupportedOperation{"retrier", "range", "not implemented by backend"}
+	}
+
+	w := &countingWriter{w: dest}
+	return r.retry(ctx, opGet, func() error {
+		// Resume where a failed attempt stopped.
+		return rg.GetRange(ctx, url, offset+w.n, length-w.n, w)
+	}, nil)
+}
+
+// Put copies an object from "src" to storage.
+func (r *Retrier) Put(ctx context.Context, url string, src io.Reader, opts PutOptions) (obj *Object, err error) {
+	seeker, _ := src.(io.Seeker)
+	var start int64
+	if seeker != nil {
+		start, err = seeker.Seek(0, io.SeekCurrent)
+		if err != nil {
+			seeker = nil
+		}
+	}
+
+	rd := &countingReader{r: src}
+	err = r.retry(ctx, opPut, func() error {
+		obj, err = r.Backend.Put(ctx, url, rd, opts)
+		return err
+	}, func() bool {
+		if rd.n == 0 {
+			return true
+		}
+		if seeker == nil {
+			return false
+		}
+		_, err := seeker.Seek(start, io.SeekStart)
+		rd.n = 0
+		return err == nil
+	})
+	return obj, err
+}
+
+// Publish makes an object publicly readable and returns its public URL.
+// The backend must implement Publisher.
+func (r *Retrier) Publish(ctx context.Context, url string) (public string, err error) {
+	p, ok := r.Backend.(Publisher)
+	if !ok {
+		return "", &ErrUnsupportedOperation{"retrier", "publish", "backend can't publish objects"}
+	}
+	err = r.retry(ctx, opOther, func() error {
+		public, err = p.Publish(ctx, url)
+		return err
+	}, nil)
+	return public, err
+}
+
+// RequestRestore starts restoring an archived object.
+// The backend must implement Restorer.
+func (r *Retrier) RequestRestore(ctx context.Context, url string) error {
+	rs, ok := r.Backend.(Restorer)
+	if !ok {
+		return &ErrUnsupportedOperation{"retrier", "restore", "backend has no archive tiers"}
+	}
+	return r.retry(ctx, opOther, func() error {
+		return rs.RequestRestore(ctx, url)
+	}, nil)
+}
+
+// Lock protects an object from being deleted or overwritten.
+// The backend must implement Locker.
+func (r *Retrier) Lock(ctx context.Context, url string, until time.Time) error {
+	l, ok := r.Backend.(Locker)
+	if !ok {
+		return &ErrUnsupportedOperation{"retrier", "lock", "backend can't lock objects"}
+	}
+	return r.retry(ctx, opOther, func() error {
+		return l.Lock(ctx, url, until)
+	}, nil)
+}
+
+// Unlock releases the lock on an object.
+// The backend must implement Locker.
+func (r *Retrier) Unlock(ctx context.Context, url string) error {
+	l, ok := r.Backend.(Locker)
+	if !ok {
+		return &ErrUnsupportedOperation{"retrier", "unlock", "backend can't lock objects"}
+	}
+	return r.retry(ctx, opOther, func() error {
+		return l.Unlock(ctx, url)
+	}, nil)
+}
+
+// Delete deletes the object at the given storage URL.
+func (r *Retrier) Delete(ctx context.Context, url string) error {
+	return r.retry(ctx, opDelete, func() error {
+		return r.Backend.Delete(ctx, url)
+	}, nil)
+}
+
+// Move moves an object to a new URL within the same storage system.
+func (r *Retrier) Move(ctx context.Context, src, dst string) error {
+	return r.retry(ctx, opDelete, func() error {
+		return r.Backend.Move(ctx, src, dst)
+	}, nil)
+}
+
+// Reauthenticate passes through to the backend, if it can re-authenticate.
+func (r *Retrier) Reauthenticate(ctx context.Context) error {
+	if ra, ok := r.Backend.(Reauthenticator); ok {
+		return ra.Reauthenticate(ctx)
+	}
+	return nil
+}
+
+// Join joins the given URL with the given subpath.
+func (r *Retrier) Join(url, path string) (string, error) {
+	return r.Backend.Join(url, path)
+}
+
+// UnsupportedOperations describes which operations are not supported
+// for the given URL.
+func (r *Retrier) UnsupportedOperations(url string) UnsupportedOperations {
+	return r.Backend.UnsupportedOperations(url)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
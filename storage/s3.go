@@ -0,0 +1,699 @@
+//go:build !nos3
+// +build !nos3
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+func init() {
+	Register("s3", Backend{
+		Name: "s3",
+		New: func(c Config) (Storage, error) {
+			return NewS3(c.S3)
+		},
+		Enabled:     func(c Config) bool { return c.S3.Valid() },
+		ValidateURL: bucketValidator("s3", (&S3{}).parse),
+	})
+}
+
+// Objects larger than this are copied in parts by Move,
+// since CopyObject is limited to 5 GB.
+const s3MaxCopySize = 5 * 1024 * 1024 * 1024
+
+// S3 provides access to Amazon S3 and S3-compatible object stores.
+//
+// Objects in the Glacier storage classes are reported as Archived by Stat,
+// and are restored for S3Config.RestoreDays by RequestRestore.
+type S3 struct {
+	sess *session.Session
+	conf S3Config
+	// Client for all buckets, if the region is known. See client.
+	svc *s3.S3
+
+	mtx sync.Mutex
+	// Clients by bucket, for buckets whose region was looked up.
+	// See client.
+	clients map[string]*s3.S3
+}
+
+// NewS3 creates an S3 client. Credentials are found on first use, so
+// a missing or expired credential fails the operation, not the client.
+func NewS3(conf S3Config) (*S3, error) {
+	awsConf := aws.Config{
+		// The SDK adds the CA bundle of $AWS_CA_BUNDLE to the transport,
+		// which must be an *http.Transport, so S3 gets its own copy of the
+		// pooled transport, and requests are tagged by a handler instead.
+		HTTPClient: &http.Client{Transport: pooledTransport.Clone()},
+		// Failed operations are retried by the Retrier.
+		MaxRetries: aws.Int(0),
+	}
+	if conf.Region != "" {
+		awsConf.Region = aws.String(conf.Region)
+	}
+	if conf.Endpoint != "" {
+		awsConf.Endpoint = aws.String(conf.Endpoint)
+	}
+	if conf.ForcePathStyle {
+		awsConf.S3ForcePathStyle = aws.Bool(true)
+	}
+	if conf.Anonymous {
+		awsConf.Credentials = credentials.AnonymousCredentials
+	}
+
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            awsConf,
+		Profile:           conf.Profile,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Build handlers run before requests are signed.
+	sess.Handlers.Build.PushBack(func(r *request.Request) {
+		tagRequest(r.HTTPRequest)
+	})
+
+	b := &S3{sess: sess, conf: conf, clients: map[string]*s3.S3{}}
+	if aws.StringValue(sess.Config.Region) != "" {
+		b.svc = s3.New(sess)
+	} else if conf.Endpoint != "" {
+		// S3-compatible stores mostly ignore the region,
+		// but the signature needs one.
+		b.svc = s3.New(sess, aws.NewConfig().WithRegion("us-east-1"))
+	}
+	return b, nil
+}
+
+// client returns the client for a bucket. When no region is configured,
+// the bucket's region is looked up once, since requests signed for
+// another region are rejected.
+func (b *S3) client(ctx context.Context, bucket string) (*s3.S3, error) {
+	if b.svc != nil {
+		return b.svc, nil
+	}
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if c, ok := b.clients[bucket]; ok {
+		return c, nil
+	}
+	region, err := s3manager.GetBucketRegion(ctx, b.sess, bucket, "us-east-1")
+	if err != nil {
+		return nil, &s3Error{fmt.Sprintf("finding the region of bucket %s", bucket), err}
+	}
+	c := s3.New(b.sess, aws.NewConfig().WithRegion(region))
+	b.clients[bucket] = c
+	return c, nil
+}
+
+// Reauthenticate expires the cached credentials, so that the next request
+// gets new ones, e.g. after an SSO session or an assumed role expired.
+func (b *S3) Reauthenticate(ctx context.Context) error {
+	if !b.conf.Anonymous {
+		b.sess.Config.Credentials.Expire()
+	}
+	return nil
+}
+
+// Stat returns information about the object at the given storage URL.
+func (b *S3) Stat(ctx context.Context, url string) (*Object, error) {
+	return b.stat(ctx, url, "")
+}
+
+func (b *S3) stat(ctx context.Context, url, version string) (*Object, error) {
+	u, c, err := b.parseClient(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+
+	in := &s3.HeadObjectInput{Bucket: aws.String(u.bucket), Key: aws.String(u.path)}
+	if version != "" {
+		in.VersionId = aws.String(version)
+	}
+	resp, err := c.HeadObjectWithContext(ctx, in)
+	if err != nil {
+		return nil, &s3Error{fmt.Sprintf("calling stat on object %s", url), err}
+	}
+
+	obj := &Object{
+		URL:          url,
+		Name:         u.path,
+		ETag:         strings.Trim(aws.StringValue(resp.ETag), `"`),
+		Size:         aws.Int64Value(resp.ContentLength),
+		LastModified: aws.TimeValue(resp.LastModified),
+		Version:      aws.StringValue(resp.VersionId),
+		StorageClass: aws.StringValue(resp.StorageClass),
+	}
+	// The ETag is the MD5 of the content, except for multipart uploads,
+	// whose ETags have a "-<parts>" suffix, and objects encrypted with KMS.
+	sse := aws.StringValue(resp.ServerSideEncryption)
+	if len(obj.ETag) == 32 && (sse == "" || sse == s3.ServerSideEncryptionAes256) {
+		obj.Checksum = obj.ETag
+		obj.ChecksumType = ChecksumMD5
+	}
+
+	// Restored copies have a restore header with ongoing-request="false".
+	restore := aws.StringValue(resp.Restore)
+	switch obj.StorageClass {
+	case s3.StorageClassGlacier, s3.StorageClassDeepArchive:
+		obj.Archived = !strings.Contains(restore, `ongoing-request="false"`)
+		obj.Restoring = strings.Contains(restore, `ongoing-request="true"`)
+	}
+	return obj, nil
+}
+
+// List lists the objects at the given url.
+func (b *S3) List(ctx context.Context, url string, opts ListOptions) ([]*Object, error) {
+	u, c, err := b.parseClient(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+
+	in := &s3.ListObjectsV2Input{Bucket: aws.String(u.bucket), Prefix: aws.String(u.path)}
+	if !opts.Recursive {
+		in.Prefix = aws.String(dirPrefix(u.path))
+		in.Delimiter = aws.String("/")
+	}
+
+	var objects []*Object
+	err = c.ListObjectsV2PagesWithContext(ctx, in, func(page *s3.ListObjectsV2Output, last bool) bool {
+		for _, prefix := range page.CommonPrefixes {
+			name := aws.StringValue(prefix.Prefix)
+			objects = append(objects, &Object{
+				URL:  S3Protocol + u.bucket + "/" + name,
+				Name: name,
+				Dir:  true,
+			})
+		}
+		for _, obj := range page.Contents {
+			name := aws.StringValue(obj.Key)
+			if strings.HasSuffix(name, "/") {
+				continue
+			}
+			objects = append(objects, &Object{
+				URL:          S3Protocol + u.bucket + "/" + name,
+				Name:         name,
+				ETag:         strings.Trim(aws.StringValue(obj.ETag), `"`),
+				Size:         aws.Int64Value(obj.Size),
+				LastModified: aws.TimeValue(obj.LastModified),
+				StorageClass: aws.StringValue(obj.StorageClass),
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, &s3Error{fmt.Sprintf("listing %s", url), err}
+	}
+	return objects, nil
+}
+
+// Get copies an object from S3 to "dest".
+func (b *S3) Get(ctx context.Context, url string, dest io.Writer) (*Object, error) {
+	return b.GetVersion(ctx, url, "", dest)
+}
+
+// GetVersion copies a specific version of an object from S3 to "dest".
+// An empty version is the current version.
+func (b *S3) GetVersion(ctx context.Context, url, version string, dest io.Writer) (*Object, error) {
+	obj, err := b.stat(ctx, url, version)
+	if err != nil {
+		return nil, err
+	}
+	if obj.Archived {
+		return nil, &ErrArchived{"s3", url, obj.Restoring}
+	}
+
+	u, c, err := b.parseClient(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	in := &s3.GetObjectInput{Bucket: aws.String(u.bucket), Key: aws.String(u.path)}
+	if version != "" {
+		in.VersionId = aws.String(version)
+	} else if obj.ETag != "" {
+		// Don't mix the content of an object overwritten since the stat
+		// with its old metadata.
+		in.IfMatch = aws.String(`"` + obj.ETag + `"`)
+	}
+	resp, err := c.GetObjectWithContext(ctx, in)
+	if err != nil {
+		return nil, &s3Error{fmt.Sprintf("getting object %s", url), err}
+	}
+	defer resp.Body.Close()
+
+	_, copyErr := io.Copy(dest, ContextReader(ctx, resp.Body))
+	if copyErr != nil {
+		return nil, &s3Error{"copying file", copyErr}
+	}
+	return obj, nil
+}
+
+// GetRange copies part of an object from S3 to "dest".
+func (b *S3) GetRange(ctx context.Context, url string, offset, length int64, dest io.Writer) error {
+	u, c, err := b.parseClient(ctx, url)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(u.bucket),
+		Key:    aws.String(u.path),
+		Range:  aws.String(rangeHeader(offset, length)),
+	})
+	if err != nil {
+		return &s3Error{fmt.Sprintf("getting object %s", url), err}
+	}
+	defer resp.Body.Close()
+
+	_, copyErr := io.Copy(dest, ContextReader(ctx, resp.Body))
+	if copyErr != nil {
+		return &s3Error{"copying file", copyErr}
+	}
+	return nil
+}
+
+// Put copies an object from "src" to S3. Objects larger than one part
+// are uploaded with a multipart upload, whose parts are sent concurrently.
+func (b *S3) Put(ctx context.Context, url string, src io.Reader, opts PutOptions) (*Object, error) {
+	u, c, err := b.parseClient(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+
+	rd := &countingReader{r: ContextReader(ctx, src)}
+	in := &s3manager.UploadInput{
+		Bucket: aws.String(u.bucket),
+		Key:    aws.String(u.path),
+		Body:   rd,
+	}
+	if opts.ContentType != "" {
+		in.ContentType = aws.String(opts.ContentType)
+	}
+	switch opts.ACL {
+	case "":
+	case ACLPrivate:
+		in.ACL = aws.String(s3.ObjectCannedACLPrivate)
+	case ACLPublicRead:
+		in.ACL = aws.String(s3.ObjectCannedACLPublicRead)
+	default:
+		return nil, ValidateACL(opts.ACL)
+	}
+
+	partSize := b.conf.PartSize
+	if partSize < s3manager.MinUploadPartSize {
+		partSize = s3manager.MinUploadPartSize
+	}
+	if opts.Size/partSize >= s3manager.MaxUploadParts {
+		partSize = opts.Size/(s3manager.MaxUploadParts-1) + 1
+	}
+	uploader := s3manager.NewUploaderWithClient(c, func(up *s3manager.Uploader) {
+		up.PartSize = partSize
+		if b.conf.UploadConcurrency > 0 {
+			up.Concurrency = b.conf.UploadConcurrency
+		}
+	})
+
+	var reqOpts []request.Option
+	if opts.IfNotExists {
+		reqOpts = append(reqOpts, ifNoneMatch)
+	}
+	out, err := uploader.UploadWithContext(ctx, in, s3manager.WithUploaderRequestOptions(reqOpts...))
+	if isPreconditionFailed(err) && opts.IfNotExists {
+		return nil, &ErrObjectExists{"s3", url}
+	}
+	if err != nil {
+		return nil, &s3Error{fmt.Sprintf("uploading object %s", url), err}
+	}
+	return b.putResult(ctx, url, u, rd.n, out)
+}
+
+// putResult describes an uploaded object from the upload's response,
+// so that uploads don't need another request to stat the object.
+func (b *S3) putResult(ctx context.Context, url string, u *urlparts, size int64, out *s3manager.UploadOutput) (*Object, error) {
+	if out.ETag == nil {
+		return b.Stat(ctx, url)
+	}
+	// The response doesn't say whether the ETag is the MD5 of the content,
+	// see stat, so Checksum is left unset.
+	return &Object{
+		URL:     url,
+		Name:    u.path,
+		ETag:    strings.Trim(aws.StringValue(out.ETag), `"`),
+		Size:    size,
+		Version: aws.StringValue(out.VersionID),
+	}, nil
+}
+
+// ifNoneMatch makes an upload fail if the object already exists. S3 checks
+// the condition when an object is put or a multipart upload is completed.
+func ifNoneMatch(r *request.Request) {
+	switch r.Operation.Name {
+	case "PutObject", "CompleteMultipartUpload":
+		r.HTTPRequest.Header.Set("If-None-Match", "*")
+	}
+}
+
+// isPreconditionFailed returns true if "err" is the error of a conditional
+// request whose condition didn't hold, or which raced with another one.
+func isPreconditionFailed(err error) bool {
+	if mf, ok := err.(s3manager.MultiUploadFailure); ok {
+		err = mf.OrigErr()
+	}
+	if rf, ok := err.(awserr.RequestFailure); ok {
+		return rf.StatusCode() == http.StatusPreconditionFailed || rf.StatusCode() == http.StatusConflict
+	}
+	return false
+}
+
+// Publish grants read access on the object to all users, and returns the
+// object's public URL. Buckets which enforce object ownership have no ACLs,
+// and must be made public with a bucket policy instead.
+func (b *S3) Publish(ctx context.Context, url string) (string, error) {
+	u, c, err := b.parseClient(ctx, url)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = c.PutObjectAclWithContext(ctx, &s3.PutObjectAclInput{
+		Bucket: aws.String(u.bucket),
+		Key:    aws.String(u.path),
+		ACL:    aws.String(s3.ObjectCannedACLPublicRead),
+	})
+	if err != nil {
+		return "", &s3Error{fmt.Sprintf("publishing object %s", url), err}
+	}
+
+	// Build the URL the client would request, without signing it.
+	req, _ := c.GetObjectRequest(&s3.GetObjectInput{Bucket: aws.String(u.bucket), Key: aws.String(u.path)})
+	if err := req.Build(); err != nil {
+		return "", &s3Error{fmt.Sprintf("publishing object %s", url), err}
+	}
+	return req.HTTPRequest.URL.String(), nil
+}
+
+// RequestRestore starts restoring an object in a Glacier storage class,
+// which takes minutes to hours, depending on S3Config.RestoreTier.
+func (b *S3) RequestRestore(ctx context.Context, url string) error {
+	u, c, err := b.parseClient(ctx, url)
+	if err != nil {
+		return err
+	}
+
+	days := b.conf.RestoreDays
+	if days <= 0 {
+		days = 7
+	}
+	tier := b.conf.RestoreTier
+	if tier == "" {
+		tier = s3.TierStandard
+	}
+	_, err = c.RestoreObjectWithContext(ctx, &s3.RestoreObjectInput{
+		Bucket: aws.String(u.bucket),
+		Key:    aws.String(u.path),
+		RestoreRequest: &s3.RestoreRequest{
+			Days:                 aws.Int64(days),
+			GlacierJobParameters: &s3.GlacierJobParameters{Tier: aws.String(tier)},
+		},
+	})
+	// A restore which is already in progress isn't an error.
+	if e, ok := err.(awserr.Error); ok && e.Code() == "RestoreAlreadyInProgress" {
+		return nil
+	}
+	if err != nil {
+		return &s3Error{fmt.Sprintf("restoring object %s", url), err}
+	}
+	return nil
+}
+
+// Lock places a legal hold on the object. If "until" isn't zero, the object
+// is also retained until then in governance mode. Both require S3 Object Lock
+// to be enabled on the bucket.
+func (b *S3) Lock(ctx context.Context, url string, until time.Time) error {
+	u, c, err := b.parseClient(ctx, url)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.PutObjectLegalHoldWithContext(ctx, &s3.PutObjectLegalHoldInput{
+		Bucket:    aws.String(u.bucket),
+		Key:       aws.String(u.path),
+		LegalHold: &s3.ObjectLockLegalHold{Status: aws.String(s3.ObjectLockLegalHoldStatusOn)},
+	})
+	if err != nil {
+		return &s3Error{fmt.Sprintf("locking object %s", url), err}
+	}
+	if until.IsZero() {
+		return nil
+	}
+	_, err = c.PutObjectRetentionWithContext(ctx, &s3.PutObjectRetentionInput{
+		Bucket: aws.String(u.bucket),
+		Key:    aws.String(u.path),
+		Retention: &s3.ObjectLockRetention{
+			Mode:            aws.String(s3.ObjectLockRetentionModeGovernance),
+			RetainUntilDate: aws.Time(until.UTC()),
+		},
+	})
+	if err != nil {
+		return &s3Error{fmt.Sprintf("setting retention of object %s", url), err}
+	}
+	return nil
+}
+
+// Unlock releases the legal hold on the object and removes its retention
+// period, which requires the s3:BypassGovernanceRetention permission.
+func (b *S3) Unlock(ctx context.Context, url string) error {
+	u, c, err := b.parseClient(ctx, url)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.PutObjectLegalHoldWithContext(ctx, &s3.PutObjectLegalHoldInput{
+		Bucket:    aws.String(u.bucket),
+		Key:       aws.String(u.path),
+		LegalHold: &s3.ObjectLockLegalHold{Status: aws.String(s3.ObjectLockLegalHoldStatusOff)},
+	})
+	if err != nil {
+		return &s3Error{fmt.Sprintf("unlocking object %s", url), err}
+	}
+	_, err = c.PutObjectRetentionWithContext(ctx, &s3.PutObjectRetentionInput{
+		Bucket:                    aws.String(u.bucket),
+		Key:                       aws.String(u.path),
+		Retention:                 &s3.ObjectLockRetention{},
+		BypassGovernanceRetention: aws.Bool(true),
+	})
+	if err != nil {
+		return &s3Error{fmt.Sprintf("removing retention of object %s", url), err}
+	}
+	return nil
+}
+
+// Delete deletes the object at the given url.
+func (b *S3) Delete(ctx context.Context, url string) error {
+	u, c, err := b.parseClient(ctx, url)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(u.bucket),
+		Key:    aws.String(u.path),
+	})
+	if err != nil {
+		return &s3Error{fmt.Sprintf("deleting object %s", url), err}
+	}
+	return nil
+}
+
+// Move moves an object to a new url. The object is copied server-side,
+// in parts if it's larger than 5 GB, then the original is deleted.
+func (b *S3) Move(ctx context.Context, src, dst string) error {
+	obj, err := b.Stat(ctx, src)
+	if err != nil {
+		return err
+	}
+	su, err := b.parse(src)
+	if err != nil {
+		return err
+	}
+	du, c, err := b.parseClient(ctx, dst)
+	if err != nil {
+		return err
+	}
+
+	source := su.bucket + "/" + escapePath(su.path)
+	if obj.Size <= s3MaxCopySize {
+		_, err = c.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+			Bucket:     aws.String(du.bucket),
+			Key:        aws.String(du.path),
+			CopySource: aws.String(source),
+		})
+	} else {
+		err = b.copyParts(ctx, c, source, du, obj.Size)
+	}
+	if err != nil {
+		return &s3Error{fmt.Sprintf("copying object %s to %s", src, dst), err}
+	}
+	return b.Delete(ctx, src)
+}
+
+// copyParts copies an object of the given size with a multipart upload
+// whose parts are copied from "source", "<bucket>/<key>".
+func (b *S3) copyParts(ctx context.Context, c *s3.S3, source string, dst *urlparts, size int64) error {
+	created, err := c.CreateMultipartUploadWithContext(ctx, &s3.CreateMultipartUploadInput{
+		Bucket: aws.String(dst.bucket),
+		Key:    aws.String(dst.path),
+	})
+	if err != nil {
+		return err
+	}
+
+	var parts []*s3.CompletedPart
+	for offset := int64(0); offset < size; offset += s3MaxCopySize {
+		length := size - offset
+		if length > s3MaxCopySize {
+			length = s3MaxCopySize
+		}
+		num := aws.Int64(int64(len(parts) + 1))
+		resp, err := c.UploadPartCopyWithContext(ctx, &s3.UploadPartCopyInput{
+			Bucket:          aws.String(dst.bucket),
+			Key:             aws.String(dst.path),
+			UploadId:        created.UploadId,
+			PartNumber:      num,
+			CopySource:      aws.String(source),
+			CopySourceRange: aws.String(rangeHeader(offset, length)),
+		})
+		if err != nil {
+			c.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(dst.bucket),
+				Key:      aws.String(dst.path),
+				UploadId: created.UploadId,
+			})
+			return err
+		}
+		parts = append(parts, &s3.CompletedPart{ETag: resp.CopyPartResult.ETag, PartNumber: num})
+	}
+
+	_, err = c.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(dst.bucket),
+		Key:             aws.String(dst.path),
+		UploadId:        created.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	return err
+}
+
+// UnsupportedOperations describes which operations are not supported
+// for the given URL.
+func (b *S3) UnsupportedOperations(url string) UnsupportedOperations {
+	u, err := b.parse(url)
+	if err != nil {
+		return AllUnsupported(err)
+	}
+	if u.bucket == "" {
+		return AllUnsupported(&ErrInvalidURL{"s3"})
+	}
+
+	ops := UnsupportedOperations{}
+	if b.conf.Anonymous {
+		// Unsigned requests can only read public objects.
+		reason := "anonymous access is configured"
+		ops.Put = &ErrUnsupportedOperation{"s3", "put", reason}
+		ops.Delete = &ErrUnsupportedOperation{"s3", "delete", reason}
+		ops.Copy = &ErrUnsupportedOperation{"s3", "copy", reason}
+		ops.ACL = &ErrUnsupportedOperation{"s3", "acl", reason}
+	}
+	return ops
+}
+
+// Join joins the given URL with the given subpath.
+func (b *S3) Join(url, path string) (string, error) {
+	return strings.TrimSuffix(url, "/") + "/" + path, nil
+}
+
+func (b *S3) parse(rawurl string) (*urlparts, error) {
+	if !strings.HasPrefix(rawurl, S3Protocol) {
+		return nil, &ErrUnsupportedProtocol{"s3"}
+	}
+
+	path := strings.TrimPrefix(rawurl, S3Protocol)
+	if path == "" {
+		return nil, &ErrInvalidURL{"s3"}
+	}
+
+	split := strings.SplitN(path, "/", 2)
+	url := &urlparts{}
+	if len(split) > 0 {
+		url.bucket = split[0]
+	}
+	if len(split) == 2 {
+		url.path = split[1]
+	}
+	return url, nil
+}
+
+// parseClient parses a URL, and returns the client for its bucket.
+func (b *S3) parseClient(ctx context.Context, url string) (*urlparts, *s3.S3, error) {
+	u, err := b.parse(url)
+	if err != nil {
+		return nil, nil, err
+	}
+	c, err := b.client(ctx, u.bucket)
+	if err != nil {
+		return nil, nil, err
+	}
+	return u, c, nil
+}
+
+type s3Error struct {
+	msg string
+	err error
+}
+
+func (e *s3Error) Error() string {
+	return fmt.Sprintf("s3: %s: %v", e.msg, e.err)
+}
+
+// Kind classifies the error. See ErrorKind.
+func (e *s3Error) Kind() ErrorKind {
+	err := e.err
+	if mf, ok := err.(s3manager.MultiUploadFailure); ok {
+		err = mf.OrigErr()
+	}
+	if ae, ok := err.(awserr.Error); ok {
+		switch ae.Code() {
+		// S3 rejects expired temporary credentials with 400 or 403,
+		// which re-authenticating fixes.
+		case "ExpiredToken", "TokenRefreshRequired", "RequestExpired":
+			return AuthError
+		case "NoCredentialProviders", "InvalidAccessKeyId", "SignatureDoesNotMatch":
+			return AuthError
+		case s3.ErrCodeNoSuchKey, s3.ErrCodeNoSuchBucket, "NotFound":
+			return NotFoundError
+		case "SlowDown", "RequestTimeout":
+			return TransientError
+		}
+		if rf, ok := err.(awserr.RequestFailure); ok && rf.StatusCode() != 0 {
+			return classifyHTTPStatus(rf.StatusCode())
+		}
+		if orig := ae.OrigErr(); orig != nil {
+			return classifyNetError(orig)
+		}
+	}
+	return classifyNetError(err)
+}
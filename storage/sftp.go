@@ -0,0 +1,712 @@
+//go:build !nosftp
+// +build !nosftp
+
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	urllib "net/url"
+	"os"
+	"os/user"
+	pathlib "path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/kevinburke/ssh_config"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sftpChunkSize is the buffer size of downloads. Reads of large buffers
+// are split into concurrent requests, which matters on high latency links.
+const sftpChunkSize = 1 << 20
+
+// SFTP provides access to files on SSH servers, at URLs such as
+// "sftp://user@host:port/path". Paths are absolute, except that paths
+// under "/~/" are relative to the login's home directory.
+type SFTP struct {
+	conf SFTPConfig
+
+	sshConfigOnce sync.Once
+	sshConfig     *ssh_config.Config
+	sshConfigErr  error
+
+	mtx   sync.Mutex
+	conns map[string]*sftpConn
+}
+
+// sftpConn is an SSH connection and the SFTP session running over it.
+type sftpConn struct {
+	ssh  *ssh.Client
+	sftp *sftp.Client
+}
+
+func (c *sftpConn) Close() {
+	c.sftp.Close()
+	c.ssh.Close()
+}
+
+func init() {
+	Register("sftp", Backend{
+		Name: "sftp",
+		New: func(c Config) (Storage, error) {
+			return NewSFTP(c.SFTP)
+		},
+		Enabled: func(c Config) bool { return c.SFTP.Valid() },
+		ValidateURL: func(url string) error {
+			u, err := urllib.Parse(url)
+			if err != nil {
+				return &sftpError{"parsing URL", err}
+			}
+			if u.Host == "" {
+				return &ErrInvalidURL{"sftp"}
+			}
+			return nil
+		},
+	})
+}
+
+// NewSFTP creates a new SFTP instance.
+func NewSFTP(conf SFTPConfig) (*SFTP, error) {
+	return &SFTP{conf: conf, conns: map[string]*sftpConn{}}, nil
+}
+
+// sftpHost is a server resolved from a URL and the ssh config.
+type sftpHost struct {
+	user           string
+	addr           string
+	password       string
+	identityFile   string
+	knownHostsFile string
+	proxyJump      string
+}
+
+// loadSSHConfig returns the ssh config, or nil if there isn't one.
+func (b *SFTP) loadSSHConfig() (*ssh_config.Config, error) {
+	b.sshConfigOnce.Do(func() {
+		if b.conf.IgnoreSSHConfig {
+			return
+		}
+		path := b.conf.SSHConfigFile
+		if path == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return
+			}
+			path = filepath.Join(home, ".ssh", "config")
+		}
+		fh, err := os.Open(path)
+		if err != nil {
+			return
+		}
+		defer fh.Close()
+		b.sshConfig, b.sshConfigErr = ssh_config.Decode(fh)
+		if b.sshConfigErr != nil {
+			b.sshConfigErr = &sftpError{"reading ssh config " + path, b.sshConfigErr}
+		}
+	})
+	return b.sshConfig, b.sshConfigErr
+}
+
+// sshConfigValue returns the ssh config's value of "key" for "alias",
+// or "" if it isn't set.
+func (b *SFTP) sshConfigValue(alias, key string) string {
+	cfg, _ := b.loadSSHConfig()
+	if cfg == nil {
+		return ""
+	}
+	v, _ := cfg.Get(alias, key)
+	return v
+}
+
+// resolve resolves the server of a URL, whose host may be an alias in
+// the ssh config. The user comes from the URL, then the ssh config, then
+// SFTPConfig.User; the password from the URL, then the .netrc file.
+func (b *SFTP) resolve(u *urllib.URL) sftpHost {
+	alias := u.Hostname()
+	host := alias
+	if h := b.sshConfigValue(alias, "HostName"); h != "" {
+		host = strings.Replace(h, "%h", alias, -1)
+	}
+	port := u.Port()
+	if port == "" {
+		port = b.sshConfigValue(alias, "Port")
+	}
+	if port == "" {
+		port = "22"
+	}
+
+	h := sftpHost{
+		addr:           net.JoinHostPort(host, port),
+		identityFile:   b.conf.IdentityFile,
+		knownHostsFile: b.conf.KnownHostsFile,
+	}
+	if h.identityFile == "" {
+		h.identityFile = expandHome(b.sshConfigValue(alias, "IdentityFile"))
+	}
+	if h.knownHostsFile == "" {
+		// Only the first of several files is used.
+		files := strings.Fields(b.sshConfigValue(alias, "UserKnownHostsFile"))
+		if len(files) > 0 {
+			h.knownHostsFile = expandHome(files[0])
+		}
+	}
+	if j := b.sshConfigValue(alias, "ProxyJump"); j != "none" {
+		h.proxyJump = j
+	}
+
+	if u.User != nil {
+		h.user = u.User.Username()
+		h.password, _ = u.User.Password()
+	}
+	if h.user == "" {
+		h.user = b.sshConfigValue(alias, "User")
+	}
+	if h.user == "" {
+		h.user = b.conf.User
+	}
+	if h.user == "" {
+		if cur, err := user.Current(); err == nil {
+			h.user = cur.Username
+		}
+	}
+	if h.password == "" && !b.conf.IgnoreNetrc {
+		if _, p, ok := netrcLogin(b.conf.NetrcFile, host, h.user); ok {
+			h.password = p
+		}
+	}
+	return h
+}
+
+// expandHome expands a leading "~" in a path from the ssh config.
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[1:])
+}
+
+// conn returns the connection to the server of "u", connecting if there
+// isn't one yet. Connections are shared by concurrent transfers.
+func (b *SFTP) conn(ctx context.Context, u *urllib.URL) (*sftpConn, error) {
+	if _, err := b.loadSSHConfig(); err != nil {
+		return nil, err
+	}
+	h := b.resolve(u)
+	key := h.user + "@" + h.addr
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if c, ok := b.conns[key]; ok {
+		return c, nil
+	}
+	c, err := b.dial(ctx, h)
+	if err != nil {
+		return nil, err
+	}
+	b.conns[key] = c
+	return c, nil
+}
+
+func (b *SFTP) dial(ctx context.Context, h sftpHost) (*sftpConn, error) {
+	auth, err := sshAuth(h.identityFile)
+	if err != nil && h.password == "" {
+		return nil, &sftpError{"loading SSH keys", err}
+	}
+	if h.password != "" {
+		auth = append(auth, ssh.Password(h.password))
+	}
+	hostKeys, err := knownHosts(h.knownHostsFile)
+	if err != nil {
+		return nil, &sftpError{"loading host keys", err}
+	}
+	conf := &ssh.ClientConfig{
+		User:            h.user,
+		Auth:            auth,
+		HostKeyCallback: hostKeys,
+		Timeout:         directDialer.Timeout,
+	}
+
+	conn, err := b.dialServer(ctx, h)
+	if err != nil {
+		return nil, &sftpError{fmt.Sprintf("connecting to %s", h.addr), err}
+	}
+	sc, chans, reqs, err := ssh.NewClientConn(conn, h.addr, conf)
+	if err != nil {
+		conn.Close()
+		return nil, &sftpError{fmt.Sprintf("connecting to %s", h.addr), err}
+	}
+	client := ssh.NewClient(sc, chans, reqs)
+
+	s, err := sftp.NewClient(client, sftp.UseConcurrentWrites(true))
+	if err != nil {
+		client.Close()
+		return nil, &sftpError{fmt.Sprintf("starting SFTP session on %s", h.addr), err}
+	}
+	return &sftpConn{client, s}, nil
+}
+
+// dialServer connects to the server, through its ProxyJump host from the
+// ssh config, unless the proxy config routes it, which takes precedence.
+func (b *SFTP) dialServer(ctx context.Context, h sftpHost) (net.Conn, error) {
+	host, _, _ := net.SplitHostPort(h.addr)
+	if _, ok := proxyFor(host); ok || h.proxyJump == "" {
+		return dialContext(ctx, "tcp", h.addr)
+	}
+	if strings.Contains(h.proxyJump, ",") {
+		return nil, fmt.Errorf("ProxyJump with several hops isn't supported: %s", h.proxyJump)
+	}
+
+	ju, err := urllib.Parse("ssh://" + h.proxyJump)
+	if err != nil {
+		return nil, fmt.Errorf("parsing ProxyJump %q: %s", h.proxyJump, err)
+	}
+	jump := b.resolve(ju)
+	p := ProxyConfig{
+		JumpHost:       jump.user + "@" + jump.addr,
+		IdentityFile:   jump.identityFile,
+		KnownHostsFile: jump.knownHostsFile,
+	}
+	client, err := tunnel(ctx, p, directDialer)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := client.DialContext(ctx, "tcp", h.addr)
+	if err != nil {
+		// The connection to the jump host may have dropped, so reconnect once.
+		dropTunnel(p.JumpHost, client)
+		if client, err = tunnel(ctx, p, directDialer); err != nil {
+			return nil, err
+		}
+		conn, err = client.DialContext(ctx, "tcp", h.addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("through jump host %s: %s", p.JumpHost, err)
+	}
+	return conn, nil
+}
+
+// do runs "f" with the connection to the server of "url", and the server
+// path of the URL. Connections which fail are dropped, so that the next
+// call reconnects.
+func (b *SFTP) do(ctx context.Context, url string, f func(c *sftp.Client, path string) error) error {
+	u, err := urllib.Parse(url)
+	if err != nil {
+		return &sftpError{"parsing URL", err}
+	}
+	c, err := b.conn(ctx, u)
+	if err != nil {
+		return err
+	}
+	err = f(c.sftp, sftpPath(u.Path))
+	if KindOf(err) == TransientError {
+		b.drop(c)
+	}
+	return err
+}
+
+// drop closes a connection and removes it from the cache.
+func (b *SFTP) drop(c *sftpConn) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	for k, v := range b.conns {
+		if v == c {
+			delete(b.conns, k)
+		}
+	}
+	c.Close()
+}
+
+// Reauthenticate closes all connections, so that the next calls log in
+// again, e.g. after a key was added to ssh-agent.
+func (b *SFTP) Reauthenticate(ctx context.Context) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	for k, c := range b.conns {
+		c.Close()
+		delete(b.conns, k)
+	}
+	return nil
+}
+
+// sftpPath returns the server path of a URL path. "/~/" is the login's
+// home directory, which SFTP servers resolve relative paths against.
+func sftpPath(p string) string {
+	if p == "/~" {
+		return "."
+	}
+	if strings.HasPrefix(p, "/~/") {
+		return p[3:]
+	}
+	return p
+}
+
+// Stat returns information about the object at the given storage URL.
+func (b *SFTP) Stat(ctx context.Context, url string) (*Object, error) {
+	var obj *Object
+	err := b.do(ctx, url, func(c *sftp.Client, p string) error {
+		var err error
+		obj, err = sftpStat(c, url, p)
+		return err
+	})
+	return obj, err
+}
+
+func sftpStat(c *sftp.Client, url, p string) (*Object, error) {
+	info, err := c.Stat(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, &ErrNotFound{"sftp", url}
+	}
+	if err != nil {
+		return nil, &sftpError{fmt.Sprintf("getting file info for %s", url), err}
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("sftp: stat on non-regular file type: %s", url)
+	}
+	return &Object{
+		URL:          url,
+		Name:         strings.TrimPrefix(p, "/"),
+		LastModified: info.ModTime(),
+		Size:         info.Size(),
+	}, nil
+}
+
+// Get copies a file from a given URL to the host.
+func (b *SFTP) Get(ctx context.Context, url string, dest io.Writer) (*Object, error) {
+	var obj *Object
+	err := b.do(ctx, url, func(c *sftp.Client, p string) error {
+		var err error
+		obj, err = sftpStat(c, url, p)
+		if err != nil {
+			return err
+		}
+		f, err := c.Open(p)
+		if err != nil {
+			return &sftpError{fmt.Sprintf("opening %s", url), err}
+		}
+		defer f.Close()
+
+		// The struct hides dest's ReaderFrom, which would read in small chunks.
+		_, err = io.CopyBuffer(struct{ io.Writer }{dest}, ContextReader(ctx, f), make([]byte, sftpChunkSize))
+		if err != nil {
+			return &sftpError{fmt.Sprintf("copying %s", url), err}
+		}
+		return nil
+	})
+	return obj, err
+}
+
+// GetRange copies part of a file from a given URL to the host.
+func (b *SFTP) GetRange(ctx context.Context, url string, offset, length int64, dest io.Writer) error {
+	return b.do(ctx, url, func(c *sftp.Client, p string) error {
+		f, err := c.Open(p)
+		if errors.Is(err, os.ErrNotExist) {
+			return &ErrNotFound{"sftp", url}
+		}
+		if err != nil {
+			return &sftpError{fmt.Sprintf("opening %s", url), err}
+		}
+		defer f.Close()
+
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			return &sftpError{fmt.Sprintf("seeking in %s", url), err}
+		}
+		n, err := io.Copy(dest, io.LimitReader(ContextReader(ctx, f), length))
+		if err != nil {
+			return &sftpError{fmt.Sprintf("copying %s", url), err}
+		}
+		if n < length {
+			return fmt.Errorf("sftp: %s ends before the end of the range, at byte %d", url, offset+n)
+		}
+		return nil
+	})
+}
+
+// Put copies a file from the host to the SSH server. The file is written
+// to a hidden temporary file next to it, and renamed into place once
+// complete, so that readers never see a partial file. With
+// PutOptions.IfNotExists, the file is linked into place instead, which
+// fails if the file exists, on servers with OpenSSH's hardlink extension.
+func (b *SFTP) Put(ctx context.Context, url string, src io.Reader, opts PutOptions) (*Object, error) {
+	if opts.ACL != "" {
+		return nil, &ErrUnsupportedOperation{"sftp", "acl", "SFTP has no access controls"}
+	}
+	var obj *Object
+	err := b.do(ctx, url, func(c *sftp.Client, p string) error {
+		dir, name := pathlib.Split(p)
+		if dir != "" {
+			if err := c.MkdirAll(dir); err != nil {
+				return &sftpError{fmt.Sprintf("creating directory %s", dir), err}
+			}
+		}
+
+		tmp := pathlib.Join(dir, "."+name+".part-"+randomSuffix())
+		f, err := c.Create(tmp)
+		if err != nil {
+			return &sftpError{fmt.Sprintf("creating %s", tmp), err}
+		}
+		// ReadFrom writes chunks concurrently, see UseConcurrentWrites.
+		_, err = f.ReadFrom(ContextReader(ctx, src))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			c.Remove(tmp)
+			return &sftpError{fmt.Sprintf("uploading %s", url), err}
+		}
+
+		if opts.IfNotExists {
+			err = sftpCreate(c, tmp, p)
+		} else {
+			err = sftpRename(c, tmp, p)
+		}
+		if err != nil {
+			c.Remove(tmp)
+			if errors.Is(err, os.ErrExist) {
+				return &ErrObjectExists{"sftp", url}
+			}
+			return &sftpError{fmt.Sprintf("renaming upload to %s", url), err}
+		}
+
+		obj, err = sftpStat(c, url, p)
+		return err
+	})
+	return obj, err
+}
+
+// sftpCreate moves "src" to "dst", failing with os.ErrExist if "dst"
+// exists. Hard links never replace a file, so OpenSSH's hardlink extension
+// is used if the server has it. Otherwise, as some servers' renames replace
+// files, "dst" is checked first, which is subject to races.
+func sftpCreate(c *sftp.Client, src, dst string) error {
+	if _, ok := c.HasExtension("hardlink@openssh.com"); ok {
+		err := c.Link(src, dst)
+		if err != nil {
+			if _, serr := c.Stat(dst); serr == nil {
+				return os.ErrExist
+			}
+			return err
+		}
+		return c.Remove(src)
+	}
+	if _, err := c.Stat(dst); err == nil {
+		return os.ErrExist
+	}
+	return c.Rename(src, dst)
+}
+
+// sftpRename renames "src" to "dst", replacing it. Plain SFTP renames may
+// fail if "dst" exists, so this uses OpenSSH's posix-rename extension, if the
+// server has it, or removes "dst" first.
+func sftpRename(c *sftp.Client, src, dst string) error {
+	if _, ok := c.HasExtension("posix-rename@openssh.com"); ok {
+		return c.PosixRename(src, dst)
+	}
+	if err := c.Remove(dst); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return c.Rename(src, dst)
+}
+
+// randomSuffix returns a random string for temporary file names.
+func randomSuffix() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Delete deletes a file from the SSH server.
+func (b *SFTP) Delete(ctx context.Context, url string) error {
+	return b.do(ctx, url, func(c *sftp.Client, p string) error {
+		err := c.Remove(p)
+		if errors.Is(err, os.ErrNotExist) {
+			return &ErrNotFound{"sftp", url}
+		}
+		if err != nil {
+			return &sftpError{fmt.Sprintf("deleting %s", url), err}
+		}
+		return nil
+	})
+}
+
+// Move renames a file on the SSH server, replacing "dst" if it exists.
+// Both URLs must refer to the same server.
+func (b *SFTP) Move(ctx context.Context, src, dst string) error {
+	su, err := urllib.Parse(src)
+	if err != nil {
+		return &sftpError{"parsing URL", err}
+	}
+	du, err := urllib.Parse(dst)
+	if err != nil {
+		return &sftpError{"parsing URL", err}
+	}
+	if su.Host != du.Host || su.User.String() != du.User.String() {
+		return fmt.Errorf("sftp: can't move files between servers: %s to %s", src, dst)
+	}
+
+	return b.do(ctx, src, func(c *sftp.Client, p string) error {
+		to := sftpPath(du.Path)
+		if dir := pathlib.Dir(to); dir != "." {
+			if err := c.MkdirAll(dir); err != nil {
+				return &sftpError{fmt.Sprintf("creating directory %s", dir), err}
+			}
+		}
+		err := sftpRename(c, p, to)
+		if errors.Is(err, os.ErrNotExist) {
+			return &ErrNotFound{"sftp", src}
+		}
+		if err != nil {
+			return &sftpError{fmt.Sprintf("renaming %s to %s", src, dst), err}
+		}
+		return nil
+	})
+}
+
+// List lists the files under the given URL. Links to directories are
+// listed as directories, but never descended into, to avoid cycles.
+func (b *SFTP) List(ctx context.Context, url string, opts ListOptions) ([]*Object, error) {
+	var objects []*Object
+	err := b.do(ctx, url, func(c *sftp.Client, p string) error {
+		info, err := c.Stat(p)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return &sftpError{fmt.Sprintf("getting file info for %s", url), err}
+		}
+		// Special case where the user called List on a regular file.
+		if info.Mode().IsRegular() {
+			objects = []*Object{{
+				URL:          url,
+				Name:         strings.TrimPrefix(p, "/"),
+				LastModified: info.ModTime(),
+				Size:         info.Size(),
+			}}
+			return nil
+		}
+		objects, err = sftpList(ctx, c, url, p, opts)
+		return err
+	})
+	return objects, err
+}
+
+func sftpList(ctx context.Context, c *sftp.Client, url, dir string, opts ListOptions) ([]*Object, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	entries, err := c.ReadDir(dir)
+	if err != nil {
+		return nil, &sftpError{fmt.Sprintf("listing %s", url), err}
+	}
+
+	var objects []*Object
+	for _, info := range entries {
+		joined := strings.TrimSuffix(url, "/") + "/" + info.Name()
+		p := pathlib.Join(dir, info.Name())
+		name := strings.TrimPrefix(p, "/")
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := c.Stat(p)
+			if err != nil {
+				// Broken link. Report it instead of failing the whole listing.
+				link, _ := c.ReadLink(p)
+				objects = append(objects, &Object{
+					URL:          joined,
+					Name:         name,
+					LastModified: info.ModTime(),
+					Link:         link,
+				})
+				continue
+			}
+			if target.IsDir() {
+				objects = append(objects, &Object{URL: joined + "/", Name: name + "/", Dir: true})
+				continue
+			}
+			info = target
+		}
+
+		switch {
+		case info.IsDir() && opts.Recursive:
+			sub, err := sftpList(ctx, c, joined, p, opts)
+			if err != nil {
+				return nil, err
+			}
+			objects = append(objects, sub...)
+
+		case info.IsDir():
+			objects = append(objects, &Object{URL: joined + "/", Name: name + "/", Dir: true})
+
+		case info.Mode().IsRegular():
+			objects = append(objects, &Object{
+				URL:          joined,
+				Name:         name,
+				LastModified: info.ModTime(),
+				Size:         info.Size(),
+			})
+		}
+	}
+	return objects, nil
+}
+
+// UnsupportedOperations describes which operations are not supported
+// for the given URL.
+func (b *SFTP) UnsupportedOperations(url string) UnsupportedOperations {
+	u, err := urllib.Parse(url)
+	if err != nil {
+		return AllUnsupported(&sftpError{"parsing URL", err})
+	}
+	if u.Scheme != "sftp" {
+		return AllUnsupported(&ErrUnsupportedProtocol{"sftp"})
+	}
+	if u.Host == "" {
+		return AllUnsupported(&ErrInvalidURL{"sftp"})
+	}
+	return UnsupportedOperations{
+		ACL: &ErrUnsupportedOperation{"sftp", "acl", "SFTP has no access controls"},
+	}
+}
+
+// Join joins the given URL with the given subpath.
+func (b *SFTP) Join(url, path string) (string, error) {
+	return strings.TrimSuffix(url, "/") + "/" + path, nil
+}
+
+type sftpError struct {
+	msg string
+	err error
+}
+
+func (e *sftpError) Error() string {
+	return fmt.Sprintf("sftp: %s: %v", e.msg, e.err)
+}
+
+// Kind classifies the error. See ErrorKind.
+func (e *sftpError) Kind() ErrorKind {
+	var keyErr *knownhosts.KeyError
+	switch {
+	case errors.Is(e.err, os.ErrNotExist):
+		return NotFoundError
+	case errors.Is(e.err, os.ErrPermission):
+		return PermissionError
+	case errors.As(e.err, &keyErr):
+		// The server's key is unknown or changed, which retrying won't fix.
+		return InvalidError
+	case strings.Contains(e.err.Error(), "unable to authenticate"):
+		return AuthError
+	case errors.Is(e.err, sftp.ErrSSHFxConnectionLost), e.err == io.EOF:
+		return TransientError
+	}
+	return classifyNetError(e.err)
+}
@@ -5,27 +5,62 @@ import (
 	"fmt"
 	"github.com/alecthomas/units"
 	"io"
-	"strings"
 	"time"
 )
 
 type Config struct {
 	GoogleCloud GoogleCloudConfig
 	Swift       SwiftConfig
+	S3          S3Config
 	FTP         FTPConfig
+	SFTP        SFTPConfig
+	IPFS        IPFSConfig
+	Globus      GlobusConfig
+	IRODS       IRODSConfig
+	GoogleDrive GoogleDriveConfig
+	Dropbox     DropboxConfig
+	ADLS        ADLSConfig
+	WebDAV      WebDAVConfig
+	Retry       RetryConfig
+	RateLimit   RateLimitConfig
+	// User-Agent and headers of HTTP requests. See HTTPConfig.
+	HTTP HTTPConfig
+	// SOCKS5 proxies and SSH jump hosts for the connections of all
+	// backends. The first one whose Host matches is used. See ProxyConfig.
+	Proxies []ProxyConfig
+	// External transfer commands for large objects. See ExternalConfig.
+	External []ExternalConfig
 }
 
 func DefaultConfig() Config {
 	return Config{
 		Swift: SwiftConfig{
-			MaxRetries:     20,
-			ChunkSizeBytes: int64(500 * units.MB),
+			ChunkSizeBytes:    int64(500 * units.MB),
+			TargetChunkCount:  20,
+			UploadConcurrency: 1,
+		},
+		S3: S3Config{
+			PartSize:          int64(64 * units.MB),
+			UploadConcurrency: 4,
+			RestoreDays:       7,
+		},
+		Retry: RetryConfig{
+			MaxTries:        5,
+			InitialInterval: Duration(time.Second),
+			MaxInterval:     Duration(time.Second * 30),
+			MaxRetryAfter:   Duration(time.Minute * 5),
 		},
 		FTP: FTPConfig{
 			Timeout:  Duration(time.Second * 10),
 			User:     "anonymous",
 			Password: "anonymous",
 		},
+		IPFS: IPFSConfig{
+			Gateway: "https://ipfs.io",
+		},
+		Globus: GlobusConfig{
+			PollInterval: Duration(time.Second * 5),
+		},
 	}
 }
 
@@ -39,17 +74,129 @@ type Storage interface {
 	Stat(ctx context.Context, url string) (*Object, error)
 
 	// List a directory. Calling List on a File is an error.
-	List(ctx context.Context, url string) ([]*Object, error)
+	// See ListOptions.
+	List(ctx context.Context, url string, opts ListOptions) ([]*Object, error)
 
 	// Get a single object from storage URL, written to a local file path.
 	Get(ctx context.Context, url string, dest io.Writer) (*Object, error)
 
 	// Put a single object to storage URL, from a local file path.
 	// Returns the Object that was created in storage.
-	Put(ctx context.Context, url string, src io.Reader) (*Object, error)
+	Put(ctx context.Context, url string, src io.Reader, opts PutOptions) (*Object, error)
+
+	// Delete the object at the given storage URL.
+	Delete(ctx context.Context, url string) error
+
+	// Move an object to a new URL within the same storage system.
+	Move(ctx context.Context, src, dst string) error
 
 	// Join a directory URL with a subpath.
 	Join(url, path string) (string, error)
+
+	// UnsupportedOperations describes which operations (Get, Put, etc) are
+	// not supported for the given URL, so that callers can fail early
+	// instead of partway through a transfer.
+	UnsupportedOperations(url string) UnsupportedOperations
+}
+
+// UnsupportedOperations describes which operations are not supported by a
+// storage backend for a specific URL. A nil field means the operation is
+// supported; otherwise the field holds the reason it isn't.
+type UnsupportedOperations struct {
+	Get    error
+	Put    error
+	List   error
+	Delete error
+	// Range is reading part of an object.
+	Range error
+	// Copy is copying or moving an object within the storage system
+	// without downloading it, e.g. Storage.Move.
+	Copy error
+	// ACL is setting access controls on upload, see PutOptions.ACL.
+	ACL error
+}
+
+// AllUnsupported returns an UnsupportedOperations with every operation
+// unsupported for the same reason, e.g. an invalid URL.
+func AllUnsupported(err error) UnsupportedOperations {
+	return UnsupportedOperations{
+		Get:    err,
+		Put:    err,
+		List:   err,
+		Delete: err,
+		Range:  err,
+		Copy:   err,
+		ACL:    err,
+	}
+}
+
+// Ops returns the operations by name, in a stable order,
+// which is useful for reporting.
+func (u UnsupportedOperations) Ops() []Op {
+	return []Op{
+		{"get", u.Get},
+		{"put", u.Put},
+		{"list", u.List},
+		{"delete", u.Delete},
+		{"range", u.Range},
+		{"copy", u.Copy},
+		{"acl", u.ACL},
+	}
+}
+
+// Op is the name of an operation and the reason it's unsupported, if any.
+type Op struct {
+	Name string
+	Err  error
+}
+
+// ListOptions describes optional behavior of Storage.List.
+type ListOptions struct {
+	// List every object under the URL. When false, only the URL's immediate
+	// children are listed, and deeper objects are grouped into
+	// pseudo-directories (objects with Dir set), using "/" as the delimiter.
+	Recursive bool
+}
+
+// PutOptions describes optional behavior of Storage.Put.
+type PutOptions struct {
+	// Only create the object if nothing exists at the URL yet.
+	// If an object already exists, Put returns *ErrObjectExists.
+	IfNotExists bool
+
+	// Content-Type to store with the object, if the backend supports it.
+	// See DetectContentType.
+	ContentType string
+
+	// Size of the object in bytes, if known in advance. Zero means unknown.
+	// Backends may use this to tune how the object is uploaded.
+	Size int64
+
+	// Canned access control to apply to the object, e.g. ACLPublicRead.
+	// Empty means the backend's default. See ValidateACL.
+	ACL string
+
+	// Path of the local file which "src" reads, if any. Backends which
+	// transfer files rather than streams may read it directly instead
+	// of copying "src", e.g. see ExternalConfig.
+	SourcePath string
+}
+
+// Canned ACLs, which backends map onto their own access controls.
+const (
+	// Only the owner of the bucket can access the object.
+	ACLPrivate = "private"
+	// Anyone can read the object, without credentials.
+	ACLPublicRead = "public-read"
+)
+
+// ValidateACL returns an error if "acl" isn't one of the canned ACLs.
+func ValidateACL(acl string) error {
+	switch acl {
+	case "", ACLPrivate, ACLPublicRead:
+		return nil
+	}
+	return fmt.Errorf("unknown ACL %q, expected %q or %q", acl, ACLPrivate, ACLPublicRead)
 }
 
 // Object represents metadata about an object in storage.
@@ -68,52 +215,127 @@ type Object struct {
 	// a unique ID (for example the local filesystem).
 	ETag string
 
+	// Checksum of the object's content, hex encoded, if the backend provides
+	// one. Unlike ETag, this can be compared against a locally computed
+	// checksum. See ChecksumType and NewChecksumHash.
+	Checksum string
+
+	// The algorithm of Checksum, e.g. ChecksumMD5.
+	// Empty if Checksum isn't set.
+	ChecksumType string
+
 	LastModified time.Time
 
 	// Size of the object, in bytes.
 	Size int64
+
+	// Version identifies a specific version of the object in a versioned bucket,
+	// e.g. the Google Cloud Storage generation number or the Swift version ID.
+	// This field is empty if the system doesn't support versioning.
+	Version string
+
+	// Dir is set for pseudo-directories returned by a non-recursive List,
+	// i.e. a common prefix of other objects. For object stores these don't
+	// exist as objects, so only URL and Name are set, with a trailing "/".
+	Dir bool
+
+	// Link is the target of a symbolic link, for backends which have links
+	// and are configured to report them instead of following them.
+	// e.g. see FTPConfig.FollowLinks.
+	Link string
+
+	// StorageClass is the backend's storage class or access tier,
+	// e.g. "Archive". Empty if the backend doesn't report one.
+	StorageClass string
+
+	// Archived is set when the object is in an archive tier, e.g. tape,
+	// and must be restored with Restorer.RequestRestore before it can
+	// be downloaded.
+	Archived bool
+
+	// Restoring is set when a restore of an archived object is in progress.
+	Restoring bool
 }
 
-type urlparts struct {
-	bucket, path string
+// VersionGetter is implemented by backends which can download a specific
+// version of an object from a versioned bucket.
+type VersionGetter interface {
+	// GetVersion gets a specific version of an object from storage URL,
+	// where "version" is the Version field of a previously returned Object.
+	GetVersion(ctx context.Context, url, version string, dest io.Writer) (*Object, error)
 }
 
-func NewStorage(url string, conf Config) (Storage, error) {
+// RangeGetter is implemented by backends which can download part of an object.
+type RangeGetter interface {
+	// GetRange copies "length" bytes of the object at storage URL,
+	// starting at "offset", to "dest".
+	GetRange(ctx context.Context, url string, offset, length int64, dest io.Writer) error
+}
 
-	if strings.HasPrefix(url, GSProtocol) {
-		if !conf.GoogleCloud.Valid() {
-			return nil, fmt.Errorf("failed to configure Google Storage backend")
-		}
-		gs, err := NewGoogleCloud(conf.GoogleCloud)
-		if err != nil {
-			return nil, fmt.Errorf("failed to configure Google Storage backend: %s", err)
-		}
-		return gs, nil
+// RangeUnsupported returns the reason the backend can't read part of the
+// object at "url", or nil if it can: the backend must implement RangeGetter,
+// and support ranges for the URL, see UnsupportedOperations.Range.
+func RangeUnsupported(s Storage, url string) error {
+	if _, ok := s.(RangeGetter); !ok {
+		return &ErrUnsupportedOperation{"storage", "range", "not implemented by backend"}
 	}
+	return s.UnsupportedOperations(url).Range
+}
 
-	if strings.HasPrefix(url, SwiftProtocol) {
-		if !conf.Swift.Valid() {
-			return nil, fmt.Errorf("failed to config Swift storage backend")
-		}
-		s, err := NewSwift(conf.Swift)
-		if err != nil {
-			return nil, fmt.Errorf("failed to config Swift storage backend: %s", err)
-		}
-		return s, nil
+// GetRange copies "length" bytes of the object at storage URL, starting at
+// "offset", to "dest", if the backend supports it. See RangeUnsupported.
+func GetRange(ctx context.Context, s Storage, url string, offset, length int64, dest io.Writer) error {
+	if err := RangeUnsupported(s, url); err != nil {
+		return err
 	}
+	return s.(RangeGetter).GetRange(ctx, url, offset, length, dest)
+}
 
-	if strings.HasPrefix(url, FTPProtocol) {
-		if !conf.FTP.Valid() {
-			return nil, fmt.Errorf("failed to config ftp storage backend")
-		}
-		ftp, err := NewFTP(conf.FTP)
-		if err != nil {
-			return nil, fmt.Errorf("failed to config ftp storage backend: %s", err)
-		}
-		return ftp, nil
-	}
+// rangeHeader returns the value of an HTTP Range header requesting
+// "length" bytes starting at "offset".
+func rangeHeader(offset, length int64) string {
+	return fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)
+}
+
+// Publisher is implemented by backends which can make objects publicly
+// readable, e.g. for sharing datasets with people who don't use git.
+type Publisher interface {
+	// Publish makes the object at the given storage URL readable by anyone
+	// and returns a plain URL which can be used to download it, e.g. with
+	// a web browser or curl.
+	Publish(ctx context.Context, url string) (string, error)
+}
+
+// Restorer is implemented by backends which have archive tiers.
+type Restorer interface {
+	// RequestRestore starts restoring the archived object at the given
+	// storage URL, so that it can be downloaded once the restore completes.
+	// Restores can take hours, so this doesn't wait for it.
+	RequestRestore(ctx context.Context, url string) error
+}
+
+// Locker is implemented by backends which can protect objects from being
+// deleted or overwritten, e.g. with object holds.
+type Locker interface {
+	// Lock places a hold on the object at the given storage URL, so that it
+	// can't be deleted or overwritten until it's unlocked. If "until" isn't
+	// zero, the object is also retained until then, even once unlocked.
+	Lock(ctx context.Context, url string, until time.Time) error
+	// Unlock releases the hold, and any retention, placed by Lock.
+	// This usually requires admin permissions on the bucket.
+	Unlock(ctx context.Context, url string) error
+}
 
-	return nil, fmt.Errorf("failed to find matching storage backend for %q", url)
+// Reauthenticator is implemented by backends whose credentials can expire
+// in the middle of a long session, e.g. Swift tokens. The Retrier calls
+// Reauthenticate before retrying an operation which failed with AuthError.
+type Reauthenticator interface {
+	// Reauthenticate drops cached credentials, and signs in again if needed.
+	Reauthenticate(ctx context.Context) error
+}
+
+type urlparts struct {
+	bucket, path string
 }
 
 // Duration is a wrapper type for time.Duration which provides human-friendly
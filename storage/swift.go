@@ -1,54 +1,62 @@
+//go:build !noswift
+// +build !noswift
+
 package storage
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/json"
 	"fmt"
 	"io"
-	"os"
+	"net/http"
+	urllib "net/url"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/alecthomas/units"
 	"github.com/ncw/swift"
 )
 
-const SwiftProtocol = "swift://"
-
-// SwiftConfig configures the OpenStack Swift object storage backend.
-type SwiftConfig struct {
-	Disabled   bool
-	UserName   string
-	Password   string
-	AuthURL    string
-	TenantName string
-	TenantID   string
-	RegionName string
-	// Size of chunks to use for large object creation.
-	// Defaults to 500 MB if not set or set below 10 MB.
-	// The max number of chunks for a single object is 1000.
-	ChunkSizeBytes int64
-	// The maximum number of times to retry on error.
-	// Defaults to 3.
-	MaxRetries int
-}
-
-// Valid validates the SwiftConfig configuration.
-func (s SwiftConfig) Valid() bool {
-	user := s.UserName != "" || os.Getenv("OS_USERNAME") != ""
-	password := s.Password != "" || os.Getenv("OS_PASSWORD") != ""
-	authURL := s.AuthURL != "" || os.Getenv("OS_AUTH_URL") != ""
-	tenantName := s.TenantName != "" || os.Getenv("OS_TENANT_NAME") != "" || os.Getenv("OS_PROJECT_NAME") != ""
-	tenantID := s.TenantID != "" || os.Getenv("OS_TENANT_ID") != "" || os.Getenv("OS_PROJECT_ID") != ""
-	region := s.RegionName != "" || os.Getenv("OS_REGION_NAME") != ""
+// swiftVersionHeader holds the version ID of objects in containers
+// with object versioning enabled.
+const swiftVersionHeader = "X-Object-Version-Id"
 
-	valid := user && password && authURL && tenantName && tenantID && region
+// Limits on static large object segments.
+const (
+	swiftMinChunkSize = int64(10 * units.MB)
+	swiftMaxChunkSize = int64(5 * units.GB)
+	swiftMaxChunks    = 1000
+)
 
-	return !s.Disabled && valid
-}
+// swiftSegmentBuffer is the initial size of segment buffers, which grow
+// up to the chunk size as segments are read.
+const swiftSegmentBuffer = 1 << 20
 
 // Swift provides access to an sw object store.
 type Swift struct {
-	conn      *swift.Connection
-	chunkSize int64
+	conn         *swift.Connection
+	chunkSize    int64
+	targetChunks int
+	concurrency  int
+	hints        *retryAfterTransport
+	// Set when reading public containers without credentials.
+	anonymous bool
+	// Containers which have been made public-readable, see setACL.
+	public sync.Map
+}
+
+func init() {
+	Register("swift", Backend{
+		Name: "swift",
+		New: func(c Config) (Storage, error) {
+			return NewSwift(c.Swift)
+		},
+		Enabled:     func(c Config) bool { return c.Swift.Valid() },
+		ValidateURL: bucketValidator("swift", (&Swift{}).parse),
+	})
 }
 
 // NewSwift creates an Swift client instance, give an endpoint URL
@@ -72,6 +80,19 @@ func NewSwift(conf SwiftConfig) (*Swift, error) {
 		return nil, err
 	}
 
+	// Record Retry-After hints from throttled responses,
+	// on top of the transport shared by all backends.
+	hints := &retryAfterTransport{RoundTripper: sharedTransport}
+	conn.Transport = hints
+
+	if conf.Anonymous {
+		if conf.StorageURL != "" {
+			conn.StorageUrl = conf.StorageURL
+		}
+		conn.Auth = anonymousAuth{conn.StorageUrl}
+		conn.Transport = anonymousTransport{hints}
+	}
+
 	err = conn.Authenticate()
 	if err != nil {
 		return nil, err
@@ -80,13 +101,51 @@ func NewSwift(conf SwiftConfig) (*Swift, error) {
 	var chunkSize int64
 	if conf.ChunkSizeBytes < int64(100*units.MB) {
 		chunkSize = int64(500 * units.MB)
-	} else if conf.ChunkSizeBytes > int64(5*units.GB) {
-		chunkSize = int64(5 * units.GB)
+	} else if conf.ChunkSizeBytes > swiftMaxChunkSize {
+		chunkSize = swiftMaxChunkSize
 	} else {
 		chunkSize = conf.ChunkSizeBytes
 	}
 
-	return &Swift{conn, chunkSize}, nil
+	concurrency := conf.UploadConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	return &Swift{
+		conn:         conn,
+		chunkSize:    chunkSize,
+		targetChunks: conf.TargetChunkCount,
+		concurrency:  concurrency,
+		hints:        hints,
+		anonymous:    conf.Anonymous,
+	}, nil
+}
+
+// chunkSizeFor returns the chunk size to use for an object of the given size.
+// A size of zero means the size is unknown.
+func (sw *Swift) chunkSizeFor(size int64) int64 {
+	if size <= 0 || sw.targetChunks <= 0 {
+		return sw.chunkSize
+	}
+
+	chunk := (size + int64(sw.targetChunks) - 1) / int64(sw.targetChunks)
+	if chunk < swiftMinChunkSize {
+		chunk = swiftMinChunkSize
+	}
+	// Stay under the maximum number of chunks for huge objects.
+	if min := (size + swiftMaxChunks - 1) / swiftMaxChunks; chunk < min {
+		chunk = min
+	}
+	if chunk > swiftMaxChunkSize {
+		chunk = swiftMaxChunkSize
+	}
+	// Chunks are buffered in memory, so don't allocate more than needed
+	// for small objects.
+	if chunk > size {
+		chunk = size
+	}
+	return chunk
 }
 
 // Stat returns metadata about the given url, such as checksum.
@@ -96,35 +155,65 @@ func (sw *Swift) Stat(ctx context.Context, url string) (*Object, error) {
 		return nil, err
 	}
 
-	info, _, err := sw.conn.Object(u.bucket, u.path)
+	info, headers, err := sw.conn.Object(u.bucket, u.path)
 	if err != nil {
 		return nil, &swiftError{"getting object info", url, err}
 	}
-	return &Object{
+	obj := &Object{
 		URL:          url,
 		Name:         info.Name,
 		Size:         info.Bytes,
 		LastModified: info.LastModified,
 		ETag:         info.Hash,
-	}, nil
+		// Only set when object versioning is enabled on the container.
+		Version: headers[swiftVersionHeader],
+	}
+	setSwiftChecksum(obj, headers)
+	return obj, nil
+}
+
+// setSwiftChecksum sets the object's checksum from its ETag, which is the
+// MD5 of the content, except for large objects, where it's derived from
+// the segments' ETags instead. Object listings don't say which objects are
+// large, so only objects returned with headers have a checksum.
+func setSwiftChecksum(obj *Object, headers swift.Headers) {
+	if headers["X-Static-Large-Object"] != "" || headers["X-Object-Manifest"] != "" {
+		return
+	}
+	if obj.ETag != "" {
+		obj.Checksum = obj.ETag
+		obj.ChecksumType = ChecksumMD5
+	}
 }
 
 // List lists the objects at the given url.
-func (sw *Swift) List(ctx context.Context, url string) ([]*Object, error) {
+func (sw *Swift) List(ctx context.Context, url string, opts ListOptions) ([]*Object, error) {
 	u, err := sw.parse(url)
 	if err != nil {
 		return nil, err
 	}
 
-	objs, err := sw.conn.ObjectsAll(u.bucket, &swift.ObjectsOpts{
-		Prefix: u.path,
-	})
+	listOpts := &swift.ObjectsOpts{Prefix: u.path}
+	if !opts.Recursive {
+		listOpts.Prefix = dirPrefix(u.path)
+		listOpts.Delimiter = '/'
+	}
+
+	objs, err := sw.conn.ObjectsAll(u.bucket, listOpts)
 	if err != nil {
 		return nil, &swiftError{"listing objects by prefix", url, err}
 	}
 
 	var objects []*Object
 	for _, obj := range objs {
+		if obj.PseudoDirectory {
+			objects = append(objects, &Object{
+				URL:  SwiftProtocol + u.bucket + "/" + obj.Name,
+				Name: obj.Name,
+				Dir:  true,
+			})
+			continue
+		}
 		objects = append(objects, &Object{
 			URL:          SwiftProtocol + u.bucket + "/" + obj.Name,
 			Name:         obj.Name,
@@ -164,18 +253,126 @@ func (sw *Swift) Get(ctx context.Context, url string, dest io.Writer) (*Object,
 	return obj, nil
 }
 
-// Put copies an object (file) from the host to storage.
-func (sw *Swift) Put(ctx context.Context, url string, src io.Reader) (*Object, error) {
+// GetRange copies part of an object from storage to the host.
+func (sw *Swift) GetRange(ctx context.Context, url string, offset, length int64, dest io.Writer) error {
+	u, err := sw.parse(url)
+	if err != nil {
+		return err
+	}
 
+	headers := swift.Headers{"Range": rangeHeader(offset, length)}
+	f, _, err := sw.conn.ObjectOpen(u.bucket, u.path, false, headers)
+	if err != nil {
+		return &swiftError{"initiating download", url, err}
+	}
+	defer f.Close()
+
+	_, copyErr := io.Copy(dest, ContextReader(ctx, f))
+	if copyErr != nil {
+		return &swiftError{"copying file", url, copyErr}
+	}
+	return nil
+}
+
+// GetVersion copies a specific version of an object from storage to the host.
+// The container must have object versioning enabled.
+func (sw *Swift) GetVersion(ctx context.Context, url, version string, dest io.Writer) (*Object, error) {
 	u, err := sw.parse(url)
 	if err != nil {
 		return nil, err
 	}
 
-	writer, err := sw.conn.StaticLargeObjectCreate(&swift.LargeObjectOpts{
+	resp, headers, err := sw.conn.Call(sw.conn.StorageUrl, swift.RequestOpts{
 		Container:  u.bucket,
 		ObjectName: u.path,
-		ChunkSize:  sw.chunkSize,
+		Operation:  "GET",
+		Parameters: urllib.Values{"version-id": {version}},
+		OnReAuth: func() (string, error) {
+			return sw.conn.StorageUrl, nil
+		},
+	})
+	if err != nil {
+		return nil, &swiftError{"initiating download of version " + version, url, err}
+	}
+	defer resp.Body.Close()
+
+	_, copyErr := io.Copy(dest, ContextReader(ctx, resp.Body))
+	if copyErr != nil {
+		return nil, &swiftError{"copying file", url, copyErr}
+	}
+
+	modtime, _ := time.Parse(http.TimeFormat, headers["Last-Modified"])
+	obj := &Object{
+		URL:          url,
+		Name:         u.path,
+		Size:         resp.ContentLength,
+		LastModified: modtime,
+		ETag:         strings.Trim(headers["Etag"], `"`),
+		Version:      headers[swiftVersionHeader],
+	}
+	setSwiftChecksum(obj, headers)
+	return obj, nil
+}
+
+// Put copies an object (file) from the host to storage.
+func (sw *Swift) Put(ctx context.Context, url string, src io.Reader, opts PutOptions) (*Object, error) {
+
+	u, err := sw.parse(url)
+	if err != nil {
+		return nil, err
+	}
+
+	err = sw.setACL(u.bucket, opts.ACL)
+	if err != nil {
+		return nil, &swiftError{"setting container ACL", url, err}
+	}
+
+	headers := swift.Headers{}
+	if opts.IfNotExists {
+		// Check first, to avoid uploading segments which would be rejected
+		// when the manifest is written. The If-None-Match header guards
+		// against a concurrent upload winning the race.
+		_, _, err := sw.conn.Object(u.bucket, u.path)
+		if err == nil {
+			return nil, &ErrObjectExists{"swift", url}
+		}
+		if err != swift.ObjectNotFound {
+			return nil, &swiftError{"getting object info", url, err}
+		}
+		headers["If-None-Match"] = "*"
+	}
+
+	// Objects which fit in a single chunk are uploaded as regular objects,
+	// so that the upload is a single request, and the response describes it.
+	if opts.Size > 0 && sw.chunkSizeFor(opts.Size) >= opts.Size {
+		rd := &countingReader{r: ContextReader(ctx, src)}
+		h, err := sw.conn.ObjectPut(u.bucket, u.path, rd, true, "", opts.ContentType, headers)
+		if e, ok := err.(*swift.Error); ok && e.StatusCode == http.StatusPreconditionFailed {
+			return nil, &ErrObjectExists{"swift", url}
+		}
+		if err != nil {
+			return nil, &swiftError{"uploading object", url, err}
+		}
+		return sw.putResult(ctx, url, u, rd.n, h)
+	}
+
+	if sw.concurrency > 1 {
+		h, size, err := sw.putSegments(ctx, u, src, opts, headers)
+		if e, ok := err.(*swift.Error); ok && e.StatusCode == http.StatusPreconditionFailed {
+			return nil, &ErrObjectExists{"swift", url}
+		}
+		if err != nil {
+			return nil, &swiftError{"uploading large object", url, err}
+		}
+		return sw.putResult(ctx, url, u, size, h)
+	}
+
+	writer, err := sw.conn.StaticLargeObjectCreate(&swift.LargeObjectOpts{
+		Container:   u.bucket,
+		ObjectName:  u.path,
+		ChunkSize:   sw.chunkSizeFor(opts.Size),
+		ContentType: opts.ContentType,
+		Headers:     headers,
 	})
 	if err != nil {
 		return nil, &swiftError{"creating object", url, err}
@@ -186,13 +383,377 @@ func (sw *Swift) Put(ctx context.Context, url string, src io.Reader) (*Object, e
 	if copyErr != nil {
 		return nil, &swiftError{"copying file", url, copyErr}
 	}
+	if e, ok := closeErr.(*swift.Error); ok && e.StatusCode == http.StatusPreconditionFailed {
+		return nil, &ErrObjectExists{"swift", url}
+	}
 	if closeErr != nil {
 		return nil, &swiftError{"closing upload", url, closeErr}
 	}
 
+	// The swift library doesn't expose the response to the manifest upload.
 	return sw.Stat(ctx, url)
 }
 
+// putResult describes an uploaded object using the headers of the response
+// to the upload, falling back to Stat if they're incomplete.
+func (sw *Swift) putResult(ctx context.Context, url string, u *urlparts, size int64, headers swift.Headers) (*Object, error) {
+	modtime, err := time.Parse(http.TimeFormat, headers["Last-Modified"])
+	if err != nil {
+		return sw.Stat(ctx, url)
+	}
+	obj := &Object{
+		URL:          url,
+		Name:         u.path,
+		Size:         size,
+		LastModified: modtime,
+		ETag:         strings.Trim(headers["Etag"], `"`),
+		Version:      headers[swiftVersionHeader],
+	}
+	setSwiftChecksum(obj, headers)
+	return obj, nil
+}
+
+// Delete deletes the object at the given url, including the segments of large objects.
+func (sw *Swift) Delete(ctx context.Context, url string) error {
+	u, err := sw.parse(url)
+	if err != nil {
+		return err
+	}
+
+	err = sw.conn.LargeObjectDelete(u.bucket, u.path)
+	if err != nil {
+		return &swiftError{"deleting object", url, err}
+	}
+	return nil
+}
+
+// Move moves an object to a new url. Large objects are moved by rewriting
+// their manifest, so their segments are not copied.
+func (sw *Swift) Move(ctx context.Context, src, dst string) error {
+	su, err := sw.parse(src)
+	if err != nil {
+		return err
+	}
+	du, err := sw.parse(dst)
+	if err != nil {
+		return err
+	}
+
+	err = sw.conn.StaticLargeObjectMove(su.bucket, su.path, du.bucket, du.path)
+	if err == swift.NotLargeObject {
+		err = sw.conn.ObjectMove(su.bucket, su.path, du.bucket, du.path)
+	}
+	if err != nil {
+		return &swiftError{"moving object to " + dst, src, err}
+	}
+	return nil
+}
+
+// Publish makes the object's container publicly readable,
+// and returns the object's URL on the storage server.
+func (sw *Swift) Publish(ctx context.Context, url string) (string, error) {
+	u, err := sw.parse(url)
+	if err != nil {
+		return "", err
+	}
+	err = sw.setACL(u.bucket, ACLPublicRead)
+	if err != nil {
+		return "", &swiftError{"setting container ACL", url, err}
+	}
+	return sw.conn.StorageUrl + "/" + u.bucket + "/" + escapePath(u.path), nil
+}
+
+// setACL applies a canned ACL. Swift access controls are set on containers,
+// not objects, so "public-read" makes the whole container readable, and
+// "private" leaves the container's ACL as it is.
+func (sw *Swift) setACL(container, acl string) error {
+	switch acl {
+	case "", ACLPrivate:
+		return nil
+	case ACLPublicRead:
+	default:
+		return ValidateACL(acl)
+	}
+
+	if _, done := sw.public.Load(container); done {
+		return nil
+	}
+	err := sw.conn.ContainerUpdate(container, swift.Headers{
+		"X-Container-Read": ".r:*",
+	})
+	if err != nil {
+		return err
+	}
+	sw.public.Store(container, true)
+	return nil
+}
+
+// swiftSegment describes a segment in a static large object manifest.
+type swiftSegment struct {
+	Path string `json:"path"`
+	Etag string `json:"etag"`
+	Size int64  `json:"size_bytes"`
+}
+
+// putSegments uploads a static large object, uploading up to sw.concurrency
+// segments in parallel, then writes the manifest which joins them. It returns
+// the headers of the response to the final request, and the object's size.
+//
+// Segments are stored in the "<container>_segments" container, the same
+// place the swift library puts them, so large objects created either way
+// are indistinguishable.
+func (sw *Swift) putSegments(ctx context.Context, u *urlparts, src io.Reader, opts PutOptions, headers swift.Headers) (swift.Headers, int64, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	segContainer := u.bucket + "_segments"
+	err := sw.conn.ContainerCreate(segContainer, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return nil, 0, err
+	}
+	prefix := fmt.Sprintf("segments/%s/%x", u.path, random)
+	chunkSize := sw.chunkSizeFor(opts.Size)
+
+	// Reuse chunk buffers; this also bounds the number of segments in flight.
+	// Buffers start empty and grow as segments are read, see readSegment.
+	buffers := make(chan []byte, sw.concurrency)
+	for i := 0; i < sw.concurrency; i++ {
+		buffers <- nil
+	}
+
+	var (
+		mtx      sync.Mutex
+		wg       sync.WaitGroup
+		segments []swiftSegment
+		firstErr error
+	)
+	fail := func(err error) {
+		mtx.Lock()
+		if firstErr == nil {
+			firstErr = err
+		}
+		mtx.Unlock()
+		cancel()
+	}
+
+	r := ContextReader(ctx, src)
+	for i := 0; ; i++ {
+		var buf []byte
+		select {
+		case buf = <-buffers:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		buf, err := readSegment(r, buf, chunkSize)
+		if err == io.EOF {
+			buffers <- buf
+			break
+		}
+		if err != nil {
+			fail(err)
+			break
+		}
+		n := len(buf)
+
+		name := fmt.Sprintf("%s/%016d", prefix, i+1)
+		mtx.Lock()
+		segments = append(segments, swiftSegment{Path: segContainer + "/" + name, Size: int64(n)})
+		mtx.Unlock()
+
+		wg.Add(1)
+		go func(i int, chunk []byte) {
+			defer wg.Done()
+			defer func() { buffers <- chunk }()
+
+			h, err := sw.conn.ObjectPut(segContainer, name, bytes.NewReader(chunk), true, "", "", nil)
+			if err != nil {
+				fail(err)
+				return
+			}
+			mtx.Lock()
+			segments[i].Etag = strings.Trim(h["Etag"], `"`)
+			mtx.Unlock()
+		}(i, buf)
+
+		if int64(n) < chunkSize {
+			// Short read means the end of the source.
+			break
+		}
+	}
+	wg.Wait()
+
+	if firstErr == nil {
+		firstErr = ctx.Err()
+	}
+	if firstErr == nil && len(segments) == 0 {
+		// Static large objects need at least one segment,
+		// so store empty objects as regular objects.
+		h, err := sw.conn.ObjectPut(u.bucket, u.path, bytes.NewReader(nil), false, "", opts.ContentType, headers)
+		return h, 0, err
+	}
+
+	var h swift.Headers
+	if firstErr == nil {
+		h, firstErr = sw.putManifest(u, segments, opts, headers)
+	}
+	if firstErr != nil {
+		// Clean up segments which won't be referenced by a manifest.
+		for _, seg := range segments {
+			sw.conn.ObjectDelete(segContainer, strings.TrimPrefix(seg.Path, segContainer+"/"))
+		}
+		return nil, 0, firstErr
+	}
+
+	var size int64
+	for _, seg := range segments {
+		size += seg.Size
+	}
+	// The response doesn't say the object is a large object, as Stat would.
+	h["X-Static-Large-Object"] = "True"
+	return h, size, nil
+}
+
+// readSegment reads the next segment, of up to "size" bytes, from "r" into
+// "buf", reusing its capacity. The buffer grows as data arrives, rather than
+// by a whole chunk up front, so that small objects of unknown size don't
+// take a chunk of memory. It returns io.EOF if "r" has no more data.
+func readSegment(r io.Reader, buf []byte, size int64) ([]byte, error) {
+	buf = buf[:0]
+	for int64(len(buf)) < size {
+		if len(buf) == cap(buf) {
+			n := int64(2 * cap(buf))
+			if n < swiftSegmentBuffer {
+				n = swiftSegmentBuffer
+			}
+			if n > size {
+				n = size
+			}
+			grown := make([]byte, len(buf), n)
+			copy(grown, buf)
+			buf = grown
+		}
+		n, err := r.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		if err == io.EOF {
+			if len(buf) == 0 {
+				return buf, io.EOF
+			}
+			return buf, nil
+		}
+		if err != nil {
+			return buf, err
+		}
+	}
+	return buf, nil
+}
+
+// putManifest writes a static large object manifest joining the given segments.
+func (sw *Swift) putManifest(u *urlparts, segments []swiftSegment, opts PutOptions, headers swift.Headers) (swift.Headers, error) {
+	manifest, err := json.Marshal(segments)
+	if err != nil {
+		return nil, err
+	}
+
+	h := swift.Headers{}
+	for k, v := range headers {
+		h[k] = v
+	}
+	if opts.ContentType != "" {
+		h["Content-Type"] = opts.ContentType
+	}
+
+	_, resp, err := sw.conn.Call(sw.conn.StorageUrl, swift.RequestOpts{
+		Container:  u.bucket,
+		ObjectName: u.path,
+		Operation:  "PUT",
+		Parameters: urllib.Values{"multipart-manifest": {"put"}},
+		Headers:    h,
+		Body:       bytes.NewReader(manifest),
+		NoResponse: true,
+		OnReAuth: func() (string, error) {
+			return sw.conn.StorageUrl, nil
+		},
+	})
+	return resp, err
+}
+
+// Reauthenticate drops the connection's token and signs in again, e.g.
+// when the token expires in the middle of a long session.
+func (sw *Swift) Reauthenticate(ctx context.Context) error {
+	sw.conn.UnAuthenticate()
+	if err := sw.conn.Authenticate(); err != nil {
+		return fmt.Errorf("swift: re-authenticating: %s", err)
+	}
+	return nil
+}
+
+// RetryAfter returns how much longer the server asked clients to wait,
+// according to the Retry-After header of the latest throttled response.
+func (sw *Swift) RetryAfter() time.Duration {
+	return sw.hints.wait()
+}
+
+// UnsupportedOperations describes which operations are not supported
+// for the given URL.
+func (sw *Swift) UnsupportedOperations(url string) UnsupportedOperations {
+	u, err := sw.parse(url)
+	if err != nil {
+		return AllUnsupported(err)
+	}
+	if u.bucket == "" {
+		return AllUnsupported(&ErrInvalidURL{"swift"})
+	}
+	if sw.anonymous {
+		reason := "anonymous access is configured"
+		return UnsupportedOperations{
+			Put:    &ErrUnsupportedOperation{"swift", "put", reason},
+			Delete: &ErrUnsupportedOperation{"swift", "delete", reason},
+			Copy:   &ErrUnsupportedOperation{"swift", "copy", reason},
+			ACL:    &ErrUnsupportedOperation{"swift", "acl", reason},
+		}
+	}
+	return UnsupportedOperations{}
+}
+
+// anonymousToken stands in for a token when reading public containers,
+// since the swift library requires one. It's removed from requests by
+// anonymousTransport.
+const anonymousToken = "anonymous"
+
+// anonymousAuth is a swift.Authenticator which doesn't sign in, for reading
+// public containers.
+type anonymousAuth struct {
+	storageURL string
+}
+
+func (a anonymousAuth) Request(*swift.Connection) (*http.Request, error) { return nil, nil }
+func (a anonymousAuth) Response(*http.Response) error                    { return nil }
+func (a anonymousAuth) StorageUrl(internal bool) string                  { return a.storageURL }
+func (a anonymousAuth) Token() string                                    { return anonymousToken }
+func (a anonymousAuth) CdnUrl() string                                   { return "" }
+
+// anonymousTransport removes the placeholder token from requests.
+type anonymousTransport struct {
+	http.RoundTripper
+}
+
+func (t anonymousTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("X-Auth-Token") == anonymousToken {
+		// A RoundTripper must not modify the request it's given.
+		req = req.Clone(req.Context())
+		req.Header.Del("X-Auth-Token")
+	}
+	return t.RoundTripper.RoundTrip(req)
+}
+
 // Join joins the given URL with the given subpath.
 func (sw *Swift) Join(url, path string) (string, error) {
 	return strings.TrimSuffix(url, "/") + "/" + path, nil
@@ -228,3 +789,52 @@ type swiftError struct {
 func (s *swiftError) Error() string {
 	return fmt.Sprintf("swift: %s for URL %q: %v", s.msg, s.url, s.err)
 }
+
+// Kind classifies the error. See ErrorKind.
+func (s *swiftError) Kind() ErrorKind {
+	if e, ok := s.err.(*swift.Error); ok && e.StatusCode != 0 {
+		// The swift library re-authenticates and retries once on a 401,
+		// so an expired token shows up here as AuthError.
+		return classifyHTTPStatus(e.StatusCode)
+	}
+	return classifyNetError(s.err)
+}
+
+// retryAfterTransport records the Retry-After hints of throttled responses.
+// The swift library doesn't return response headers with its errors,
+// so the hint is recorded here and applies to the whole connection.
+type retryAfterTransport struct {
+	http.RoundTripper
+	mtx   sync.Mutex
+	until time.Time
+}
+
+func (t *retryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable, 498:
+		if d := parseRetryAfter(resp.Header); d > 0 {
+			until := time.Now().Add(d)
+			t.mtx.Lock()
+			if until.After(t.until) {
+				t.until = until
+			}
+			t.mtx.Unlock()
+		}
+	}
+	return resp, nil
+}
+
+// wait returns the time left until the latest Retry-After hint expires.
+func (t *retryAfterTransport) wait() time.Duration {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if d := time.Until(t.until); d > 0 {
+		return d
+	}
+	return 0
+}
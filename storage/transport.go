@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HTTPConfig configures the requests of all HTTP-based backends, so that
+// storage admins can attribute traffic to teams.
+type HTTPConfig struct {
+	// Appended to the User-Agent of each request, e.g. "team-genomics".
+	UserAgent string
+	// Extra headers sent with each request, e.g. an "x-goog-user-project"
+	// header which bills requests to a Google Cloud project.
+	Headers []HTTPHeader
+}
+
+// HTTPHeader is a header sent with requests.
+type HTTPHeader struct {
+	Name  string
+	Value string
+	// Only send the header to this host, e.g. "storage.googleapis.com",
+	// or its subdomains. Empty means every host.
+	Host string
+}
+
+// UserAgent identifies tanker in the User-Agent of each request, after the
+// storage library's own, e.g. "tanker/1.2.0". Set by the tanker command.
+var UserAgent = "tanker"
+
+// httpConf is the HTTPConfig in effect, set by NewStorage.
+var httpConf struct {
+	sync.RWMutex
+	HTTPConfig
+}
+
+func setHTTPConfig(conf HTTPConfig) {
+	httpConf.Lock()
+	defer httpConf.Unlock()
+	httpConf.HTTPConfig = conf
+}
+
+// taggingTransport adds the User-Agent and headers of the HTTPConfig
+// to each request.
+type taggingTransport struct {
+	http.RoundTripper
+}
+
+func (t *taggingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// A RoundTripper must not modify the request it's given.
+	req = req.Clone(req.Context())
+	tagRequest(req)
+	return t.RoundTripper.RoundTrip(req)
+}
+
+// tagRequest adds the User-Agent and headers of the HTTPConfig to "req".
+func tagRequest(req *http.Request) {
+	httpConf.RLock()
+	conf := httpConf.HTTPConfig
+	httpConf.RUnlock()
+
+	ua := strings.TrimSpace(req.Header.Get("User-Agent") + " " + UserAgent + " " + conf.UserAgent)
+	req.Header.Set("User-Agent", ua)
+	for _, h := range conf.Headers {
+		if h.Host == "" || matchHost(req.URL.Hostname(), h.Host) {
+			req.Header.Set(h.Name, h.Value)
+		}
+	}
+}
+
+// matchHost returns true if "host" is "pattern" or one of its subdomains.
+func matchHost(host, pattern string) bool {
+	host, pattern = strings.ToLower(host), strings.ToLower(pattern)
+	return host == pattern || strings.HasSuffix(host, "."+pattern)
+}
+
+// sharedTransport is used by all HTTP-based backends, so that connections
+// are pooled and kept alive across all object operations, rather than each
+// backend instance dialing its own. This matters most for workloads with
+// many small objects, where connection setup dominates.
+var sharedTransport = &taggingTransport{pooledTransport}
+
+var pooledTransport = &http.Transport{
+	Proxy:                 http.ProxyFromEnvironment,
+	DialContext:           dialContext,
+	ForceAttemptHTTP2:     true,
+	MaxIdleConns:          1024,
+	MaxIdleConnsPerHost:   512,
+	IdleConnTimeout:       90 * time.Second,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ExpectContinueTimeout: 5 * time.Second,
+}
+
+// sharedClient is an http.Client using sharedTransport.
+var sharedClient = &http.Client{Transport: sharedTransport}
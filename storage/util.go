@@ -1,10 +1,16 @@
 package storage
 
 import (
+	"bufio"
 	"context"
 	"io"
+	"mime"
+	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -42,6 +48,60 @@ func (r reader) Read(p []byte) (n int, err error) {
 	return
 }
 
+// DetectContentType determines the Content-Type of an object, first by the
+// extension of "name", then by sniffing the first 512 bytes of "r".
+//
+// Since sniffing consumes data from "r", the returned reader must be used
+// in place of "r" to read the full content.
+func DetectContentType(name string, r io.Reader) (string, io.Reader) {
+	if ct := mime.TypeByExtension(filepath.Ext(name)); ct != "" {
+		return ct, r
+	}
+
+	br := bufio.NewReaderSize(r, 512)
+	// Peek returns an error when there are fewer than 512 bytes,
+	// which is fine; sniff whatever is available.
+	head, _ := br.Peek(512)
+	return http.DetectContentType(head), br
+}
+
+// parseRetryAfter parses the Retry-After header of a response, which is
+// either a number of seconds or an HTTP date. Returns zero if the header
+// is missing or invalid.
+func parseRetryAfter(h http.Header) time.Duration {
+	v := strings.TrimSpace(h.Get("Retry-After"))
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// escapePath escapes an object path for use in an HTTP URL,
+// leaving the "/" separators intact.
+func escapePath(p string) string {
+	return (&url.URL{Path: p}).EscapedPath()
+}
+
+// dirPrefix returns the object prefix which lists the children of
+// the directory at path p, i.e. p with a trailing "/".
+func dirPrefix(p string) string {
+	if p == "" || strings.HasSuffix(p, "/") {
+		return p
+	}
+	return p + "/"
+}
+
 // FileSize returns the file size in bytes, or return 0 if there's an error calling os.Stat().
 func FileSize(path string) int64 {
 	st, err := os.Stat(path)
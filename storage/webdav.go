@@ -0,0 +1,526 @@
+//go:build !nowebdav
+// +build !nowebdav
+
+package storage
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	urllib "net/url"
+	"os"
+	pathlib "path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	b := Backend{
+		Name: "webdav",
+		New: func(c Config) (Storage, error) {
+			return NewWebDAV(c.WebDAV)
+		},
+		Enabled: func(c Config) bool { return c.WebDAV.Valid() },
+		ValidateURL: func(url string) error {
+			_, err := parseWebDAV(url)
+			return err
+		},
+	}
+	Register("dav", b)
+	Register("davs", b)
+}
+
+// WebDAV provides access to WebDAV servers, e.g. Nextcloud and ownCloud.
+// "dav://host/path" is "http://host/path", and "davs://" is HTTPS.
+type WebDAV struct {
+	conf  WebDAVConfig
+	token string
+	// Collections which are known to exist, by HTTP URL, so that uploads
+	// to the same directory create it once.
+	dirs sync.Map
+}
+
+// NewWebDAV creates a WebDAV client from the given config.
+func NewWebDAV(conf WebDAVConfig) (*WebDAV, error) {
+	token := conf.Token
+	if token == "" {
+		token = os.Getenv("WEBDAV_TOKEN")
+	}
+	if conf.Password == "" {
+		conf.Password = os.Getenv("WEBDAV_PASSWORD")
+	}
+	return &WebDAV{conf: conf, token: token}, nil
+}
+
+// davURL is a parsed WebDAV URL.
+type davURL struct {
+	// The URL of the resource over HTTP(S), without credentials.
+	http *urllib.URL
+	user *urllib.Userinfo
+}
+
+func parseWebDAV(rawurl string) (*davURL, error) {
+	u, err := urllib.Parse(rawurl)
+	if err != nil {
+		return nil, &webdavError{"parsing URL", rawurl, 0, err}
+	}
+	switch u.Scheme {
+	case "dav":
+		u.Scheme = "http"
+	case "davs":
+		u.Scheme = "https"
+	default:
+		return nil, &ErrUnsupportedProtocol{"webdav"}
+	}
+	if u.Host == "" {
+		return nil, &ErrInvalidURL{"webdav"}
+	}
+	d := &davURL{http: u, user: u.User}
+	u.User = nil
+	return d, nil
+}
+
+// authorize adds the credentials for "u" to a request: the bearer token,
+// or else the login in the URL, the .netrc file, or the config, like curl.
+func (b *WebDAV) authorize(req *http.Request, u *davURL) {
+	if b.token != "" {
+		req.Header.Set("Authorization", "Bearer "+b.token)
+		return
+	}
+
+	var user, pass string
+	var ok bool
+	if u.user != nil {
+		user = u.user.Username()
+		pass, ok = u.user.Password()
+	}
+	if !ok && !b.conf.IgnoreNetrc {
+		var login string
+		login, pass, ok = netrcLogin(b.conf.NetrcFile, u.http.Hostname(), user)
+		if ok && user == "" {
+			user = login
+		}
+	}
+	if !ok && (user == "" || user == b.conf.User) {
+		user, pass, ok = b.conf.User, b.conf.Password, b.conf.User != ""
+	}
+	if ok || user != "" {
+		req.SetBasicAuth(user, pass)
+	}
+}
+
+// request sends a request for the resource at "url". Responses other than
+// 2xx are returned as errors; 404 as ErrNotFound.
+func (b *WebDAV) request(ctx context.Context, method, url string, body io.Reader, header http.Header) (*http.Response, error) {
+	u, err := parseWebDAV(url)
+	if err != nil {
+		return nil, err
+	}
+	return b.requestHTTP(ctx, method, url, u, u.http.String(), body, header)
+}
+
+// requestHTTP sends a request to "target", an HTTP URL on the server of
+// "u", reporting errors for the storage URL "url".
+func (b *WebDAV) requestHTTP(ctx context.Context, method, url string, u *davURL, target string, body io.Reader, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, target, body)
+	if err != nil {
+		return nil, &webdavError{"creating request", url, 0, err}
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if n := header.Get("Content-Length"); n != "" {
+		req.ContentLength, _ = strconv.ParseInt(n, 10, 64)
+		req.Header.Del("Content-Length")
+	}
+	b.authorize(req, u)
+
+	resp, err := sharedClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, &webdavError{method + " request", url, 0, err}
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, &ErrNotFound{"webdav", url}
+	}
+	if resp.StatusCode/100 != 2 {
+		resp.Body.Close()
+		return nil, &webdavError{method + " request", url, resp.StatusCode, nil}
+	}
+	return resp, nil
+}
+
+// propfindBody requests the properties which describe an object.
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:">
+  <d:prop>
+    <d:resourcetype/>
+    <d:getcontentlength/>
+    <d:getlastmodified/>
+    <d:getetag/>
+  </d:prop>
+</d:propfind>`
+
+type davMultistatus struct {
+	Responses []davResponse `xml:"DAV: response"`
+}
+
+type davResponse struct {
+	Href      string        `xml:"DAV: href"`
+	Propstats []davPropstat `xml:"DAV: propstat"`
+}
+
+type davPropstat struct {
+	Status string `xml:"DAV: status"`
+	Prop   struct {
+		ResourceType struct {
+			Collection *struct{} `xml:"DAV: collection"`
+		} `xml:"DAV: resourcetype"`
+		ContentLength string `xml:"DAV: getcontentlength"`
+		LastModified  string `xml:"DAV: getlastmodified"`
+		ETag          string `xml:"DAV: getetag"`
+	} `xml:"DAV: prop"`
+}
+
+// davResource is a resource described by a PROPFIND response.
+type davResource struct {
+	// Unescaped path on the server.
+	path         string
+	dir          bool
+	size         int64
+	lastModified time.Time
+	etag         string
+}
+
+// propfind lists the resource at "url", and its children if "depth" is 1.
+func (b *WebDAV) propfind(ctx context.Context, url string, depth int) ([]davResource, error) {
+	header := http.Header{
+		"Depth":        {strconv.Itoa(depth)},
+		"Content-Type": {"application/xml; charset=utf-8"},
+	}
+	resp, err := b.request(ctx, "PROPFIND", url, strings.NewReader(propfindBody), header)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var ms davMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, &webdavError{"parsing PROPFIND response", url, 0, err}
+	}
+
+	var resources []davResource
+	for _, r := range ms.Responses {
+		href, err := urllib.Parse(r.Href)
+		if err != nil {
+			return nil, &webdavError{"parsing PROPFIND response", url, 0, err}
+		}
+		res := davResource{path: href.Path}
+		for _, ps := range r.Propstats {
+			// Properties the server doesn't have are reported with a 404.
+			if !strings.Contains(ps.Status, " 200") {
+				continue
+			}
+			p := ps.Prop
+			res.dir = p.ResourceType.Collection != nil
+			res.size, _ = strconv.ParseInt(p.ContentLength, 10, 64)
+			res.lastModified, _ = time.Parse(http.TimeFormat, p.LastModified)
+			res.etag = strings.Trim(p.ETag, `"`)
+		}
+		resources = append(resources, res)
+	}
+	return resources, nil
+}
+
+// object returns the object at "url" described by "r".
+func (r davResource) object(url string) *Object {
+	return &Object{
+		URL:          url,
+		Name:         strings.TrimPrefix(r.path, "/"),
+		ETag:         r.etag,
+		LastModified: r.lastModified,
+		Size:         r.size,
+	}
+}
+
+// Stat returns information about the object at the given storage URL.
+func (b *WebDAV) Stat(ctx context.Context, url string) (*Object, error) {
+	resources, err := b.propfind(ctx, url, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(resources) == 0 {
+		return nil, &webdavError{"empty PROPFIND response", url, 0, nil}
+	}
+	if resources[0].dir {
+		return nil, fmt.Errorf("webdav: stat on a collection: %s", url)
+	}
+	return resources[0].object(url), nil
+}
+
+// List lists the objects under the given URL. Servers often refuse
+// PROPFIND with infinite depth, so collections are listed one at a time.
+func (b *WebDAV) List(ctx context.Context, url string, opts ListOptions) ([]*Object, error) {
+	resources, err := b.propfind(ctx, url, 1)
+	if KindOf(err) == NotFoundError {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	u, err := parseWebDAV(url)
+	if err != nil {
+		return nil, err
+	}
+
+	var objects []*Object
+	self := strings.TrimSuffix(u.http.Path, "/")
+	for _, r := range resources {
+		p := strings.TrimSuffix(r.path, "/")
+		if p == self {
+			if !r.dir {
+				// Special case where the user called List on a regular file.
+				return []*Object{r.object(url)}, nil
+			}
+			continue
+		}
+
+		joined := strings.TrimSuffix(url, "/") + "/" + pathlib.Base(p)
+		switch {
+		case r.dir && opts.Recursive:
+			sub, err := b.List(ctx, joined, opts)
+			if err != nil {
+				return nil, err
+			}
+			objects = append(objects, sub...)
+		case r.dir:
+			objects = append(objects, &Object{
+				URL:  joined + "/",
+				Name: strings.TrimPrefix(p, "/") + "/",
+				Dir:  true,
+			})
+		default:
+			objects = append(objects, r.object(joined))
+		}
+	}
+	return objects, nil
+}
+
+// Get copies an object from the server to "dest".
+func (b *WebDAV) Get(ctx context.Context, url string, dest io.Writer) (*Object, error) {
+	resp, err := b.request(ctx, "GET", url, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	u, _ := parseWebDAV(url)
+	modtime, _ := time.Parse(http.TimeFormat, resp.Header.Get("Last-Modified"))
+	obj := &Object{
+		URL:          url,
+		Name:         strings.TrimPrefix(u.http.Path, "/"),
+		ETag:         strings.Trim(resp.Header.Get("Etag"), `"`),
+		LastModified: modtime,
+		Size:         resp.ContentLength,
+	}
+
+	_, copyErr := io.Copy(dest, ContextReader(ctx, resp.Body))
+	if copyErr != nil {
+		return nil, &webdavError{"copying file", url, 0, copyErr}
+	}
+	return obj, nil
+}
+
+// GetRange copies part of an object from the server to "dest".
+func (b *WebDAV) GetRange(ctx context.Context, url string, offset, length int64, dest io.Writer) error {
+	resp, err := b.request(ctx, "GET", url, nil, http.Header{"Range": {rangeHeader(offset, length)}})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return &webdavError{"server ignored range request", url, resp.StatusCode, nil}
+	}
+	_, copyErr := io.Copy(dest, ContextReader(ctx, resp.Body))
+	if copyErr != nil {
+		return &webdavError{"copying file", url, 0, copyErr}
+	}
+	return nil
+}
+
+// Put uploads an object, creating its parent collections with MKCOL as
+// needed. PutOptions.IfNotExists is sent as "If-None-Match: *".
+func (b *WebDAV) Put(ctx context.Context, url string, src io.Reader, opts PutOptions) (*Object, error) {
+	if opts.ACL != "" {
+		return nil, &ErrUnsupportedOperation{"webdav", "acl", "WebDAV has no access controls"}
+	}
+	u, err := parseWebDAV(url)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.mkcol(ctx, url, u, parentURL(u.http)); err != nil {
+		return nil, err
+	}
+
+	header := http.Header{}
+	if opts.ContentType != "" {
+		header.Set("Content-Type", opts.ContentType)
+	}
+	if opts.Size > 0 {
+		header.Set("Content-Length", strconv.FormatInt(opts.Size, 10))
+	}
+	if opts.IfNotExists {
+		// Not every server honors If-None-Match, so check first too.
+		_, err := b.Stat(ctx, url)
+		if err == nil {
+			return nil, &ErrObjectExists{"webdav", url}
+		}
+		if KindOf(err) != NotFoundError {
+			return nil, err
+		}
+		header.Set("If-None-Match", "*")
+	}
+
+	resp, err := b.request(ctx, "PUT", url, ContextReader(ctx, src), header)
+	if e, ok := err.(*webdavError); ok && e.code == http.StatusPreconditionFailed {
+		return nil, &ErrObjectExists{"webdav", url}
+	}
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return b.Stat(ctx, url)
+}
+
+// parentURL returns the URL of the collection containing "u".
+func parentURL(u *urllib.URL) *urllib.URL {
+	parent := *u
+	parent.Path = pathlib.Dir(strings.TrimSuffix(u.Path, "/")) + "/"
+	parent.RawPath = ""
+	return &parent
+}
+
+// mkcol creates the collection "dir" on the server of "u", and its
+// parents, unless they're known to exist. Parents are created only if
+// the server reports them missing, since the collections at the root of
+// the server, e.g. Nextcloud's "/remote.php", usually can't be created.
+func (b *WebDAV) mkcol(ctx context.Context, url string, u *davURL, dir *urllib.URL) error {
+	if dir.Path == "/" {
+		return nil
+	}
+	key := dir.String()
+	if _, ok := b.dirs.Load(key); ok {
+		return nil
+	}
+
+	resp, err := b.requestHTTP(ctx, "MKCOL", url, u, key, nil, nil)
+	if e, ok := err.(*webdavError); ok && e.code == http.StatusConflict {
+		// A parent is missing.
+		if err := b.mkcol(ctx, url, u, parentURL(dir)); err != nil {
+			return err
+		}
+		resp, err = b.requestHTTP(ctx, "MKCOL", url, u, key, nil, nil)
+	}
+	if e, ok := err.(*webdavError); ok && e.code == http.StatusMethodNotAllowed {
+		// The collection exists.
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	if resp != nil {
+		resp.Body.Close()
+	}
+	b.dirs.Store(key, true)
+	return nil
+}
+
+// Delete deletes an object from the server.
+func (b *WebDAV) Delete(ctx context.Context, url string) error {
+	resp, err := b.request(ctx, "DELETE", url, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Move renames an object on the server, replacing "dst" if it exists.
+// Both URLs must refer to the same server.
+func (b *WebDAV) Move(ctx context.Context, src, dst string) error {
+	su, err := parseWebDAV(src)
+	if err != nil {
+		return err
+	}
+	du, err := parseWebDAV(dst)
+	if err != nil {
+		return err
+	}
+	if su.http.Scheme != du.http.Scheme || su.http.Host != du.http.Host {
+		return fmt.Errorf("webdav: can't move objects between servers: %s to %s", src, dst)
+	}
+	if err := b.mkcol(ctx, dst, du, parentURL(du.http)); err != nil {
+		return err
+	}
+
+	header := http.Header{
+		"Destination": {du.http.String()},
+		"Overwrite":   {"T"},
+	}
+	resp, err := b.request(ctx, "MOVE", src, nil, header)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Join joins the given URL with the given subpath.
+func (b *WebDAV) Join(url, path string) (string, error) {
+	return strings.TrimSuffix(url, "/") + "/" + path, nil
+}
+
+// UnsupportedOperations describes which operations are not supported
+// for the given URL.
+func (b *WebDAV) UnsupportedOperations(url string) UnsupportedOperations {
+	if _, err := parseWebDAV(url); err != nil {
+		return AllUnsupported(err)
+	}
+	return UnsupportedOperations{
+		ACL: &ErrUnsupportedOperation{"webdav", "acl", "WebDAV has no access controls"},
+	}
+}
+
+type webdavError struct {
+	msg, url string
+	// HTTP status code of the server's response, if any.
+	code int
+	err  error
+}
+
+func (e *webdavError) Error() string {
+	if e.code != 0 {
+		return fmt.Sprintf("webdav: %s: %s: %d %s", e.msg, e.url, e.code, http.StatusText(e.code))
+	}
+	if e.err == nil {
+		return fmt.Sprintf("webdav: %s: %s", e.msg, e.url)
+	}
+	return fmt.Sprintf("webdav: %s: %s: %v", e.msg, e.url, e.err)
+}
+
+// Kind classifies the error. See ErrorKind.
+func (e *webdavError) Kind() ErrorKind {
+	switch e.code {
+	case 0:
+		return classifyNetError(e.err)
+	case http.StatusInsufficientStorage:
+		// The user's quota is exceeded, which retrying won't fix.
+		return PermissionError
+	}
+	return classifyHTTPStatus(e.code)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buchanae/tanker/storage"
+)
+
+// SyncConfig configures "tanker sync".
+type SyncConfig struct {
+	// Time between the start of one sync and the next.
+	Interval storage.Duration
+	// Number of times "git lfs pull" is retried in each sync.
+	Retries int
+}
+
+// syncStatus is written to ".git/tanker/sync.json" during and after each
+// sync, for monitoring, e.g. alerting when LastSuccess is too old.
+type syncStatus struct {
+	PID      int
+	Interval string
+	// Set while a sync is in progress.
+	Running     bool
+	LastStart   time.Time
+	LastFinish  time.Time
+	LastSuccess time.Time
+	// Error of the last sync, or empty if it succeeded.
+	LastError string
+	// Number of syncs which failed in a row.
+	Failures int
+	NextRun  time.Time
+}
+
+func syncStatusPath(t *Tanker) string {
+	return filepath.Join(t.Paths.Tanker, "sync.json")
+}
+
+// syncLoop syncs the repo every interval, until the process is stopped.
+// If "once" is set, it syncs once and returns the sync's error.
+func syncLoop(t *Tanker, conf SyncConfig, once bool, out io.Writer) error {
+	interval := time.Duration(conf.Interval)
+	if interval <= 0 && !once {
+		return fmt.Errorf("invalid sync interval %s", interval)
+	}
+
+	// The transfers of "git lfs pull" yield to the user's own.
+	runInBackground()
+
+	status := readSyncStatus(t)
+	status.PID = os.Getpid()
+	status.Interval = interval.String()
+
+	for {
+		next := time.Now().Add(interval)
+		if !once {
+			status.NextRun = next
+		}
+		err := syncOnce(t, conf, &status, out)
+		if once {
+			return err
+		}
+		if err != nil {
+			errorln("Error syncing", err)
+			fmt.Fprintln(out, "sync failed:", err)
+		}
+
+		fmt.Fprintln(out, "next sync at", next.Format(time.RFC3339))
+		time.Sleep(time.Until(next))
+	}
+}
+
+// syncOnce pulls new commits and the objects of the included files, then
+// pushes local commits, and their objects, if the branch is ahead of its
+// upstream. A lock prevents syncs from overlapping, e.g. a sync run by hand
+// while the daemon is syncing; the overlapping sync is skipped, and leaves
+// the status alone.
+func syncOnce(t *Tanker, conf SyncConfig, status *syncStatus, out io.Writer) error {
+	unlock, err := lockFileWait(syncStatusPath(t), true, 0)
+	if err != nil {
+		return fmt.Errorf("skipping sync, another sync is running: %s", err)
+	}
+	defer unlock()
+
+	status.Running = true
+	status.LastStart = time.Now()
+	writeSyncStatus(t, *status)
+
+	log.Println("Syncing")
+	err = syncRepo(t, conf, out)
+
+	status.Running = false
+	status.LastFinish = time.Now()
+	if err != nil {
+		status.LastError = err.Error()
+		status.Failures++
+	} else {
+		status.LastError = ""
+		status.LastSuccess = status.LastFinish
+		status.Failures = 0
+		fmt.Fprintln(out, "synced at", status.LastFinish.Format(time.RFC3339))
+	}
+	writeSyncStatus(t, *status)
+	return err
+}
+
+func syncRepo(t *Tanker, conf SyncConfig, out io.Writer) error {
+	// Objects are downloaded by the resumable pull below, not by the
+	// checkout, so that an interrupted sync doesn't start over.
+	cmd := exec.Command("git", "pull", "--ff-only")
+	cmd.Env = append(os.Environ(), "GIT_LFS_SKIP_SMUDGE=1")
+	cmd.Stdout = out
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("git pull failed: %s", err)
+	}
+
+	// With no paths, "git lfs pull" uses the include patterns set by
+	// "tanker include".
+	if err := pull(t, nil, conf.Retries, nil); err != nil {
+		return err
+	}
+
+	ahead, err := exec.Command("git", "rev-list", "--count", "@{upstream}..HEAD").Output()
+	if err != nil {
+		return fmt.Errorf("comparing with upstream: %s", err)
+	}
+	if n, _ := strconv.Atoi(strings.TrimSpace(string(ahead))); n == 0 {
+		return nil
+	}
+
+	log.Println("Pushing local commits")
+	cmd = exec.Command("git", "push")
+	cmd.Stdout = out
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("git push failed: %s", err)
+	}
+	return nil
+}
+
+// readSyncStatus reads the status of the last sync, if any.
+func readSyncStatus(t *Tanker) syncStatus {
+	var status syncStatus
+	b, err := ioutil.ReadFile(syncStatusPath(t))
+	if err == nil {
+		json.Unmarshal(b, &status)
+	}
+	return status
+}
+
+// writeSyncStatus writes the status file. It's only for monitoring,
+// so errors are logged and ignored.
+func writeSyncStatus(t *Tanker, status syncStatus) {
+	b, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		return
+	}
+	if err := writeFileAtomic(syncStatusPath(t), append(b, '\n'), 0644); err != nil {
+		errorln("Error writing sync status", err)
+	}
+}
+
+// printSyncStatus prints the status of the last sync.
+func printSyncStatus(t *Tanker, out io.Writer) error {
+	b, err := ioutil.ReadFile(syncStatusPath(t))
+	if os.IsNotExist(err) {
+		fmt.Fprintln(out, "never synced")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading sync status: %s", err)
+	}
+	_, err = out.Write(b)
+	return err
+}
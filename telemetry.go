@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/units"
+	"github.com/buchanae/tanker/buildinfo"
+	"github.com/buchanae/tanker/storage"
+)
+
+// Telemetry is off unless the user turns it on with "tanker telemetry on".
+// When on, each command reports one anonymous telemetryEvent to the
+// configured endpoint. Events never include URLs, paths, OIDs, or error
+// messages, only the kinds of things used, so maintainers can see which
+// backends and commands matter. DO_NOT_TRACK=1 or TANKER_TELEMETRY=off
+// turn it off regardless of the setting.
+
+// telemetrySettings is the user's telemetry setting, shared by all repos.
+type telemetrySettings struct {
+	Enabled  bool
+	Endpoint string
+	// Random ID of this installation, so that events from one user can be
+	// grouped without identifying them.
+	ID string
+}
+
+// telemetryEvent is the anonymous report of a single command.
+type telemetryEvent struct {
+	ID      string
+	Version string
+	OS      string
+	Arch    string
+	// e.g. "transfer" or "trash empty"
+	Command string
+	// URL scheme of the base URL, e.g. "gs".
+	Scheme string
+	// Number of objects transferred and their total size, in buckets,
+	// e.g. "10-99" and "100MiB-10GiB".
+	Objects string
+	Bytes   string
+	// Kind of the error the command failed with, e.g. "auth", or empty.
+	Error string
+}
+
+// telemetryTimeout bounds the time spent reporting an event, so that
+// an unreachable endpoint doesn't slow tanker down.
+const telemetryTimeout = 2 * time.Second
+
+// usage accumulates the statistics of this run.
+var usage struct {
+	mtx     sync.Mutex
+	scheme  string
+	objects int
+	bytes   int64
+}
+
+// countTransfer adds a transferred object to the usage statistics.
+func countTransfer(size int64) {
+	usage.mtx.Lock()
+	defer usage.mtx.Unlock()
+	usage.objects++
+	usage.bytes += size
+}
+
+func telemetryPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("finding user config dir: %s", err)
+	}
+	return filepath.Join(dir, "tanker", "telemetry.json"), nil
+}
+
+// loadTelemetry reads the user's telemetry setting. Telemetry is off
+// if it was never set.
+func loadTelemetry() (telemetrySettings, error) {
+	var s telemetrySettings
+	path, err := telemetryPath()
+	if err != nil {
+		return s, err
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return s, fmt.Errorf("reading telemetry setting: %s", err)
+	}
+	if err := json.Unmarshal(b, &s); err != nil {
+		return s, fmt.Errorf("parsing telemetry setting %s: %s", path, err)
+	}
+	return s, nil
+}
+
+func saveTelemetry(s telemetrySettings) error {
+	path, err := telemetryPath()
+	if err != nil {
+		return err
+	}
+	if err := storage.EnsurePath(path); err != nil {
+		return fmt.Errorf("creating config dir: %s", err)
+	}
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0644)
+}
+
+// setTelemetry turns telemetry on or off. Turning it on requires an
+// endpoint, given now or previously.
+func setTelemetry(on bool, endpoint string, out io.Writer) error {
+	s, err := loadTelemetry()
+	if err != nil {
+		return err
+	}
+	if endpoint != "" {
+		s.Endpoint = endpoint
+	}
+	if on && s.Endpoint == "" {
+		return userErrorf("no telemetry endpoint: use --endpoint to set one")
+	}
+	if s.ID == "" {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return fmt.Errorf("generating telemetry ID: %s", err)
+		}
+		s.ID = fmt.Sprintf("%x", b)
+	}
+	s.Enabled = on
+	if err := saveTelemetry(s); err != nil {
+		return err
+	}
+	return telemetryStatus(out)
+}
+
+// telemetryStatus prints the telemetry setting, and what is reported.
+func telemetryStatus(out io.Writer) error {
+	s, err := loadTelemetry()
+	if err != nil {
+		return err
+	}
+	switch {
+	case !s.Enabled:
+		fmt.Fprintln(out, "telemetry is off")
+		return nil
+	case telemetryDisabledByEnv():
+		fmt.Fprintln(out, "telemetry is on, but disabled by DO_NOT_TRACK or TANKER_TELEMETRY")
+	default:
+		fmt.Fprintln(out, "telemetry is on")
+	}
+	fmt.Fprintln(out, "endpoint:", s.Endpoint)
+	fmt.Fprintln(out, "each command reports: installation ID, tanker version, OS, command name,")
+	fmt.Fprintln(out, "storage scheme, object count and size buckets, and error kind")
+	return nil
+}
+
+func telemetryDisabledByEnv() bool {
+	dnt := os.Getenv("DO_NOT_TRACK")
+	return (dnt != "" && dnt != "0") || os.Getenv("TANKER_TELEMETRY") == "off"
+}
+
+// reportUsage reports the command which ran, if telemetry is on.
+// Failures are only logged at debug level.
+func reportUsage(command string, cmdErr error) {
+	if telemetryDisabledByEnv() || strings.HasPrefix(command, "telemetry") {
+		return
+	}
+	s, err := loadTelemetry()
+	if err != nil || !s.Enabled || s.Endpoint == "" {
+		return
+	}
+
+	usage.mtx.Lock()
+	event := telemetryEvent{
+		ID:      s.ID,
+		Version: buildinfo.Version,
+		OS:      runtime.GOOS,
+		Arch:    runtime.GOARCH,
+		Command: command,
+		Scheme:  usage.scheme,
+		Objects: countBucket(usage.objects),
+		Bytes:   sizeBucket(usage.bytes),
+	}
+	usage.mtx.Unlock()
+	if cmdErr != nil {
+		event.Error = storage.KindOf(cmdErr).String()
+	}
+
+	b, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	client := &http.Client{Timeout: telemetryTimeout}
+	resp, err := client.Post(s.Endpoint, "application/json", bytes.NewReader(b))
+	if err != nil {
+		debugln("Error reporting telemetry", err)
+		return
+	}
+	resp.Body.Close()
+}
+
+func countBucket(n int) string {
+	switch {
+	case n == 0:
+		return "0"
+	case n < 10:
+		return "1-9"
+	case n < 100:
+		return "10-99"
+	case n < 1000:
+		return "100-999"
+	}
+	return "1000+"
+}
+
+func sizeBucket(n int64) string {
+	switch {
+	case n == 0:
+		return "0"
+	case n < int64(units.MiB):
+		return "<1MiB"
+	case n < int64(100*units.MiB):
+		return "1MiB-100MiB"
+	case n < int64(10*units.GiB):
+		return "100MiB-10GiB"
+	}
+	return "10GiB+"
+}
@@ -3,174 +3,658 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
 	"log"
-  "time"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime/debug"
-
-  "github.com/buchanae/tanker/storage"
-  "github.com/machinebox/progress"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/buchanae/tanker/protocol"
+	"github.com/buchanae/tanker/storage"
+	"github.com/machinebox/progress"
 )
 
+// agent holds the state of a transfer agent session.
+type agent struct {
+	conf  Config
+	comms *protocol.Comms
+	store storage.Storage
+	// Directory where downloads are written before git-lfs moves them.
+	dataDir string
+	// Path to the transfer journal.
+	journal string
+	// Index of the objects known to be in remote storage.
+	index *objectIndex
+	// Index of remote objects shared by all clones, if enabled.
+	shared *sharedIndex
+	// Set once an object was uploaded in this session.
+	uploaded atomic.Bool
+	// Stores small objects in git, if enabled.
+	inline *inlineStore
+	// Objects completed in this session by earlier runs of the agent.
+	ledger *ledger
+	// Serves downloads from packs, if enabled.
+	packs *packReader
+	// Downloads large objects from mirrors, if configured.
+	stripes *stripedDownloader
+	// Limits the size of dataDir, if configured.
+	quota *dirQuota
+	// Secondary remotes uploads are copied to during the push,
+	// unless they're replicated in the background.
+	replicas []replicaTarget
+	// Generates sidecars of uploads, if configured.
+	sidecars *sidecarGenerators
+	// Makes background transfers yield to interactive ones.
+	priority *priorityGate
+	// Tracks the transfers in progress for the status file, if enabled.
+	status *statusFile
+}
+
 // transfer implements the actual git-lfs transfer agent,
 // which handles communication with git-lfs via stdin/out,
 // downloading/uploading, etc.
-func transfer(conf Config, dataDir string) error {
+func transfer(conf Config, dataDir, journal, packCache, indexPath, sessionsDir, statusPath, tracePath string) error {
+
+	// Get a storage (swift, s3, etc) client.
+	store, err := newStorage(conf)
+	if err != nil {
+		return err
+	}
 
-  if conf.BaseURL == "" {
-    return fmt.Errorf("config BaseURL is required")
-  }
+	index := loadIndex(indexPath, conf.Namespace)
+	defer index.Close()
+
+	// Ctrl-C cancels the transfers in progress, so that they're reported
+	// to git-lfs as interrupted. A second Ctrl-C kills tanker.
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	go func() {
+		select {
+		case sig := <-sigs:
+			signal.Stop(sigs)
+			cancel(fmt.Errorf("interrupted by %s", sig))
+		case <-ctx.Done():
+		}
+	}()
 
-  // Get a storage (swift, s3, etc) client.
-  store, err := storage.NewStorage(conf.BaseURL, conf.Storage)
+	comms := protocol.DefaultComms()
+	if tracePath != "" {
+		f, err := os.OpenFile(tracePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return userErrorf("opening protocol trace: %s", err)
+		}
+		defer f.Close()
+		comms.Trace(f)
+	}
+	status := newStatusFile(statusPath)
+	comms.OnSend(status.sent)
+	defer status.start()()
+
+	a := &agent{
+		conf:    conf,
+		comms:   comms,
+		store:   store,
+		dataDir: dataDir,
+		journal: journal,
+		index:   index,
+		shared:  newSharedIndex(conf, store),
+		inline:  newInlineStore(conf, filepath.Dir(journal)),
+		ledger:  sessionLedger(sessionsDir),
+		quota:   newDataQuota(conf, dataDir),
+		status:  status,
+	}
+	if err := validateSidecars(conf.Sidecars); err != nil {
+		return err
+	}
+	a.sidecars = newSidecarGenerators(conf, store)
+	a.priority = newPriorityGate(conf.Priority)
+	defer a.priority.close()
+	defer a.shared.flush(ctx, conf.Index.Shared.CompactAfter)
+	a.replicas, err = pushReplicas(conf)
 	if err != nil {
-    return err
+		return err
+	}
+	defer func() {
+		if a.uploaded.Load() && len(conf.Replication.URLs) > 0 && a.replicas == nil {
+			startReplicator()
+		}
+	}()
+	if len(conf.Mirrors.URLs) > 0 {
+		a.stripes, err = newStripedDownloader(conf, store)
+		if err != nil {
+			return err
+		}
+	}
+	if conf.Pack.Enabled {
+		a.packs = &packReader{
+			store:    store,
+			baseURL:  conf.BaseURL,
+			cacheDir: packCache,
+		}
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	return a.run(ctx)
+}
 
-  // Start processing git-lfs messages
-	comms := DefaultComms()
+// run processes git-lfs messages until git-lfs terminates the session.
+// Uploads and downloads are handled by workers, started once the init
+// message gives the concurrency.
+func (a *agent) run(ctx context.Context) error {
+	var workers *transferWorkers
+	defer func() { workers.wait() }()
+	inputs := readInputs(a.comms)
 	for {
-		msg, err := comms.Input()
-		if err != nil {
-      return err
+		var in agentInput
+		select {
+		case in = <-inputs:
+		case <-workers.done():
+			return workers.wait()
+		}
+		if in.err != nil {
+			return in.err
+		}
+		msg := in.msg
+		debugln("Received message", fmt.Sprintf("%+v", msg))
+		a.status.received(msg)
+
+		switch msg.(type) {
+		case *protocol.UploadMessage, *protocol.DownloadMessage:
+			if workers != nil {
+				if !workers.add(msg) {
+					return workers.wait()
+				}
+				continue
+			}
+		case *protocol.TerminateMessage:
+			if err := workers.wait(); err != nil {
+				return err
+			}
 		}
 
-		err = handle(ctx, msg, comms, store, conf.BaseURL, dataDir)
-		if err != nil {
-      return err
+		if err := a.handle(ctx, msg); err != nil {
+			return err
 		}
 
-		if _, ok := msg.(*TerminateMessage); ok {
+		if init, ok := msg.(*protocol.InitMessage); ok && workers == nil {
+			workers = a.startWorkers(ctx, a.concurrency(init))
+		}
+		if _, ok := msg.(*protocol.TerminateMessage); ok {
 			break
 		}
 	}
-  return nil
+	return a.inline.flush()
 }
 
 // handle handles a single input message from git-lfs (init, upload, download, etc)
-func handle(
-  ctx context.Context,
-  m Message,
-  comms *Comms,
-  store storage.Storage,
-  baseURL, dataDir string,
-  ) (err error) {
-
-  defer handlePanic(func(e error) {
-    err = e
-  })
+func (a *agent) handle(ctx context.Context, m protocol.Message) (err error) {
+
+	defer handlePanic(func(e error) {
+		err = e
+	})
 
 	switch msg := m.(type) {
-	case *InitMessage:
-		comms.Initialized()
+	case *protocol.InitMessage:
+		// Fail early if the storage can't do what git-lfs is about to ask for.
+		err := checkSupported(a.store, a.conf, msg.Operation)
+		if err != nil {
+			a.comms.InitError(storage.WithHint(err))
+			return err
+		}
+		if a.inline != nil {
+			a.inline.remote = msg.Remote
+		}
+		a.comms.Initialized()
 		return nil
 
-	case *UploadMessage:
-		url, err := store.Join(baseURL, msg.Oid)
-		if err != nil {
-			comms.SendError(msg.Oid, err)
+	case *protocol.UploadMessage:
+		return a.upload(ctx, msg)
+
+	case *protocol.DownloadMessage:
+		return a.download(ctx, msg)
+
+	case *protocol.TerminateMessage:
+		return nil
+
+	case *protocol.UnknownMessage:
+		// Newer versions of git-lfs may send events we don't know about.
+		// Skip them, but fail the object if there is one, so that git-lfs
+		// isn't left waiting for a response.
+		log.Println("Skipping unknown message", msg.Event, msg.Oid)
+		if msg.Oid != "" {
+			a.comms.SendError(msg.Oid, fmt.Errorf("unsupported event %q", msg.Event))
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("unknown message type %#v", msg)
+	}
+}
+
+// upload handles a single upload message from git-lfs.
+func (a *agent) upload(ctx context.Context, msg *protocol.UploadMessage) error {
+	if err := a.priority.wait(ctx); err != nil {
+		a.comms.SendError(msg.Oid, a.interruptedErr(ctx, err))
+		// A failed upload should not fail the whole process,
+		// so we return nil. The error has been communicated
+		// to git-lfs above.
+		return nil
+	}
+	ctx, cancelDeadline := a.withDeadline(ctx)
+	defer cancelDeadline()
+
+	url, err := a.store.Join(a.conf.BaseURL, msg.Oid)
+	if err != nil {
+		a.comms.SendError(msg.Oid, err)
+		// A failed upload should not fail the whole process,
+		// so we return nil. The error has been communicated
+		// to git-lfs above.
+		return nil
+	}
+
+	if a.ledger.completed("upload", msg.Oid) {
+		log.Println("Skipping upload of", msg.Oid, "which completed earlier in this session")
+		return a.comms.SendComplete(msg.Oid, "")
+	}
+	if a.inline != nil && int64(msg.Size) <= a.conf.Inline.MaxSize {
+		if err := a.inline.add(msg.Oid, msg.Path); err != nil {
+			a.comms.SendError(msg.Oid, err)
 			// A failed upload should not fail the whole process,
 			// so we return nil. The error has been communicated
 			// to git-lfs above.
 			return nil
 		}
+		log.Println("Stored", msg.Path, "in git, in", inlineRef)
+		a.record("upload", msg.Oid, &storage.Object{URL: inlineRef + ":" + inlinePath(msg.Oid), Size: int64(msg.Size)}, 0)
+		a.ledger.record("upload", msg.Oid)
+		return a.comms.SendComplete(msg.Oid, "")
+	}
+	if a.index.knownUpload(a.conf.Index, msg.Oid, int64(msg.Size)) {
+		log.Println("Skipping upload of", msg.Oid, "which the index shows is already at", url)
+		return a.comms.SendComplete(msg.Oid, "")
+	}
+	if a.shared.known(ctx, msg.Oid, int64(msg.Size)) {
+		log.Println("Skipping upload of", msg.Oid, "which the shared index shows is already at", url)
+		return a.comms.SendComplete(msg.Oid, "")
+	}
 
-    log.Println("Uploading", msg.Path, url)
+	log.Println("Uploading", msg.Path, url)
 
-    src, err := os.Open(msg.Path)
-    if err != nil {
-      return fmt.Errorf("opening source file %q: %s", err)
-    }
-    defer src.Close()
+	src, err := os.Open(msg.Path)
+	if err != nil {
+		return fmt.Errorf("opening source file %q: %s", msg.Path, err)
+	}
+	defer src.Close()
+
+	opts, body := putOptions(a.conf, msg.Path, src)
+	opts.Size = int64(msg.Size)
+	opts.SourcePath = msg.Path
+
+	// Set up progress monitoring.
+	reader := progress.NewReader(a.priority.reader(ctx, body))
+	stopProgress := a.startProgress(ctx, msg.Oid, msg.Size, reader)
+	defer stopProgress()
+	xferCtx, cancelStall := a.watchStall(ctx, reader)
+	defer cancelStall()
+
+	// Start uploading
+	start := time.Now()
+	obj, err := a.store.Put(xferCtx, url, reader, opts)
+	// Classified before cancelStall, which cancels xferCtx.
+	err = a.interruptedErr(xferCtx, err)
+	stopProgress()
+	cancelStall()
+
+	if _, ok := err.(*storage.ErrObjectExists); ok {
+		// Pushing the same content again isn't a conflict.
+		obj, err = a.sameContent(ctx, url, src, int64(msg.Size), err)
+	}
 
-    // Set up progress monitoring.
-    reader := progress.NewReader(src)
-    watchCtx, cancel := context.WithCancel(ctx)
-    defer cancel()
-    go watchProgress(watchCtx, comms, msg.Oid, msg.Size, reader)
+	if err == nil && a.conf.Signing.Key != "" {
+		err = signObject(ctx, a.store, a.conf, msg.Oid, int64(msg.Size))
+	}
 
-    // Start uploading
-		_, err = store.Put(ctx, url, reader)
-    cancel()
+	if err != nil {
+		a.comms.SendError(msg.Oid, storage.WithHint(a.interruptedErr(ctx, err)))
+		// A failed upload should not fail the whole process,
+		// so we return nil. The error has been communicated
+		// to git-lfs above.
+		return nil
+	}
 
+	a.record("upload", msg.Oid, obj, time.Since(start))
+	if err := a.replicateUpload(ctx, msg.Oid, msg.Path, int64(msg.Size)); err != nil {
+		// The object is in the base URL, and recorded in the journal,
+		// so "tanker replicate" can copy it if the push isn't retried.
+		a.comms.SendError(msg.Oid, storage.WithHint(a.interruptedErr(ctx, err)))
+		return nil
+	}
+	a.sidecars.generate(ctx, msg.Oid, msg.Path)
+	a.index.seen(msg.Oid, obj)
+	a.shared.add(msg.Oid, obj.Size)
+	a.uploaded.Store(true)
+	a.ledger.record("upload", msg.Oid)
+	return a.comms.SendComplete(msg.Oid, "")
+}
+
+// download handles a single download message from git-lfs.
+func (a *agent) download(ctx context.Context, msg *protocol.DownloadMessage) error {
+	if err := a.priority.wait(ctx); err != nil {
+		a.comms.SendError(msg.Oid, a.interruptedErr(ctx, err))
+		// A failed download should not fail the whole process,
+		// so we return nil. The error has been communicated
+		// to git-lfs above.
+		return nil
+	}
+	ctx, cancelDeadline := a.withDeadline(ctx)
+	defer cancelDeadline()
+
+	// determine path to download file to.
+	// this usually goes into ".tanker/data".
+	// git-lfs will handle moving the file from here.
+	path := filepath.Join(a.dataDir, msg.Oid)
+	abspath, err := filepath.Abs(path)
+	if err != nil {
+		return fmt.Errorf("determining download path: %s", err)
+	}
+
+	url, err := a.store.Join(a.conf.BaseURL, msg.Oid)
+	if err != nil {
+		a.comms.SendError(msg.Oid, err)
+		// A failed download should not fail the whole process,
+		// so we return nil. The error has been communicated
+		// to git-lfs above.
+		return nil
+	}
+
+	// Look up the version recorded when this object was uploaded, if any.
+	var version string
+	if a.conf.PinVersions {
+		version, err = pinnedVersion(a.journal, msg.Oid)
 		if err != nil {
-			comms.SendError(msg.Oid, err)
-			// A failed upload should not fail the whole process,
-			// so we return nil. The error has been communicated
-			// to git-lfs above.
-			return nil
+			errorln("Error reading pinned version from journal", err)
+		}
+	}
+
+	// git-lfs may have been restarted before it moved a completed download
+	// out of the data dir.
+	if a.ledger.completed("download", msg.Oid) {
+		if info, err := os.Stat(abspath); err == nil && info.Size() == int64(msg.Size) {
+			log.Println("Skipping download of", msg.Oid, "which completed earlier in this session")
+			return a.comms.SendComplete(msg.Oid, abspath)
 		}
+	}
 
-		return comms.SendComplete(msg.Oid, "")
+	release, err := a.quota.reserve(msg.Oid, int64(msg.Size))
+	if err != nil {
+		a.comms.SendError(msg.Oid, err)
+		// A failed download should not fail the whole process,
+		// so we return nil. The error has been communicated
+		// to git-lfs above.
+		return nil
+	}
+	defer release()
 
-	case *DownloadMessage:
+	// Other agents may be downloading into the same data dir, see claimObject.
+	unclaim, err := claimObject(ctx, a.dataDir, msg.Oid)
+	if err != nil {
+		a.comms.SendError(msg.Oid, a.interruptedErr(ctx, err))
+		// A failed download should not fail the whole process,
+		// so we return nil. The error has been communicated
+		// to git-lfs above.
+		return nil
+	}
+	defer unclaim()
+	if own, ok := reuseDownload(abspath, int64(msg.Size)); ok {
+		log.Println("Reusing", msg.Oid, "downloaded by another tanker process")
+		return a.comms.SendComplete(msg.Oid, own)
+	}
+	partial, err := createPartial(a.dataDir, msg.Oid)
+	if err != nil {
+		return err
+	}
+	// Does nothing once the download is renamed into place.
+	defer os.Remove(partial)
 
-		// determine path to download file to.
-		// this usually goes into ".tanker/data".
-		// git-lfs will handle moving the file from here.
-		path := filepath.Join(dataDir, msg.Oid)
-		abspath, err := filepath.Abs(path)
+	if a.inline != nil {
+		ok, err := a.inline.get(msg.Oid, partial)
 		if err != nil {
-			return fmt.Errorf("determining download path: %s", err)
+			errorln("Error reading inline object, downloading instead", msg.Oid, err)
 		}
+		if ok {
+			log.Println("Read", msg.Oid, "from", inlineRef)
+			return a.complete(msg.Oid, partial, abspath)
+		}
+	}
 
-		url, err := store.Join(baseURL, msg.Oid)
+	if a.conf.Signing.Verify {
+		fpr, err := verifyObject(ctx, a.store, a.conf, msg.Oid, int64(msg.Size))
 		if err != nil {
-			comms.SendError(msg.Oid, err)
+			a.comms.SendError(msg.Oid, err)
 			// A failed download should not fail the whole process,
 			// so we return nil. The error has been communicated
 			// to git-lfs above.
 			return nil
 		}
+		log.Println("Verified signature of", msg.Oid, "by", fpr)
+	}
 
-    log.Println("Downloading", url, abspath)
-
-    dest, err := os.Create(abspath)
-    if err != nil {
-      return fmt.Errorf("opening dest path %q: %s", abspath, dest)
-    }
+	if version == "" && cached(a.conf.Cache.Dir, msg.Oid) {
+		err := copyFromCache(a.conf.Cache.Dir, msg.Oid, partial)
+		if err == nil {
+			log.Println("Copied", msg.Oid, "from cache", a.conf.Cache.Dir)
+			return a.complete(msg.Oid, partial, abspath)
+		}
+		errorln("Error copying from cache, downloading instead", msg.Oid, err)
+	}
 
-    // Set up progress monitoring
-    writer := progress.NewWriter(dest)
-    watchCtx, cancel := context.WithCancel(ctx)
-    defer cancel()
-    go watchProgress(watchCtx, comms, msg.Oid, msg.Size, writer)
+	log.Println("Downloading", url, abspath, version)
 
-    // Start downloading
-		_, err = store.Get(ctx, url, writer)
-    cancel()
-    closeErr := dest.Close()
+	dest, err := os.Create(partial)
+	if err != nil {
+		return fmt.Errorf("opening dest path %q: %s", partial, err)
+	}
 
-		if err != nil {
-			// TODO probably need to ensure files are cleanup up on failed downloads.
-			comms.SendError(msg.Oid, err)
+	// Set up progress monitoring
+	counter := &byteCounter{}
+	writer := io.MultiWriter(a.priority.writer(ctx, dest), counter)
+	stopProgress := a.startProgress(ctx, msg.Oid, msg.Size, counter)
+	defer stopProgress()
+	xferCtx, cancelStall := a.watchStall(ctx, counter)
+	defer cancelStall()
+
+	// Start downloading
+	start := time.Now()
+	var obj *storage.Object
+	var packed packEntry
+	var isPacked bool
+	if a.packs != nil {
+		packed, isPacked = a.packs.lookup(ctx, msg.Oid)
+	}
 
-			// A failed download should not fail the whole process,
-			// so we return nil. The error has been communicated
-			// to git-lfs above.
-			return nil
+	if isPacked {
+		obj, err = a.packs.extract(xferCtx, msg.Oid, packed, writer)
+	} else if a.stripes != nil && version == "" && int64(msg.Size) >= a.conf.Mirrors.MinSize {
+		// Mirrors can't be used for pinned versions, since version IDs
+		// differ between them.
+		obj, err = a.stripes.download(xferCtx, msg.Oid, int64(msg.Size), dest, counter, a.priority)
+	} else if vg, ok := a.store.(storage.VersionGetter); ok && version != "" {
+		obj, err = vg.GetVersion(xferCtx, url, version, writer)
+	} else {
+		obj, err = a.store.Get(xferCtx, url, writer)
+		if archived, ok := err.(*storage.ErrArchived); ok {
+			// Waiting for the restore transfers nothing, but isn't a stall.
+			cancelStall()
+			xferCtx = ctx
+			err = waitForRestore(xferCtx, a.store, a.conf.Restore, url, archived)
+			if err == nil {
+				xferCtx, cancelStall = a.watchStall(ctx, counter)
+				defer cancelStall()
+				obj, err = a.store.Get(xferCtx, url, writer)
+			}
 		}
+	}
+	stopProgress()
+	closeErr := dest.Close()
 
-		if closeErr != nil {
-			// TODO probably need to ensure files are cleanup up on failed downloads.
-			comms.SendError(msg.Oid, closeErr)
+	if err != nil {
+		a.comms.SendError(msg.Oid, storage.WithHint(a.interruptedErr(xferCtx, err)))
 
-			// A failed download should not fail the whole process,
-			// so we return nil. The error has been communicated
-			// to git-lfs above.
-			return nil
-		}
+		// A failed download should not fail the whole process,
+		// so we return nil. The error has been communicated
+		// to git-lfs above.
+		return nil
+	}
 
-		return comms.SendComplete(msg.Oid, abspath)
+	if closeErr == nil {
+		closeErr = os.Rename(partial, abspath)
+	}
+	if closeErr != nil {
+		a.comms.SendError(msg.Oid, closeErr)
 
-	case *TerminateMessage:
+		// A failed download should not fail the whole process,
+		// so we return nil. The error has been communicated
+		// to git-lfs above.
 		return nil
-	default:
-		return fmt.Errorf("unknown message type %#v", msg)
+	}
+
+	a.record("download", msg.Oid, obj, time.Since(start))
+	if !isPacked {
+		a.index.seen(msg.Oid, obj)
+	}
+	a.ledger.record("download", msg.Oid)
+	return a.comms.SendComplete(msg.Oid, abspath)
+}
+
+// complete renames a partial download which completed into place at
+// "path", and reports it to git-lfs.
+func (a *agent) complete(oid, partial, path string) error {
+	if err := os.Rename(partial, path); err != nil {
+		a.comms.SendError(oid, err)
+		// A failed download should not fail the whole process,
+		// so we return nil. The error has been communicated
+		// to git-lfs above.
+		return nil
+	}
+	return a.comms.SendComplete(oid, path)
+}
+
+// withDeadline limits the time spent transferring a single object,
+// if configured, so that one pathological object can't hold up the rest
+// of the session.
+func (a *agent) withDeadline(ctx context.Context) (context.Context, context.CancelFunc) {
+	if a.conf.ObjectTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, time.Duration(a.conf.ObjectTimeout))
+}
+
+// interruptedErr explains errors of transfers which were interrupted:
+// canceled, e.g. by Ctrl-C, out of time, see ObjectTimeout, or stalled,
+// see StallTimeout. See storage.ErrInterrupted.
+func (a *agent) interruptedErr(ctx context.Context, err error) error {
+	err = storage.Interrupted(ctx, err)
+	ie, ok := err.(*storage.ErrInterrupted)
+	if ok && ie.Cause == storage.DeadlineExceeded && ie.Reason == nil && a.conf.ObjectTimeout > 0 {
+		ie.Reason = fmt.Errorf("ObjectTimeout of %s", time.Duration(a.conf.ObjectTimeout))
+	}
+	return err
+}
+
+// watchStall returns a context for transferring an object, which is
+// canceled with *storage.ErrStalled if "c" counts no bytes for StallTimeout,
+// e.g. on a hung connection which is never closed.
+func (a *agent) watchStall(ctx context.Context, c progress.Counter) (context.Context, context.CancelFunc) {
+	timeout := time.Duration(a.conf.StallTimeout)
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	go func() {
+		ticker := time.NewTicker(timeout / 4)
+		defer ticker.Stop()
+		last, since := c.N(), time.Now()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if n := c.N(); n != last {
+					last, since = n, time.Now()
+				} else if time.Since(since) >= timeout {
+					cancel(&storage.ErrStalled{Timeout: timeout})
+					return
+				}
+			}
+		}
+	}()
+	return ctx, func() { cancel(nil) }
+}
+
+// putOptions returns the storage.PutOptions for uploading the file at "path"
+// from "src", based on the config. The returned reader must be used in place
+// of "src", since detecting the content type may consume data from it.
+func putOptions(conf Config, path string, src io.Reader) (storage.PutOptions, io.Reader) {
+	opts := storage.PutOptions{
+		IfNotExists: conf.Immutable,
+		ACL:         conf.ACL,
+	}
+	if !conf.DisableContentTypeDetection {
+		opts.ContentType, src = storage.DetectContentType(path, src)
+	}
+	return opts, src
+}
+
+// sameContent checks whether the existing object at "url" has the same
+// content as the local file "src", by comparing the checksum provided by
+// the storage backend. If so, the existing object is returned. Otherwise,
+// including when the backend provides no checksum, "conflict" is returned.
+func (a *agent) sameContent(ctx context.Context, url string, src io.ReadSeeker, size int64, conflict error) (*storage.Object, error) {
+	obj, err := a.store.Stat(ctx, url)
+	if err != nil || obj.Size != size || obj.Checksum == "" {
+		return nil, conflict
+	}
+
+	h := storage.NewChecksumHash(obj.ChecksumType)
+	if h == nil {
+		return nil, conflict
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, conflict
+	}
+	if _, err := io.Copy(h, storage.ContextReader(ctx, src)); err != nil {
+		return nil, conflict
+	}
+	if storage.HexChecksum(h) != obj.Checksum {
+		return nil, conflict
+	}
+
+	log.Println("Object already exists with the same content", url)
+	return obj, nil
+}
+
+// record writes a completed transfer to the journal.
+// Failing to write the journal doesn't fail the transfer.
+func (a *agent) record(op, oid string, obj *storage.Object, elapsed time.Duration) {
+	countTransfer(obj.Size)
+	err := appendJournal(a.journal, journalEntry{
+		Time:     time.Now(),
+		Op:       op,
+		Oid:      oid,
+		URL:      obj.URL,
+		Size:     obj.Size,
+		Version:  obj.Version,
+		Duration: elapsed,
+	})
+	if err != nil {
+		errorln("Error writing journal", err)
 	}
 }
 
@@ -186,23 +670,74 @@ func handlePanic(cb func(error)) {
 	}
 }
 
+// startProgress runs watchProgress until the returned func is called,
+// which waits for it to return, so that no progress message of the object
+// can follow its complete or error message.
+func (a *agent) startProgress(ctx context.Context, oid string, size int, c progress.Counter) (stop func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		watchProgress(ctx, a.comms, oid, size, c, time.Duration(a.conf.HeartbeatInterval))
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			cancel()
+			<-done
+		})
+	}
+}
+
 // watchProgress watches the progress of a download/upload
 // and emits git-lfs progess messages.
-func watchProgress(ctx context.Context, comms *Comms, oid string, size int, c progress.Counter) {
-
-  var last int
-  t := progress.NewTicker(ctx, c, int64(size), time.Millisecond * 250)
-  for p := range t {
-
-    total := int(p.N())
-    inc := total - last
-    last = total
-
-    comms.Send(&ProgressMessage{
-      Event: "progress",
-      Oid: oid,
-      BytesSoFar: total,
-      BytesSinceLast: inc,
-    })
-  }
+//
+// If no progress is made for the heartbeat interval, a zero-byte progress
+// message is sent so that git-lfs knows tanker is still alive. Heartbeats
+// continue after all the bytes are transferred, since finishing an upload
+// may take a while, until "ctx" is canceled.
+func watchProgress(ctx context.Context, comms *protocol.Comms, oid string, size int, c progress.Counter, heartbeat time.Duration) {
+
+	var last int
+	lastSent := time.Now()
+	send := func(total int) {
+		comms.Send(&protocol.ProgressMessage{
+			Event:          "progress",
+			Oid:            oid,
+			BytesSoFar:     total,
+			BytesSinceLast: total - last,
+		})
+		last = total
+		lastSent = time.Now()
+	}
+
+	var beat <-chan time.Time
+	if heartbeat > 0 {
+		ticker := time.NewTicker(heartbeat)
+		defer ticker.Stop()
+		beat = ticker.C
+	}
+
+	t := progress.NewTicker(ctx, c, int64(size), time.Millisecond*250)
+	for {
+		select {
+		case p, ok := <-t:
+			if !ok {
+				// The transfer is complete, but the operation may not be.
+				t = nil
+				continue
+			}
+			if total := int(p.N()); total != last {
+				send(total)
+			}
+
+		case <-beat:
+			if time.Since(lastSent) >= heartbeat {
+				send(last)
+			}
+
+		case <-ctx.Done():
+			return
+		}
+	}
 }
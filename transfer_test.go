@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buchanae/tanker/protocol"
+	"github.com/buchanae/tanker/storage"
+)
+
+// blockingStorage is a storage mock whose downloads write half of the
+// object, then block until "release" is closed.
+type blockingStorage struct {
+	storage.Storage
+	objects map[string][]byte
+	started chan string
+	release chan struct{}
+}
+
+func (s *blockingStorage) Join(url, path string) (string, error) {
+	return url + "/" + path, nil
+}
+
+func (s *blockingStorage) UnsupportedOperations(url string) storage.UnsupportedOperations {
+	return storage.UnsupportedOperations{}
+}
+
+func (s *blockingStorage) Get(ctx context.Context, url string, dest io.Writer) (*storage.Object, error) {
+	oid := url[strings.LastIndex(url, "/")+1:]
+	b := s.objects[oid]
+	if _, err := dest.Write(b[:len(b)/2]); err != nil {
+		return nil, err
+	}
+	s.started <- oid
+	select {
+	case <-s.release:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if _, err := dest.Write(b[len(b)/2:]); err != nil {
+		return nil, err
+	}
+	return &storage.Object{URL: url, Name: oid, Size: int64(len(b))}, nil
+}
+
+// testAgent returns an agent reading git-lfs messages from the returned
+// writer, and sending its own to "out".
+func testAgent(t *testing.T, store storage.Storage, out io.Writer) (*agent, *io.PipeWriter) {
+	t.Helper()
+	dir := t.TempDir()
+	conf := DefaultConfig()
+	conf.BaseURL = "mock://bucket"
+	conf.HeartbeatInterval = storage.Duration(10 * time.Millisecond)
+
+	in, w := io.Pipe()
+	t.Cleanup(func() { w.Close() })
+	return &agent{
+		conf:    conf,
+		comms:   protocol.NewComms(in, out),
+		store:   store,
+		dataDir: dir,
+		journal: filepath.Join(dir, "journal"),
+	}, w
+}
+
+// runAgent runs the agent's session in the background. The result of
+// run is sent to the returned channel.
+func runAgent(a *agent) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		done <- a.run(context.Background())
+	}()
+	return done
+}
+
+func send(t *testing.T, w io.Writer, lines ...string) {
+	t.Helper()
+	for _, line := range lines {
+		if _, err := io.WriteString(w, line+"\n"); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Downloads run concurrently, each object's messages are sent in order,
+// and terminate waits for the downloads in progress.
+func TestConcurrentDownloads(t *testing.T) {
+	store := &blockingStorage{
+		objects: map[string][]byte{},
+		started: make(chan string, 2),
+		release: make(chan struct{}),
+	}
+	var oids []string
+	for _, content := range []string{"first object", "second object"} {
+		sum := sha256.Sum256([]byte(content))
+		oid := hex.EncodeToString(sum[:])
+		store.objects[oid] = []byte(content)
+		oids = append(oids, oid)
+	}
+
+	var out bytes.Buffer
+	a, w := testAgent(t, store, &out)
+	done := runAgent(a)
+
+	send(t, w, `{"event":"init","operation":"download","remote":"origin","concurrent":false,"concurrenttransfers":2}`)
+	for _, oid := range oids {
+		send(t, w, fmt.Sprintf(`{"event":"download","oid":%q,"size":%d}`, oid, len(store.objects[oid])))
+	}
+
+	// Both downloads start before either completes.
+	for range oids {
+		select {
+		case <-store.started:
+		case err := <-done:
+			t.Fatalf("session ended before both downloads started: %v", err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for both downloads to start")
+		}
+	}
+	// Let heartbeats be sent while the downloads are in progress.
+	time.Sleep(50 * time.Millisecond)
+
+	send(t, w, `{"event":"terminate"}`)
+	select {
+	case err := <-done:
+		t.Fatalf("session ended before the downloads completed: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(store.release)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the session to end")
+	}
+
+	progress := map[string]int{}
+	completed := map[string]string{}
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		var msg struct {
+			Event string
+			Oid   string
+			Path  string
+			Error *protocol.ErrorDetail
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Oid == "" {
+			// The response to init.
+			continue
+		}
+		if _, ok := completed[msg.Oid]; ok {
+			t.Errorf("%s after complete of %s", msg.Event, msg.Oid)
+		}
+		switch msg.Event {
+		case "progress":
+			progress[msg.Oid]++
+		case "complete":
+			if msg.Error != nil {
+				t.Fatalf("download of %s failed: %s", msg.Oid, msg.Error.Message)
+			}
+			completed[msg.Oid] = msg.Path
+		default:
+			t.Errorf("unexpected event %q", msg.Event)
+		}
+	}
+
+	for _, oid := range oids {
+		if progress[oid] == 0 {
+			t.Errorf("no progress sent for %s", oid)
+		}
+		path, ok := completed[oid]
+		if !ok {
+			t.Errorf("no complete sent for %s", oid)
+			continue
+		}
+		got, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, store.objects[oid]) {
+			t.Errorf("downloaded %q for %s, expected %q", got, oid, store.objects[oid])
+		}
+	}
+}
+
+// A worker which fails ends the session with its error, without waiting
+// for more input.
+func TestWorkerError(t *testing.T) {
+	a, w := testAgent(t, &blockingStorage{}, ioutil.Discard)
+	done := runAgent(a)
+
+	missing := filepath.Join(t.TempDir(), "missing")
+	send(t, w,
+		`{"event":"init","operation":"upload","remote":"origin","concurrent":false,"concurrenttransfers":2}`,
+		fmt.Sprintf(`{"event":"upload","oid":"bf3e3e2af9366a3b704ae0c31de5afa64193ebabffde2091936ad2e7510bc03a","size":10,"path":%q}`, missing),
+	)
+
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "opening source file") {
+			t.Errorf("expected the worker's error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the session to end")
+	}
+}
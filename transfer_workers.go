@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/buchanae/tanker/protocol"
+)
+
+// agentInput is a message read from git-lfs, or the error reading it.
+type agentInput struct {
+	msg protocol.Message
+	err error
+}
+
+// readInputs reads messages from git-lfs until the input ends, so that the
+// agent can watch its workers while it waits for the next message.
+func readInputs(comms *protocol.Comms) <-chan agentInput {
+	ch := make(chan agentInput)
+	go func() {
+		for {
+			msg, err := comms.Input()
+			ch <- agentInput{msg, err}
+			if err != nil {
+				return
+			}
+			if _, ok := msg.(*protocol.TerminateMessage); ok {
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+// concurrency returns the number of objects to transfer at once.
+// See Config.ConcurrentTransfers.
+func (a *agent) concurrency(init *protocol.InitMessage) int {
+	n := a.conf.ConcurrentTransfers
+	if n <= 0 && !init.Concurrent {
+		// git-lfs runs a single agent, and leaves concurrency to it.
+		n = init.ConcurrentTransfers
+	}
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+// transferWorkers runs the uploads and downloads of a session concurrently.
+// Each worker reports its own objects to git-lfs, so messages of different
+// objects interleave, but those of one object are sent in order, ending
+// with its complete or error message. A nil *transferWorkers is valid,
+// and runs nothing.
+type transferWorkers struct {
+	jobs chan protocol.Message
+	wg   sync.WaitGroup
+
+	// Closed when a worker fails with an error which ends the session.
+	failed   chan struct{}
+	failOnce sync.Once
+	err      error
+
+	closeOnce sync.Once
+}
+
+// startWorkers starts "n" workers handling messages with a.handle.
+func (a *agent) startWorkers(ctx context.Context, n int) *transferWorkers {
+	w := &transferWorkers{
+		jobs:   make(chan protocol.Message),
+		failed: make(chan struct{}),
+	}
+	for i := 0; i < n; i++ {
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			for msg := range w.jobs {
+				if err := a.handle(ctx, msg); err != nil {
+					w.fail(err)
+				}
+			}
+		}()
+	}
+	return w
+}
+
+// add waits for a worker to take "msg". It returns false, without waiting,
+// if a worker failed.
+func (w *transferWorkers) add(msg protocol.Message) bool {
+	select {
+	case w.jobs <- msg:
+		return true
+	case <-w.failed:
+		return false
+	}
+}
+
+func (w *transferWorkers) fail(err error) {
+	w.failOnce.Do(func() {
+		w.err = err
+		close(w.failed)
+	})
+}
+
+// done returns a channel which is closed when a worker fails.
+func (w *transferWorkers) done() <-chan struct{} {
+	if w == nil {
+		return nil
+	}
+	return w.failed
+}
+
+// wait waits for the transfers in progress, and returns the error of the
+// first worker which failed, if any.
+func (w *transferWorkers) wait() error {
+	if w == nil {
+		return nil
+	}
+	w.closeOnce.Do(func() { close(w.jobs) })
+	w.wg.Wait()
+	select {
+	case <-w.failed:
+		return w.err
+	default:
+		return nil
+	}
+}
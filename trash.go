@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buchanae/tanker/storage"
+)
+
+// Objects aren't deleted from remote storage right away. Instead, they're
+// moved to "<base>/.trash/<date>/<oid>", where they can be restored until
+// the trash is emptied. This protects against accidentally deleting objects
+// which are still referenced by someone else's clone.
+const trashDir = ".trash"
+
+// trashDateFormat is the format of the <date> directory in the trash.
+const trashDateFormat = "2006-01-02"
+
+// isTrashed returns true if the given object name is inside the trash.
+func isTrashed(name string) bool {
+	return strings.HasPrefix(name, trashDir+"/") || strings.Contains(name, "/"+trashDir+"/")
+}
+
+// trashURL returns the URL of the trash, or of a subpath inside the trash.
+func trashURL(store storage.Storage, baseURL string, subpath ...string) (string, error) {
+	url, err := store.Join(baseURL, trashDir)
+	if err != nil {
+		return "", err
+	}
+	for _, p := range subpath {
+		url, err = store.Join(url, p)
+		if err != nil {
+			return "", err
+		}
+	}
+	return url, nil
+}
+
+// trashObjects moves the objects with the given OIDs into today's trash directory.
+func trashObjects(ctx context.Context, store storage.Storage, baseURL string, oids []string) error {
+	date := time.Now().Format(trashDateFormat)
+
+	for _, oid := range oids {
+		src, err := store.Join(baseURL, oid)
+		if err != nil {
+			return err
+		}
+		dst, err := trashURL(store, baseURL, date, oid)
+		if err != nil {
+			return err
+		}
+
+		err = store.Move(ctx, src, dst)
+		if err != nil {
+			return fmt.Errorf("moving %s to trash: %s", oid, err)
+		}
+		log.Println("Trashed", src, dst)
+		fmt.Printf("trashed %s\n", oid)
+	}
+	return nil
+}
+
+// trashEntry describes an object in the trash.
+type trashEntry struct {
+	Oid  string
+	Date time.Time
+	Size int64
+	URL  string
+}
+
+// listTrash lists the objects in the trash.
+func listTrash(ctx context.Context, store storage.Storage, baseURL string) ([]trashEntry, error) {
+	url, err := trashURL(store, baseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	objs, err := store.List(ctx, url, storage.ListOptions{Recursive: true})
+	if err != nil {
+		return nil, fmt.Errorf("listing trash: %s", err)
+	}
+
+	var entries []trashEntry
+	for _, obj := range objs {
+		oid := path.Base(obj.Name)
+		dir := path.Base(path.Dir(obj.Name))
+		date, err := time.Parse(trashDateFormat, dir)
+		if err != nil || !isOID(oid) {
+			log.Println("Ignoring unexpected object in trash", obj.URL)
+			continue
+		}
+		entries = append(entries, trashEntry{
+			Oid:  oid,
+			Date: date,
+			Size: obj.Size,
+			URL:  obj.URL,
+		})
+	}
+	return entries, nil
+}
+
+// emptyTrash permanently deletes trashed objects older than the given age.
+func emptyTrash(ctx context.Context, store storage.Storage, baseURL string, olderThan time.Duration) error {
+	entries, err := listTrash(ctx, store, baseURL)
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-olderThan)
+	var count int
+	for _, e := range entries {
+		if !e.Date.Before(cutoff) {
+			continue
+		}
+		err := store.Delete(ctx, e.URL)
+		if err != nil {
+			return fmt.Errorf("deleting %s: %s", e.URL, err)
+		}
+		log.Println("Deleted", e.URL)
+		count++
+	}
+
+	fmt.Printf("deleted %d objects from the trash\n", count)
+	return nil
+}
+
+// restoreTrash moves trashed objects back to their original location.
+// If an OID was trashed more than once, the most recent copy is restored.
+func restoreTrash(ctx context.Context, store storage.Storage, baseURL string, oids []string) error {
+	entries, err := listTrash(ctx, store, baseURL)
+	if err != nil {
+		return err
+	}
+
+	latest := map[string]trashEntry{}
+	for _, e := range entries {
+		if l, ok := latest[e.Oid]; !ok || e.Date.After(l.Date) {
+			latest[e.Oid] = e
+		}
+	}
+
+	for _, oid := range oids {
+		e, ok := latest[oid]
+		if !ok {
+			return fmt.Errorf("%s not found in trash", oid)
+		}
+		dst, err := store.Join(baseURL, oid)
+		if err != nil {
+			return err
+		}
+		err = store.Move(ctx, e.URL, dst)
+		if err != nil {
+			return fmt.Errorf("restoring %s from trash: %s", oid, err)
+		}
+		log.Println("Restored", e.URL, dst)
+		fmt.Printf("restored %s\n", oid)
+	}
+	return nil
+}
+
+// resolveOids converts the given arguments, which may be OIDs or paths of
+// LFS files in the repo, into a list of OIDs.
+func resolveOids(args []string) ([]string, error) {
+	var oids, paths []string
+	for _, arg := range args {
+		if isOID(arg) {
+			oids = append(oids, arg)
+		} else {
+			paths = append(paths, arg)
+		}
+	}
+
+	if len(paths) > 0 {
+		files, err := lsFiles("--include", strings.Join(paths, ","))
+		if err != nil {
+			return nil, err
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("no LFS files matched %s", strings.Join(paths, ", "))
+		}
+		for _, f := range files {
+			oids = append(oids, f.Oid)
+		}
+	}
+	return oids, nil
+}
+
+// parseAge parses a duration which, in addition to the units supported
+// by time.ParseDuration, may be given in days, e.g. "30d".
+func parseAge(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return 0, fmt.Errorf("invalid age %q: %s", s, err)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid age %q: %s", s, err)
+	}
+	return d, nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+
+	"github.com/buchanae/tanker/storage"
+)
+
+// The base URL is recorded twice: in the git config, as lfs.url, and in
+// the tanker config, as BaseURL. "tanker init" sets both, but editing either
+// one by hand makes them drift. The tanker config is authoritative: the
+// transfer agent always uses BaseURL, and warns if lfs.url disagrees.
+
+// lfsURL returns lfs.url from the git config, or "" if it isn't set.
+func lfsURL() (string, error) {
+	out, err := exec.Command("git", "config", "--get", "lfs.url").Output()
+	if exit, ok := err.(*exec.ExitError); ok && exit.ExitCode() == 1 {
+		// Exit code 1 means the key isn't set.
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("reading lfs.url: %s", err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// sameBaseURL returns true if two base URLs refer to the same location.
+func sameBaseURL(a, b string) bool {
+	return strings.TrimSuffix(a, "/") == strings.TrimSuffix(b, "/")
+}
+
+// upstreamDrift returns an error describing how lfs.url and BaseURL
+// disagree, or nil if they agree.
+func upstreamDrift(conf Config) error {
+	url, err := lfsURL()
+	if err != nil {
+		return err
+	}
+	if sameBaseURL(url, conf.BaseURL) {
+		return nil
+	}
+	return userErrorf("lfs.url is %q but BaseURL is %q: run \"tanker check-upstream --fix\"", url, conf.BaseURL)
+}
+
+// warnUpstreamDrift logs a warning if lfs.url and BaseURL disagree.
+func warnUpstreamDrift(conf Config) {
+	if err := upstreamDrift(conf); err != nil {
+		errorln("Warning: using BaseURL from the tanker config:", err)
+	}
+}
+
+// checkUpstream compares lfs.url with BaseURL. If they disagree, it returns
+// an error, unless "fix" is set, in which case lfs.url is set to BaseURL,
+// or BaseURL to lfs.url if BaseURL isn't set.
+func checkUpstream(t *Tanker, fix bool, out io.Writer) error {
+	url, err := lfsURL()
+	if err != nil {
+		return err
+	}
+	base := t.Config.BaseURL
+	fmt.Fprintf(out, "lfs.url:  %s\n", url)
+	fmt.Fprintf(out, "BaseURL:  %s\n", base)
+
+	switch {
+	case url == "" && base == "":
+		return withExitCode(exitConfig, userErrorf("neither lfs.url nor BaseURL is set: run \"tanker init\""))
+
+	case sameBaseURL(url, base):
+		fmt.Fprintln(out, "lfs.url and BaseURL agree")
+		return nil
+
+	case !fix:
+		return withExitCode(exitConfig, upstreamDrift(t.Config))
+
+	case base == "":
+		if err := storage.ValidateURL(url, t.Config.Storage); err != nil {
+			return err
+		}
+		t.Config.BaseURL = url
+		if err := WriteConfigFile(t.Config, t.Paths.Config); err != nil {
+			return userErrorf("writing config file: %s", err)
+		}
+		fmt.Fprintf(out, "set BaseURL to %s\n", url)
+		return nil
+
+	default:
+		if err := exec.Command("git", "config", "lfs.url", base).Run(); err != nil {
+			return fmt.Errorf("setting lfs.url: %s", err)
+		}
+		fmt.Fprintf(out, "set lfs.url to %s\n", base)
+		return nil
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/units"
+	"github.com/buchanae/tanker/storage"
+)
+
+// verifyOptions configures "tanker verify".
+type verifyOptions struct {
+	// Fraction (0-1) of objects to fully download and hash.
+	Sample float64
+	// Maximum number of bytes to download for sampled objects.
+	// Zero means unlimited.
+	Budget int64
+	// Number of objects verified concurrently.
+	Workers int
+}
+
+// verifyResult holds the outcome of verifying a single object.
+type verifyResult struct {
+	obj     *storage.Object
+	sampled bool
+	err     error
+}
+
+// isOID returns true if the given string looks like a git-lfs OID, of any
+// registered hash algorithm. See storage.Hasher.
+func isOID(s string) bool {
+	return storage.IsOID(s)
+}
+
+// verify checks the integrity of the objects stored under the configured base URL.
+//
+// A random sample of objects is downloaded in full and checked against the
+// OID in the object's name. The remaining objects are only stat-checked,
+// which confirms they exist and their size matches the listing. Sampled
+// downloads are bounded by a byte budget; sampled objects that don't fit in
+// the remaining budget are stat-checked instead.
+//
+// Results are recorded in the index of remote objects.
+func verify(ctx context.Context, conf Config, index *objectIndex, opts verifyOptions) error {
+
+	store, err := newStorage(conf)
+	if err != nil {
+		return err
+	}
+
+	listing, err := store.List(ctx, conf.BaseURL, storage.ListOptions{Recursive: true})
+	if err != nil {
+		return fmt.Errorf("listing objects: %s", err)
+	}
+
+	// Only verify objects which are named by their OID.
+	var objs []*storage.Object
+	for _, obj := range listing {
+		if isOID(path.Base(obj.Name)) && !isTrashed(obj.Name) {
+			objs = append(objs, obj)
+		}
+	}
+
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	rnd.Shuffle(len(objs), func(i, j int) {
+		objs[i], objs[j] = objs[j], objs[i]
+	})
+
+	// Choose which objects will be downloaded, staying within the byte budget.
+	want := int(float64(len(objs))*opts.Sample + 0.5)
+	sampled := map[*storage.Object]bool{}
+	var budget int64
+	for _, obj := range objs {
+		if len(sampled) == want {
+			break
+		}
+		if opts.Budget > 0 && budget+obj.Size > opts.Budget {
+			continue
+		}
+		budget += obj.Size
+		sampled[obj] = true
+	}
+
+	workers := opts.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	jobs := make(chan *storage.Object)
+	results := make(chan verifyResult)
+	var wg sync.WaitGroup
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for obj := range jobs {
+				s := sampled[obj]
+				var err error
+				if s {
+					err = verifyContent(ctx, store, obj)
+				} else {
+					err = verifyStat(ctx, store, obj)
+				}
+				results <- verifyResult{obj, s, err}
+			}
+		}()
+	}
+
+	go func() {
+		for _, obj := range objs {
+			jobs <- obj
+		}
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+
+	var failed, downloaded int
+	for res := range results {
+		if res.sampled {
+			downloaded++
+		}
+		oid := path.Base(res.obj.Name)
+		switch {
+		case res.err == nil && res.sampled:
+			index.verified(oid, res.obj)
+		case res.err == nil:
+			index.seen(oid, res.obj)
+		case storage.KindOf(res.err) == storage.NotFoundError:
+			index.forget(oid)
+		}
+		if res.err != nil {
+			failed++
+			errorln("Verify failed", res.obj.URL, res.err)
+			fmt.Printf("FAIL %s: %s\n", res.obj.URL, res.err)
+		}
+	}
+
+	fmt.Printf("checked %d objects: %d downloaded and hashed (%s), %d stat-checked\n",
+		len(objs), downloaded, units.Base2Bytes(budget), len(objs)-downloaded)
+
+	if failed > 0 {
+		return withExitCode(exitVerify, fmt.Errorf("%d objects failed verification", failed))
+	}
+
+	// With zero failures in n samples, the "rule of three" gives an
+	// approximate 95% upper confidence bound of 3/n on the corruption rate.
+	if downloaded > 0 {
+		fmt.Printf("no corruption found; at 95%% confidence fewer than %.2f%% of objects are corrupt\n",
+			300/float64(downloaded))
+	}
+	return nil
+}
+
+// verifyContent downloads the object and checks that its hash matches its OID.
+// If the backend provides a checksum, the content is checked against that too.
+func verifyContent(ctx context.Context, store storage.Storage, obj *storage.Object) error {
+	verifier, err := storage.NewOIDVerifier(path.Base(obj.Name))
+	if err != nil {
+		return err
+	}
+	var w io.Writer = verifier
+	stored := storage.NewChecksumHash(obj.ChecksumType)
+	if stored != nil {
+		w = io.MultiWriter(verifier, stored)
+	}
+
+	_, err = store.Get(ctx, obj.URL, w)
+	if err != nil {
+		return err
+	}
+	if err := verifier.Verify(); err != nil {
+		return err
+	}
+	if stored != nil {
+		if sum := storage.HexChecksum(stored); sum != obj.Checksum {
+			return fmt.Errorf("checksum mismatch: stored %s is %s, got %s", obj.ChecksumType, obj.Checksum, sum)
+		}
+	}
+	return nil
+}
+
+// verifyStat checks that the object exists and its size and checksum
+// match the listing.
+func verifyStat(ctx context.Context, store storage.Storage, obj *storage.Object) error {
+	st, err := store.Stat(ctx, obj.URL)
+	if err != nil {
+		return err
+	}
+	if st.Size != obj.Size {
+		return fmt.Errorf("size mismatch: listed %d bytes, stat returned %d bytes", obj.Size, st.Size)
+	}
+	if obj.Checksum != "" && st.ChecksumType == obj.ChecksumType && st.Checksum != obj.Checksum {
+		return fmt.Errorf("checksum mismatch: listed %s %s, stat returned %s",
+			obj.ChecksumType, obj.Checksum, st.Checksum)
+	}
+	return nil
+}
+
+// parseSample parses a sample size given as a percentage ("5%")
+// or a fraction ("0.05").
+func parseSample(s string) (float64, error) {
+	var f float64
+	var err error
+	if strings.HasSuffix(s, "%") {
+		f, err = strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+		f = f / 100
+	} else {
+		f, err = strconv.ParseFloat(s, 64)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("invalid sample size %q: %s", s, err)
+	}
+	if f < 0 || f > 1 {
+		return 0, fmt.Errorf("invalid sample size %q: must be between 0%% and 100%%", s)
+	}
+	return f, nil
+}
@@ -1,14 +1,12 @@
 package main
 
-import "fmt"
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
 
-// Build and version details
-var (
-	GitCommit   = "unknown"
-	GitBranch   = "unknown"
-	GitUpstream = "unknown"
-	BuildDate   = "unknown"
-	Version     = "unknown"
+	"github.com/buchanae/tanker/buildinfo"
 )
 
 var tpl = `git commit:   %s
@@ -19,5 +17,33 @@ version:      %s`
 
 // VersionString formats a string with version details.
 func VersionString() string {
-	return fmt.Sprintf(tpl, GitCommit, GitBranch, GitUpstream, BuildDate, Version)
+	info := buildinfo.Read()
+	return fmt.Sprintf(tpl, info.GitCommit, info.GitBranch, info.GitUpstream, info.BuildDate, info.Version)
+}
+
+// printVersion prints the version details for "tanker version". Verbose
+// details include the environment of the build, e.g. for bug reports.
+func printVersion(out io.Writer, verbose, asJSON bool) error {
+	if asJSON {
+		b, err := json.MarshalIndent(buildinfo.Read(), "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(out, string(b))
+		return err
+	}
+
+	fmt.Fprintln(out, VersionString())
+	if !verbose {
+		return nil
+	}
+	info := buildinfo.Read()
+	fmt.Fprintf(out, "go version:   %s\n", info.GoVersion)
+	fmt.Fprintf(out, "os/arch:      %s/%s\n", info.OS, info.Arch)
+	fmt.Fprintf(out, "backends:     %s\n", strings.Join(info.Backends, ", "))
+	fmt.Fprintln(out, "sdks:")
+	for _, m := range info.SDKs {
+		fmt.Fprintf(out, "  %s %s\n", m.Path, m.Version)
+	}
+	return nil
 }
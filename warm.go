@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/buchanae/tanker/storage"
+)
+
+// warmOptions configures "tanker warm".
+type warmOptions struct {
+	// Path patterns of the LFS files in the dataset, as for "git lfs
+	// ls-files --include".
+	Dataset []string
+	// Ref whose files are warmed. Empty means the checkout.
+	Ref string
+	// Number of objects downloaded concurrently.
+	Workers int
+	// Don't ask to confirm large downloads. See confirmPlan.
+	Yes bool
+	// Path of the journal, for the throughput of recent downloads.
+	Journal string
+}
+
+// warm fills the machine-wide cache with the objects of the LFS files in
+// a dataset. Objects already in the cache are skipped, so an interrupted
+// run resumes where it stopped when run again.
+// Progress is shown by "ui", if not nil.
+func warm(ctx context.Context, conf Config, opts warmOptions, out io.Writer, ui *progressUI) error {
+	if conf.Cache.Dir == "" {
+		return withExitCode(exitConfig, userErrorf("no cache configured: set Cache.Dir in the config"))
+	}
+
+	args := []string{"--include", strings.Join(opts.Dataset, ",")}
+	if opts.Ref != "" {
+		args = append(args, opts.Ref)
+	}
+	files, err := lsFiles(args...)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return userErrorf("no LFS files matched %s", strings.Join(opts.Dataset, ", "))
+	}
+
+	// Several files may have the same content.
+	var oids []string
+	seen := map[string]bool{}
+	for _, f := range files {
+		if !seen[f.Oid] && !cached(conf.Cache.Dir, f.Oid) {
+			oids = append(oids, f.Oid)
+		}
+		seen[f.Oid] = true
+	}
+	fmt.Fprintf(out, "%d objects in dataset, %d already cached\n", len(seen), len(seen)-len(oids))
+	if len(oids) == 0 {
+		return nil
+	}
+
+	sizes, err := lsFileSizes(args...)
+	if err != nil {
+		return err
+	}
+	plan := transferPlan{Objects: len(oids)}
+	for _, oid := range oids {
+		plan.Bytes += sizes[oid]
+	}
+	if err := confirmPlan(conf, opts.Journal, plan, opts.Yes, os.Stdin, out); err != nil {
+		return err
+	}
+
+	store, err := newStorage(conf)
+	if err != nil {
+		return err
+	}
+
+	ui.setTotal(len(oids))
+	defer ui.close()
+
+	workers := opts.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	quota := newCacheQuota(conf)
+	jobs := make(chan string)
+	var mtx sync.Mutex
+	var wg sync.WaitGroup
+	var done, failed int
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for oid := range jobs {
+				err := warmObject(ctx, store, conf, quota, oid, ui)
+				ui.finish(oid)
+
+				mtx.Lock()
+				if err != nil {
+					failed++
+					errorln("Error warming", oid, err)
+					fmt.Fprintf(out, "FAIL %s: %s\n", oid, err)
+				} else {
+					done++
+					if ui == nil {
+						fmt.Fprintf(out, "cached %s (%d/%d)\n", oid, done, len(oids))
+					}
+				}
+				mtx.Unlock()
+			}
+		}()
+	}
+
+	for _, oid := range oids {
+		jobs <- oid
+	}
+	close(jobs)
+	wg.Wait()
+
+	if failed > 0 {
+		return withExitCode(exitPartial, userErrorf("%d of %d objects failed, run again to retry them", failed, len(oids)))
+	}
+	return nil
+}
+
+// warmObject checks that the object exists in remote storage, and that it
+// fits in the cache, then downloads it into the cache.
+func warmObject(ctx context.Context, store storage.Storage, conf Config, quota *cacheQuota, oid string, ui *progressUI) error {
+	url, err := store.Join(conf.BaseURL, oid)
+	if err != nil {
+		return err
+	}
+	obj, err := store.Stat(ctx, url)
+	if err != nil {
+		return err
+	}
+	release, err := quota.reserve(oid, obj.Size)
+	if err != nil {
+		return err
+	}
+	ui.update(oid, 0, obj.Size)
+
+	log.Println("Warming cache", url)
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := store.Get(ctx, url, pw)
+		pw.CloseWithError(err)
+	}()
+	progress := &progressWriter{ui: ui, name: oid, size: obj.Size}
+	err = addToCache(conf.Cache.Dir, oid, io.TeeReader(pr, progress))
+	pr.Close()
+	if err != nil {
+		release()
+	}
+	return err
+}
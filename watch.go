@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/buchanae/tanker/storage"
+	"github.com/fsnotify/fsnotify"
+)
+
+// WatchConfig configures "tanker watch".
+type WatchConfig struct {
+	// Changed files are committed once no file in the directory has been
+	// created or written for this long.
+	Quiet storage.Duration
+	// Also commit changed files this often while files keep changing,
+	// e.g. for an instrument which writes continuously. Zero means files
+	// are only committed once the directory is quiet.
+	Interval storage.Duration
+	// Files of this size or larger, in bytes, are tracked by LFS.
+	// Smaller files are committed to git as usual.
+	LFSMinSize int64
+}
+
+// watcher commits and pushes the new and changed files in a directory.
+type watcher struct {
+	conf WatchConfig
+	// Repo root, and the watched directory relative to it.
+	repo, dir string
+	fs        *fsnotify.Watcher
+	out       io.Writer
+	// Changed files to commit, relative to the repo root.
+	pending map[string]bool
+	// Set when a commit hasn't been pushed yet.
+	unpushed bool
+}
+
+// watch monitors "dir" for new and changed files, and commits and pushes
+// them, tracking large files with LFS, until the context is canceled.
+// Files which changed while tanker wasn't watching are committed first.
+func watch(ctx context.Context, t *Tanker, dir string, conf WatchConfig, out io.Writer) error {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return fmt.Errorf("finding directory: %s", err)
+	}
+	rel, err := filepath.Rel(t.Paths.Repo, abs)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%s isn't inside the repo", dir)
+	}
+	// The transfers of "git push" yield to the user's own.
+	runInBackground()
+
+	if conf.Quiet <= 0 {
+		conf.Quiet = storage.Duration(30 * time.Second)
+	}
+
+	fs, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("watching %s: %s", dir, err)
+	}
+	defer fs.Close()
+
+	w := &watcher{
+		conf:    conf,
+		repo:    t.Paths.Repo,
+		dir:     filepath.ToSlash(rel),
+		fs:      fs,
+		out:     out,
+		pending: map[string]bool{},
+	}
+	if err := w.addTree(abs, false); err != nil {
+		return err
+	}
+
+	existing, err := w.git("ls-files", "--others", "--modified", "--exclude-standard", "-z", "--", w.dir)
+	if err != nil {
+		return err
+	}
+	for _, p := range splitNull(existing) {
+		w.pending[p] = true
+	}
+	fmt.Fprintf(out, "watching %s, %d changed files\n", w.dir, len(w.pending))
+
+	quiet := time.NewTimer(0)
+	defer quiet.Stop()
+	var tick <-chan time.Time
+	if conf.Interval > 0 {
+		ticker := time.NewTicker(time.Duration(conf.Interval))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case ev, ok := <-fs.Events:
+			if !ok {
+				return nil
+			}
+			w.event(ev)
+			if !quiet.Stop() {
+				select {
+				case <-quiet.C:
+				default:
+				}
+			}
+			quiet.Reset(time.Duration(conf.Quiet))
+
+		case err, ok := <-fs.Errors:
+			if !ok {
+				return nil
+			}
+			errorln("Error watching", dir, err)
+
+		case <-quiet.C:
+			w.ingest()
+
+		case <-tick:
+			w.ingest()
+		}
+	}
+}
+
+// addTree watches "dir" and its subdirectories. If "pend" is set, files
+// in them are added to the pending files, e.g. for a new subdirectory whose
+// files may have been created before it was watched.
+func (w *watcher) addTree(dir string, pend bool) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			if pend {
+				w.pend(path)
+			}
+			return nil
+		}
+		if info.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if err := w.fs.Add(path); err != nil {
+			return fmt.Errorf("watching %s: %s", path, err)
+		}
+		return nil
+	})
+}
+
+// event records the file changed by a filesystem event. Removed files
+// are left alone, since an ingester shouldn't delete data from the repo.
+func (w *watcher) event(ev fsnotify.Event) {
+	if !ev.Has(fsnotify.Create) && !ev.Has(fsnotify.Write) {
+		return
+	}
+	info, err := os.Stat(ev.Name)
+	if err != nil {
+		return
+	}
+	if info.IsDir() && ev.Has(fsnotify.Create) {
+		if err := w.addTree(ev.Name, true); err != nil {
+			errorln(err)
+		}
+		return
+	}
+	w.pend(ev.Name)
+}
+
+func (w *watcher) pend(path string) {
+	rel, err := filepath.Rel(w.repo, path)
+	if err != nil {
+		return
+	}
+	rel = filepath.ToSlash(rel)
+	if rel == ".git" || strings.HasPrefix(rel, ".git/") || strings.Contains(rel, "/.git/") {
+		return
+	}
+	w.pending[rel] = true
+}
+
+// ingest commits and pushes the pending files. Files written within the
+// quiet period may still be in progress, so they're left for next time.
+// Errors are reported, and the files are retried next time.
+func (w *watcher) ingest() {
+	var ready []string
+	cutoff := time.Now().Add(-time.Duration(w.conf.Quiet))
+	for p := range w.pending {
+		info, err := os.Stat(filepath.Join(w.repo, p))
+		switch {
+		case err != nil || !info.Mode().IsRegular():
+			delete(w.pending, p)
+		case info.ModTime().Before(cutoff):
+			ready = append(ready, p)
+		}
+	}
+	sort.Strings(ready)
+
+	if len(ready) > 0 {
+		if err := w.commit(ready); err != nil {
+			errorln("Error committing watched files", err)
+			fmt.Fprintln(w.out, "commit failed, will retry:", err)
+			return
+		}
+		for _, p := range ready {
+			delete(w.pending, p)
+		}
+	}
+
+	if w.unpushed {
+		log.Println("Pushing watched files")
+		if _, err := w.git("push"); err != nil {
+			errorln("Error pushing watched files", err)
+			fmt.Fprintln(w.out, "push failed, will retry:", err)
+			return
+		}
+		w.unpushed = false
+		fmt.Fprintln(w.out, "pushed")
+	}
+}
+
+// commit commits the files which changed, tracking the large ones with LFS.
+func (w *watcher) commit(paths []string) error {
+	// Skip ignored files, and files written without changing them.
+	out, err := w.git(append([]string{"ls-files", "--others", "--modified", "--exclude-standard", "-z", "--"}, paths...)...)
+	if err != nil {
+		return err
+	}
+	changed := splitNull(out)
+	if len(changed) == 0 {
+		return nil
+	}
+	count := len(changed)
+
+	var large []string
+	for _, p := range changed {
+		info, err := os.Stat(filepath.Join(w.repo, p))
+		if err == nil && w.conf.LFSMinSize > 0 && info.Size() >= w.conf.LFSMinSize {
+			large = append(large, p)
+		}
+	}
+	untracked, err := w.notLFSTracked(large)
+	if err != nil {
+		return err
+	}
+	if len(untracked) > 0 {
+		if _, err := w.git(append([]string{"lfs", "track", "--filename"}, untracked...)...); err != nil {
+			return err
+		}
+		changed = append(changed, ".gitattributes")
+	}
+
+	if _, err := w.git(append([]string{"add", "--"}, changed...)...); err != nil {
+		return err
+	}
+	msg := fmt.Sprintf("Add %d files in %s\n\nCommitted by \"tanker watch\".", count, w.dir)
+	if _, err := w.git(append([]string{"commit", "-m", msg, "--"}, changed...)...); err != nil {
+		return err
+	}
+	log.Println("Committed watched files", changed)
+	fmt.Fprintf(w.out, "committed %d files, %d in LFS\n", count, len(large))
+	w.unpushed = true
+	return nil
+}
+
+// notLFSTracked returns the paths which don't match an LFS pattern.
+func (w *watcher) notLFSTracked(paths []string) ([]string, error) {
+	if len(paths) == 0 {
+		return nil, nil
+	}
+	out, err := w.git(append([]string{"check-attr", "-z", "filter", "--"}, paths...)...)
+	if err != nil {
+		return nil, err
+	}
+	// The output is "<path> NUL filter NUL <value> NUL" for each path.
+	var untracked []string
+	fields := strings.Split(string(out), "\x00")
+	for i := 0; i+2 < len(fields); i += 3 {
+		if fields[i+2] != "lfs" {
+			untracked = append(untracked, fields[i])
+		}
+	}
+	return untracked, nil
+}
+
+// git runs a git command in the repo root, and returns its output.
+func (w *watcher) git(args ...string) ([]byte, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = w.repo
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s: %s: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// splitNull splits NUL-terminated output, e.g. of "git ls-files -z".
+func splitNull(out []byte) []string {
+	var list []string
+	for _, s := range strings.Split(string(out), "\x00") {
+		if s != "" {
+			list = append(list, s)
+		}
+	}
+	return list
+}